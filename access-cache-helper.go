@@ -0,0 +1,468 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// accessChangeCounterID - the single row of access_change_counter
+const accessChangeCounterID = 1
+
+// accessRequest - cached request definition with its names and granted roles
+type accessRequest struct {
+	RequestID            int    `sql:"request_id"`
+	URL                  string `sql:"request_url"`
+	Type                 string `sql:"request_type"`
+	Template             string `sql:"request_template"`
+	Controller           string `sql:"controller"`
+	Action               string `sql:"action"`
+	RedirectURL          string `sql:"redirect_url"`
+	RedirectOnError      string `sql:"redirect_on_error"`
+	ImpersonationAllowed int    `sql:"impersonation_allowed"`
+	names                map[string]string
+	roleIDs              map[int]bool
+}
+
+// accessRules - requests by type and url and permissions by role
+type accessRules struct {
+	requests        map[string]*accessRequest
+	rolePermissions map[int][]string
+}
+
+// accessUserRoles - cached role set of a user
+type accessUserRoles struct {
+	roleIDs []int
+	expires time.Time
+}
+
+// accessCacheMetric - hits and misses of one cache
+type accessCacheMetric struct {
+	hits   uint64
+	misses uint64
+}
+
+func (m *accessCacheMetric) hit() {
+	atomic.AddUint64(&m.hits, 1)
+}
+
+func (m *accessCacheMetric) miss() {
+	atomic.AddUint64(&m.misses, 1)
+}
+
+// accessCacheStore - requests, grants, permissions and user role sets.
+// Emptied when access_change_counter changes, so every app instance sees the changes of the others.
+type accessCacheStore struct {
+	sync.RWMutex
+	rules            *accessRules
+	users            map[string]*accessUserRoles
+	generation       int64
+	counter          int64
+	nextCheck        time.Time
+	lastCheck        time.Time
+	invalidations    uint64
+	lastInvalidation time.Time
+	requestStats     accessCacheMetric
+	roleStats        accessCacheMetric
+	permissionStats  accessCacheMetric
+}
+
+var accessCache = accessCacheStore{users: make(map[string]*accessUserRoles)}
+
+// invalidateAccessCache - forget the cached access data, and the menus built from it.
+// Call after committing role, membership or request changes.
+func invalidateAccessCache() {
+	accessCache.Lock()
+	accessCache.flush()
+	accessCache.nextCheck = time.Time{}
+	accessCache.Unlock()
+
+	invalidateMenuCache()
+}
+
+// flush - expects the lock to be held
+func (c *accessCacheStore) flush() {
+	c.rules = nil
+	c.users = make(map[string]*accessUserRoles)
+	c.generation++
+	c.invalidations++
+	c.lastInvalidation = time.Now().UTC()
+}
+
+// checkChangeCounter - empties the cache if another transaction bumped access_change_counter
+func (c *accessCacheStore) checkChangeCounter() error {
+	now := time.Now().UTC()
+
+	c.RLock()
+	due := !now.Before(c.nextCheck)
+	c.RUnlock()
+
+	if !due {
+		return nil
+	}
+
+	var counter int64
+
+	pq := dbutl.PQuery(`
+		SELECT counter
+		  FROM access_change_counter
+		 WHERE counter_id = ?
+	`, accessChangeCounterID)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&counter)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	c.Lock()
+	changed := counter != c.counter
+	if changed {
+		c.flush()
+		c.counter = counter
+	}
+	c.lastCheck = now
+	c.nextCheck = now.Add(time.Duration(config.AccessCache.CheckInterval) * time.Second)
+	c.Unlock()
+
+	if changed {
+		invalidateMenuCache()
+	}
+
+	return nil
+}
+
+// bumpAccessChangeCounter - tell every app instance to reload the access data
+func bumpAccessChangeCounter(tx *sql.Tx) error {
+	pq := dbutl.PQuery(`
+	    UPDATE access_change_counter
+	       SET counter = counter + 1,
+	           change_time = ?
+	     WHERE counter_id = ?
+	`, time.Now().UTC(),
+		accessChangeCounterID)
+
+	_, err := dbutl.ExecTx(tx, pq)
+	return err
+}
+
+// ensureAccessChangeCounter - create the counter row on a new database
+func ensureAccessChangeCounter(tx *sql.Tx) error {
+	var found int
+
+	pq := dbutl.PQuery(`
+		SELECT CASE WHEN EXISTS (
+		           SELECT 1 FROM access_change_counter WHERE counter_id = ?
+		       ) THEN 1 ELSE 0 END
+		  FROM dual
+	`, accessChangeCounterID)
+
+	err := tx.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found == 1 {
+		return nil
+	}
+
+	pq = dbutl.PQuery(`
+	    INSERT INTO access_change_counter (counter_id, counter, change_time) VALUES (?, ?, ?)
+	`, accessChangeCounterID,
+		0,
+		time.Now().UTC())
+
+	_, err = dbutl.ExecTx(tx, pq)
+	return err
+}
+
+// getAccessRules - cached requests and grants; metric counts the hit or miss
+func getAccessRules(metric *accessCacheMetric) (*accessRules, error) {
+	err := accessCache.checkChangeCounter()
+	if err != nil {
+		return nil, err
+	}
+
+	accessCache.RLock()
+	rules := accessCache.rules
+	generation := accessCache.generation
+	accessCache.RUnlock()
+
+	if rules != nil {
+		metric.hit()
+		return rules, nil
+	}
+
+	metric.miss()
+
+	rules, err = loadAccessRulesFromDB()
+	if err != nil {
+		return nil, err
+	}
+
+	accessCache.Lock()
+	if accessCache.generation == generation {
+		accessCache.rules = rules
+	}
+	accessCache.Unlock()
+
+	return rules, nil
+}
+
+func loadAccessRulesFromDB() (*accessRules, error) {
+	rules := accessRules{
+		requests:        make(map[string]*accessRequest),
+		rolePermissions: make(map[int][]string),
+	}
+
+	byID := make(map[int]*accessRequest)
+
+	pq := dbutl.PQuery(`
+		SELECT request_id,
+		       request_url,
+		       request_type,
+		       request_template,
+		       controller,
+		       action,
+		       redirect_url,
+		       redirect_on_error,
+		       impersonation_allowed
+		  FROM request
+	`)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var req accessRequest
+		err = sc.Scan(dbutl, row, &req)
+		if err != nil {
+			return err
+		}
+
+		req.names = make(map[string]string)
+		req.roleIDs = make(map[int]bool)
+
+		rules.requests[accessRequestKey(req.Type, req.URL)] = &req
+		byID[req.RequestID] = &req
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	pq = dbutl.PQuery(`SELECT request_id, role_id FROM request_role`)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var requestID, roleID int
+		err = row.Scan(&requestID, &roleID)
+		if err != nil {
+			return err
+		}
+
+		if req, ok := byID[requestID]; ok {
+			req.roleIDs[roleID] = true
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	pq = dbutl.PQuery(`SELECT request_id, language, name FROM request_name`)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var requestID int
+		var lang, name string
+		err = row.Scan(&requestID, &lang, &name)
+		if err != nil {
+			return err
+		}
+
+		if req, ok := byID[requestID]; ok {
+			req.names[lang] = name
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	pq = dbutl.PQuery(`
+		SELECT rp.role_id,
+		       p.permission
+		  FROM role_permission rp
+		  JOIN permission p ON (rp.permission_id = p.permission_id)
+	`)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var roleID int
+		var perm string
+		err = row.Scan(&roleID, &perm)
+		if err != nil {
+			return err
+		}
+
+		rules.rolePermissions[roleID] = append(rules.rolePermissions[roleID], perm)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rules, nil
+}
+
+func accessRequestKey(requestType string, url string) string {
+	return strings.ToUpper(requestType) + " " + url
+}
+
+// getSessionRoleIDs - ids of the user's current roles, plus the "All" role,
+// and of every role they inherit
+func getSessionRoleIDs(user string) ([]int, error) {
+	err := accessCache.checkChangeCounter()
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.ToLower(user)
+	if len(key) == 0 {
+		key = "-"
+	}
+
+	now := time.Now().UTC()
+
+	accessCache.RLock()
+	cached, ok := accessCache.users[key]
+	generation := accessCache.generation
+	accessCache.RUnlock()
+
+	if ok && now.Before(cached.expires) {
+		accessCache.roleStats.hit()
+		return cached.roleIDs, nil
+	}
+
+	accessCache.roleStats.miss()
+
+	roleIDs, err := loadUserRoleIDs(user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := nextUserRoleChange(user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	accessCache.Lock()
+	if accessCache.generation == generation {
+		accessCache.users[key] = &accessUserRoles{roleIDs: roleIDs, expires: expires}
+	}
+	accessCache.Unlock()
+
+	return roleIDs, nil
+}
+
+// nextUserRoleChange - when a membership of the user starts or ends, at most ttl seconds away
+func nextUserRoleChange(user string, now time.Time) (time.Time, error) {
+	next := now.Add(time.Duration(config.AccessCache.TTL) * time.Second)
+
+	if len(user) == 0 {
+		return next, nil
+	}
+
+	type membershipPeriod struct {
+		ValidFrom  time.Time `sql:"valid_from"`
+		Expires    bool      `sql:"expires"`
+		ValidUntil time.Time `sql:"valid_until"`
+	}
+
+	pq := dbutl.PQuery(`
+		SELECT ur.valid_from,
+		       CASE WHEN ur.valid_until IS NULL THEN 0 ELSE 1 END AS expires,
+		       CASE WHEN ur.valid_until IS NULL THEN ur.valid_from ELSE ur.valid_until END AS valid_until
+		  FROM "user" u
+		  JOIN user_role ur ON (u.user_id = ur.user_id)
+		 WHERE u.loweredusername = lower(?)
+		   AND ur.valid = ?
+	`, user,
+		1)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var p membershipPeriod
+		err = sc.Scan(dbutl, row, &p)
+		if err != nil {
+			return err
+		}
+
+		if p.ValidFrom.After(now) && p.ValidFrom.Before(next) {
+			next = p.ValidFrom
+		}
+
+		if p.Expires && p.ValidUntil.After(now) && p.ValidUntil.Before(next) {
+			next = p.ValidUntil
+		}
+		return nil
+	})
+
+	if err != nil {
+		return now, err
+	}
+
+	return next, nil
+}
+
+// getAccessCacheStats - hit ratio of the access caches
+func getAccessCacheStats() *models.AccessCacheResponseModel {
+	accessCache.RLock()
+	defer accessCache.RUnlock()
+
+	stats := models.AccessCacheResponseModel{
+		Counter:          accessCache.counter,
+		LastCheck:        accessCache.lastCheck,
+		Invalidations:    accessCache.invalidations,
+		LastInvalidation: accessCache.lastInvalidation,
+	}
+
+	requests := 0
+	permissions := 0
+	if accessCache.rules != nil {
+		requests = len(accessCache.rules.requests)
+		permissions = len(accessCache.rules.rolePermissions)
+	}
+
+	metrics := []struct {
+		name    string
+		entries int
+		metric  *accessCacheMetric
+	}{
+		{"requests", requests, &accessCache.requestStats},
+		{"user-roles", len(accessCache.users), &accessCache.roleStats},
+		{"role-permissions", permissions, &accessCache.permissionStats},
+	}
+
+	for _, m := range metrics {
+		s := models.AccessCacheStatsModel{
+			Cache:   m.name,
+			Entries: m.entries,
+			Hits:    atomic.LoadUint64(&m.metric.hits),
+			Misses:  atomic.LoadUint64(&m.metric.misses),
+		}
+
+		if s.Hits+s.Misses > 0 {
+			s.HitRatio = float64(s.Hits) / float64(s.Hits+s.Misses)
+		}
+
+		stats.Caches = append(stats.Caches, &s)
+	}
+
+	return &stats
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+type accessExplainRequest struct {
+	RequestID  int    `sql:"request_id"`
+	Template   string `sql:"request_template"`
+	Controller string `sql:"controller"`
+	Action     string `sql:"action"`
+	Permission string `sql:"permission"`
+}
+
+type accessExplainUser struct {
+	UserID    int  `sql:"user_id"`
+	Valid     bool `sql:"valid"`
+	Activated bool `sql:"activated"`
+	LockedOut bool `sql:"locked_out"`
+}
+
+type accessExplainReach struct {
+	HeldRoleID int    `sql:"ancestor_role_id"`
+	RoleID     int    `sql:"descendant_role_id"`
+	Role       string `sql:"role"`
+	Depth      int    `sql:"depth"`
+}
+
+// explainAccess - replays the access check of getResponseHelperByURL step by step.
+// at - moment to evaluate the role memberships at (zero - now).
+func explainAccess(username string, url string, method string, at time.Time) (*models.AccessExplainModel, error) {
+	now := time.Now().UTC()
+	simulated := !at.IsZero()
+	if !simulated {
+		at = now
+	}
+
+	if !strings.HasPrefix(url, "/") {
+		url = "/" + url
+	}
+
+	ex := models.AccessExplainModel{
+		Username: username,
+		URL:      url,
+		Method:   strings.ToUpper(method),
+		At:       at,
+	}
+
+	ex.RequestURL = "index"
+	if url != "/" {
+		ex.RequestURL = strings.Replace(url[1:], ".html", "", 1)
+	}
+
+	// request
+	var req accessExplainRequest
+
+	pq := dbutl.PQuery(`
+		SELECT r.request_id,
+		       r.request_template,
+		       r.controller,
+		       r.action,
+		       CASE WHEN p.permission IS NULL THEN '-' ELSE p.permission END AS permission
+		  FROM request r
+		  LEFT OUTER JOIN request_permission rp ON (r.request_id = rp.request_id)
+		  LEFT OUTER JOIN permission p ON (rp.permission_id = p.permission_id)
+		 WHERE r.request_url = ?
+		   AND r.request_type = ?
+	`, ex.RequestURL,
+		ex.Method)
+
+	err := dbutl.RunQuery(pq, &req)
+
+	switch {
+	case err == sql.ErrNoRows:
+		ex.Notes = append(ex.Notes, fmt.Sprintf("There is no %s request for \"%s\" in the request table (see access-rules.json).", ex.Method, ex.RequestURL))
+	case err != nil:
+		return nil, err
+	default:
+		ex.RequestFound = true
+		ex.RequestID = req.RequestID
+		ex.Template = req.Template
+		ex.Controller = req.Controller
+		ex.Action = req.Action
+		ex.Permission = req.Permission
+	}
+
+	// user
+	var usr accessExplainUser
+
+	if len(username) > 0 {
+		pq = dbutl.PQuery(`
+			SELECT user_id,
+			       valid,
+			       activated,
+			       locked_out
+			  FROM "user"
+			 WHERE loweredusername = lower(?)
+		`, username)
+
+		err = dbutl.RunQuery(pq, &usr)
+
+		switch {
+		case err == sql.ErrNoRows:
+			ex.Notes = append(ex.Notes, fmt.Sprintf("User \"%s\" does not exist; only the grants of role \"All\" apply.", username))
+		case err != nil:
+			return nil, err
+		default:
+			ex.UserFound = true
+			ex.UserValid = usr.Valid
+			ex.UserActivated = usr.Activated
+			ex.UserLockedOut = usr.LockedOut
+		}
+	}
+
+	if ex.UserFound && !ex.UserValid {
+		ex.Notes = append(ex.Notes, "The user is not valid; only the grants of role \"All\" apply.")
+	}
+
+	if ex.UserFound && (!ex.UserActivated || ex.UserLockedOut) {
+		ex.Notes = append(ex.Notes, "The user is not activated or is locked out and cannot log in, whatever the grants.")
+	}
+
+	// memberships
+	var allRole MembershipRole
+	allRole.tx, err = db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer allRole.tx.Rollback()
+
+	err = allRole.GetByName("All")
+	if err != nil {
+		return nil, err
+	}
+
+	ex.Memberships = append(ex.Memberships, &models.AccessExplainRoleModel{
+		RoleID:    allRole.RoleID,
+		Role:      allRole.Rolename,
+		ValidFrom: at,
+		Valid:     true,
+		Active:    true,
+		Status:    "implicit, everyone",
+		Implicit:  true,
+	})
+
+	if ex.UserFound {
+		pq = dbutl.PQuery(`
+			SELECT ur.role_id,
+			       r.role,
+			       ur.valid_from,
+			       CASE WHEN ur.valid_until IS NULL THEN 0 ELSE 1 END AS expires,
+			       CASE WHEN ur.valid_until IS NULL THEN ur.valid_from ELSE ur.valid_until END AS valid_until,
+			       ur.valid
+			  FROM user_role ur
+			  JOIN role r ON (ur.role_id = r.role_id)
+			 WHERE ur.user_id = ?
+			 ORDER BY r.role
+		`, usr.UserID)
+
+		err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+			var m models.AccessExplainRoleModel
+			err = sc.Scan(dbutl, row, &m)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case !m.Valid:
+				m.Status = "revoked"
+			case m.ValidFrom.After(at):
+				m.Status = "starts " + m.ValidFrom.Format("2006-01-02 15:04")
+			case m.Expires && !m.ValidUntil.After(at):
+				m.Status = "expired " + m.ValidUntil.Format("2006-01-02 15:04")
+			case !ex.UserValid:
+				m.Status = "user not valid"
+			default:
+				m.Active = true
+				m.Status = "active"
+			}
+
+			ex.Memberships = append(ex.Memberships, &m)
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// roles reached through inheritance, from active and inactive memberships
+	held := make(map[int]*models.AccessExplainRoleModel)
+	var heldIDs []interface{}
+
+	for _, m := range ex.Memberships {
+		held[m.RoleID] = m
+		heldIDs = append(heldIDs, m.RoleID)
+	}
+
+	reached := make(map[int][]*accessExplainReach)
+
+	pq = dbutl.PQuery(`
+		SELECT rc.ancestor_role_id,
+		       rc.descendant_role_id,
+		       r.role,
+		       rc.depth
+		  FROM role_closure rc
+		  JOIN role r ON (rc.descendant_role_id = r.role_id)
+		 WHERE rc.ancestor_role_id IN (`+strings.Repeat("?, ", len(heldIDs)-1)+`?)
+		 ORDER BY rc.depth
+	`, heldIDs...)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var rr accessExplainReach
+		err = sc.Scan(dbutl, row, &rr)
+		if err != nil {
+			return err
+		}
+
+		reached[rr.RoleID] = append(reached[rr.RoleID], &rr)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	effective := make(map[string]bool)
+
+	for _, paths := range reached {
+		for _, p := range paths {
+			if held[p.HeldRoleID].Active {
+				effective[p.Role] = true
+			}
+		}
+	}
+
+	for role := range effective {
+		ex.EffectiveRoles = append(ex.EffectiveRoles, role)
+	}
+	sort.Strings(ex.EffectiveRoles)
+
+	// grants
+	if ex.RequestFound {
+		pq = dbutl.PQuery(`
+			SELECT rr.role_id,
+			       r.role
+			  FROM request_role rr
+			  JOIN role r ON (rr.role_id = r.role_id)
+			 WHERE rr.request_id = ?
+			 ORDER BY r.role
+		`, req.RequestID)
+
+		err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+			var g models.AccessExplainGrantModel
+			err = sc.Scan(dbutl, row, &g)
+			if err != nil {
+				return err
+			}
+
+			var inactive []string
+
+			for _, p := range reached[g.RoleID] {
+				m := held[p.HeldRoleID]
+
+				via := m.Role
+				if p.Depth > 0 {
+					via = fmt.Sprintf("%s (inherits %s)", m.Role, g.Role)
+				}
+
+				if m.Active {
+					g.Matched = true
+					g.Via = via
+					break
+				}
+
+				inactive = append(inactive, fmt.Sprintf("%s - %s", via, m.Status))
+			}
+
+			switch {
+			case g.Matched:
+				g.Reason = "granted"
+			case len(inactive) > 0:
+				g.Reason = "membership not active: " + strings.Join(inactive, "; ")
+			default:
+				g.Reason = "missing - the user holds no role reaching " + g.Role
+			}
+
+			ex.Grants = append(ex.Grants, &g)
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ex.Grants) == 0 {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("No role holds permission \"%s\", so no request_role row grants the request.", ex.Permission))
+		}
+	}
+
+	for _, g := range ex.Grants {
+		if g.Matched {
+			ex.Allowed = true
+			break
+		}
+	}
+
+	switch {
+	case !ex.RequestFound:
+		ex.Decision = "not found"
+	case ex.Allowed:
+		ex.Decision = "allowed"
+	default:
+		ex.Decision = "access denied"
+	}
+
+	// compare with the cached decision of the router
+	if !simulated && ex.RequestFound {
+		sessionData := SessionData{Lang: "EN", LoggedIn: len(username) > 0}
+		sessionData.User.Username = username
+
+		_, err = getResponseHelperByURL(&sessionData, url, ex.Method)
+		engineAllowed := err == nil
+
+		if engineAllowed != ex.Allowed {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("The router decides allowed=%t from the access cache; it may be stale or the data changed meanwhile.", engineAllowed))
+		}
+	}
+
+	return &ex, nil
+}
+
+// writeAccessExplain - plain text report, for the command line
+func writeAccessExplain(w io.Writer, ex *models.AccessExplainModel) {
+	fmt.Fprintf(w, "%s /%s for user \"%s\" at %s\n", ex.Method, ex.RequestURL, ex.Username, ex.At.Format(time.RFC3339))
+
+	if ex.RequestFound {
+		fmt.Fprintf(w, "request:     #%d %s.%s template %s, permission %s\n", ex.RequestID, ex.Controller, ex.Action, ex.Template, ex.Permission)
+	} else {
+		fmt.Fprintln(w, "request:     not found")
+	}
+
+	if ex.UserFound {
+		fmt.Fprintf(w, "user:        valid=%t activated=%t locked_out=%t\n", ex.UserValid, ex.UserActivated, ex.UserLockedOut)
+	} else {
+		fmt.Fprintln(w, "user:        not found")
+	}
+
+	fmt.Fprintln(w, "memberships:")
+	for _, m := range ex.Memberships {
+		until := "-"
+		if m.Expires {
+			until = m.ValidUntil.Format("2006-01-02 15:04")
+		}
+
+		from := m.ValidFrom.Format("2006-01-02 15:04")
+		if m.Implicit {
+			from = "-"
+		}
+
+		fmt.Fprintf(w, "  %-20s from %-16s until %-16s %s\n", m.Role, from, until, m.Status)
+	}
+
+	fmt.Fprintf(w, "roles:       %s\n", strings.Join(ex.EffectiveRoles, ", "))
+
+	fmt.Fprintln(w, "grants (request_role):")
+	for _, g := range ex.Grants {
+		fmt.Fprintf(w, "  %-20s %s", g.Role, g.Reason)
+		if g.Matched {
+			fmt.Fprintf(w, " via %s", g.Via)
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, note := range ex.Notes {
+		fmt.Fprintf(w, "note:        %s\n", note)
+	}
+
+	fmt.Fprintf(w, "decision:    %s\n", ex.Decision)
+}
+
+// dumpAccessExplain - --explain <user> <method> <url> [yyyy-mm-dd]
+func dumpAccessExplain(username string, method string, url string, at time.Time) error {
+	ex, err := explainAccess(username, url, method, at)
+	if err != nil {
+		return err
+	}
+
+	writeAccessExplain(os.Stdout, ex)
+
+	return nil
+}
@@ -0,0 +1,1220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// accessRulesFile - routes, names per language, permissions and their roles (see access-rules.json)
+type accessRulesFile struct {
+	Version     int                      `json:"version"`
+	Roles       []*accessRulesRole       `json:"roles"`
+	Permissions []*accessRulesPermission `json:"permissions"`
+	Requests    []*accessRulesRequest    `json:"requests"`
+	file        string
+	checksum    string
+}
+
+type accessRulesRole struct {
+	Name     string   `json:"name"`
+	Inherits []string `json:"inherits"`
+}
+
+type accessRulesPermission struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Roles       []string `json:"roles"`
+}
+
+type accessRulesRequest struct {
+	Type                 string            `json:"type"`
+	URL                  string            `json:"url"`
+	Template             string            `json:"template"`
+	Controller           string            `json:"controller"`
+	Action               string            `json:"action"`
+	RedirectURL          string            `json:"redirect_url"`
+	RedirectOnError      string            `json:"redirect_on_error"`
+	IndexLevel           int               `json:"index_level"`
+	OrderNumber          int               `json:"order_number"`
+	FireEvent            *int              `json:"fire_event"`
+	Parent               string            `json:"parent"`
+	Names                map[string]string `json:"names"`
+	Permission           string            `json:"permission"`
+	Roles                []string          `json:"roles"`
+	ImpersonationAllowed bool              `json:"impersonation_allowed"`
+}
+
+// accessRulesSummary - what applying the file changed
+type accessRulesSummary struct {
+	Version                 int      `json:"version"`
+	RolesAdded              []string `json:"roles_added,omitempty"`
+	UnmanagedRoles          []string `json:"unmanaged_roles,omitempty"`
+	InheritsAdded           []string `json:"inherits_added,omitempty"`
+	InheritsRemoved         []string `json:"inherits_removed,omitempty"`
+	PermissionsAdded        []string `json:"permissions_added,omitempty"`
+	PermissionsUpdated      []string `json:"permissions_updated,omitempty"`
+	PermissionsRemoved      []string `json:"permissions_removed,omitempty"`
+	PermissionGrantsAdded   []string `json:"permission_grants_added,omitempty"`
+	PermissionGrantsRemoved []string `json:"permission_grants_removed,omitempty"`
+	RequestPermissions      []string `json:"request_permissions,omitempty"`
+	RequestsAdded           []string `json:"requests_added,omitempty"`
+	RequestsUpdated         []string `json:"requests_updated,omitempty"`
+	RequestsRemoved         []string `json:"requests_removed,omitempty"`
+	TokensRevoked           []string `json:"tokens_revoked,omitempty"`
+	NamesChanged            []string `json:"names_changed,omitempty"`
+	GrantsAdded             []string `json:"grants_added,omitempty"`
+	GrantsRemoved           []string `json:"grants_removed,omitempty"`
+}
+
+func (s *accessRulesSummary) hasChanges() bool {
+	return len(s.RolesAdded) > 0 ||
+		len(s.InheritsAdded) > 0 ||
+		len(s.InheritsRemoved) > 0 ||
+		len(s.PermissionsAdded) > 0 ||
+		len(s.PermissionsUpdated) > 0 ||
+		len(s.PermissionsRemoved) > 0 ||
+		len(s.PermissionGrantsAdded) > 0 ||
+		len(s.PermissionGrantsRemoved) > 0 ||
+		len(s.RequestPermissions) > 0 ||
+		len(s.RequestsAdded) > 0 ||
+		len(s.RequestsUpdated) > 0 ||
+		len(s.RequestsRemoved) > 0 ||
+		len(s.TokensRevoked) > 0 ||
+		len(s.NamesChanged) > 0 ||
+		len(s.GrantsAdded) > 0 ||
+		len(s.GrantsRemoved) > 0
+}
+
+func (r *accessRulesRequest) key() string {
+	return r.Type + ":" + r.URL
+}
+
+func (r *accessRulesRequest) parentKey() string {
+	if len(r.Parent) == 0 {
+		return ""
+	}
+
+	return "GET:" + r.Parent
+}
+
+// legacyPermission - permission standing in for the roles listed directly on a request
+func (r *accessRulesRequest) legacyPermission() string {
+	return legacyPermissionPrefix + strings.ToLower(r.Type) + "." + r.URL
+}
+
+func (r *accessRulesRequest) toURLRequest() urlRequest {
+	fireEvent := 1
+	if r.FireEvent != nil {
+		fireEvent = *r.FireEvent
+	}
+
+	impersonationAllowed := 0
+	if r.ImpersonationAllowed {
+		impersonationAllowed = 1
+	}
+
+	return urlRequest{
+		RequestType:          r.Type,
+		RequestURL:           r.URL,
+		RequestTemplate:      dashIfEmpty(r.Template),
+		Controller:           dashIfEmpty(r.Controller),
+		Action:               dashIfEmpty(r.Action),
+		RedirectURL:          dashIfEmpty(r.RedirectURL),
+		RedirectOnError:      dashIfEmpty(r.RedirectOnError),
+		IndexLevel:           positiveOrNull(r.IndexLevel),
+		OrderNumber:          positiveOrNull(r.OrderNumber),
+		FireEvent:            fireEvent,
+		ParentURL:            r.Parent,
+		ImpersonationAllowed: impersonationAllowed,
+	}
+}
+
+func dashIfEmpty(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+
+	return s
+}
+
+// positiveOrNull - the request table reads null positions back as -1
+func positiveOrNull(i int) int {
+	if i <= 0 {
+		return -1
+	}
+
+	return i
+}
+
+// loadAccessRules - read and validate the access rules file
+func loadAccessRules(file string) (*accessRulesFile, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := accessRulesFile{file: file}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("access rules file \"%s\": %v", file, err)
+	}
+
+	sum := sha256.Sum256(b)
+	rules.checksum = hex.EncodeToString(sum[:])
+
+	errs := rules.validate()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid access rules file \"%s\":\n%s", file, strings.Join(errs, "\n"))
+	}
+
+	return &rules, nil
+}
+
+func (a *accessRulesFile) validate() []string {
+	var errs []string
+
+	if a.Version <= 0 {
+		errs = append(errs, "version must be greater than 0")
+	}
+
+	roles := make(map[string]bool)
+
+	for _, role := range a.Roles {
+		if len(role.Name) == 0 {
+			errs = append(errs, "role with empty name")
+			continue
+		}
+
+		lrole := strings.ToLower(role.Name)
+		if roles[lrole] {
+			errs = append(errs, fmt.Sprintf("duplicate role \"%s\"", role.Name))
+		}
+
+		roles[lrole] = true
+	}
+
+	inherits := make(map[string][]string)
+
+	for _, role := range a.Roles {
+		lrole := strings.ToLower(role.Name)
+
+		for _, child := range role.Inherits {
+			lchild := strings.ToLower(child)
+
+			if !roles[lchild] {
+				errs = append(errs, fmt.Sprintf("role \"%s\": inherits undeclared role \"%s\"", role.Name, child))
+				continue
+			}
+
+			inherits[lrole] = append(inherits[lrole], lchild)
+		}
+	}
+
+	if cycle := findRoleCycle(inherits); cycle != nil {
+		errs = append(errs, fmt.Sprintf("role inheritance cycle: %s", strings.Join(cycle, " -> ")))
+	}
+
+	permissions := make(map[string]bool)
+
+	for _, perm := range a.Permissions {
+		if !permissionNameRegex.MatchString(perm.Name) {
+			errs = append(errs, fmt.Sprintf("permission \"%s\": name must be lower case letters, digits, '.', '-' or '_', at most 64 characters", perm.Name))
+		}
+
+		if strings.HasPrefix(perm.Name, legacyPermissionPrefix) {
+			errs = append(errs, fmt.Sprintf("permission \"%s\": the \"%s\" prefix is reserved", perm.Name, legacyPermissionPrefix))
+		}
+
+		if permissions[perm.Name] {
+			errs = append(errs, fmt.Sprintf("duplicate permission \"%s\"", perm.Name))
+		}
+
+		permissions[perm.Name] = true
+
+		if len(perm.Description) > 256 {
+			errs = append(errs, fmt.Sprintf("permission \"%s\": description longer than 256 characters", perm.Name))
+		}
+
+		for _, role := range perm.Roles {
+			if !roles[strings.ToLower(role)] {
+				errs = append(errs, fmt.Sprintf("permission \"%s\": undeclared role \"%s\"", perm.Name, role))
+			}
+		}
+	}
+
+	requests := make(map[string]*accessRulesRequest)
+	positions := make(map[string]string)
+
+	for _, req := range a.Requests {
+		req.Type = strings.ToUpper(req.Type)
+
+		if req.Type != "GET" && req.Type != "POST" {
+			errs = append(errs, fmt.Sprintf("request \"%s\": unknown type \"%s\"", req.URL, req.Type))
+		}
+
+		if len(req.URL) == 0 || strings.HasPrefix(req.URL, "/") || req.URL != strings.ToLower(req.URL) {
+			errs = append(errs, fmt.Sprintf("request \"%s\": url must be lower case, without a leading /", req.URL))
+		}
+
+		key := req.key()
+
+		if _, ok := requests[key]; ok {
+			errs = append(errs, fmt.Sprintf("duplicate request \"%s\"", key))
+		}
+
+		requests[key] = req
+
+		controller := getController(req.Controller)
+		if controller == nil {
+			errs = append(errs, fmt.Sprintf("request \"%s\": unknown controller \"%s\"", key, req.Controller))
+		} else if len(req.Action) > 0 && req.Action != "-" &&
+			!reflect.ValueOf(controller).MethodByName(req.Action).IsValid() {
+
+			errs = append(errs, fmt.Sprintf("request \"%s\": unknown action \"%s.%s\"", key, req.Controller, req.Action))
+		}
+
+		if len(req.Template) > 0 && req.Template != "-" &&
+			templates != nil && templates.Lookup(req.Template) == nil {
+
+			errs = append(errs, fmt.Sprintf("request \"%s\": unknown template \"%s\"", key, req.Template))
+		}
+
+		if req.IndexLevel > 0 || req.OrderNumber > 0 {
+			if req.IndexLevel <= 0 || req.OrderNumber <= 0 {
+				errs = append(errs, fmt.Sprintf("request \"%s\": index_level and order_number go together", key))
+			}
+
+			pos := fmt.Sprintf("%d.%d", req.IndexLevel, req.OrderNumber)
+			if other, ok := positions[pos]; ok {
+				errs = append(errs, fmt.Sprintf("request \"%s\": position %s already used by \"%s\"", key, pos, other))
+			}
+
+			positions[pos] = key
+		}
+
+		for lang, name := range req.Names {
+			if len(lang) == 0 || len(lang) > 8 || len(name) == 0 || len(name) > 64 {
+				errs = append(errs, fmt.Sprintf("request \"%s\": invalid name \"%s\" for language \"%s\"", key, name, lang))
+			}
+		}
+
+		for _, role := range req.Roles {
+			if !roles[strings.ToLower(role)] {
+				errs = append(errs, fmt.Sprintf("request \"%s\": undeclared role \"%s\"", key, role))
+			}
+		}
+
+		if len(req.Permission) > 0 {
+			if !permissions[req.Permission] {
+				errs = append(errs, fmt.Sprintf("request \"%s\": undeclared permission \"%s\"", key, req.Permission))
+			}
+
+			if len(req.Roles) > 0 {
+				errs = append(errs, fmt.Sprintf("request \"%s\": use either permission or roles", key))
+			}
+		}
+
+		if len(req.Permission) == 0 && len(req.Roles) == 0 && len(req.Parent) == 0 {
+			errs = append(errs, fmt.Sprintf("request \"%s\": no permission or role may call it", key))
+		}
+	}
+
+	for _, req := range a.Requests {
+		visited := map[string]bool{req.key(): true}
+
+		for p := req.parentKey(); len(p) > 0; {
+			parent, ok := requests[p]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("request \"%s\": unknown parent \"%s\"", req.key(), p))
+				break
+			}
+
+			if visited[p] {
+				errs = append(errs, fmt.Sprintf("request \"%s\": parent cycle", req.key()))
+				break
+			}
+
+			visited[p] = true
+			p = parent.parentKey()
+		}
+	}
+
+	// requests refused while impersonating go back to it
+	if index, ok := requests["GET:index"]; ok && !index.ImpersonationAllowed {
+		errs = append(errs, "request \"GET:index\": must be impersonation_allowed")
+	}
+
+	return errs
+}
+
+// effectivePermissions - the declared permissions plus one per request that lists roles directly
+func (a *accessRulesFile) effectivePermissions() []*accessRulesPermission {
+	perms := append([]*accessRulesPermission{}, a.Permissions...)
+
+	for _, req := range a.Requests {
+		if len(req.Roles) == 0 {
+			continue
+		}
+
+		perms = append(perms, &accessRulesPermission{
+			Name:        req.legacyPermission(),
+			Description: fmt.Sprintf("Call %s /%s", req.Type, req.URL),
+			Roles:       req.Roles,
+		})
+	}
+
+	return perms
+}
+
+// requestPermission - permission needed to call a request.
+// A request without permission and roles needs the permission of its parent.
+func (a *accessRulesFile) requestPermission(req *accessRulesRequest) string {
+	for r := req; r != nil; {
+		if len(r.Permission) > 0 {
+			return r.Permission
+		}
+
+		if len(r.Roles) > 0 {
+			return r.legacyPermission()
+		}
+
+		p := r.parentKey()
+		r = nil
+
+		for _, other := range a.Requests {
+			if other.key() == p {
+				r = other
+				break
+			}
+		}
+	}
+
+	return ""
+}
+
+// grants - roles holding the permission needed to call a request
+func (a *accessRulesFile) grants(req *accessRulesRequest) map[string]bool {
+	roles := make(map[string]bool)
+	name := a.requestPermission(req)
+
+	for _, perm := range a.effectivePermissions() {
+		if perm.Name != name {
+			continue
+		}
+
+		for _, role := range perm.Roles {
+			roles[strings.ToLower(role)] = true
+		}
+	}
+
+	return roles
+}
+
+// sortedRequests - parents before their children
+func (a *accessRulesFile) sortedRequests() []*accessRulesRequest {
+	var sorted []*accessRulesRequest
+	done := make(map[string]bool)
+
+	for len(sorted) < len(a.Requests) {
+		for _, req := range a.Requests {
+			if done[req.key()] {
+				continue
+			}
+
+			if p := req.parentKey(); len(p) > 0 && !done[p] {
+				continue
+			}
+
+			sorted = append(sorted, req)
+			done[req.key()] = true
+		}
+	}
+
+	return sorted
+}
+
+func (a *accessRulesFile) checkVersion(tx *sql.Tx) (bool, error) {
+	var version int
+	var checksum string
+
+	pq := dbutl.PQuery(`
+		SELECT version, checksum
+		  FROM access_rules_version
+		 ORDER BY access_rules_version_id DESC
+		 LIMIT ?
+	`, 1)
+
+	err := tx.QueryRow(pq.Query, pq.Args...).Scan(&version, &checksum)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+
+	if a.Version < version {
+		return false, fmt.Errorf("access rules version %d is older than the applied version %d", a.Version, version)
+	}
+
+	if a.Version == version && a.checksum != checksum {
+		return false, fmt.Errorf("access rules changed without increasing the version (%d)", version)
+	}
+
+	return a.Version > version, nil
+}
+
+type accessRulesGrant struct {
+	RequestID int    `sql:"request_id"`
+	RoleID    int    `sql:"role_id"`
+	Role      string `sql:"role"`
+}
+
+type accessRulesPermissionRow struct {
+	PermissionID int    `sql:"permission_id"`
+	Permission   string `sql:"permission"`
+	Description  string `sql:"description"`
+}
+
+type accessRulesPermissionGrant struct {
+	Permission   string `sql:"permission"`
+	PermissionID int    `sql:"permission_id"`
+	RoleID       int    `sql:"role_id"`
+	Role         string `sql:"role"`
+}
+
+type accessRulesName struct {
+	RequestID int    `sql:"request_id"`
+	Language  string `sql:"language"`
+	Name      string `sql:"name"`
+}
+
+// apply - bring the role, permission, request, request_role and request_name tables in line with the file
+func (a *accessRulesFile) apply(tx *sql.Tx) (*accessRulesSummary, error) {
+	summary := accessRulesSummary{Version: a.Version}
+
+	newVersion, err := a.checkVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// roles
+	roleIDs := make(map[string]int)
+
+	for _, role := range a.Roles {
+		mrole := MembershipRole{tx: tx, Rolename: role.Name}
+
+		found, err := mrole.Exists()
+		if err != nil {
+			return nil, err
+		}
+
+		if !found {
+			err = mrole.Save()
+			if err != nil {
+				return nil, err
+			}
+
+			summary.RolesAdded = append(summary.RolesAdded, role.Name)
+		}
+	}
+
+	pq := dbutl.PQuery(`SELECT role_id, role FROM role ORDER BY role`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var roleID int
+		var role string
+
+		err = row.Scan(&roleID, &role)
+		if err != nil {
+			return err
+		}
+
+		roleIDs[strings.ToLower(role)] = roleID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for lrole := range roleIDs {
+		managed := false
+
+		for _, role := range a.Roles {
+			if strings.ToLower(role.Name) == lrole {
+				managed = true
+				break
+			}
+		}
+
+		if !managed {
+			summary.UnmanagedRoles = append(summary.UnmanagedRoles, lrole)
+		}
+	}
+
+	// role inheritance, only for the roles declared in the file
+	var edges []*roleEdge
+
+	pq = dbutl.PQuery(`SELECT parent_role_id, child_role_id FROM role_inheritance`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var e roleEdge
+		err = sc.Scan(dbutl, row, &e)
+		if err != nil {
+			return err
+		}
+
+		edges = append(edges, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range a.Roles {
+		lrole := strings.ToLower(role.Name)
+		wanted := make(map[string]bool)
+
+		for _, child := range role.Inherits {
+			wanted[strings.ToLower(child)] = true
+		}
+
+		for _, e := range edges {
+			if e.ParentRoleID != roleIDs[lrole] {
+				continue
+			}
+
+			lchild := ""
+			for name, roleID := range roleIDs {
+				if roleID == e.ChildRoleID {
+					lchild = name
+					break
+				}
+			}
+
+			if wanted[lchild] {
+				delete(wanted, lchild)
+				continue
+			}
+
+			pq = dbutl.PQuery(`
+				DELETE FROM role_inheritance
+				 WHERE parent_role_id = ?
+				   AND child_role_id = ?
+			`, e.ParentRoleID,
+				e.ChildRoleID)
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.InheritsRemoved = append(summary.InheritsRemoved, lrole+" -> "+lchild)
+		}
+
+		for _, lchild := range sortedKeys(wanted) {
+			pq = dbutl.PQuery(`
+				INSERT INTO role_inheritance (
+					parent_role_id,
+					child_role_id
+				)
+				VALUES (?, ?)
+			`, roleIDs[lrole],
+				roleIDs[lchild])
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.InheritsAdded = append(summary.InheritsAdded, lrole+" -> "+lchild)
+		}
+	}
+
+	// also fills in the closure of roles created before role_closure existed
+	err = rebuildRoleClosure(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// permissions
+	permIDs := make(map[string]int)
+	oldPerms := make(map[string]*accessRulesPermissionRow)
+	perms := a.effectivePermissions()
+
+	pq = dbutl.PQuery(`
+		SELECT permission_id,
+		       permission,
+		       CASE WHEN description IS NULL THEN '' ELSE description END AS description
+		  FROM permission
+	`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var p accessRulesPermissionRow
+		err = sc.Scan(dbutl, row, &p)
+		if err != nil {
+			return err
+		}
+
+		oldPerms[p.Permission] = &p
+		permIDs[p.Permission] = p.PermissionID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, perm := range perms {
+		old, found := oldPerms[perm.Name]
+
+		switch {
+		case !found:
+			p := Permission{tx: tx, Name: perm.Name, Description: perm.Description}
+			err = p.Save()
+			if err != nil {
+				return nil, err
+			}
+
+			permIDs[perm.Name] = p.PermissionID
+			summary.PermissionsAdded = append(summary.PermissionsAdded, perm.Name)
+		case old.Description != perm.Description:
+			p := Permission{tx: tx, PermissionID: old.PermissionID, Name: perm.Name, Description: perm.Description}
+			err = p.Save()
+			if err != nil {
+				return nil, err
+			}
+
+			summary.PermissionsUpdated = append(summary.PermissionsUpdated, perm.Name)
+		}
+	}
+
+	var permGrants []*accessRulesPermissionGrant
+
+	pq = dbutl.PQuery(`
+		SELECT p.permission,
+		       rp.permission_id,
+		       rp.role_id,
+		       r.role
+		  FROM role_permission rp
+		  JOIN permission p ON (rp.permission_id = p.permission_id)
+		  JOIN role r ON (rp.role_id = r.role_id)
+	`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var g accessRulesPermissionGrant
+		err = sc.Scan(dbutl, row, &g)
+		if err != nil {
+			return err
+		}
+
+		permGrants = append(permGrants, &g)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, perm := range perms {
+		wantedRoles := make(map[string]bool)
+		for _, role := range perm.Roles {
+			wantedRoles[strings.ToLower(role)] = true
+		}
+
+		for _, g := range permGrants {
+			if g.Permission != perm.Name {
+				continue
+			}
+
+			lrole := strings.ToLower(g.Role)
+
+			if wantedRoles[lrole] {
+				delete(wantedRoles, lrole)
+				continue
+			}
+
+			pq = dbutl.PQuery(`
+				DELETE FROM role_permission
+				 WHERE role_id = ?
+				   AND permission_id = ?
+			`, g.RoleID,
+				g.PermissionID)
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.PermissionGrantsRemoved = append(summary.PermissionGrantsRemoved, perm.Name+" -> "+g.Role)
+		}
+
+		for _, lrole := range sortedKeys(wantedRoles) {
+			pq = dbutl.PQuery(`
+				INSERT INTO role_permission (
+					role_id,
+					permission_id
+				)
+				VALUES (?, ?)
+			`, roleIDs[lrole],
+				permIDs[perm.Name])
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.PermissionGrantsAdded = append(summary.PermissionGrantsAdded, perm.Name+" -> "+lrole)
+		}
+	}
+
+	// requests
+	existing := make(map[string]*RequestHelper)
+
+	pq = dbutl.PQuery(`
+		select request_id,
+			   request_type,
+			   request_url,
+			   request_template,
+			   controller,
+			   action,
+			   redirect_url,
+			   redirect_on_error,
+			   case when index_level is null then -1 else index_level end AS index_level,
+			   case when order_number is null then -1 else order_number end AS order_number,
+			   fire_event,
+			   impersonation_allowed,
+			   case when parent_id is null then -1 else parent_id end AS parent_id
+		  from request
+	`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		req := RequestHelper{tx: tx}
+		err = sc.Scan(dbutl, row, &req)
+		if err != nil {
+			return err
+		}
+
+		existing[req.RequestType+":"+req.RequestURL] = &req
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]*accessRulesRequest)
+	for _, req := range a.Requests {
+		wanted[req.key()] = req
+	}
+
+	// free the positions that are about to be taken by other requests
+	for key, old := range existing {
+		req, ok := wanted[key]
+
+		if old.IndexLevel <= 0 ||
+			ok && old.IndexLevel == positiveOrNull(req.IndexLevel) && old.OrderNumber == positiveOrNull(req.OrderNumber) {
+
+			continue
+		}
+
+		pq = dbutl.PQuery(`
+			UPDATE request
+			   SET index_level = NULL,
+			       order_number = NULL
+			 WHERE request_id = ?
+		`, old.RequestID)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	requestIDs := make(map[string]int)
+
+	for _, req := range a.sortedRequests() {
+		key := req.key()
+		u := req.toURLRequest()
+
+		r := RequestHelper{tx: tx, RequestID: -1}
+		r.Load(&u)
+		r.ParentURL = u.ParentURL
+		r.ParentID = -1
+
+		if p := req.parentKey(); len(p) > 0 {
+			r.ParentID = requestIDs[p]
+		}
+
+		old, found := existing[key]
+		if found {
+			r.RequestID = old.RequestID
+
+			if r.Equals(old) {
+				requestIDs[key] = r.RequestID
+				continue
+			}
+		}
+
+		err = r.Save()
+		if err != nil {
+			return nil, err
+		}
+
+		requestIDs[key] = r.RequestID
+
+		if found {
+			summary.RequestsUpdated = append(summary.RequestsUpdated, key)
+		} else {
+			summary.RequestsAdded = append(summary.RequestsAdded, key)
+		}
+	}
+
+	for key, old := range existing {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		revoked, err := removeRequest(tx, old.RequestID)
+		if err != nil {
+			return nil, err
+		}
+
+		summary.RequestsRemoved = append(summary.RequestsRemoved, key)
+
+		if revoked > 0 {
+			summary.TokensRevoked = append(summary.TokensRevoked, fmt.Sprintf("%s: %d", key, revoked))
+		}
+	}
+
+	// names
+	names := make(map[int]map[string]string)
+
+	pq = dbutl.PQuery(`SELECT request_id, language, name FROM request_name`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var n accessRulesName
+		err = sc.Scan(dbutl, row, &n)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := names[n.RequestID]; !ok {
+			names[n.RequestID] = make(map[string]string)
+		}
+
+		names[n.RequestID][n.Language] = n.Name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, req := range a.Requests {
+		requestID := requestIDs[req.key()]
+		current := names[requestID]
+
+		for lang, name := range req.Names {
+			old, ok := current[lang]
+
+			switch {
+			case !ok:
+				pq = dbutl.PQuery(`
+					INSERT INTO request_name (
+						request_id,
+						language,
+						name
+					)
+					VALUES (?, ?, ?)
+				`, requestID,
+					lang,
+					name)
+			case old != name:
+				pq = dbutl.PQuery(`
+					UPDATE request_name
+					   SET name = ?
+					 WHERE request_id = ?
+					   AND language = ?
+				`, name,
+					requestID,
+					lang)
+			default:
+				continue
+			}
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.NamesChanged = append(summary.NamesChanged, fmt.Sprintf("%s [%s]", req.key(), lang))
+		}
+
+		for lang := range current {
+			if _, ok := req.Names[lang]; ok {
+				continue
+			}
+
+			pq = dbutl.PQuery(`
+				DELETE FROM request_name
+				 WHERE request_id = ?
+				   AND language = ?
+			`, requestID,
+				lang)
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.NamesChanged = append(summary.NamesChanged, fmt.Sprintf("%s [%s] removed", req.key(), lang))
+		}
+	}
+
+	// request permissions
+	requestPerms := make(map[int]map[int]bool)
+
+	pq = dbutl.PQuery(`SELECT request_id, permission_id FROM request_permission`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var requestID, permissionID int
+		err = row.Scan(&requestID, &permissionID)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := requestPerms[requestID]; !ok {
+			requestPerms[requestID] = make(map[int]bool)
+		}
+
+		requestPerms[requestID][permissionID] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, req := range a.Requests {
+		requestID := requestIDs[req.key()]
+		name := a.requestPermission(req)
+		permissionID := permIDs[name]
+		current := requestPerms[requestID]
+
+		if current[permissionID] && len(current) == 1 {
+			continue
+		}
+
+		pq = dbutl.PQuery(`
+			DELETE FROM request_permission
+			 WHERE request_id = ?
+		`, requestID)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return nil, err
+		}
+
+		pq = dbutl.PQuery(`
+			INSERT INTO request_permission (
+				request_id,
+				permission_id
+			)
+			VALUES (?, ?)
+		`, requestID,
+			permissionID)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return nil, err
+		}
+
+		summary.RequestPermissions = append(summary.RequestPermissions, req.key()+" -> "+name)
+	}
+
+	// grants - request_role is derived from the request permission and the roles holding it
+	var grants []*accessRulesGrant
+
+	pq = dbutl.PQuery(`
+		SELECT rr.request_id,
+		       rr.role_id,
+		       r.role
+		  FROM request_role rr
+		  JOIN role r ON (rr.role_id = r.role_id)
+	`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var g accessRulesGrant
+		err = sc.Scan(dbutl, row, &g)
+		if err != nil {
+			return err
+		}
+
+		grants = append(grants, &g)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, req := range a.Requests {
+		requestID := requestIDs[req.key()]
+		wantedRoles := a.grants(req)
+
+		for _, g := range grants {
+			if g.RequestID != requestID {
+				continue
+			}
+
+			lrole := strings.ToLower(g.Role)
+
+			if wantedRoles[lrole] {
+				delete(wantedRoles, lrole)
+				continue
+			}
+
+			pq = dbutl.PQuery(`
+				DELETE FROM request_role
+				 WHERE role_id = ?
+				   AND request_id = ?
+			`, g.RoleID,
+				requestID)
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.GrantsRemoved = append(summary.GrantsRemoved, req.key()+" -> "+g.Role)
+		}
+
+		for _, lrole := range sortedKeys(wantedRoles) {
+			pq = dbutl.PQuery(`
+				INSERT INTO request_role (
+					role_id,
+					request_id
+				)
+				VALUES (?, ?)
+			`, roleIDs[lrole],
+				requestID)
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return nil, err
+			}
+
+			summary.GrantsAdded = append(summary.GrantsAdded, req.key()+" -> "+lrole)
+		}
+	}
+
+	// permissions no longer in the file
+	wantedPerms := make(map[string]bool)
+	for _, perm := range perms {
+		wantedPerms[perm.Name] = true
+	}
+
+	for name, old := range oldPerms {
+		if wantedPerms[name] {
+			continue
+		}
+
+		p := Permission{tx: tx, PermissionID: old.PermissionID, Name: name}
+		err = p.Delete()
+		if err != nil {
+			return nil, err
+		}
+
+		summary.PermissionsRemoved = append(summary.PermissionsRemoved, name)
+	}
+
+	if newVersion || summary.hasChanges() {
+		pq = dbutl.PQuery(`
+			INSERT INTO access_rules_version (
+				version,
+				checksum,
+				rules_file,
+				applied_time
+			)
+			VALUES (?, ?, ?, ?)
+		`, a.Version,
+			a.checksum,
+			a.file,
+			time.Now().UTC())
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &summary, nil
+}
+
+// removeRequest - delete a request together with everything that references it.
+// The API tokens scoped to the request are revoked, since without their scope rows they would allow everything.
+// Returns how many tokens were revoked.
+func removeRequest(tx *sql.Tx, requestID int) (int64, error) {
+	pq := dbutl.PQuery(`
+	    UPDATE user_api_token
+	       SET valid = ?
+	     WHERE valid = ?
+	       AND api_token_id IN (
+	         SELECT api_token_id FROM user_api_token_request WHERE request_id = ?
+	     )
+	`, 0,
+		1,
+		requestID)
+
+	result, err := dbutl.ExecTx(tx, pq)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	queries := []string{
+		`UPDATE request SET parent_id = NULL WHERE parent_id = ?`,
+		`DELETE FROM user_api_token_request WHERE request_id = ?`,
+		`DELETE FROM request_permission WHERE request_id = ?`,
+		`DELETE FROM request_role WHERE request_id = ?`,
+		`DELETE FROM request_name WHERE request_id = ?`,
+		`DELETE FROM request WHERE request_id = ?`,
+	}
+
+	for _, query := range queries {
+		pq = dbutl.PQuery(query, requestID)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return revoked, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// AccountController - user self service controller
+type AccountController struct {
+}
+
+// APITokens - API tokens page
+func (AccountController) APITokens(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.APITokensResponseModel, error) {
+	var lres models.APITokensResponseModel
+
+	sessionData, _ := getSessionData(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(sessionData.User.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Tokens, err = GetUserAPITokens(usr.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := usr.GetUserRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		lres.Roles = append(lres.Roles, role.Rolename)
+	}
+
+	lres.Requests, err = getAPITokenScopeRequests(usr.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lres, nil
+}
+
+// CreateAPIToken - create a new API token
+func (AccountController) CreateAPIToken(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	username := sessionData.User.Username
+
+	if sessionData.APITokenID > 0 {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "api-tokens.create-with-token")
+		audit.Log(err, "add-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	name := r.FormValue("name")
+	validDays := utils.String2int(r.FormValue("valid_days"))
+
+	if len(name) == 0 {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "api-tokens.name-empty")
+		audit.Log(err, "add-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	if validDays < 0 {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "api-tokens.valid-days-negative")
+		audit.Log(err, "add-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "api-tokens.create-failed")
+		audit.Log(err, "add-api-token", "Could not create the token", "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	token := APIToken{
+		tx:     tx,
+		UserID: usr.UserID,
+		Name:   name,
+	}
+
+	if validDays > 0 {
+		token.Expires = true
+		token.ValidUntil = time.Now().UTC().Add(time.Duration(validDays*24) * time.Hour)
+	}
+
+	roles, err := usr.GetUserRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, roleName := range r.Form["role"] {
+		found := false
+
+		for _, role := range roles {
+			if role.Rolename == roleName {
+				token.Roles = append(token.Roles, role.RoleID)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			lres.BError = true
+			lres.SError, err = trErr(lang, "api-tokens.not-role-member", roleName)
+			audit.Log(err, "add-api-token", err.Error(), "user", username)
+
+			return &lres, nil
+		}
+	}
+
+	requests, err := getAPITokenScopeRequests(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sRequestID := range r.Form["request"] {
+		requestID := utils.String2int(sRequestID)
+		found := false
+
+		for _, req := range requests {
+			if req.RequestID == requestID {
+				token.Requests = append(token.Requests, requestID)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			lres.BError = true
+			lres.SError, err = trErr(lang, "api-tokens.unknown-request")
+			audit.Log(err, "add-api-token", err.Error(), "user", username, "request", sRequestID)
+
+			return &lres, nil
+		}
+	}
+
+	err = token.Save()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	lres.BError = false
+	lres.SError = translate(lang, "api-tokens.token-created", token.Token)
+
+	return &lres, nil
+}
+
+// RevokeAPIToken - revoke an API token
+func (AccountController) RevokeAPIToken(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	username := sessionData.User.Username
+	tokenID := utils.String2int(r.FormValue("token_id"))
+
+	if sessionData.APITokenID > 0 {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "api-tokens.revoke-with-token")
+		audit.Log(err, "revoke-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "api-tokens.revoke-failed")
+		audit.Log(err, "revoke-api-token", "Could not revoke the token", "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "revoke-api-token", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	token := APIToken{tx: tx}
+	err = token.Revoke(usr.UserID, tokenID)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "revoke-api-token", err.Error(), "user", username, "token_id", tokenID)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	lres.BError = false
+	lres.SError = translate(lang, "api-tokens.revoked")
+
+	return &lres, nil
+}
+
+// Profile - own name, surname and email
+func (AccountController) Profile(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.ProfileResponseModel, error) {
+	var lres models.ProfileResponseModel
+
+	sessionData, _ := getSessionData(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(sessionData.User.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Username = usr.Username
+	lres.Name = usr.Name
+	lres.Surname = usr.Surname
+	lres.Email = usr.Email
+	lres.PasswordSource = usr.PasswordSource
+
+	lres.PendingEmail, err = getPendingEmailChange(tx, usr.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	deletionRequestID, err := getPendingDeletionRequest(tx, usr.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	lres.DeletionRequested = deletionRequestID > 0
+
+	return &lres, nil
+}
+
+// SaveProfile - save name and surname; a new email waits for the confirmation link mailed to it
+func (AccountController) SaveProfile(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	username := sessionData.User.Username
+	name := strings.TrimSpace(r.FormValue("name"))
+	surname := strings.TrimSpace(r.FormValue("surname"))
+	email := strings.TrimSpace(r.FormValue("email"))
+
+	if len(email) == 0 {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "register.email-empty")
+		audit.Log(err, "profile", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "profile.save-failed")
+		audit.Log(err, "profile", err.Error(), "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "profile", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	// the directory is the reference for delegated users
+	if usr.IsDelegated() {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "profile.delegated", usr.PasswordSource)
+		audit.Log(err, "profile", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	// another case of the same address needs no confirmation
+	emailChanged := !strings.EqualFold(email, usr.Email)
+	if !emailChanged {
+		usr.Email = email
+	}
+
+	if emailChanged && !mailEnabled() {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "profile.email-no-mail")
+		audit.Log(err, "profile", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	usr.Name = name
+	usr.Surname = surname
+
+	err = usr.Save()
+	if err == nil && emailChanged {
+		err = requestEmailChange(r, &usr, email, lang)
+	}
+
+	if err != nil {
+		lres.BError = true
+		if _, ok := err.(*localizedError); ok {
+			lres.SError = translateError(lang, err)
+		} else {
+			lres.SError = translate(lang, "profile.save-failed")
+		}
+		audit.Log(err, "profile", "Could not save the profile", "user", username, "email", email)
+
+		return &lres, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "profile.save-failed")
+		audit.Log(err, "profile", "Could not save the profile", "user", username)
+
+		return &lres, nil
+	}
+
+	if sessionData.APITokenID <= 0 {
+		sessionData.User.Name = usr.Name
+		sessionData.User.Surname = usr.Surname
+
+		err = refreshSessionData(w, r, *sessionData)
+		if err != nil {
+			audit.Log(err, "profile", "Could not refresh the session", "user", username)
+		}
+	}
+
+	lres.BError = false
+
+	if emailChanged {
+		audit.Log(nil, "profile", "Email change requested", "user", username, "email", usr.Email, "new_email", email)
+		lres.SError = translate(lang, "profile.email-sent", email)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "profile", "Profile saved", "user", username)
+	lres.SError = translate(lang, "profile.saved")
+
+	return &lres, nil
+}
+
+// ConfirmEmail - the link mailed to a new email; it may be opened without being logged in
+func (AccountController) ConfirmEmail(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	lang := requestLanguage(r)
+	ip := getClientIP(r)
+
+	usr, oldEmail, err := confirmEmailChange(r.FormValue("token"))
+	if err != nil {
+		lres.BError = true
+		if _, ok := err.(*localizedError); ok {
+			lres.SError = translateError(lang, err)
+		} else {
+			lres.SError = translate(lang, "profile.save-failed")
+		}
+		audit.Log(err, "profile", "Could not confirm the email", "ip", ip)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "profile", "Email changed", "user", usr.Username, "old_email", oldEmail, "email", usr.Email, "ip", ip)
+
+	notifyEmailChanged(usr, oldEmail)
+
+	lres.BError = false
+	lres.SError = translate(lang, "profile.email-changed", usr.Email)
+
+	return &lres, nil
+}
+
+// ExportData - zip of everything kept about the user
+func (AccountController) ExportData(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.FileResponseModel, error) {
+	var lres models.FileResponseModel
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	username := sessionData.User.Username
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "account-export.failed")
+		audit.Log(err, "account-export", err.Error(), "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		lres.Content, err = exportUserData(tx, &usr)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "account-export.failed")
+		audit.Log(err, "account-export", "Could not export the data of the user", "user", username)
+
+		return &lres, nil
+	}
+
+	lres.FileName = fmt.Sprintf("%s-%s.zip", usr.Username, time.Now().UTC().Format("20060102"))
+	lres.ContentType = "application/zip"
+
+	if sessionData.Impersonating() {
+		audit.Log(nil, "account-export", "User data exported", "user", usr.Username, "admin", sessionData.RealUser.Username)
+	} else {
+		audit.Log(nil, "account-export", "User data exported", "user", usr.Username)
+	}
+
+	return &lres, nil
+}
+
+// RequestDeletion - ask for the account to be deleted; an administrator approves it
+func (AccountController) RequestDeletion(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	username := sessionData.User.Username
+
+	// typing the username guards against a stray click
+	if !strings.EqualFold(strings.TrimSpace(r.FormValue("confirm_username")), username) {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "account-deletion.confirm-mismatch")
+		audit.Log(err, "account-deletion", err.Error(), "user", username)
+
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "account-deletion.failed")
+		audit.Log(err, "account-deletion", err.Error(), "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		err = requestAccountDeletion(tx, usr.UserID, strings.TrimSpace(r.FormValue("reason")))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		lres.BError = true
+		if _, ok := err.(*localizedError); ok {
+			lres.SError = translateError(lang, err)
+		} else {
+			lres.SError = translate(lang, "account-deletion.failed")
+		}
+		audit.Log(err, "account-deletion", "Could not request the deletion of the account", "user", username)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "account-deletion", "Account deletion requested", "user", usr.Username)
+
+	lres.BError = false
+	lres.SError = translate(lang, "account-deletion.requested")
+
+	return &lres, nil
+}
+
+// CancelDeletion - withdraw the pending deletion request
+func (AccountController) CancelDeletion(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	username := sessionData.User.Username
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "account-deletion.failed")
+		audit.Log(err, "account-deletion", err.Error(), "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		err = cancelAccountDeletion(tx, usr.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		lres.BError = true
+		if _, ok := err.(*localizedError); ok {
+			lres.SError = translateError(lang, err)
+		} else {
+			lres.SError = translate(lang, "account-deletion.failed")
+		}
+		audit.Log(err, "account-deletion", "Could not cancel the deletion of the account", "user", username)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "account-deletion", "Account deletion cancelled", "user", usr.Username)
+
+	lres.BError = false
+	lres.SError = translate(lang, "account-deletion.cancelled")
+
+	return &lres, nil
+}
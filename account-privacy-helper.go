@@ -0,0 +1,572 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// Users download what is kept about them as a zip of json files, and may ask for their account to be deleted.
+// Once an administrator approves, the "user" row stays for the foreign keys but is anonymized,
+// passwords, networks and identities are removed and the audit log names the user by a pseudonym.
+
+const (
+	// DeletionPending - waiting for an administrator
+	DeletionPending = "pending"
+	// DeletionApproved - the account was anonymized
+	DeletionApproved = "approved"
+	// DeletionRejected - the account was kept
+	DeletionRejected = "rejected"
+	// DeletionCancelled - the user withdrew the request
+	DeletionCancelled = "cancelled"
+)
+
+// exportRows - rows as column -> value, NULL as nil
+func exportRows(tx *sql.Tx, pq *utils.PreparedQuery) ([]map[string]interface{}, error) {
+	rows := []map[string]interface{}{}
+
+	err := dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		cols, err := row.Columns()
+		if err != nil {
+			return err
+		}
+
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+
+		err = row.Scan(ptrs...)
+		if err != nil {
+			return err
+		}
+
+		m := make(map[string]interface{})
+		for i, col := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				vals[i] = string(b)
+			}
+
+			m[strings.ToLower(col)] = vals[i]
+		}
+
+		rows = append(rows, m)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// exportUserData - zip with a json file for each kind of data kept about the user
+func exportUserData(tx *sql.Tx, u *MembershipUser) ([]byte, error) {
+	sections := []struct {
+		file string
+		pq   *utils.PreparedQuery
+	}{
+		{"profile.json", dbutl.PQuery(`
+		    SELECT username,
+		           name,
+		           surname,
+		           email,
+		           creation_time,
+		           last_update,
+		           activated,
+		           activation_time,
+		           last_password_change,
+		           failed_password_atmpts,
+		           last_connect_time,
+		           last_connect_ip,
+		           valid,
+		           locked_out,
+		           locked_until,
+		           password_expires,
+		           password_source,
+		           language
+		      FROM "user"
+		     WHERE user_id = ?
+		`, u.UserID)},
+		{"roles.json", dbutl.PQuery(`
+		    SELECT r.role,
+		           ur.valid_from,
+		           ur.valid_until,
+		           ur.valid
+		      FROM user_role ur
+		      JOIN role r ON (ur.role_id = r.role_id)
+		     WHERE ur.user_id = ?
+		     ORDER BY ur.valid_from
+		`, u.UserID)},
+		{"role-history.json", dbutl.PQuery(`
+		    SELECT role,
+		           valid_from,
+		           valid_until,
+		           valid,
+		           change_type,
+		           change_time,
+		           changed_by
+		      FROM user_role_history
+		     WHERE user_id = ?
+		     ORDER BY change_time
+		`, u.UserID)},
+		// when the passwords changed, never the hashes
+		{"password-changes.json", dbutl.PQuery(`
+		    SELECT valid_from,
+		           valid_until,
+		           temporary,
+		           valid
+		      FROM user_password
+		     WHERE user_id = ?
+		     ORDER BY valid_from
+		`, u.UserID)},
+		{"networks.json", dbutl.PQuery(`
+		    SELECT ip
+		      FROM user_ip
+		     WHERE user_id = ?
+		     ORDER BY ip
+		`, u.UserID)},
+		{"api-tokens.json", dbutl.PQuery(`
+		    SELECT name,
+		           token_prefix,
+		           creation_time,
+		           valid_until,
+		           last_used_time,
+		           last_used_ip,
+		           valid
+		      FROM user_api_token
+		     WHERE user_id = ?
+		     ORDER BY creation_time
+		`, u.UserID)},
+		{"external-identities.json", dbutl.PQuery(`
+		    SELECT issuer,
+		           subject,
+		           email,
+		           creation_time,
+		           last_login
+		      FROM user_external_identity
+		     WHERE user_id = ?
+		`, u.UserID)},
+		{"email-changes.json", dbutl.PQuery(`
+		    SELECT new_email,
+		           creation_time,
+		           valid_until,
+		           valid
+		      FROM user_email_change
+		     WHERE user_id = ?
+		     ORDER BY creation_time
+		`, u.UserID)},
+		{"deletion-requests.json", dbutl.PQuery(`
+		    SELECT request_time,
+		           reason,
+		           status,
+		           decision_time
+		      FROM account_deletion_request
+		     WHERE user_id = ?
+		     ORDER BY request_time
+		`, u.UserID)},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, s := range sections {
+		rows, err := exportRows(tx, s.pq)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeZipJSON(zw, s.file, rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	type auditExport struct {
+		AuditLogID int64       `json:"audit_log_id"`
+		Source     string      `json:"source"`
+		LogTime    time.Time   `json:"log_time"`
+		LogMsg     interface{} `json:"log_msg"`
+	}
+
+	entries := []*auditExport{}
+
+	err := forEachAuditMention(tx, auditMentionValues(u.Username, u.Email), func(e *auditLogEntry) error {
+		var msg interface{} = e.LogMsg
+		if json.Valid([]byte(e.LogMsg)) {
+			msg = json.RawMessage(e.LogMsg)
+		}
+
+		entries = append(entries, &auditExport{e.AuditLogID, e.Source, e.LogTime, msg})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeZipJSON(zw, "audit-log.json", entries)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// getPendingDeletionRequest - id of the request of the user waiting for an administrator; 0 when there is none
+func getPendingDeletionRequest(tx *sql.Tx, userID int) (int, error) {
+	var requestID int
+
+	pq := dbutl.PQuery(`
+	    SELECT deletion_request_id
+	      FROM account_deletion_request
+	     WHERE user_id = ?
+	       AND status = ?
+	`, userID,
+		DeletionPending)
+
+	err := tx.QueryRow(pq.Query, pq.Args...).Scan(&requestID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+
+	return requestID, nil
+}
+
+// requestAccountDeletion - ask for the account of the user to be deleted
+func requestAccountDeletion(tx *sql.Tx, userID int, reason string) error {
+	requestID, err := getPendingDeletionRequest(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if requestID > 0 {
+		return newLocalizedError("account-deletion.already-requested")
+	}
+
+	if runes := []rune(reason); len(runes) > 512 {
+		reason = string(runes[:512])
+	}
+
+	pq := dbutl.PQuery(`
+	    INSERT INTO account_deletion_request (
+	        user_id,
+	        request_time,
+	        reason,
+	        status
+	    )
+	    VALUES (?, ?, ?, ?)
+	`, userID,
+		time.Now().UTC(),
+		reason,
+		DeletionPending)
+
+	_, err = dbutl.ExecTx(tx, pq)
+	return err
+}
+
+// cancelAccountDeletion - the user withdraws their pending request
+func cancelAccountDeletion(tx *sql.Tx, userID int) error {
+	requestID, err := getPendingDeletionRequest(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if requestID <= 0 {
+		return newLocalizedError("account-deletion.not-requested")
+	}
+
+	return setDeletionRequestStatus(tx, requestID, DeletionCancelled, "")
+}
+
+func setDeletionRequestStatus(tx *sql.Tx, requestID int, status string, decidedBy string) error {
+	pq := dbutl.PQuery(`
+	    UPDATE account_deletion_request
+	       SET status        = ?,
+	           decided_by    = ?,
+	           decision_time = ?
+	     WHERE deletion_request_id = ?
+	`, status,
+		decidedBy,
+		time.Now().UTC(),
+		requestID)
+
+	_, err := dbutl.ExecTx(tx, pq)
+	return err
+}
+
+// getAccountDeletionRequests - the pending requests or the decided ones, the newest first
+func getAccountDeletionRequests(pending bool) ([]*models.AccountDeletionRequestModel, error) {
+	var requests []*models.AccountDeletionRequestModel
+
+	filter := "d.status = ?"
+	order := "d.request_time DESC"
+	if !pending {
+		filter = "d.status <> ?"
+		order = "d.decision_time DESC"
+	}
+
+	pq := dbutl.PQuery(`
+	    SELECT d.deletion_request_id,
+	           d.user_id,
+	           u.username,
+	           u.name,
+	           u.surname,
+	           d.request_time,
+	           CASE WHEN d.reason IS NULL THEN '-' ELSE d.reason END AS reason,
+	           d.status,
+	           CASE WHEN d.decided_by IS NULL THEN '-' ELSE d.decided_by END AS decided_by,
+	           CASE WHEN d.decision_time IS NULL THEN d.request_time ELSE d.decision_time END AS decision_time
+	      FROM account_deletion_request d
+	      JOIN "user" u ON (d.user_id = u.user_id)
+	     WHERE `+filter+`
+	     ORDER BY `+order+`
+	`, DeletionPending)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var req models.AccountDeletionRequestModel
+		err = sc.Scan(dbutl, row, &req)
+		if err != nil {
+			return err
+		}
+
+		requests = append(requests, &req)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// decideAccountDeletion - approve (anonymize the account) or reject a pending request.
+// Returns the user as they were known before and the pseudonym they got.
+func decideAccountDeletion(requestID int, approve bool, admin string) (*MembershipUser, string, error) {
+	var userID int
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	pq := dbutl.PQuery(`
+	    SELECT user_id
+	      FROM account_deletion_request
+	     WHERE deletion_request_id = ?
+	       AND status = ?
+	`, requestID,
+		DeletionPending)
+
+	err = tx.QueryRow(pq.Query, pq.Args...).Scan(&userID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, "", newLocalizedError("account-deletion.not-found")
+	case err != nil:
+		return nil, "", err
+	}
+
+	u := MembershipUser{tx: tx}
+	err = u.GetByID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.EqualFold(u.Username, admin) {
+		return nil, "", newLocalizedError("account-deletion.own")
+	}
+
+	status := DeletionRejected
+	pseudonym := ""
+
+	if approve {
+		status = DeletionApproved
+		pseudonym = fmt.Sprintf("deleted-%d", u.UserID)
+
+		err = anonymizeUser(tx, &u, pseudonym)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = setDeletionRequestStatus(tx, requestID, status, admin)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if approve {
+		invalidateAccessCache()
+	}
+
+	return &u, pseudonym, nil
+}
+
+// anonymizeUser - remove what identifies the user; the row stays for the foreign keys of the history
+func anonymizeUser(tx *sql.Tx, u *MembershipUser, pseudonym string) error {
+	dt := time.Now().UTC()
+
+	queries := []*utils.PreparedQuery{
+		dbutl.PQuery(`
+		    UPDATE "user"
+		       SET username               = ?,
+		           loweredusername        = ?,
+		           name                   = '-',
+		           surname                = '-',
+		           email                  = ?,
+		           loweredemail           = ?,
+		           last_update            = ?,
+		           activated              = 0,
+		           valid                  = 0,
+		           failed_password_atmpts = 0,
+		           first_failed_password  = NULL,
+		           last_failed_password   = NULL,
+		           last_connect_ip        = NULL,
+		           language               = NULL
+		     WHERE user_id = ?
+		`, pseudonym,
+			pseudonym,
+			pseudonym,
+			pseudonym,
+			dt,
+			u.UserID),
+		dbutl.PQuery(`DELETE FROM user_password WHERE user_id = ?`, u.UserID),
+		dbutl.PQuery(`DELETE FROM user_ip WHERE user_id = ?`, u.UserID),
+		dbutl.PQuery(`DELETE FROM user_role WHERE user_id = ?`, u.UserID),
+		dbutl.PQuery(`DELETE FROM user_external_identity WHERE user_id = ?`, u.UserID),
+		dbutl.PQuery(`DELETE FROM user_email_change WHERE user_id = ?`, u.UserID),
+		dbutl.PQuery(`
+		    UPDATE user_api_token
+		       SET name         = '-',
+		           last_used_ip = NULL,
+		           valid        = 0
+		     WHERE user_id = ?
+		`, u.UserID),
+		dbutl.PQuery(`
+		    UPDATE account_deletion_request
+		       SET reason = NULL
+		     WHERE user_id = ?
+		`, u.UserID),
+		// changes the user made to others
+		dbutl.PQuery(`
+		    UPDATE user_role_history
+		       SET changed_by = ?
+		     WHERE lower(changed_by) = lower(?)
+		`, pseudonym,
+			u.Username),
+		dbutl.PQuery(`
+		    UPDATE account_deletion_request
+		       SET decided_by = ?
+		     WHERE lower(decided_by) = lower(?)
+		`, pseudonym,
+			u.Username),
+	}
+
+	for _, pq := range queries {
+		_, err := dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := deleteUserLoginAttempts(tx, u.Username)
+	if err != nil {
+		return err
+	}
+
+	// the roles are gone, the other app instances must not serve them from their cache
+	err = bumpAccessChangeCounter(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = pseudonymizeAuditLog(tx, auditMentionValues(u.Username, u.Email), pseudonym)
+	return err
+}
+
+// deleteUserLoginAttempts - the failed logins kept under the username; the ip-user keys are
+// compared whole, a LIKE would take the _ and % of a username as wildcards
+func deleteUserLoginAttempts(tx *sql.Tx, username string) error {
+	var keys []string
+	user := strings.ToLower(username)
+
+	pq := dbutl.PQuery(`
+	    SELECT DISTINCT limit_key
+	      FROM login_attempt
+	     WHERE limit_key = ?
+	        OR limit_key LIKE 'ip-user:%'
+	`, "user:"+user)
+
+	err := dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var key string
+
+		err := row.Scan(&key)
+		if err != nil {
+			return err
+		}
+
+		// ip-user:<ip>|<user>, an ip has no |
+		i := strings.Index(key, "|")
+		if key == "user:"+user || (i >= 0 && key[i+1:] == user) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the rows are read, the connection can take the deletes
+	for _, key := range keys {
+		pq = dbutl.PQuery(`
+		    DELETE FROM login_attempt
+		     WHERE limit_key = ?
+		`, key)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,974 @@
+package main
+
+import (
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+const (
+	roleRowsOnPage     = 50
+	roleDaysAhead      = 30
+	maxRoleDaysAhead   = 366
+	auditRowsOnPage    = 50
+	maxAuditRowsOnPage = 500
+)
+
+// AdminController - administration controller
+type AdminController struct {
+}
+
+// parseFormDate - ISO date from a form field; empty - nil
+func parseFormDate(r *http.Request, field string) (*time.Time, error) {
+	val := r.FormValue(field)
+
+	if len(val) == 0 {
+		return nil, nil
+	}
+
+	if !utils.IsISODate(val) {
+		return nil, newLocalizedError("form.invalid-date", val)
+	}
+
+	dt, err := time.Parse("2006-01-02", val[:10])
+	if err != nil {
+		return nil, err
+	}
+
+	return &dt, nil
+}
+
+// withRoleID - redirect url that keeps the selected role
+func withRoleID(url string, roleID int) string {
+	if len(url) == 0 || url == "-" {
+		return url
+	}
+
+	return url + "?role_id=" + strconv.Itoa(roleID)
+}
+
+// withUsername - redirect url that keeps the selected user
+func withUsername(url string, username string) string {
+	if len(url) == 0 || url == "-" {
+		return url
+	}
+
+	return url + "?username=" + neturl.QueryEscape(username)
+}
+
+// Roles - roles page with upcoming membership changes
+func (AdminController) Roles(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.RolesResponseModel, error) {
+	var lres models.RolesResponseModel
+	var err error
+
+	lres.DaysAhead = utils.String2int(r.FormValue("days"))
+	if lres.DaysAhead <= 0 || lres.DaysAhead > maxRoleDaysAhead {
+		lres.DaysAhead = roleDaysAhead
+	}
+
+	lres.Roles, err = GetRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Upcoming, err = GetUpcomingRoleMemberships(lres.DaysAhead)
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Expiring, err = GetExpiringRoleMemberships(lres.DaysAhead)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lres, nil
+}
+
+// RoleMembers - members of a role
+func (AdminController) RoleMembers(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.RoleMembersResponseModel, error) {
+	var lres models.RoleMembersResponseModel
+
+	roleID := utils.String2int(r.FormValue("role_id"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	role := MembershipRole{tx: tx}
+	err = role.GetByID(roleID)
+	if err != nil {
+		return nil, err
+	}
+
+	managed, err := role.IsManaged()
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Role = models.RoleModel{
+		RoleID:  role.RoleID,
+		Role:    role.Rolename,
+		Managed: managed,
+	}
+
+	lres.Members, err = GetRoleMembers(role.RoleID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range lres.Members {
+		if m.Active {
+			lres.Role.Members++
+		}
+	}
+
+	return &lres, nil
+}
+
+// RoleHistory - membership history, of one role or of all
+func (AdminController) RoleHistory(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.RoleHistoryResponseModel, error) {
+	var lres models.RoleHistoryResponseModel
+	var err error
+
+	lres.RoleID = utils.String2int(r.FormValue("role_id"))
+	lres.Page = utils.String2int(r.FormValue("lpage"))
+	if lres.Page <= 0 {
+		lres.Page = 1
+	}
+
+	if lres.RoleID > 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		role := MembershipRole{tx: tx}
+		err = role.GetByID(lres.RoleID)
+		if err == nil {
+			lres.Role = role.Rolename
+		}
+	}
+
+	lres.History, err = GetRoleHistory(lres.RoleID, lres.Page, roleRowsOnPage)
+	if err != nil {
+		return nil, err
+	}
+
+	if lres.Page > 1 {
+		lres.PrevPage = lres.Page - 1
+	}
+
+	if len(lres.History) == roleRowsOnPage {
+		lres.NextPage = lres.Page + 1
+	}
+
+	return &lres, nil
+}
+
+// AccessExplain - why a user may or may not call an url
+func (AdminController) AccessExplain(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.AccessExplainResponseModel, error) {
+	var lres models.AccessExplainResponseModel
+
+	username := r.FormValue("username")
+	url := r.FormValue("url")
+	method := r.FormValue("method")
+
+	if len(method) == 0 {
+		method = "GET"
+	}
+
+	if len(url) == 0 {
+		return &lres, nil
+	}
+
+	at, err := parseFormDate(r, "at")
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(requestLanguage(r), err)
+		return &lres, nil
+	}
+
+	var dt time.Time
+	if at != nil {
+		dt = *at
+	}
+
+	lres.Explain, err = explainAccess(username, url, method, dt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lres, nil
+}
+
+// AccessCache - hit ratio of the access caches
+func (AdminController) AccessCache(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.AccessCacheResponseModel, error) {
+	return getAccessCacheStats(), nil
+}
+
+// AuditLog - audit log entries matching the filters, newest first
+func (AdminController) AuditLog(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.AuditLogResponseModel, error) {
+	var lres models.AuditLogResponseModel
+	var f auditLogFilter
+	var err error
+
+	lres.From = r.FormValue("from")
+	lres.To = r.FormValue("to")
+	lres.Operation = strings.TrimSpace(r.FormValue("operation"))
+	lres.User = strings.TrimSpace(r.FormValue("user"))
+	lres.IP = strings.TrimSpace(r.FormValue("ip"))
+	lres.Status = r.FormValue("status")
+	lres.Text = strings.TrimSpace(r.FormValue("text"))
+
+	if lres.Status != "error" && lres.Status != "ok" {
+		lres.Status = ""
+	}
+
+	lres.Rows = utils.String2int(r.FormValue("rows"))
+	if lres.Rows <= 0 {
+		lres.Rows = auditRowsOnPage
+	} else if lres.Rows > maxAuditRowsOnPage {
+		lres.Rows = maxAuditRowsOnPage
+	}
+
+	lres.Page = utils.String2int(r.FormValue("lpage"))
+	if lres.Page <= 0 {
+		lres.Page = 1
+	}
+
+	f.From, err = parseFormDate(r, "from")
+	if err == nil {
+		f.To, err = parseFormDate(r, "to")
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(requestLanguage(r), err)
+		return &lres, nil
+	}
+
+	f.Operation = lres.Operation
+	f.User = lres.User
+	f.IP = lres.IP
+	f.Status = lres.Status
+	f.Text = lres.Text
+
+	lres.Entries, err = searchAuditLog(&f, lres.Page, lres.Rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if lres.Page > 1 {
+		lres.PrevPage = lres.Page - 1
+	}
+
+	if len(lres.Entries) == lres.Rows {
+		lres.NextPage = lres.Page + 1
+	}
+
+	return &lres, nil
+}
+
+// CreateRole - create a role
+func (AdminController) CreateRole(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	name := r.FormValue("role")
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "roles.create-failed")
+		audit.Log(err, "add-role", "Could not create the role", "role", name)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	role := MembershipRole{tx: tx, Rolename: name}
+	err = role.Save()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-role", err.Error(), "role", name, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	lres.BError = false
+	lres.SError = translate(lang, "roles.created", role.Rolename)
+
+	return &lres, nil
+}
+
+// RenameRole - rename a role that is not used in access-rules.json
+func (AdminController) RenameRole(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	roleID := utils.String2int(r.FormValue("role_id"))
+	name := r.FormValue("role")
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "roles.rename-failed")
+		audit.Log(err, "update-role", "Could not rename the role", "role_id", roleID)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	role := MembershipRole{tx: tx}
+	err = role.GetByID(roleID)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "update-role", err.Error(), "role_id", roleID)
+
+		return &lres, nil
+	}
+
+	managed, err := role.IsManaged()
+	if err != nil {
+		return nil, err
+	}
+
+	if managed {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "roles.managed-rename", role.Rolename)
+		audit.Log(err, "update-role", err.Error(), "role", role.Rolename, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	role.Rolename = name
+	err = role.Save()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "update-role", err.Error(), "role_id", roleID, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	lres.BError = false
+	lres.SError = translate(lang, "roles.renamed")
+
+	return &lres, nil
+}
+
+// DeleteRole - delete a role that is not used in access-rules.json
+func (AdminController) DeleteRole(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	roleID := utils.String2int(r.FormValue("role_id"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "roles.delete-failed")
+		audit.Log(err, "delete-role", "Could not delete the role", "role_id", roleID)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	role := MembershipRole{tx: tx}
+	err = role.GetByID(roleID)
+	if err == nil {
+		err = role.Delete(sessionData.User.Username)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "delete-role", err.Error(), "role_id", roleID, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+	invalidateAccessCache()
+
+	lres.BError = false
+	lres.SError = translate(lang, "roles.deleted", role.Rolename)
+
+	return &lres, nil
+}
+
+// AddRoleMember - add a user to a role, optionally for a limited period
+func (AdminController) AddRoleMember(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	roleID := utils.String2int(r.FormValue("role_id"))
+	username := r.FormValue("username")
+
+	if res != nil {
+		lres.SSuccessURL = withRoleID(res.RedirectURL, roleID)
+		lres.SErrorURL = withRoleID(res.RedirectOnError, roleID)
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+
+	validFrom, err := parseFormDate(r, "valid_from")
+	if err == nil && validFrom == nil {
+		dt := time.Now().UTC()
+		validFrom = &dt
+	}
+
+	var validUntil *time.Time
+	if err == nil {
+		validUntil, err = parseFormDate(r, "valid_until")
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-user-role", err.Error(), "user", username, "role_id", roleID)
+
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "role-members.add-failed")
+		audit.Log(err, "add-user-role", "Could not add the user to the role", "user", username, "role_id", roleID)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	role := MembershipRole{tx: tx}
+	err = role.GetByID(roleID)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-user-role", err.Error(), "user", username, "role_id", roleID)
+
+		return &lres, nil
+	}
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		err = usr.AddToRoleBetween(role.Rolename, *validFrom, validUntil, sessionData.User.Username)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-user-role", err.Error(), "user", username, "role", role.Rolename)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+	invalidateAccessCache()
+
+	lres.BError = false
+	lres.SError = translate(lang, "role-members.added", usr.Username, role.Rolename)
+
+	return &lres, nil
+}
+
+// RemoveRoleMember - remove a user from a role
+func (AdminController) RemoveRoleMember(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	roleID := utils.String2int(r.FormValue("role_id"))
+	username := r.FormValue("username")
+
+	if res != nil {
+		lres.SSuccessURL = withRoleID(res.RedirectURL, roleID)
+		lres.SErrorURL = withRoleID(res.RedirectOnError, roleID)
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "role-members.remove-failed")
+		audit.Log(err, "remove-user-role", "Could not remove the user from the role", "user", username, "role_id", roleID)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	role := MembershipRole{tx: tx}
+	err = role.GetByID(roleID)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "remove-user-role", err.Error(), "user", username, "role_id", roleID)
+
+		return &lres, nil
+	}
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		err = usr.RemoveFromRoleBy(role.Rolename, sessionData.User.Username)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "remove-user-role", err.Error(), "user", username, "role", role.Rolename)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+	invalidateAccessCache()
+
+	lres.BError = false
+	lres.SError = translate(lang, "role-members.removed", usr.Username, role.Rolename)
+
+	return &lres, nil
+}
+
+// ResetPassword - give a user a temporary password, to be changed at the next login
+func (AdminController) ResetPassword(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, _ = trErr(lang, "users.reset-failed")
+		audit.Log(err, "reset-password", "Could not reset the password", "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		err = usr.SetTemporaryPassword(password)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "reset-password", err.Error(), "user", username, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	audit.Log(nil, "reset-password", "Temporary password set", "user", usr.Username, "changed_by", sessionData.User.Username)
+
+	lres.BError = false
+	lres.SError = translate(lang, "users.password-reset", usr.Username)
+
+	return &lres, nil
+}
+
+// UnlockUser - end the lockout of a user and give them a temporary password, shown to the administrator
+func (AdminController) UnlockUser(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	username := r.FormValue("username")
+
+	password, err := generateTemporaryPassword()
+	if err != nil {
+		lres.BError = true
+		lres.SError, _ = trErr(lang, "users.unlock-failed")
+		audit.Log(err, "unlock", "Could not unlock the user", "user", username)
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, _ = trErr(lang, "users.unlock-failed")
+		audit.Log(err, "unlock", "Could not unlock the user", "user", username)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		err = usr.UnlockAccount()
+	}
+	// the directory keeps the password of a delegated user
+	if err == nil && !usr.IsDelegated() {
+		err = usr.SetTemporaryPassword(password)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "unlock", err.Error(), "user", username, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	lres.BError = false
+
+	if usr.IsDelegated() {
+		audit.Log(nil, "unlock", "User unlocked", "user", usr.Username, "changed_by", sessionData.User.Username)
+		lres.SError = translate(lang, "users.unlocked-delegated", usr.Username, usr.PasswordSource)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "unlock", "User unlocked, temporary password set", "user", usr.Username, "changed_by", sessionData.User.Username)
+
+	lres.SError = translate(lang, "users.unlocked", usr.Username, password)
+
+	return &lres, nil
+}
+
+// Impersonate - continue the session as the user, to see the site as they do
+func (AdminController) Impersonate(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	username := r.FormValue("username")
+	ip := getClientIP(r)
+
+	// an API token has no session to hand over
+	if sessionData.APITokenID > 0 {
+		lres.BError = true
+		lres.SError = translate(lang, "impersonation.failed")
+		audit.Log(nil, "impersonation", "API token requests cannot impersonate", "user", username, "admin", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "impersonation.failed")
+		audit.Log(err, "impersonation", "Could not start the impersonation", "user", username, "admin", sessionData.User.Username, "ip", ip)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "impersonation", err.Error(), "user", username, "admin", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	if strings.EqualFold(usr.Username, sessionData.User.Username) {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "impersonation.self")
+		audit.Log(err, "impersonation", err.Error(), "user", usr.Username, "admin", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	// seeing the site as another administrator would hand over their rights
+	isAdmin, err := HasPermission(usr.Username, "users.impersonate")
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "impersonation.failed")
+		audit.Log(err, "impersonation", "Could not check the permissions of the user", "user", usr.Username, "admin", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	if isAdmin {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "impersonation.administrator", usr.Username)
+		audit.Log(err, "impersonation", err.Error(), "user", usr.Username, "admin", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	_, err = startImpersonation(w, r, sessionData, &usr)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "impersonation.failed")
+		audit.Log(err, "impersonation", "Could not start the impersonation", "user", usr.Username, "admin", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "impersonation-start", "Impersonation started", "user", usr.Username, "admin", sessionData.User.Username, "ip", ip)
+
+	lres.BError = false
+	lres.SError = translate(lang, "impersonation.started", usr.Username)
+
+	return &lres, nil
+}
+
+// DeletionRequests - account deletion requests waiting for a decision, and the decided ones
+func (AdminController) DeletionRequests(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.AccountDeletionRequestsResponseModel, error) {
+	var lres models.AccountDeletionRequestsResponseModel
+	var err error
+
+	lres.Pending, err = getAccountDeletionRequests(true)
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Decided, err = getAccountDeletionRequests(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lres, nil
+}
+
+// ApproveDeletion - anonymize the account of a user who asked for it
+func (AdminController) ApproveDeletion(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	return decideDeletion(w, r, res, true)
+}
+
+// RejectDeletion - keep the account of a user who asked for it to be deleted
+func (AdminController) RejectDeletion(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	return decideDeletion(w, r, res, false)
+}
+
+func decideDeletion(w http.ResponseWriter, r *http.Request, res *ResponseHelper, approve bool) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+	admin := sessionData.User.Username
+	requestID := utils.String2int(r.FormValue("deletion_request_id"))
+
+	usr, pseudonym, err := decideAccountDeletion(requestID, approve, admin)
+	if err != nil {
+		lres.BError = true
+		if _, ok := err.(*localizedError); ok {
+			lres.SError = translateError(lang, err)
+		} else {
+			lres.SError = translate(lang, "account-deletion.failed")
+		}
+		audit.Log(err, "account-deletion", "Could not decide the account deletion", "deletion_request_id", requestID, "admin", admin)
+
+		return &lres, nil
+	}
+
+	lres.BError = false
+
+	if approve {
+		// the entry must not name the user again
+		audit.Log(nil, "account-deletion", "Account anonymized", "user", pseudonym, "deletion_request_id", requestID, "admin", admin)
+		lres.SError = translate(lang, "account-deletion.approved", pseudonym)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "account-deletion", "Account deletion rejected", "user", usr.Username, "deletion_request_id", requestID, "admin", admin)
+	lres.SError = translate(lang, "account-deletion.rejected", usr.Username)
+
+	return &lres, nil
+}
+
+// UserIPs - ips and cidr ranges a user may log in from
+func (AdminController) UserIPs(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.UserIPsResponseModel, error) {
+	var lres models.UserIPsResponseModel
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(r.FormValue("username"))
+	if err != nil {
+		return nil, err
+	}
+
+	lres.User = models.UserModel{
+		UserID:    usr.UserID,
+		Username:  usr.Username,
+		Name:      usr.Name,
+		Surname:   usr.Surname,
+		Email:     usr.Email,
+		Activated: usr.Activated,
+		LockedOut: usr.LockedOut,
+		Valid:     usr.Valid,
+	}
+
+	lres.Networks, err = usr.GetAllowedNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	lres.ClientIP = getClientIP(r)
+
+	return &lres, nil
+}
+
+// AddUserIP - allow a user to log in from an ip or cidr range
+func (AdminController) AddUserIP(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	username := r.FormValue("username")
+	network := r.FormValue("network")
+
+	if res != nil {
+		lres.SSuccessURL = withUsername(res.RedirectURL, username)
+		lres.SErrorURL = withUsername(res.RedirectOnError, username)
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, _ = trErr(lang, "user-ips.add-failed")
+		audit.Log(err, "add-user-ip", "Could not add the network", "user", username, "network", network)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		network, err = usr.AddAllowedNetwork(network)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "add-user-ip", err.Error(), "user", username, "network", network, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	audit.Log(nil, "add-user-ip", "Network allowed", "user", usr.Username, "network", network, "changed_by", sessionData.User.Username)
+
+	lres.BError = false
+	lres.SError = translate(lang, "user-ips.added", network)
+
+	return &lres, nil
+}
+
+// RemoveUserIP - stop allowing a network; with none left the user may log in from anywhere
+func (AdminController) RemoveUserIP(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	username := r.FormValue("username")
+	userIPID := utils.String2int(r.FormValue("user_ip_id"))
+
+	if res != nil {
+		lres.SSuccessURL = withUsername(res.RedirectURL, username)
+		lres.SErrorURL = withUsername(res.RedirectOnError, username)
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := requestLanguage(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		lres.BError = true
+		lres.SError, _ = trErr(lang, "user-ips.remove-failed")
+		audit.Log(err, "remove-user-ip", "Could not remove the network", "user", username, "user_ip_id", userIPID)
+		return &lres, nil
+	}
+	defer tx.Rollback()
+
+	var network string
+
+	usr := MembershipUser{tx: tx}
+	err = usr.GetByName(username)
+	if err == nil {
+		network, err = usr.RemoveAllowedNetwork(userIPID)
+	}
+
+	if err != nil {
+		lres.BError = true
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "remove-user-ip", err.Error(), "user", username, "user_ip_id", userIPID, "changed_by", sessionData.User.Username)
+
+		return &lres, nil
+	}
+
+	tx.Commit()
+
+	audit.Log(nil, "remove-user-ip", "Network removed", "user", usr.Username, "network", network, "changed_by", sessionData.User.Username)
+
+	lres.BError = false
+	lres.SError = translate(lang, "user-ips.removed", network)
+
+	return &lres, nil
+}
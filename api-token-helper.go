@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"./models"
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+const (
+	apiTokenPrefix = "gwa_"
+)
+
+type apiTokenContextKey int
+
+const apiTokenSessionKey apiTokenContextKey = 0
+
+// APIToken - personal API token
+type APIToken struct {
+	sync.RWMutex
+	tx           *sql.Tx
+	APITokenID   int       `sql:"api_token_id"`
+	UserID       int       `sql:"user_id"`
+	Name         string    `sql:"name"`
+	TokenPrefix  string    `sql:"token_prefix"`
+	CreationTime time.Time `sql:"creation_time"`
+	ValidUntil   time.Time `sql:"valid_until"`
+	Expires      bool
+	Roles        []int
+	Requests     []int
+	Token        string `json:"-"`
+}
+
+var apiTokenLock sync.RWMutex
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPITokenValue() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Save - creates the token.
+// The plain token is only available in t.Token after Save.
+func (t *APIToken) Save() error {
+	apiTokenLock.Lock()
+	defer apiTokenLock.Unlock()
+
+	if t.UserID <= 0 {
+		return fmt.Errorf("unknown user")
+	}
+
+	if len(t.Name) == 0 {
+		return fmt.Errorf("token name cannot be empty")
+	}
+
+	if t.APITokenID > 0 {
+		return fmt.Errorf("tokens cannot be changed, only revoked")
+	}
+
+	token, err := newAPITokenValue()
+	if err != nil {
+		return err
+	}
+
+	t.Token = token
+	t.TokenPrefix = token[:len(apiTokenPrefix)+6]
+	t.CreationTime = time.Now().UTC()
+
+	var validUntil interface{}
+	if t.Expires {
+		validUntil = t.ValidUntil
+	}
+
+	pq := dbutl.PQuery(`
+	    INSERT INTO user_api_token (
+	        user_id,
+	        name,
+	        token_hash,
+	        token_prefix,
+	        creation_time,
+	        valid_until
+	    )
+	    VALUES (?, ?, ?, ?, ?, ?)
+	`, t.UserID,
+		t.Name,
+		hashAPIToken(token),
+		t.TokenPrefix,
+		t.CreationTime,
+		validUntil)
+
+	_, err = dbutl.ExecTx(t.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	pq = dbutl.PQuery(`
+	    SELECT api_token_id FROM user_api_token WHERE token_hash = ?
+	`, hashAPIToken(token))
+
+	err = t.tx.QueryRow(pq.Query, pq.Args...).Scan(&t.APITokenID)
+	if err != nil {
+		return err
+	}
+
+	for _, roleID := range t.Roles {
+		pq = dbutl.PQuery(`
+		    INSERT INTO user_api_token_role (api_token_id, role_id) VALUES (?, ?)
+		`, t.APITokenID,
+			roleID)
+
+		_, err = dbutl.ExecTx(t.tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, requestID := range t.Requests {
+		pq = dbutl.PQuery(`
+		    INSERT INTO user_api_token_request (api_token_id, request_id) VALUES (?, ?)
+		`, t.APITokenID,
+			requestID)
+
+		_, err = dbutl.ExecTx(t.tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	audit.Log(nil, "add-api-token", "Add new API token.",
+		"user_id", t.UserID,
+		"token_id", t.APITokenID,
+		"name", t.Name,
+		"prefix", t.TokenPrefix)
+
+	return nil
+}
+
+// Revoke - revoke one of the user's tokens
+func (t *APIToken) Revoke(userID int, tokenID int) error {
+	t.Lock()
+	defer t.Unlock()
+
+	pq := dbutl.PQuery(`
+	    UPDATE user_api_token
+	       SET valid = ?
+	     WHERE api_token_id = ?
+	       AND user_id = ?
+	       AND valid = ?
+	`, 0,
+		tokenID,
+		userID,
+		1)
+
+	result, err := dbutl.ExecTx(t.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return fmt.Errorf("token not found")
+	}
+
+	audit.Log(nil, "revoke-api-token", "Revoke API token.", "user_id", userID, "token_id", tokenID)
+
+	return nil
+}
+
+// GetUserAPITokens - get the valid tokens of a user
+func GetUserAPITokens(userID int) ([]*models.APITokenModel, error) {
+	var tokens []*models.APITokenModel
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT api_token_id,
+	           name,
+	           token_prefix,
+	           creation_time,
+	           CASE WHEN valid_until IS NULL THEN 0 ELSE 1 END AS expires,
+	           CASE WHEN valid_until IS NULL THEN creation_time ELSE valid_until END AS valid_until,
+	           CASE WHEN last_used_time IS NULL THEN 0 ELSE 1 END AS used,
+	           CASE WHEN last_used_time IS NULL THEN creation_time ELSE last_used_time END AS last_used_time,
+	           CASE WHEN last_used_ip IS NULL THEN '-' ELSE last_used_ip END AS last_used_ip
+	      FROM user_api_token
+	     WHERE user_id = ?
+	       AND valid = ?
+	       AND (valid_until IS NULL OR valid_until > ?)
+	     ORDER BY api_token_id DESC
+	`, userID,
+		1,
+		dt)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var t models.APITokenModel
+		err = sc.Scan(dbutl, row, &t)
+		if err != nil {
+			return err
+		}
+
+		tokens = append(tokens, &t)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+type validateAPITokenUtil struct {
+	APITokenID int    `sql:"api_token_id"`
+	UserID     int    `sql:"user_id"`
+	Username   string `sql:"username"`
+	Name       string `sql:"name"`
+	Surname    string `sql:"surname"`
+	Activated  int    `sql:"activated"`
+	LockedOut  int    `sql:"locked_out"`
+	Valid      int    `sql:"valid"`
+}
+
+// ValidateAPIToken - check the token and build the session data of its owner
+func ValidateAPIToken(token string, ip string) (*SessionData, error) {
+	res, err := authenticate(&Credentials{Token: token, IP: ip})
+	if err != nil {
+		return nil, err
+	}
+
+	sessionData := SessionData{
+		Lang:       "EN",
+		LoggedIn:   true,
+		SessionID:  fmt.Sprintf("%s-%d", res.Provider, res.APITokenID),
+		APITokenID: res.APITokenID,
+		User: User{
+			Name:     res.Name,
+			Surname:  res.Surname,
+			Username: res.Username,
+		},
+	}
+
+	return &sessionData, nil
+}
+
+// apiTokenAuthenticator - bearer tokens of user_api_token
+type apiTokenAuthenticator struct {
+}
+
+func (apiTokenAuthenticator) Name() string {
+	return "api-token"
+}
+
+func (apiTokenAuthenticator) Authenticate(c *Credentials) (*AuthResult, error) {
+	if len(c.Token) == 0 {
+		return nil, errAuthNotApplicable
+	}
+
+	token := c.Token
+	ip := c.IP
+
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, refusedf("malformed API token")
+	}
+
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT t.api_token_id,
+	           u.user_id,
+	           u.username,
+	           u.name,
+	           u.surname,
+	           u.activated,
+	           u.locked_out,
+	           u.valid
+	      FROM user_api_token t
+	      JOIN "user" u ON (t.user_id = u.user_id)
+	     WHERE t.token_hash = ?
+	       AND t.valid = ?
+	       AND (t.valid_until IS NULL OR t.valid_until > ?)
+	`, hashAPIToken(token),
+		1,
+		dt)
+
+	testToken := validateAPITokenUtil{}
+	err := dbutl.RunQuery(pq, &testToken)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, refusedf("API token not found, revoked or expired")
+	case err != nil:
+		return nil, err
+	}
+
+	if testToken.LockedOut > 0 || testToken.Activated <= 0 || testToken.Valid <= 0 {
+		return nil, refusedf("username \"%s\" is locked out, not activated or not valid", testToken.Username)
+	}
+
+	pq = dbutl.PQuery(`
+	    UPDATE user_api_token
+	       SET last_used_time = ?,
+	           last_used_ip   = ?
+	     WHERE api_token_id = ?
+	`, dt,
+		ip,
+		testToken.APITokenID)
+
+	_, err = dbutl.Exec(pq)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResult{
+		UserID:     testToken.UserID,
+		Username:   testToken.Username,
+		Name:       testToken.Name,
+		Surname:    testToken.Surname,
+		APITokenID: testToken.APITokenID,
+	}, nil
+}
+
+// apiTokenAllowsRequest - check the token scope.
+// A token without roles and requests is scoped to everything its owner can call.
+func apiTokenAllowsRequest(tokenID int, requestURL string, requestType string) (bool, error) {
+	found := 0
+
+	pq := dbutl.PQuery(`
+	    SELECT CASE
+	             WHEN NOT EXISTS (
+	               SELECT 1 FROM user_api_token_role WHERE api_token_id = ?
+	             ) AND NOT EXISTS (
+	               SELECT 1 FROM user_api_token_request WHERE api_token_id = ?
+	             ) THEN 1
+	             WHEN EXISTS (
+	               SELECT 1
+	                 FROM user_api_token_request tr
+	                 JOIN request r ON (tr.request_id = r.request_id)
+	                WHERE tr.api_token_id = ?
+	                  AND r.request_url   = ?
+	                  AND r.request_type  = ?
+	             ) THEN 1
+	             WHEN EXISTS (
+	               SELECT 1
+	                 FROM user_api_token_role tr
+	                 JOIN role_closure rc ON (tr.role_id = rc.ancestor_role_id)
+	                 JOIN request_role rr ON (rc.descendant_role_id = rr.role_id)
+	                 JOIN request r ON (rr.request_id = r.request_id)
+	                WHERE tr.api_token_id = ?
+	                  AND r.request_url   = ?
+	                  AND r.request_type  = ?
+	             ) THEN 1
+	             ELSE 0
+	           END
+	      FROM dual
+	`, tokenID,
+		tokenID,
+		tokenID,
+		requestURL,
+		requestType,
+		tokenID,
+		requestURL,
+		requestType)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return false, err
+	}
+
+	return found == 1, nil
+}
+
+// getAPITokenScopeRequests - JSON requests the user may bind a token to
+func getAPITokenScopeRequests(user string) ([]*models.APITokenRequestModel, error) {
+	var requests []*models.APITokenRequestModel
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT DISTINCT r.request_id,
+	           r.request_type,
+	           r.request_url
+	      FROM "user" u
+	      JOIN user_role ur ON (u.user_id = ur.user_id)
+	      JOIN role_closure rc ON (ur.role_id = rc.ancestor_role_id)
+	      JOIN request_role rr ON (rc.descendant_role_id = rr.role_id)
+	      JOIN request r ON (rr.request_id = r.request_id)
+	     WHERE u.loweredusername = lower(?)
+	       AND ur.valid = ?
+	       AND ur.valid_from <= ?
+	       AND (ur.valid_until is null OR ur.valid_until > ?)
+	       AND r.request_template = ?
+	     ORDER BY r.request_url, r.request_type
+	`, user,
+		1,
+		dt,
+		dt,
+		"-")
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var req models.APITokenRequestModel
+		err = sc.Scan(dbutl, row, &req)
+		if err != nil {
+			return err
+		}
+
+		requests = append(requests, &req)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+func getBearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(auth[7:])
+	if len(token) == 0 {
+		return "", false
+	}
+
+	return token, true
+}
+
+// apiTokenHandler - requests carrying an "Authorization: Bearer" header
+// are authenticated by token and skip the anti XRSF protection,
+// all other requests go through the protected handler.
+func apiTokenHandler(router http.Handler, protected http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := getBearerToken(r)
+		if !ok {
+			protected.ServeHTTP(w, r)
+			return
+		}
+
+		ip := getClientIP(r)
+
+		sessionData, err := ValidateAPIToken(token, ip)
+		if err != nil {
+			audit.Log(err, "api-token", "API token rejected.", "ip", ip, "url", r.URL.Path)
+
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			http.Error(w, "Invalid API token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiTokenSessionKey, sessionData)
+		router.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geo-stanciu/go-utils/utils"
+	"golang.org/x/crypto/ed25519"
+)
+
+// utils.AuditLog writes the audit_log rows, so they are chained afterwards: per source, in
+// audit_log_id order, msg_hash is the sha-256 of log_msg and entry_hash the sha-256 of the previous
+// entry_hash and of the fields of the row. A changed, removed or inserted row breaks the chain from
+// there on; a chain rewritten from the start is caught by the signed checkpoints, kept outside the
+// database. The anonymization of accounts changes log_msg on purpose: the hash of the new log_msg
+// goes to audit_redaction and the chain keeps the original one. The redactions and the archive
+// records, from which the chain of the entries left in audit_log goes on, are signed with the key
+// of the checkpoints: rows written in the database by hand do not verify.
+
+const (
+	auditChainBatch = 1000
+	// newer entries are left for the next run, ids of rows still being written may come before them
+	auditChainSettle = time.Minute
+)
+
+// auditChainRow - audit_log row as the chain sees it
+type auditChainRow struct {
+	AuditLogID    int64
+	SourceVersion string
+	LogTime       time.Time
+	LogMsg        string
+	MsgHash       string
+	EntryHash     string
+}
+
+// auditCheckpoint - last entry_hash of a source, signed
+type auditCheckpoint struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	AuditLogID int64     `json:"audit_log_id"`
+	EntryHash  string    `json:"entry_hash"`
+	Signature  string    `json:"signature"`
+}
+
+// auditArchiveRecord - audit_archive row as --verify-audit sees it
+type auditArchiveRecord struct {
+	FirstAuditLogID int64
+	LastAuditLogID  int64
+	Entries         int
+	FileName        string
+	Deleted         bool
+	LastEntryHash   string
+	Signature       string
+}
+
+// auditChainReport - what --verify-audit found for a source
+type auditChainReport struct {
+	Source      string
+	StartID     int64
+	Archived    int
+	Entries     int
+	Unchained   int
+	Redacted    int
+	Checkpoints int
+	BrokenID    int64
+	Reason      string
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditEntryHash - the wall clock of log_time is hashed, it does not depend on the time zone
+// the driver reads it in
+func auditEntryHash(prevHash string, source string, row *auditChainRow) string {
+	return sha256Hex(strings.Join([]string{
+		prevHash,
+		strconv.FormatInt(row.AuditLogID, 10),
+		source,
+		row.SourceVersion,
+		row.LogTime.Format("2006-01-02 15:04:05.000000"),
+		row.MsgHash,
+	}, "\n"))
+}
+
+func (c *auditCheckpoint) payload() []byte {
+	return []byte(strings.Join([]string{
+		c.Time.UTC().Format(time.RFC3339Nano),
+		c.Source,
+		strconv.FormatInt(c.AuditLogID, 10),
+		c.EntryHash,
+	}, "\n"))
+}
+
+// payload - what is signed of the archive record; the times are left out, the database may round them
+func (a *auditArchiveRecord) payload(source string) []byte {
+	return []byte(strings.Join([]string{
+		"audit_archive",
+		source,
+		strconv.FormatInt(a.FirstAuditLogID, 10),
+		strconv.FormatInt(a.LastAuditLogID, 10),
+		strconv.Itoa(a.Entries),
+		a.FileName,
+		strconv.FormatBool(a.Deleted),
+		a.LastEntryHash,
+	}, "\n"))
+}
+
+// auditRedactionPayload - what is signed of a redaction
+func auditRedactionPayload(auditLogID int64, msgHash string, reason string) []byte {
+	return []byte(strings.Join([]string{
+		"audit_redaction",
+		strconv.FormatInt(auditLogID, 10),
+		msgHash,
+		reason,
+	}, "\n"))
+}
+
+// signAudit - base64 signature of the payload with the key of the checkpoints
+func signAudit(payload []byte) (string, error) {
+	key, err := loadAuditSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)), nil
+}
+
+// auditSignatureValid - the base64 signature is the one of the payload; empty - not signed
+func auditSignatureValid(pub ed25519.PublicKey, payload []byte, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+
+	return ed25519.Verify(pub, payload, sig)
+}
+
+// getAuditArchiveAnchor - the last entry archived and deleted from audit_log: the chain of the
+// entries left goes on from it. No such entry - the chain starts at the first entry of the source.
+func getAuditArchiveAnchor(source string) (string, int64, error) {
+	var lastID int64
+	var lastHash sql.NullString
+
+	pq := dbutl.PQuery(`
+	    SELECT last_audit_log_id,
+	           last_entry_hash
+	      FROM audit_archive
+	     WHERE source = ?
+	       AND deleted = 1
+	       AND last_audit_log_id = (
+	            SELECT MAX(last_audit_log_id)
+	              FROM audit_archive
+	             WHERE source = ?
+	               AND deleted = 1
+	       )
+	`, source,
+		source)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&lastID, &lastHash)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "", 0, nil
+	case err != nil:
+		return "", 0, err
+	}
+
+	return lastHash.String, lastID, nil
+}
+
+// getAuditChainHead - the last chained entry of the source, or the archive anchor
+func getAuditChainHead(source string) (string, int64, error) {
+	var lastID int64
+	var lastHash string
+
+	pq := dbutl.PQuery(`
+	    SELECT audit_log_id,
+	           entry_hash
+	      FROM audit_log
+	     WHERE source = ?
+	       AND audit_log_id = (
+	            SELECT MAX(audit_log_id)
+	              FROM audit_log
+	             WHERE source = ?
+	               AND entry_hash IS NOT NULL
+	       )
+	`, source,
+		source)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&lastID, &lastHash)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return getAuditArchiveAnchor(source)
+	case err != nil:
+		return "", 0, err
+	}
+
+	return lastHash, lastID, nil
+}
+
+// startAuditChain - chain the new audit entries each interval and sign checkpoints, in the background
+func startAuditChain() {
+	if !config.AuditChain.Enabled {
+		return
+	}
+
+	go func() {
+		var lastCheckpoint time.Time
+
+		for {
+			err := chainAuditLog()
+			if err != nil {
+				audit.Log(err, "audit-chain", "Error chaining the audit log")
+			}
+
+			if err == nil && time.Since(lastCheckpoint) >= time.Duration(config.AuditChain.CheckpointInterval)*time.Second {
+				err = writeAuditCheckpoints()
+				if err != nil {
+					audit.Log(err, "audit-chain", "Error writing the audit checkpoints")
+				} else {
+					lastCheckpoint = time.Now()
+				}
+			}
+
+			time.Sleep(time.Duration(config.AuditChain.Interval) * time.Second)
+		}
+	}()
+}
+
+// chainAuditLog - chain the new entries of every source
+func chainAuditLog() error {
+	sources, err := getAuditSources()
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		for {
+			n, more, err := chainAuditBatch(source)
+			if err != nil {
+				return err
+			}
+
+			if n == 0 || !more {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// chainAuditBatch - chain the next entries of the source; more - there may be others ready
+func chainAuditBatch(source string) (int, bool, error) {
+	var rows []*auditChainRow
+
+	prevHash, lastID, err := getAuditChainHead(source)
+	if err != nil {
+		return 0, false, err
+	}
+
+	settled := time.Now().UTC().Add(-auditChainSettle)
+	more := true
+
+	pq := dbutl.PQuery(`
+	    SELECT audit_log_id,
+	           source_version,
+	           log_time,
+	           log_msg
+	      FROM audit_log
+	     WHERE source = ?
+	       AND audit_log_id > ?
+	     ORDER BY audit_log_id
+	     LIMIT ?
+	`, source,
+		lastID,
+		auditChainBatch)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var r auditChainRow
+
+		if !more {
+			return nil
+		}
+
+		err := row.Scan(&r.AuditLogID, &r.SourceVersion, &r.LogTime, &r.LogMsg)
+		if err != nil {
+			return err
+		}
+
+		// the chain stops at the first entry too new, not to go past an older one not written yet
+		if !r.LogTime.Before(settled) {
+			more = false
+			return nil
+		}
+
+		rows = append(rows, &r)
+		return nil
+	})
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(rows) == 0 {
+		return 0, false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	for _, r := range rows {
+		r.MsgHash = sha256Hex(r.LogMsg)
+		r.EntryHash = auditEntryHash(prevHash, source, r)
+		prevHash = r.EntryHash
+
+		// another instance may have chained it already, to the same hash
+		pq = dbutl.PQuery(`
+		    UPDATE audit_log
+		       SET msg_hash = ?,
+		           entry_hash = ?
+		     WHERE audit_log_id = ?
+		       AND entry_hash IS NULL
+		`, r.MsgHash,
+			r.EntryHash,
+			r.AuditLogID)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return len(rows), more && len(rows) == auditChainBatch, nil
+}
+
+// recordAuditRedaction - log_msg of a chained entry was changed on purpose; the hash of the new one
+// is what --verify-audit accepts in place of msg_hash
+func recordAuditRedaction(tx *sql.Tx, auditLogID int64, reason string) error {
+	var msg string
+
+	// the database may store the json otherwise than it was given
+	pq := dbutl.PQuery(`
+	    SELECT log_msg
+	      FROM audit_log
+	     WHERE audit_log_id = ?
+	`, auditLogID)
+
+	err := tx.QueryRow(pq.Query, pq.Args...).Scan(&msg)
+	if err != nil {
+		return err
+	}
+
+	msgHash := sha256Hex(msg)
+
+	signature, err := signAudit(auditRedactionPayload(auditLogID, msgHash, reason))
+	if err != nil {
+		return err
+	}
+
+	pq = dbutl.PQuery(`
+	    INSERT INTO audit_redaction (
+	        audit_log_id,
+	        msg_hash,
+	        redaction_time,
+	        reason,
+	        signature
+	    )
+	    VALUES (?, ?, ?, ?, ?)
+	`, auditLogID,
+		msgHash,
+		time.Now().UTC(),
+		reason,
+		signature)
+
+	_, err = dbutl.ExecTx(tx, pq)
+	return err
+}
+
+// loadAuditSigningKey - the private key of the checkpoints, created with its .pub file when missing
+func loadAuditSigningKey() (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(config.AuditChain.KeyFile)
+
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+
+		_, err = rand.Read(seed)
+		if err != nil {
+			return nil, err
+		}
+
+		key := ed25519.NewKeyFromSeed(seed)
+		pub := key.Public().(ed25519.PublicKey)
+
+		err = ioutil.WriteFile(config.AuditChain.KeyFile, []byte(base64.StdEncoding.EncodeToString(seed)+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ioutil.WriteFile(config.AuditChain.KeyFile+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		audit.Log(nil, "audit-chain", "Audit checkpoint key created.",
+			"file", config.AuditChain.KeyFile,
+			"public key", base64.StdEncoding.EncodeToString(pub))
+
+		return key, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a base64 ed25519 seed", config.AuditChain.KeyFile)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// loadAuditVerifyKey - the .pub file of the key, enough for an auditor; or else the key itself
+func loadAuditVerifyKey() (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(config.AuditChain.KeyFile + ".pub")
+
+	if os.IsNotExist(err) {
+		key, err := loadAuditSigningKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return key.Public().(ed25519.PublicKey), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s.pub is not a base64 ed25519 public key", config.AuditChain.KeyFile)
+	}
+
+	return ed25519.PublicKey(pub), nil
+}
+
+// writeAuditCheckpoints - append the signed chain head of every source to the checkpoint file
+func writeAuditCheckpoints() error {
+	key, err := loadAuditSigningKey()
+	if err != nil {
+		return err
+	}
+
+	sources, err := getAuditSources()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(config.AuditChain.CheckpointFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+
+	for _, source := range sources {
+		hash, id, err := getAuditChainHead(source)
+		if err != nil {
+			return err
+		}
+
+		if len(hash) == 0 {
+			continue
+		}
+
+		cp := auditCheckpoint{
+			Time:       time.Now().UTC(),
+			Source:     source,
+			AuditLogID: id,
+			EntryHash:  hash,
+		}
+		cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, cp.payload()))
+
+		err = enc.Encode(&cp)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// readAuditCheckpoints - the checkpoints of the file by source, and by audit_log_id;
+// a checkpoint with a bad signature is an error
+func readAuditCheckpoints(file string, pub ed25519.PublicKey) (map[string]map[int64]*auditCheckpoint, error) {
+	res := make(map[string]map[int64]*auditCheckpoint)
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+		var cp auditCheckpoint
+
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		err = json.Unmarshal(scanner.Bytes(), &cp)
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", file, line, err)
+		}
+
+		if !auditSignatureValid(pub, cp.payload(), cp.Signature) {
+			return nil, fmt.Errorf("%s, line %d: the signature of the checkpoint does not match", file, line)
+		}
+
+		if res[cp.Source] == nil {
+			res[cp.Source] = make(map[int64]*auditCheckpoint)
+		}
+
+		res[cp.Source][cp.AuditLogID] = &cp
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// getAuditRedactions - the log_msg hashes accepted by audit_log_id, from the signed redactions;
+// and the hashes of the redactions whose signature does not match, which are not accepted
+func getAuditRedactions(pub ed25519.PublicKey) (map[int64][]string, map[int64][]string, error) {
+	signed := make(map[int64][]string)
+	unsigned := make(map[int64][]string)
+
+	pq := dbutl.PQuery(`
+	    SELECT audit_log_id,
+	           msg_hash,
+	           reason,
+	           signature
+	      FROM audit_redaction
+	`)
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var id int64
+		var hash, reason string
+		var signature sql.NullString
+
+		err := row.Scan(&id, &hash, &reason, &signature)
+		if err != nil {
+			return err
+		}
+
+		if auditSignatureValid(pub, auditRedactionPayload(id, hash, reason), signature.String) {
+			signed[id] = append(signed[id], hash)
+		} else {
+			unsigned[id] = append(unsigned[id], hash)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signed, unsigned, nil
+}
+
+// getAuditArchives - the archive records of the source, in audit_log_id order
+func getAuditArchives(source string) ([]*auditArchiveRecord, error) {
+	var archives []*auditArchiveRecord
+
+	pq := dbutl.PQuery(`
+	    SELECT first_audit_log_id,
+	           last_audit_log_id,
+	           entries,
+	           file_name,
+	           deleted,
+	           last_entry_hash,
+	           signature
+	      FROM audit_archive
+	     WHERE source = ?
+	     ORDER BY first_audit_log_id
+	`, source)
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var a auditArchiveRecord
+		var deleted int
+		var lastHash, signature sql.NullString
+
+		err := row.Scan(&a.FirstAuditLogID, &a.LastAuditLogID, &a.Entries, &a.FileName, &deleted, &lastHash, &signature)
+		if err != nil {
+			return err
+		}
+
+		a.Deleted = deleted == 1
+		a.LastEntryHash = lastHash.String
+		a.Signature = signature.String
+
+		archives = append(archives, &a)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return archives, nil
+}
+
+// getAuditEntryHash - entry_hash of an entry of the source; no such entry - empty
+func getAuditEntryHash(source string, auditLogID int64) (string, error) {
+	var hash sql.NullString
+
+	pq := dbutl.PQuery(`
+	    SELECT entry_hash
+	      FROM audit_log
+	     WHERE source = ?
+	       AND audit_log_id = ?
+	`, source,
+		auditLogID)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&hash)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	return hash.String, nil
+}
+
+// readAuditArchive - the entries of an archive file, one by one
+func readAuditArchive(fileName string, f func(line *auditArchiveLine) error) error {
+	file, err := os.Open(filepath.Join(config.AuditRetention.Dir, fileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+
+	for {
+		var line auditArchiveLine
+
+		err = dec.Decode(&line)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = f(&line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rep *auditChainReport) broken(id int64, reason string) {
+	if rep.BrokenID != 0 {
+		return
+	}
+
+	rep.BrokenID = id
+	rep.Reason = reason
+}
+
+// verifyAuditArchives - walk the chain through the files of the archives deleted from audit_log, up to
+// the anchor; their records must be signed and the checkpoints of archived entries found in them.
+// log_msg of an archived entry is compacted json, its msg_hash is taken as it was written.
+func verifyAuditArchives(source string, pub ed25519.PublicKey, archives []*auditArchiveRecord, checkpoints map[int64]*auditCheckpoint, rep *auditChainReport, seen map[int64]bool) {
+	var prevHash string
+	// the first entry of a file after an archive kept in audit_log follows one not walked here
+	linked := false
+
+	for _, a := range archives {
+		var first, last *auditArchiveLine
+		entries := 0
+
+		if a.LastAuditLogID > rep.StartID {
+			break
+		}
+
+		if !a.Deleted {
+			linked = false
+			continue
+		}
+
+		if !auditSignatureValid(pub, a.payload(source), a.Signature) {
+			rep.broken(a.FirstAuditLogID, "the archive record of "+a.FileName+" is not signed")
+			return
+		}
+
+		err := readAuditArchive(a.FileName, func(line *auditArchiveLine) error {
+			if rep.BrokenID != 0 {
+				return nil
+			}
+
+			if first == nil {
+				first = line
+			}
+
+			last = line
+			entries++
+			rep.Archived++
+
+			// archived before the chain was on, the chain starts after it
+			if len(line.EntryHash) == 0 {
+				prevHash = ""
+				linked = true
+				return nil
+			}
+
+			r := auditChainRow{
+				AuditLogID:    line.AuditLogID,
+				SourceVersion: line.SourceVersion,
+				LogTime:       line.LogTime,
+				MsgHash:       line.MsgHash,
+				EntryHash:     line.EntryHash,
+			}
+
+			if linked && auditEntryHash(prevHash, source, &r) != r.EntryHash {
+				rep.broken(r.AuditLogID, "entry_hash does not follow from the previous entry in "+a.FileName)
+				return nil
+			}
+
+			if cp, ok := checkpoints[r.AuditLogID]; ok {
+				if cp.EntryHash != r.EntryHash {
+					rep.broken(r.AuditLogID, "entry_hash in "+a.FileName+" differs from the checkpoint of "+cp.Time.Format(time.RFC3339))
+					return nil
+				}
+
+				rep.Checkpoints++
+				seen[r.AuditLogID] = true
+			}
+
+			prevHash = r.EntryHash
+			linked = true
+
+			return nil
+		})
+
+		if err != nil {
+			rep.broken(a.FirstAuditLogID, "the archive file "+a.FileName+" can not be read: "+err.Error())
+			return
+		}
+
+		if rep.BrokenID != 0 {
+			return
+		}
+
+		if entries != a.Entries ||
+			first.AuditLogID != a.FirstAuditLogID ||
+			last.AuditLogID != a.LastAuditLogID ||
+			last.EntryHash != a.LastEntryHash {
+			rep.broken(a.FirstAuditLogID, "the archive file "+a.FileName+" does not hold the entries of its record")
+			return
+		}
+	}
+}
+
+// verifyAuditSource - walk the chain of the source, through its archives and then audit_log,
+// and stop at the first broken link
+func verifyAuditSource(source string, pub ed25519.PublicKey, redactions map[int64][]string, unsigned map[int64][]string, checkpoints map[int64]*auditCheckpoint) (*auditChainReport, error) {
+	rep := auditChainReport{Source: source}
+	var prevHash string
+	var firstUnchained int64
+
+	archives, err := getAuditArchives(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// the anchor - the last archive deleted from audit_log
+	for _, a := range archives {
+		if a.Deleted && a.LastAuditLogID > rep.StartID {
+			rep.StartID = a.LastAuditLogID
+			prevHash = a.LastEntryHash
+		}
+	}
+
+	seen := make(map[int64]bool)
+
+	verifyAuditArchives(source, pub, archives, checkpoints, &rep, seen)
+	if rep.BrokenID != 0 {
+		return &rep, nil
+	}
+
+	// checkpointed entries up to the anchor not in the files can only be in archives kept in audit_log
+	for id, cp := range checkpoints {
+		if id > rep.StartID || seen[id] {
+			continue
+		}
+
+		hash, err := getAuditEntryHash(source, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(hash) == 0 || hash != cp.EntryHash {
+			rep.broken(id, "the entry of the checkpoint of "+cp.Time.Format(time.RFC3339)+" is not in the archives")
+			return &rep, nil
+		}
+
+		rep.Checkpoints++
+	}
+
+	pq := dbutl.PQuery(`
+	    SELECT audit_log_id,
+	           source_version,
+	           log_time,
+	           log_msg,
+	           msg_hash,
+	           entry_hash
+	      FROM audit_log
+	     WHERE source = ?
+	       AND audit_log_id > ?
+	     ORDER BY audit_log_id
+	`, source,
+		rep.StartID)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var r auditChainRow
+		var msgHash, entryHash sql.NullString
+
+		if rep.BrokenID != 0 {
+			return nil
+		}
+
+		err := row.Scan(&r.AuditLogID, &r.SourceVersion, &r.LogTime, &r.LogMsg, &msgHash, &entryHash)
+		if err != nil {
+			return err
+		}
+
+		if !entryHash.Valid {
+			if firstUnchained == 0 {
+				firstUnchained = r.AuditLogID
+			}
+
+			rep.Unchained++
+			return nil
+		}
+
+		if firstUnchained != 0 {
+			rep.broken(firstUnchained, "not chained, while later entries are")
+			return nil
+		}
+
+		r.MsgHash = msgHash.String
+		r.EntryHash = entryHash.String
+
+		if hash := sha256Hex(r.LogMsg); hash != r.MsgHash {
+			switch {
+			case containsString(redactions[r.AuditLogID], hash):
+				rep.Redacted++
+			case containsString(unsigned[r.AuditLogID], hash):
+				rep.broken(r.AuditLogID, "log_msg was changed, its redaction is not signed")
+				return nil
+			default:
+				rep.broken(r.AuditLogID, "log_msg was changed")
+				return nil
+			}
+		}
+
+		if auditEntryHash(prevHash, source, &r) != r.EntryHash {
+			rep.broken(r.AuditLogID, "entry_hash does not follow from the previous entry (changed, removed or inserted rows)")
+			return nil
+		}
+
+		if cp, ok := checkpoints[r.AuditLogID]; ok {
+			if cp.EntryHash != r.EntryHash {
+				rep.broken(r.AuditLogID, "entry_hash differs from the checkpoint of "+cp.Time.Format(time.RFC3339))
+				return nil
+			}
+
+			rep.Checkpoints++
+		}
+
+		seen[r.AuditLogID] = true
+		prevHash = r.EntryHash
+		rep.Entries++
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rep.BrokenID != 0 {
+		return &rep, nil
+	}
+
+	// checkpointed entries after the archived ones must still be there
+	for id, cp := range checkpoints {
+		if id > rep.StartID && !seen[id] && (firstUnchained == 0 || id < firstUnchained) {
+			rep.broken(id, "the entry of the checkpoint of "+cp.Time.Format(time.RFC3339)+" is missing")
+			break
+		}
+	}
+
+	return &rep, nil
+}
+
+// verifyAuditLog - verify the chain of every source against the checkpoint file
+// (default - the one of the configuration); ok - no broken link and no redaction not signed
+func verifyAuditLog(w io.Writer, checkpointFile string) (bool, error) {
+	if len(checkpointFile) == 0 {
+		checkpointFile = config.AuditChain.CheckpointFile
+	}
+
+	pub, err := loadAuditVerifyKey()
+	if err != nil {
+		return false, err
+	}
+
+	checkpoints, err := readAuditCheckpoints(checkpointFile, pub)
+	if err != nil {
+		return false, err
+	}
+
+	redactions, unsigned, err := getAuditRedactions(pub)
+	if err != nil {
+		return false, err
+	}
+
+	sources, err := getAuditSources()
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+
+	for _, source := range sources {
+		rep, err := verifyAuditSource(source, pub, redactions, unsigned, checkpoints[source])
+		if err != nil {
+			return false, err
+		}
+
+		fmt.Fprintf(w, "%s: %d archived entries, %d entries after #%d chained, %d redacted, %d checkpoints matched, %d not chained yet\n",
+			rep.Source, rep.Archived, rep.Entries, rep.StartID, rep.Redacted, rep.Checkpoints, rep.Unchained)
+
+		if rep.BrokenID != 0 {
+			ok = false
+			fmt.Fprintf(w, "  broken at #%d: %s\n", rep.BrokenID, rep.Reason)
+		}
+	}
+
+	// a redaction not signed was not written by the application, whatever entry it is for
+	if len(unsigned) > 0 {
+		ok = false
+		fmt.Fprintf(w, "%d entries have redactions with no valid signature\n", len(unsigned))
+	}
+
+	return ok, nil
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// audit_log.log_msg is json (jsonb, JSON, nvarchar(max) or LONG, depending on the database).
+// A user is found in it as a json string: a value ("user": "geo") or quoted in a message ("username \"geo\" ...").
+
+// auditLogEntry - one row of audit_log
+type auditLogEntry struct {
+	AuditLogID int64
+	Source     string
+	LogTime    time.Time
+	LogMsg     string
+}
+
+// auditMsgAsText - log_msg as text a LIKE can search; empty when the database cannot (Oracle LONG)
+func auditMsgAsText() string {
+	switch config.Database.DbType {
+	case "postgres":
+		return "log_msg::text"
+	case "mysql":
+		return "CAST(log_msg AS CHAR)"
+	case "mssql":
+		return "log_msg"
+	default:
+		return ""
+	}
+}
+
+// jsonStringForms - how s is written inside a json document: as a string, and as a quote inside another string.
+// Both with and without html escaping, databases with a json type rewrite the document.
+func jsonStringForms(s string) []string {
+	var forms []string
+
+	for _, escapeHTML := range []bool{true, false} {
+		quoted := jsonString(s, escapeHTML)
+		inner := jsonString(quoted, escapeHTML)
+
+		// the quote inside another string first, it contains the plain form
+		forms = append(forms, inner[1:len(inner)-1], quoted)
+	}
+
+	return forms
+}
+
+func jsonString(s string, escapeHTML bool) string {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(escapeHTML)
+	enc.Encode(s)
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// auditMentionValues - non empty values, each also in lower case, without duplicates
+func auditMentionValues(values ...string) []string {
+	var res []string
+	seen := make(map[string]bool)
+
+	for _, v := range values {
+		for _, val := range []string{v, strings.ToLower(v)} {
+			if len(strings.TrimSpace(val)) == 0 || seen[val] {
+				continue
+			}
+
+			seen[val] = true
+			res = append(res, val)
+		}
+	}
+
+	return res
+}
+
+// auditMentions - log_msg contains one of the values as a json string
+func auditMentions(msg string, values []string) bool {
+	for _, val := range values {
+		for _, form := range jsonStringForms(val) {
+			if strings.Contains(msg, form) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// forEachAuditMention - audit entries mentioning one of the values, oldest first.
+// The database narrows them down with LIKE where it can, the json forms are checked here.
+func forEachAuditMention(tx *sql.Tx, values []string, f func(e *auditLogEntry) error) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	query := `
+	    SELECT audit_log_id,
+	           source,
+	           log_time,
+	           log_msg
+	      FROM audit_log
+	`
+	var args []interface{}
+
+	if expr := auditMsgAsText(); len(expr) > 0 {
+		var filters []string
+
+		for _, val := range values {
+			filters = append(filters, expr+" LIKE ?")
+			args = append(args, "%"+val+"%")
+		}
+
+		query += " WHERE " + strings.Join(filters, " OR ")
+	}
+
+	query += " ORDER BY audit_log_id"
+
+	pq := dbutl.PQuery(query, args...)
+
+	return dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var e auditLogEntry
+
+		err := row.Scan(&e.AuditLogID, &e.Source, &e.LogTime, &e.LogMsg)
+		if err != nil {
+			return err
+		}
+
+		if !auditMentions(e.LogMsg, values) {
+			return nil
+		}
+
+		return f(&e)
+	})
+}
+
+// auditUserFields - keys of log_msg, at any depth, whose value names a user
+var auditUserFields = map[string]bool{
+	"user":            true,
+	"username":        true,
+	"loweredusername": true,
+	"email":           true,
+	"loweredemail":    true,
+	"old_email":       true,
+	"new_email":       true,
+	"changed_by":      true,
+	"admin":           true,
+}
+
+// auditTextFields - keys of log_msg whose value is a text that may quote a user
+var auditTextFields = map[string]bool{
+	"msg":   true,
+	"error": true,
+}
+
+// pseudonymizeAuditLog - replace the values with the pseudonym in the audit entries mentioning them;
+// returns how many entries changed
+func pseudonymizeAuditLog(tx *sql.Tx, values []string, pseudonym string) (int, error) {
+	changed := make(map[int64]string)
+
+	err := forEachAuditMention(tx, values, func(e *auditLogEntry) error {
+		msg, ok := pseudonymizeAuditMsg(e.LogMsg, values, pseudonym)
+		if ok {
+			changed[e.AuditLogID] = msg
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the rows are read, the connection can take the updates
+	for id, msg := range changed {
+		pq := dbutl.PQuery(`
+		    UPDATE audit_log
+		       SET log_msg = ?
+		     WHERE audit_log_id = ?
+		`, msg,
+			id)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return 0, err
+		}
+
+		// the hash chain keeps the hash of the original entry
+		err = recordAuditRedaction(tx, id, "pseudonymized")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(changed), nil
+}
+
+// pseudonymizeAuditMsg - log_msg with the values replaced in the user fields and quoted in the texts.
+// Keys and the other fields are kept; false when nothing changed or log_msg is not a json object.
+func pseudonymizeAuditMsg(msg string, values []string, pseudonym string) (string, bool) {
+	var fields map[string]interface{}
+
+	dec := json.NewDecoder(strings.NewReader(msg))
+	dec.UseNumber()
+
+	err := dec.Decode(&fields)
+	if err != nil {
+		return msg, false
+	}
+
+	if !pseudonymizeAuditFields(fields, values, pseudonym) {
+		return msg, false
+	}
+
+	res, err := json.Marshal(fields)
+	if err != nil {
+		return msg, false
+	}
+
+	return string(res), true
+}
+
+func pseudonymizeAuditFields(fields map[string]interface{}, values []string, pseudonym string) bool {
+	changed := false
+
+	for key, val := range fields {
+		res, ok := pseudonymizeAuditValue(strings.ToLower(key), val, values, pseudonym)
+		if ok {
+			fields[key] = res
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// pseudonymizeAuditValue - val of the field key; the elements of a list belong to the key of the list
+func pseudonymizeAuditValue(key string, val interface{}, values []string, pseudonym string) (interface{}, bool) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return v, pseudonymizeAuditFields(v, values, pseudonym)
+	case []interface{}:
+		changed := false
+
+		for i := range v {
+			res, ok := pseudonymizeAuditValue(key, v[i], values, pseudonym)
+			if ok {
+				v[i] = res
+				changed = true
+			}
+		}
+
+		return v, changed
+	case string:
+		if auditUserFields[key] {
+			for _, name := range values {
+				if strings.EqualFold(v, name) {
+					return pseudonym, true
+				}
+			}
+		}
+
+		if auditTextFields[key] {
+			res := v
+
+			for _, name := range values {
+				res = strings.Replace(res, `"`+name+`"`, `"`+pseudonym+`"`, -1)
+			}
+
+			return res, res != v
+		}
+	}
+
+	return val, false
+}
+
+// auditLogFilter - what the audit log viewer looks for; empty fields do not filter
+type auditLogFilter struct {
+	From      *time.Time
+	To        *time.Time // the whole day is included
+	Operation string     // audit.Log keeps the operation as a key of log_msg
+	User      string
+	IP        string
+	Status    string // "error", "ok" or empty
+	Text      string
+}
+
+// auditFieldSQL - a top level string of log_msg; key is a constant of the code, never user input
+func auditFieldSQL(key string) string {
+	switch config.Database.DbType {
+	case "postgres":
+		return "(log_msg->>'" + key + "')"
+	case "mysql":
+		return "JSON_UNQUOTE(JSON_EXTRACT(log_msg, '$." + key + "'))"
+	default:
+		return "JSON_VALUE(log_msg, '$." + key + "')"
+	}
+}
+
+// auditHasKeySQL - log_msg has the top level key given as parameter (see auditKeyArg)
+func auditHasKeySQL() string {
+	switch config.Database.DbType {
+	case "postgres":
+		// the ? operator of jsonb would be taken for a parameter
+		return "jsonb_exists(log_msg, ?)"
+	case "mysql":
+		return "JSON_CONTAINS_PATH(log_msg, 'one', ?)"
+	default:
+		return "EXISTS (SELECT 1 FROM OPENJSON(log_msg) WHERE [key] = ?)"
+	}
+}
+
+// auditKeyArg - the parameter of auditHasKeySQL; MySQL wants a path, with the key quoted
+// since operations may have spaces or dashes
+func auditKeyArg(key string) interface{} {
+	if config.Database.DbType == "mysql" {
+		return "$." + jsonString(key, false)
+	}
+
+	return key
+}
+
+// auditErrorSQL - the entry was logged with an error
+func auditErrorSQL() (string, interface{}) {
+	cond := "(" + auditHasKeySQL() + " OR COALESCE(" + auditFieldSQL("level") + ", '') IN ('error', 'fatal', 'panic'))"
+
+	return cond, auditKeyArg("error")
+}
+
+// conditions - the filter in sql; log_msg is only looked into where auditMsgAsText can read it,
+// otherwise (Oracle LONG) only the time range is in the sql and matches checks the rest
+func (f *auditLogFilter) conditions() ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if f.From != nil {
+		conds = append(conds, "log_time >= ?")
+		args = append(args, *f.From)
+	}
+
+	if f.To != nil {
+		conds = append(conds, "log_time < ?")
+		args = append(args, f.To.AddDate(0, 0, 1))
+	}
+
+	text := auditMsgAsText()
+	if len(text) == 0 {
+		return conds, args
+	}
+
+	if len(f.Operation) > 0 {
+		conds = append(conds, auditHasKeySQL())
+		args = append(args, auditKeyArg(f.Operation))
+	}
+
+	if len(f.User) > 0 {
+		conds = append(conds, "LOWER("+auditFieldSQL("user")+") = ?")
+		args = append(args, strings.ToLower(f.User))
+	}
+
+	if len(f.IP) > 0 {
+		conds = append(conds, auditFieldSQL("ip")+" = ?")
+		args = append(args, f.IP)
+	}
+
+	switch f.Status {
+	case "error":
+		cond, arg := auditErrorSQL()
+		conds = append(conds, cond)
+		args = append(args, arg)
+	case "ok":
+		cond, arg := auditErrorSQL()
+		conds = append(conds, "NOT "+cond)
+		args = append(args, arg)
+	}
+
+	if len(f.Text) > 0 {
+		conds = append(conds, "LOWER("+text+") LIKE ?")
+		args = append(args, "%"+strings.ToLower(f.Text)+"%")
+	}
+
+	return conds, args
+}
+
+// matches - the entry passes the filters on log_msg
+func (f *auditLogFilter) matches(msg string, fields map[string]interface{}) bool {
+	if len(f.Operation) > 0 {
+		if _, ok := fields[f.Operation]; !ok {
+			return false
+		}
+	}
+
+	if len(f.User) > 0 && !strings.EqualFold(auditField(fields, "user"), f.User) {
+		return false
+	}
+
+	if len(f.IP) > 0 && auditField(fields, "ip") != f.IP {
+		return false
+	}
+
+	switch f.Status {
+	case "error":
+		if !auditIsError(fields) {
+			return false
+		}
+	case "ok":
+		if auditIsError(fields) {
+			return false
+		}
+	}
+
+	if len(f.Text) > 0 && !strings.Contains(strings.ToLower(msg), strings.ToLower(f.Text)) {
+		return false
+	}
+
+	return true
+}
+
+// parseAuditMsg - the top level fields of log_msg; nil when it is not a json object
+func parseAuditMsg(msg string) map[string]interface{} {
+	var fields map[string]interface{}
+
+	err := json.Unmarshal([]byte(msg), &fields)
+	if err != nil {
+		return nil
+	}
+
+	return fields
+}
+
+func auditField(fields map[string]interface{}, key string) string {
+	val, ok := fields[key]
+	if !ok || val == nil {
+		return ""
+	}
+
+	if s, ok := val.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(val)
+}
+
+func auditIsError(fields map[string]interface{}) bool {
+	if _, ok := fields["error"]; ok {
+		return true
+	}
+
+	switch auditField(fields, "level") {
+	case "error", "fatal", "panic":
+		return true
+	}
+
+	return false
+}
+
+// auditCommonFields - fields of log_msg with a column of their own in the viewer
+var auditCommonFields = map[string]bool{
+	"level": true,
+	"msg":   true,
+	"time":  true,
+	"error": true,
+	"user":  true,
+	"ip":    true,
+}
+
+func newAuditLogModel(e *auditLogEntry, fields map[string]interface{}) *models.AuditLogModel {
+	m := models.AuditLogModel{
+		AuditLogID: e.AuditLogID,
+		Source:     e.Source,
+		LogTime:    e.LogTime,
+		Details:    make(map[string]interface{}),
+	}
+
+	if fields == nil {
+		m.Message = e.LogMsg
+		return &m
+	}
+
+	m.Level = auditField(fields, "level")
+	m.Message = auditField(fields, "msg")
+	m.Error = auditField(fields, "error")
+	m.IsError = auditIsError(fields)
+	m.User = auditField(fields, "user")
+	m.IP = auditField(fields, "ip")
+
+	for key, val := range fields {
+		if !auditCommonFields[key] {
+			m.Details[key] = val
+		}
+	}
+
+	return &m
+}
+
+// searchAuditLog - audit entries passing the filter, newest first
+func searchAuditLog(f *auditLogFilter, page int, rowsOnPage int) ([]*models.AuditLogModel, error) {
+	var entries []*models.AuditLogModel
+
+	lmin := 0
+	if page > 1 {
+		lmin = (page - 1) * rowsOnPage
+	}
+
+	query := `
+	    SELECT audit_log_id,
+	           source,
+	           log_time,
+	           log_msg
+	      FROM audit_log
+	`
+	conds, args := f.conditions()
+
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	query += " ORDER BY log_time DESC, audit_log_id DESC"
+
+	// the database pages what it can filter; the rest is paged here
+	inSQL := len(auditMsgAsText()) > 0
+	if inSQL {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, rowsOnPage, lmin)
+	}
+
+	pq := dbutl.PQuery(query, args...)
+	skipped := 0
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var e auditLogEntry
+
+		if !inSQL && len(entries) == rowsOnPage {
+			return nil
+		}
+
+		err := row.Scan(&e.AuditLogID, &e.Source, &e.LogTime, &e.LogMsg)
+		if err != nil {
+			return err
+		}
+
+		fields := parseAuditMsg(e.LogMsg)
+
+		if !inSQL {
+			if !f.matches(e.LogMsg, fields) {
+				return nil
+			}
+
+			if skipped < lmin {
+				skipped++
+				return nil
+			}
+		}
+
+		entries = append(entries, newAuditLogModel(&e, fields))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
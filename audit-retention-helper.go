@@ -0,0 +1,441 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// Rows of audit_log older than the retention of their source are written to gzipped NDJSON files,
+// one audit_archive row per file, and deleted from audit_log when the configuration says so.
+// audit_archive remembers what was archived: kept rows are not archived twice and, when two
+// instances archive the same rows, its unique key lets only one of them through.
+
+var auditFileNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// auditArchiveLine - one audit_log row of an archive or of an export; log_msg is kept as json
+type auditArchiveLine struct {
+	AuditLogID    int64           `json:"audit_log_id"`
+	Source        string          `json:"source"`
+	SourceVersion string          `json:"source_version"`
+	LogTime       time.Time       `json:"log_time"`
+	LogMsg        json.RawMessage `json:"log_msg"`
+	MsgHash       string          `json:"msg_hash,omitempty"`
+	EntryHash     string          `json:"entry_hash,omitempty"`
+}
+
+// auditWriteStats - what writeAuditNDJSON wrote
+type auditWriteStats struct {
+	Entries   int
+	FirstID   int64
+	LastID    int64
+	FirstTime time.Time
+	LastTime  time.Time
+	LastHash  string
+}
+
+// writeAuditNDJSON - the audit_log rows of the query (audit_log_id, source, source_version,
+// log_time, log_msg, msg_hash, entry_hash), one json object per line
+func writeAuditNDJSON(w io.Writer, pq *utils.PreparedQuery) (*auditWriteStats, error) {
+	var stats auditWriteStats
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var line auditArchiveLine
+		var msg string
+		var msgHash, entryHash sql.NullString
+
+		err := row.Scan(&line.AuditLogID, &line.Source, &line.SourceVersion, &line.LogTime, &msg, &msgHash, &entryHash)
+		if err != nil {
+			return err
+		}
+
+		line.MsgHash = msgHash.String
+		line.EntryHash = entryHash.String
+
+		if json.Valid([]byte(msg)) {
+			line.LogMsg = json.RawMessage(msg)
+		} else {
+			line.LogMsg = json.RawMessage(jsonString(msg, false))
+		}
+
+		err = enc.Encode(&line)
+		if err != nil {
+			return err
+		}
+
+		if stats.Entries == 0 {
+			stats.FirstID = line.AuditLogID
+			stats.FirstTime = line.LogTime
+		}
+
+		stats.Entries++
+		stats.LastID = line.AuditLogID
+		stats.LastTime = line.LogTime
+		stats.LastHash = line.EntryHash
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// writeAuditGzip - writeAuditNDJSON to a gzipped file, synced to disk
+func writeAuditGzip(f *os.File, pq *utils.PreparedQuery) (*auditWriteStats, error) {
+	gz := gzip.NewWriter(f)
+
+	stats, err := writeAuditNDJSON(gz, pq)
+	if err != nil {
+		gz.Close()
+		return nil, err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// auditRetentionDays - how many days the entries of the source are kept in audit_log; 0 - forever
+func auditRetentionDays(source string) int {
+	for _, s := range config.AuditRetention.Sources {
+		if s.Name == source {
+			return s.Days
+		}
+	}
+
+	return config.AuditRetention.Days
+}
+
+// startAuditRetention - archive the audit log now and then each interval, in the background
+func startAuditRetention() {
+	if !config.AuditRetention.Enabled {
+		return
+	}
+
+	go func() {
+		for {
+			err := archiveAuditLog()
+			if err != nil {
+				audit.Log(err, "audit-retention", "Error archiving the audit log")
+			}
+
+			time.Sleep(time.Duration(config.AuditRetention.Interval) * time.Second)
+		}
+	}()
+}
+
+// getAuditSources - the sources found in audit_log
+func getAuditSources() ([]string, error) {
+	var sources []string
+
+	pq := dbutl.PQuery(`
+	    SELECT DISTINCT source
+	      FROM audit_log
+	`)
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var source string
+
+		err := row.Scan(&source)
+		if err != nil {
+			return err
+		}
+
+		sources = append(sources, source)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// archiveAuditLog - archive the entries past their retention, for every source of audit_log
+func archiveAuditLog() error {
+	err := os.MkdirAll(config.AuditRetention.Dir, 0750)
+	if err != nil {
+		return err
+	}
+
+	sources, err := getAuditSources()
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		days := auditRetentionDays(source)
+		if days <= 0 {
+			continue
+		}
+
+		cutoff := time.Now().UTC().AddDate(0, 0, -days)
+
+		for {
+			n, err := archiveAuditBatch(source, cutoff)
+			if err != nil {
+				return err
+			}
+
+			if n < config.AuditRetention.FileRows {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// archiveAuditBatch - write the next file-rows entries of the source logged before cutoff
+// to a new archive file; returns how many were written. With the audit chain on, only chained
+// entries are archived, so the chain of the entries left goes on from the last one archived.
+func archiveAuditBatch(source string, cutoff time.Time) (int, error) {
+	var lastID int64
+
+	pq := dbutl.PQuery(`
+	    SELECT COALESCE(MAX(last_audit_log_id), 0)
+	      FROM audit_archive
+	     WHERE source = ?
+	`, source)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&lastID)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(config.AuditRetention.Dir, ".audit-archive-")
+	if err != nil {
+		return 0, err
+	}
+
+	tmpName := tmp.Name()
+
+	chained := 0
+	if config.AuditChain.Enabled {
+		chained = 1
+	}
+
+	pq = dbutl.PQuery(`
+	    SELECT audit_log_id,
+	           source,
+	           source_version,
+	           log_time,
+	           log_msg,
+	           msg_hash,
+	           entry_hash
+	      FROM audit_log
+	     WHERE source = ?
+	       AND audit_log_id > ?
+	       AND log_time < ?
+	       AND (entry_hash IS NOT NULL OR ? = 0)
+	     ORDER BY audit_log_id
+	     LIMIT ?
+	`, source,
+		lastID,
+		cutoff,
+		chained,
+		config.AuditRetention.FileRows)
+
+	stats, err := writeAuditGzip(tmp, pq)
+	tmp.Close()
+
+	if err != nil || stats.Entries == 0 {
+		os.Remove(tmpName)
+		return 0, err
+	}
+
+	fileName := fmt.Sprintf("%s-%d-%d.ndjson.gz",
+		auditFileNameRe.ReplaceAllString(source, "_"),
+		stats.FirstID,
+		stats.LastID)
+	file := filepath.Join(config.AuditRetention.Dir, fileName)
+
+	err = os.Rename(tmpName, file)
+	if err != nil {
+		os.Remove(tmpName)
+		return 0, err
+	}
+
+	err = saveAuditArchive(source, cutoff, stats, fileName)
+	if err != nil {
+		// another instance archived the same entries or nothing was recorded; the file goes
+		os.Remove(file)
+		return 0, err
+	}
+
+	audit.Log(nil, "audit-retention", "Audit log archived.",
+		"source", source,
+		"file", fileName,
+		"entries", stats.Entries,
+		"deleted", config.AuditRetention.Delete)
+
+	return stats.Entries, nil
+}
+
+// saveAuditArchive - record the archive file and, when configured, delete the entries in it
+func saveAuditArchive(source string, cutoff time.Time, stats *auditWriteStats, fileName string) error {
+	deleted := 0
+	if config.AuditRetention.Delete {
+		deleted = 1
+	}
+
+	chained := 0
+	if config.AuditChain.Enabled {
+		chained = 1
+	}
+
+	var lastHash interface{}
+	if len(stats.LastHash) > 0 {
+		lastHash = stats.LastHash
+	}
+
+	// the chain of the entries left in audit_log goes on from the last archived one
+	rec := auditArchiveRecord{
+		FirstAuditLogID: stats.FirstID,
+		LastAuditLogID:  stats.LastID,
+		Entries:         stats.Entries,
+		FileName:        fileName,
+		Deleted:         deleted == 1,
+		LastEntryHash:   stats.LastHash,
+	}
+
+	signature, err := signAudit(rec.payload(source))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pq := dbutl.PQuery(`
+	    INSERT INTO audit_archive (
+	        source,
+	        first_audit_log_id,
+	        last_audit_log_id,
+	        first_log_time,
+	        last_log_time,
+	        entries,
+	        file_name,
+	        archive_time,
+	        deleted,
+	        last_entry_hash,
+	        signature
+	    )
+	    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, source,
+		stats.FirstID,
+		stats.LastID,
+		stats.FirstTime,
+		stats.LastTime,
+		stats.Entries,
+		fileName,
+		time.Now().UTC(),
+		deleted,
+		lastHash,
+		signature)
+
+	_, err = dbutl.ExecTx(tx, pq)
+	if err != nil {
+		return err
+	}
+
+	if deleted == 1 {
+		// the same rows the archive was written from
+		pq = dbutl.PQuery(`
+		    DELETE FROM audit_log
+		     WHERE source = ?
+		       AND audit_log_id BETWEEN ? AND ?
+		       AND log_time < ?
+		       AND (entry_hash IS NOT NULL OR ? = 0)
+		`, source,
+			stats.FirstID,
+			stats.LastID,
+			cutoff,
+			chained)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// exportAuditLog - the entries logged from one date to another (both included) as NDJSON,
+// gzipped when the file ends in .gz; no file - stdout
+func exportAuditLog(from time.Time, to time.Time, file string) error {
+	pq := dbutl.PQuery(`
+	    SELECT audit_log_id,
+	           source,
+	           source_version,
+	           log_time,
+	           log_msg,
+	           msg_hash,
+	           entry_hash
+	      FROM audit_log
+	     WHERE log_time >= ?
+	       AND log_time < ?
+	     ORDER BY audit_log_id
+	`, from,
+		to.AddDate(0, 0, 1))
+
+	if len(file) == 0 {
+		_, err := writeAuditNDJSON(os.Stdout, pq)
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var stats *auditWriteStats
+
+	if strings.HasSuffix(strings.ToLower(file), ".gz") {
+		stats, err = writeAuditGzip(f, pq)
+	} else {
+		stats, err = writeAuditNDJSON(f, pq)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, "audit-export", "Audit log exported.",
+		"file", file,
+		"from", from.Format(utils.ISODate),
+		"to", to.Format(utils.ISODate),
+		"entries", stats.Entries)
+
+	return f.Close()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// Authentication goes through a chain of providers. Each one looks at the credentials and either
+// says they are not its kind (errAuthNotApplicable, the next provider is asked) or decides:
+// a result, or an error. The first provider that decides ends the chain.
+
+// Credentials - what the client presented
+type Credentials struct {
+	Username string
+	Password string
+	// Token - bearer API token
+	Token string
+	// Request, Response - the redirect of a login started elsewhere (OpenID Connect callback)
+	Request  *http.Request
+	Response http.ResponseWriter
+	IP       string
+
+	source       string
+	sourceLoaded bool
+}
+
+// AuthResult - the authenticated user
+type AuthResult struct {
+	UserID            int
+	Username          string
+	Name              string
+	Surname           string
+	Roles             []string
+	TemporaryPassword bool
+	Provider          string
+	APITokenID        int
+}
+
+// Authenticator - a way of proving who the user is
+type Authenticator interface {
+	// Name - of the provider, for the audit log
+	Name() string
+	// Authenticate - the user, errAuthNotApplicable when the credentials are not for this provider,
+	// a credentialsError when they are refused, any other error when they could not be checked
+	Authenticate(c *Credentials) (*AuthResult, error)
+}
+
+// errAuthNotApplicable - the provider does not handle this kind of credentials
+var errAuthNotApplicable = errors.New("credentials not handled by the provider")
+
+// credentialsError - the credentials were checked and refused: unknown user, wrong password, locked out...
+type credentialsError struct {
+	msg string
+}
+
+func (e *credentialsError) Error() string {
+	return e.msg
+}
+
+func refusedf(format string, args ...interface{}) error {
+	return &credentialsError{msg: fmt.Sprintf(format, args...)}
+}
+
+// isCredentialsError - the error is a refusal of the credentials, not a failure to check them
+func isCredentialsError(err error) bool {
+	_, ok := err.(*credentialsError)
+	return ok
+}
+
+var authenticators = struct {
+	sync.RWMutex
+	chain []Authenticator
+}{
+	chain: []Authenticator{
+		apiTokenAuthenticator{},
+		oidcAuthenticator{},
+		ldapAuthenticator{},
+		localAuthenticator{},
+	},
+}
+
+// registerAuthenticator - plug in a provider; it is asked before the built-in ones
+func registerAuthenticator(a Authenticator) {
+	authenticators.Lock()
+	defer authenticators.Unlock()
+
+	authenticators.chain = append([]Authenticator{a}, authenticators.chain...)
+}
+
+// authenticate - ask the providers in turn; the first one handling the credentials decides
+func authenticate(c *Credentials) (*AuthResult, error) {
+	authenticators.RLock()
+	chain := authenticators.chain
+	authenticators.RUnlock()
+
+	for _, a := range chain {
+		res, err := a.Authenticate(c)
+		if err == errAuthNotApplicable {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res.Provider = a.Name()
+
+		res.Roles, err = getUserRoleNames(res.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	return nil, refusedf("no authentication provider for the credentials")
+}
+
+// passwordSource - password_source of the user, read once; empty for an unknown user
+func (c *Credentials) passwordSource() (string, error) {
+	if c.sourceLoaded {
+		return c.source, nil
+	}
+
+	source, err := getPasswordSource(c.Username)
+	if err != nil {
+		return "", err
+	}
+
+	c.source = source
+	c.sourceLoaded = true
+
+	return source, nil
+}
+
+// getUserRoleNames - roles held directly by the user now
+func getUserRoleNames(userID int) ([]string, error) {
+	var roles []string
+
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT r.role
+	      FROM user_role ur
+	      JOIN role r ON (ur.role_id = r.role_id)
+	     WHERE ur.user_id = ?
+	       AND ur.valid   = ?
+	       AND ur.valid_from <= ?
+	       AND (ur.valid_until is null OR ur.valid_until > ?)
+	     ORDER BY r.role
+	`, userID,
+		1,
+		dt,
+		dt)
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var role string
+		err := row.Scan(&role)
+		if err != nil {
+			return err
+		}
+
+		roles = append(roles, role)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// localAuthenticator - username and password kept in user_password
+type localAuthenticator struct {
+}
+
+func (localAuthenticator) Name() string {
+	return PasswordSourceLocal
+}
+
+func (localAuthenticator) Authenticate(c *Credentials) (*AuthResult, error) {
+	if len(c.Username) == 0 || len(c.Token) > 0 || c.Request != nil {
+		return nil, errAuthNotApplicable
+	}
+
+	source, err := c.passwordSource()
+	if err != nil {
+		return nil, err
+	}
+
+	// unknown users end here too, to be refused
+	if len(source) > 0 && source != PasswordSourceLocal {
+		return nil, errAuthNotApplicable
+	}
+
+	user := c.Username
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT u.user_id,
+	           u.username,
+	           u.name,
+	           u.surname,
+	           p.password_id,
+	           CASE
+	             WHEN p.password is null THEN
+	               '-'
+	             ELSE
+	               p.password
+	           END AS hashed_password,
+	           CASE
+	             WHEN p.password_salt is null THEN
+	               '-'
+	             ELSE
+	               p.password_salt
+	           END AS password_salt,
+	           activated,
+	           locked_out,
+	           CASE WHEN u.locked_until IS NULL THEN 0 ELSE 1 END AS lock_expires,
+	           CASE WHEN u.locked_until IS NULL THEN u.creation_time ELSE u.locked_until END AS locked_until,
+	           u.valid,
+	           p.temporary
+	      FROM "user" u
+	      LEFT OUTER JOIN user_password p ON (u.user_id = p.user_id)
+	     WHERE loweredusername = lower(?)
+	       AND p.valid = ?
+	       AND p.valid_from <= ?
+	       AND (p.valid_until is null OR p.valid_until > ?)
+	`, user,
+		1,
+		dt,
+		dt)
+
+	testUser := validateUserUtil{}
+	err = dbutl.RunQuery(pq, &testUser)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, refusedf("username \"%s\" not found or password expired", user)
+	case err != nil:
+		return nil, err
+	}
+
+	err = checkUserCanLogin(nil, &testUser, user, c.IP, dt)
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := verifyPassword(testUser.HashedPassword, testUser.PasswordSalt, c.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !match {
+		failedUserPasswordValidation(testUser.UserID, user)
+		return nil, refusedf("wrong password for \"%s\"", user)
+	}
+
+	if passwordNeedsRehash(testUser.HashedPassword) {
+		err = rehashUserPassword(testUser.PasswordID, testUser.HashedPassword, testUser.PasswordSalt, c.Password)
+		if err != nil {
+			audit.Log(err, "rehash-password", "Could not upgrade the password hash", "user", user)
+		}
+	}
+
+	return &AuthResult{
+		UserID:            testUser.UserID,
+		Username:          testUser.Username,
+		Name:              testUser.Name,
+		Surname:           testUser.Surname,
+		TemporaryPassword: testUser.Temporary > 0,
+	}, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/xml"
 	"os"
+	"strings"
 )
 
 // Configuration - config helper
@@ -11,16 +12,28 @@ type Configuration struct {
 	General        ConfigurationGeneral
 	Database       ConfigurationDatabase
 	PasswordRules  ConfigurationPassword
+	PasswordHash   ConfigurationPasswordHash
+	LoginRateLimit ConfigurationLoginRateLimit
 	UserActivation ConfigurationUserActivation
+	AccessRules    ConfigurationAccessRules
+	AccessCache    ConfigurationAccessCache
+	I18n           ConfigurationI18n
+	Mail           ConfigurationMail
+	OIDC           ConfigurationOIDC
+	LDAP           ConfigurationLDAP
+	AuditRetention ConfigurationAuditRetention
+	AuditChain     ConfigurationAuditChain
 }
 
 // ConfigurationGeneral - general config
 type ConfigurationGeneral struct {
-	XMLName  xml.Name `xml:"general"`
-	Port     string   `xml:"port"`
-	Timezone string   `xml:"timezone"`
-	IsHTTPS  bool     `xml:"use-https"`
-	AdminIP  string   `xml:"admin-ip"`
+	XMLName        xml.Name `xml:"general"`
+	Port           string   `xml:"port"`
+	Timezone       string   `xml:"timezone"`
+	IsHTTPS        bool     `xml:"use-https"`
+	AdminIP        string   `xml:"admin-ip"`
+	TrustedProxies string   `xml:"trusted-proxies"`
+	PublicURL      string   `xml:"public-url"`
 }
 
 // ConfigurationDatabase - database config
@@ -44,6 +57,39 @@ type ConfigurationPassword struct {
 	MinNonAlphaNumerics       int      `xml:"min-non-alpha-numerics,attr"`
 	AllowRepetitiveCharacters bool     `xml:"allow-repetitive-characters,attr"`
 	CanContainUsername        bool     `xml:"can-contain-username,attr"`
+	CommonPasswordsFile       string   `xml:"common-passwords-file,attr"`
+	PwnedPasswordsDir         string   `xml:"pwned-passwords-dir,attr"`
+	PwnedMinCount             int      `xml:"pwned-min-count,attr"`
+	MinStrengthScore          int      `xml:"min-strength-score,attr"`
+	LockoutDuration           int      `xml:"lockout-duration,attr"`
+	LockoutEscalationFactor   int      `xml:"lockout-escalation-factor,attr"`
+	LockoutMaxDuration        int      `xml:"lockout-max-duration,attr"`
+	LockoutPermanentAfter     int      `xml:"lockout-permanent-after,attr"`
+	LockoutResetAfter         int      `xml:"lockout-reset-after,attr"`
+}
+
+// ConfigurationPasswordHash - how new passwords are hashed; older hashes are upgraded at login
+type ConfigurationPasswordHash struct {
+	XMLName           xml.Name `xml:"password-hash"`
+	Algorithm         string   `xml:"algorithm,attr"`
+	BcryptCost        int      `xml:"bcrypt-cost,attr"`
+	Argon2Memory      uint32   `xml:"argon2-memory,attr"`
+	Argon2Iterations  uint32   `xml:"argon2-iterations,attr"`
+	Argon2Parallelism uint8    `xml:"argon2-parallelism,attr"`
+}
+
+// ConfigurationLoginRateLimit - failed logins allowed in a sliding window of seconds
+// per ip, per username and per ip + username (0 - no limit), and the delays after them
+type ConfigurationLoginRateLimit struct {
+	XMLName      xml.Name `xml:"login-rate-limit"`
+	Storage      string   `xml:"storage,attr"`
+	Window       int      `xml:"window,attr"`
+	MaxPerIP     int      `xml:"max-per-ip,attr"`
+	MaxPerUser   int      `xml:"max-per-user,attr"`
+	MaxPerIPUser int      `xml:"max-per-ip-user,attr"`
+	DelayAfter   int      `xml:"delay-after,attr"`
+	DelayStep    int      `xml:"delay-step,attr"`
+	MaxDelay     int      `xml:"max-delay,attr"`
 }
 
 // ConfigurationUserActivation - user activation config
@@ -54,6 +100,114 @@ type ConfigurationUserActivation struct {
 	MaxValidURL  int      `xml:"max-valid-url,attr"`
 }
 
+// ConfigurationAccessRules - requests, roles and grants file
+type ConfigurationAccessRules struct {
+	XMLName xml.Name `xml:"access-rules"`
+	File    string   `xml:"file,attr"`
+}
+
+// ConfigurationAccessCache - in-memory cache of requests, grants and user roles
+type ConfigurationAccessCache struct {
+	XMLName       xml.Name `xml:"access-cache"`
+	CheckInterval int      `xml:"check-interval,attr"`
+	TTL           int      `xml:"ttl,attr"`
+}
+
+// ConfigurationI18n - message catalogs
+type ConfigurationI18n struct {
+	XMLName         xml.Name `xml:"i18n"`
+	Dir             string   `xml:"dir,attr"`
+	DefaultLanguage string   `xml:"default-language,attr"`
+}
+
+// ConfigurationMail - smtp server for the emails sent to users; no host - no emails
+type ConfigurationMail struct {
+	XMLName  xml.Name `xml:"mail"`
+	Host     string   `xml:"host,attr"`
+	Port     string   `xml:"port,attr"`
+	Username string   `xml:"username,attr"`
+	Password string   `xml:"password,attr"`
+	From     string   `xml:"from,attr"`
+}
+
+// ConfigurationOIDC - login through an OpenID Connect provider (authorization code + PKCE)
+type ConfigurationOIDC struct {
+	XMLName       xml.Name `xml:"oidc"`
+	Enabled       bool     `xml:"enabled,attr"`
+	Name          string   `xml:"name,attr"`
+	Issuer        string   `xml:"issuer,attr"`
+	ClientID      string   `xml:"client-id,attr"`
+	ClientSecret  string   `xml:"client-secret,attr"`
+	RedirectURL   string   `xml:"redirect-url,attr"`
+	Scopes        string   `xml:"scopes,attr"`
+	UsernameClaim string   `xml:"username-claim,attr"`
+	AutoProvision bool     `xml:"auto-provision,attr"`
+	LinkByEmail   bool     `xml:"link-by-email,attr"`
+	RolesClaim    string   `xml:"roles-claim,attr"`
+	RoleMapping   string   `xml:"role-mapping,attr"`
+}
+
+// ConfigurationLDAP - directory checking the passwords of the users with password_source "ldap".
+// user-filter and group-filter get the escaped username / user dn in place of %s.
+type ConfigurationLDAP struct {
+	XMLName            xml.Name                     `xml:"ldap"`
+	Enabled            bool                         `xml:"enabled,attr"`
+	URL                string                       `xml:"url,attr"`
+	StartTLS           bool                         `xml:"start-tls,attr"`
+	InsecureSkipVerify bool                         `xml:"insecure-skip-verify,attr"`
+	Timeout            int                          `xml:"timeout,attr"`
+	BindDN             string                       `xml:"bind-dn,attr"`
+	BindPassword       string                       `xml:"bind-password,attr"`
+	BaseDN             string                       `xml:"base-dn,attr"`
+	UserFilter         string                       `xml:"user-filter,attr"`
+	NameAttribute      string                       `xml:"name-attribute,attr"`
+	SurnameAttribute   string                       `xml:"surname-attribute,attr"`
+	EmailAttribute     string                       `xml:"email-attribute,attr"`
+	GroupAttribute     string                       `xml:"group-attribute,attr"`
+	GroupBaseDN        string                       `xml:"group-base-dn,attr"`
+	GroupFilter        string                       `xml:"group-filter,attr"`
+	AutoProvision      bool                         `xml:"auto-provision,attr"`
+	GroupRoles         []ConfigurationLDAPGroupRole `xml:"group-role"`
+}
+
+// ConfigurationLDAPGroupRole - members of the directory group get the role
+type ConfigurationLDAPGroupRole struct {
+	Group string `xml:"group,attr"`
+	Role  string `xml:"role,attr"`
+}
+
+// ConfigurationAuditRetention - audit_log entries older than the days of their source are archived
+// each interval seconds to gzipped NDJSON files of at most file-rows entries in dir,
+// and deleted from audit_log when delete is set (days 0 - kept forever)
+type ConfigurationAuditRetention struct {
+	XMLName  xml.Name                   `xml:"audit-retention"`
+	Enabled  bool                       `xml:"enabled,attr"`
+	Dir      string                     `xml:"dir,attr"`
+	Interval int                        `xml:"interval,attr"`
+	Days     int                        `xml:"days,attr"`
+	Delete   bool                       `xml:"delete,attr"`
+	FileRows int                        `xml:"file-rows,attr"`
+	Sources  []ConfigurationAuditSource `xml:"source"`
+}
+
+// ConfigurationAuditSource - retention of the entries logged by one source (audit_log.source)
+type ConfigurationAuditSource struct {
+	Name string `xml:"name,attr"`
+	Days int    `xml:"days,attr"`
+}
+
+// ConfigurationAuditChain - each interval seconds the new audit_log entries get a hash chained
+// to the previous entry of their source; each checkpoint-interval seconds the last hash of every
+// source is signed with the ed25519 key in key-file (created when missing) and appended to checkpoint-file
+type ConfigurationAuditChain struct {
+	XMLName            xml.Name `xml:"audit-chain"`
+	Enabled            bool     `xml:"enabled,attr"`
+	Interval           int      `xml:"interval,attr"`
+	CheckpointInterval int      `xml:"checkpoint-interval,attr"`
+	CheckpointFile     string   `xml:"checkpoint-file,attr"`
+	KeyFile            string   `xml:"key-file,attr"`
+}
+
 // ReadFromFile - read config from file
 func (c *Configuration) ReadFromFile(cfgFile string) error {
 	if _, err := os.Stat(cfgFile); os.IsNotExist(err) {
@@ -85,5 +239,128 @@ func (c *Configuration) ReadFromFile(cfgFile string) error {
 		}
 	}
 
+	if len(c.AccessRules.File) == 0 {
+		c.AccessRules.File = "./access-rules.json"
+	}
+
+	if c.PasswordRules.PwnedMinCount <= 0 {
+		c.PasswordRules.PwnedMinCount = 1
+	}
+
+	if c.PasswordRules.LockoutEscalationFactor <= 0 {
+		c.PasswordRules.LockoutEscalationFactor = 1
+	}
+
+	if len(c.Mail.Port) == 0 {
+		c.Mail.Port = "25"
+	}
+
+	c.PasswordHash.Algorithm = strings.ToLower(c.PasswordHash.Algorithm)
+	if len(c.PasswordHash.Algorithm) == 0 {
+		c.PasswordHash.Algorithm = "argon2id"
+	}
+
+	if c.PasswordHash.BcryptCost <= 0 {
+		c.PasswordHash.BcryptCost = 12
+	}
+
+	if c.PasswordHash.Argon2Memory == 0 {
+		c.PasswordHash.Argon2Memory = 64 * 1024
+	}
+
+	if c.PasswordHash.Argon2Iterations == 0 {
+		c.PasswordHash.Argon2Iterations = 3
+	}
+
+	if c.PasswordHash.Argon2Parallelism == 0 {
+		c.PasswordHash.Argon2Parallelism = 2
+	}
+
+	c.LoginRateLimit.Storage = strings.ToLower(c.LoginRateLimit.Storage)
+	if len(c.LoginRateLimit.Storage) == 0 {
+		c.LoginRateLimit.Storage = "memory"
+	}
+
+	if c.LoginRateLimit.Window <= 0 {
+		c.LoginRateLimit.Window = 900
+	}
+
+	if len(c.OIDC.Name) == 0 {
+		c.OIDC.Name = "OpenID Connect"
+	}
+
+	if len(c.OIDC.Scopes) == 0 {
+		c.OIDC.Scopes = "openid profile email"
+	}
+
+	if len(c.OIDC.UsernameClaim) == 0 {
+		c.OIDC.UsernameClaim = "preferred_username"
+	}
+
+	if len(c.AuditRetention.Dir) == 0 {
+		c.AuditRetention.Dir = "./audit-archive"
+	}
+
+	if c.AuditRetention.Interval <= 0 {
+		c.AuditRetention.Interval = 3600
+	}
+
+	if c.AuditRetention.FileRows <= 0 {
+		c.AuditRetention.FileRows = 10000
+	}
+
+	if c.AuditChain.Interval <= 0 {
+		c.AuditChain.Interval = 60
+	}
+
+	if c.AuditChain.CheckpointInterval <= 0 {
+		c.AuditChain.CheckpointInterval = 3600
+	}
+
+	if len(c.AuditChain.CheckpointFile) == 0 {
+		c.AuditChain.CheckpointFile = "./audit-checkpoints.ndjson"
+	}
+
+	if len(c.AuditChain.KeyFile) == 0 {
+		c.AuditChain.KeyFile = "./audit-checkpoint.key"
+	}
+
+	if c.LDAP.Timeout <= 0 {
+		c.LDAP.Timeout = 10
+	}
+
+	if len(c.LDAP.UserFilter) == 0 {
+		c.LDAP.UserFilter = "(&(objectClass=person)(uid=%s))"
+	}
+
+	if len(c.LDAP.NameAttribute) == 0 {
+		c.LDAP.NameAttribute = "givenName"
+	}
+
+	if len(c.LDAP.SurnameAttribute) == 0 {
+		c.LDAP.SurnameAttribute = "sn"
+	}
+
+	if len(c.LDAP.EmailAttribute) == 0 {
+		c.LDAP.EmailAttribute = "mail"
+	}
+
+	if c.AccessCache.CheckInterval <= 0 {
+		c.AccessCache.CheckInterval = 5
+	}
+
+	if c.AccessCache.TTL <= 0 {
+		c.AccessCache.TTL = 300
+	}
+
+	if len(c.I18n.Dir) == 0 {
+		c.I18n.Dir = "./i18n"
+	}
+
+	if len(c.I18n.DefaultLanguage) == 0 {
+		c.I18n.DefaultLanguage = "EN"
+	}
+	c.I18n.DefaultLanguage = strings.ToUpper(c.I18n.DefaultLanguage)
+
 	return nil
 }
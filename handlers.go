@@ -5,24 +5,61 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"mime"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
+	"./models"
+
 	"github.com/geo-stanciu/go-utils/utils"
 	"github.com/gorilla/csrf"
 )
 
 type template0Data struct {
-	Err     bool
-	SErr    string
-	Title   string
-	AppName string
-	Version string
-	Date    int64
-	Session SessionData
-	Model   interface{}
+	Err         bool
+	SErr        string
+	Title       string
+	AppName     string
+	Version     string
+	Date        int64
+	Session     SessionData
+	Model       interface{}
+	Menu        []*MenuItem
+	Breadcrumbs []*MenuItem
+	permissions map[string]bool
+}
+
+// Can - the session holds the permission; used in templates: {{% if .m.Can "roles.manage" %}}
+func (d template0Data) Can(permission string) bool {
+	return d.permissions[permission]
+}
+
+// T - translated message; used in templates: {{% .m.T "login.submit" %}}
+func (d template0Data) T(key string, args ...interface{}) string {
+	return translate(d.Session.Lang, key, args...)
+}
+
+// OIDC - name of the OpenID Connect provider for the login button; empty when it is not enabled
+func (d template0Data) OIDC() string {
+	if !config.OIDC.Enabled {
+		return ""
+	}
+
+	return config.OIDC.Name
+}
+
+// Lang - language of the page, for the html lang attribute
+func (d template0Data) Lang() string {
+	return strings.ToLower(d.Session.Lang)
+}
+
+// Languages - languages with a message catalog, for the language switcher
+func (d template0Data) Languages() []*messageCatalog {
+	return catalogLanguages
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -42,32 +79,94 @@ func handlePostRequest(w http.ResponseWriter, r *http.Request) {
 	url := getBaseURL(r)
 	sessionData, err := getSessionData(r)
 
-	if (err != nil || !sessionData.LoggedIn) && url != "/login" && url != "/register" && url != "/stop-process" {
+	if (err != nil || !sessionData.LoggedIn) && url != "/login" && url != "/register" && url != "/stop-process" && url != "/set-language" && url != "/password-strength" {
 		if err != nil {
 			audit.Log(err, "no-context", "Failed request", "url", r.URL.Path)
 		}
 
-		setOperationError(w, r, "Request failed.")
+		setOperationError(w, r, translate(requestLanguage(r), "request.failed"))
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
 	if sessionData.LoggedIn && strings.HasPrefix(url, "/login") {
-		setOperationError(w, r, "Request failed.")
+		setOperationError(w, r, translate(sessionData.Lang, "request.failed"))
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
+	if url == "/login" && isLoginRateLimited(w, r) {
+		return
+	}
+
+	if isImpersonationRefused(w, r, url, sessionData) {
+		return
+	}
+
 	handleRequest(w, r, url, sessionData)
 }
 
+// isImpersonationRefused - the administrator impersonating the user may not make the request:
+// redirect to the index with an error
+func isImpersonationRefused(w http.ResponseWriter, r *http.Request, url string, sessionData *SessionData) bool {
+	if !sessionData.Impersonating() {
+		return false
+	}
+
+	blocked, err := isImpersonationBlocked(r.Method, url)
+	if err != nil {
+		audit.Log(err, "impersonation", "Could not check the request while impersonating", "url", url)
+	}
+
+	if !blocked {
+		return false
+	}
+
+	audit.Log(nil, "impersonation", "Request refused while impersonating",
+		"url", url,
+		"user", sessionData.User.Username,
+		"admin", sessionData.RealUser.Username)
+
+	setOperationError(w, r, translate(sessionData.Lang, "impersonation.blocked"))
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	return true
+}
+
+// isLoginRateLimited - too many failed logins from the ip or for the username: answer 429 with Retry-After
+func isLoginRateLimited(w http.ResponseWriter, r *http.Request) bool {
+	ip := getClientIP(r)
+	user := r.FormValue("username")
+
+	retryAfter, err := checkLoginRateLimit(ip, user)
+	if err != nil {
+		// the login itself is still guarded by the account lockout
+		audit.Log(err, "login-rate-limit", "Could not check the failed logins", "user", user, "ip", ip)
+		return false
+	}
+
+	if retryAfter <= 0 {
+		return false
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+
+	audit.Log(nil, "login-rate-limit", "Login refused, too many failed attempts", "user", user, "ip", ip, "retry-after", seconds)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, translate(requestLanguage(r), "login.rate-limited", seconds), http.StatusTooManyRequests)
+
+	return true
+}
+
 func handleGetRequest(w http.ResponseWriter, r *http.Request) {
 	url := getBaseURL(r)
 	sessionData, err := getSessionData(r)
 
-	if (err != nil || !sessionData.LoggedIn) && url != "/login" && url != "/register" && url != "/stop-process" {
+	if (err != nil || !sessionData.LoggedIn) && url != "/login" && url != "/register" && url != "/stop-process" && url != "/login-oidc" && url != "/login-oidc-callback" && url != "/confirm-email" {
 		if err != nil {
 			audit.Log(err, "no-context", "Failed request", "url", r.URL.Path)
 		}
@@ -91,6 +190,10 @@ func handleGetRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isImpersonationRefused(w, r, url, sessionData) {
+		return
+	}
+
 	handleRequest(w, r, url, sessionData)
 }
 
@@ -138,6 +241,16 @@ func handleRequest(w http.ResponseWriter, r *http.Request, url string, sessionDa
 	w.Header().Set("X-CSRF-Token", csrf.Token(r))
 
 	if response.Template != "-" {
+		passedObj.Menu, passedObj.Breadcrumbs, err = getMenu(sessionData, url)
+		if err != nil {
+			audit.Log(err, "no-context", "Failed to build the menu", "url", r.URL.Path)
+		}
+
+		passedObj.permissions, err = getSessionPermissions(sessionData)
+		if err != nil {
+			audit.Log(err, "no-context", "Failed to load the permissions", "url", r.URL.Path)
+		}
+
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Header().Set("Cache-Control", "private, max-age=600, no-store, must-revalidate")
 		w.Header().Set("X-Frame-Options", "DENY")
@@ -165,6 +278,15 @@ func handleRequest(w http.ResponseWriter, r *http.Request, url string, sessionDa
 	}
 
 	if model != nil && !reflect.ValueOf(model).IsNil() {
+		if file, ok := model.(*models.FileResponseModel); ok && !file.Err() {
+			w.Header().Set("Content-Type", file.ContentType)
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+			w.Header().Set("Cache-Control", "no-store")
+
+			w.Write(file.Content)
+			return
+		}
+
 		if model.Err() {
 			setOperationError(w, r, model.SErr())
 		} else {
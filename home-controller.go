@@ -31,7 +31,7 @@ func (HomeController) StopProcess(w http.ResponseWriter, r *http.Request, res *R
 	if !isRequestFromLocalhost(r) {
 		ip := getClientIP(r)
 		lres.BError = true
-		lres.SError = fmt.Sprintf("Request denied from \"%s\". Your IP address is not acceped for this request.", ip)
+		lres.SError = translate(requestLanguage(r), "stop.denied", ip)
 
 		err1 := fmt.Errorf("request denied from \"%s\"", ip)
 		audit.Log(err1, "process-exit", "Stop process request denied", "ip", ip)
@@ -55,6 +55,7 @@ func (HomeController) Login(w http.ResponseWriter, r *http.Request, res *Respons
 	var ip string
 	var user string
 	var pass string
+	var provider string
 	var err error
 	throwErr2Client := true
 
@@ -73,71 +74,138 @@ func (HomeController) Login(w http.ResponseWriter, r *http.Request, res *Respons
 
 		if len(user) == 0 || len(pass) == 0 {
 			throwErr2Client = false
-			lres, err = loginerr(&lres, err, user, ip, throwErr2Client)
+			lres, err = loginerr(&lres, err, sessionData.Lang, user, ip, throwErr2Client)
 			return &lres, err
 		}
 
-		success, err := ValidateUserPassword(user, pass, ip)
-		if err != nil || (success != ValidationOK && success != ValidationTemporaryPassword) {
-			throwErr2Client = false
-			lres, err = loginerr(&lres, err, user, ip, throwErr2Client)
-			return &lres, err
-		}
+		auth, err := authenticate(&Credentials{Username: user, Password: pass, IP: ip})
+		if isCredentialsError(err) {
+			// answer each new failure slower, it makes guessing expensive
+			delay, rerr := recordLoginFailure(ip, user)
+			if rerr != nil {
+				audit.Log(rerr, "login-rate-limit", "Could not record the failed login", "user", user, "ip", ip)
+			}
 
-		if success == ValidationTemporaryPassword {
-			lres.TemporaryPassword = true
+			time.Sleep(delay)
 		}
 
-		var name string
-		var surname string
-
-		pq := dbutl.PQuery(`
-		    SELECT name, surname
-		      FROM "user"
-		     WHERE loweredusername = lower(?)
-		`, user)
-
-		err = db.QueryRow(pq.Query, pq.Args...).Scan(&name, &surname)
 		if err != nil {
-			lres, err = loginerr(&lres, err, user, ip, throwErr2Client)
+			throwErr2Client = false
+			lres, err = loginerr(&lres, err, sessionData.Lang, user, ip, throwErr2Client)
 			return &lres, err
 		}
 
-		sessionData, err = createSession(w, r, sessionData.Lang, user, name, surname, lres.TemporaryPassword)
+		err = resetLoginFailures(ip, user)
 		if err != nil {
-			lres, err = loginerr(&lres, err, user, ip, throwErr2Client)
-			return &lres, err
+			audit.Log(err, "login-rate-limit", "Could not reset the failed logins", "user", user, "ip", ip)
 		}
 
-		dt := time.Now().UTC()
+		lres.TemporaryPassword = auth.TemporaryPassword
+		provider = auth.Provider
 
-		pq = dbutl.PQuery(`
-		    UPDATE "user"
-		       SET last_connect_time = ?,
-		           last_connect_ip   = ?
-		     WHERE loweredusername = lower(?)
-		`, dt,
-			ip,
-			user)
-
-		_, err = dbutl.Exec(pq)
+		userSession, err := startUserSession(w, r, sessionData, auth.Username, ip, lres.TemporaryPassword)
 		if err != nil {
-			lres, err = loginerr(&lres, err, user, ip, throwErr2Client)
+			lres, err = loginerr(&lres, err, sessionData.Lang, user, ip, throwErr2Client)
 			return &lres, err
 		}
+
+		sessionData = userSession
 	}
 
 	lres.BError = false
 	audit.Log(nil, "login", "User logged in.",
 		"user", sessionData.User.Username,
 		"ip", ip,
+		"provider", provider,
 		"Temporary Password", lres.TemporaryPassword)
 
 	return &lres, nil
 }
 
+// LoginOIDC - send the browser to the OpenID Connect provider
+func (HomeController) LoginOIDC(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	lang := requestLanguage(r)
+
+	if !config.OIDC.Enabled {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "oidc.disabled")
+		audit.Log(err, "login", err.Error(), "ip", getClientIP(r))
+		return &lres, nil
+	}
+
+	authURL, err := oidcAuthorizationURL(w, r)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "oidc.failed", config.OIDC.Name)
+		audit.Log(err, "login", "Could not start the OpenID Connect login", "ip", getClientIP(r))
+		return &lres, nil
+	}
+
+	lres.SetURL(authURL)
+
+	return &lres, nil
+}
+
+// LoginOIDCCallback - the provider sends the browser back here with the authorization code
+func (HomeController) LoginOIDCCallback(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.LoginResponseModel, error) {
+	var lres models.LoginResponseModel
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	ip := getClientIP(r)
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+
+	if !config.OIDC.Enabled {
+		lres.BError = true
+		lres.SError = translate(lang, "oidc.disabled")
+		audit.Log(nil, "login", "OpenID Connect login is disabled", "ip", ip)
+		return &lres, nil
+	}
+
+	auth, err := authenticate(&Credentials{Request: r, Response: w, IP: ip})
+	if err != nil {
+		lres.BError = true
+		if _, ok := err.(*localizedError); ok {
+			lres.SError = translateError(lang, err)
+		} else if isCredentialsError(err) {
+			lres.SError = translate(lang, "login.failed")
+		} else {
+			lres.SError = translate(lang, "oidc.failed", config.OIDC.Name)
+		}
+		audit.Log(err, "login", translate(auditLanguage, "login.failed"), "ip", ip, "provider", config.OIDC.Issuer)
+		return &lres, nil
+	}
+
+	userSession, err := startUserSession(w, r, sessionData, auth.Username, ip, false)
+	if err != nil {
+		lres, err = loginerr(&lres, err, lang, auth.Username, ip, false)
+		return &lres, err
+	}
+
+	lres.BError = false
+	audit.Log(nil, "login", "User logged in.",
+		"user", userSession.User.Username,
+		"ip", ip,
+		"provider", config.OIDC.Issuer)
+
+	return &lres, nil
+}
+
 func loginerr(lres *models.LoginResponseModel,
 	errLogin error,
+	lang string,
 	user string,
 	ip string,
 	throwErr2Client bool) (models.LoginResponseModel, error) {
@@ -151,12 +219,12 @@ func loginerr(lres *models.LoginResponseModel,
 			err = fmt.Errorf("Unknown error")
 		}
 
-		lres.SError = err.Error()
+		lres.SError = translateError(lang, err)
 	} else {
-		lres.SError = "Unknown user or wrong password."
+		lres.SError = translate(lang, "login.failed")
 	}
 
-	audit.Log(err, "login", lres.SError,
+	audit.Log(err, "login", translate(auditLanguage, "login.failed"),
 		"user", user,
 		"ip", ip,
 		"Temporary Password", lres.TemporaryPassword,
@@ -188,6 +256,12 @@ func (HomeController) Logout(w http.ResponseWriter, r *http.Request, res *Respon
 			audit.Log(err, "logout", lres.SError, "user", user)
 			return nil, err
 		}
+
+		// the administrator leaves too
+		if sessionData.Impersonating() {
+			audit.Log(nil, "impersonation-stop", "Impersonation ended by logout", "user", user, "admin", sessionData.RealUser.Username, "ip", getClientIP(r))
+			user = sessionData.RealUser.Username
+		}
 	}
 
 	audit.Log(nil, "logout", "User logged out.", "user", user)
@@ -195,6 +269,95 @@ func (HomeController) Logout(w http.ResponseWriter, r *http.Request, res *Respon
 	return &lres, nil
 }
 
+// StopImpersonation - back to the session of the administrator
+func (HomeController) StopImpersonation(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+	var err error
+
+	if res != nil {
+		lres.SSuccessURL = res.RedirectURL
+		lres.SErrorURL = res.RedirectOnError
+	}
+
+	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
+	ip := getClientIP(r)
+
+	if !sessionData.Impersonating() {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "impersonation.not-started")
+		audit.Log(err, "impersonation", err.Error(), "user", sessionData.User.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	_, err = stopImpersonation(w, r, sessionData)
+	if err != nil {
+		lres.BError = true
+		lres.SError = translate(lang, "impersonation.failed")
+		audit.Log(err, "impersonation", "Could not stop the impersonation", "user", sessionData.User.Username, "admin", sessionData.RealUser.Username, "ip", ip)
+
+		return &lres, nil
+	}
+
+	audit.Log(nil, "impersonation-stop", "Impersonation stopped", "user", sessionData.User.Username, "admin", sessionData.RealUser.Username, "ip", ip)
+
+	lres.BError = false
+
+	return &lres, nil
+}
+
+// SetLanguage - language of the pages, kept in the session and in the user profile
+func (HomeController) SetLanguage(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
+	var lres models.GenericResponseModel
+
+	lres.SetURL(localRedirectURL(r))
+
+	sessionData, err := getSessionData(r)
+	if err != nil || sessionData == nil {
+		lres.BError = true
+		lres.SError, err = trErr(requestLanguage(r), "request.failed")
+		audit.Log(err, "set-language", err.Error())
+		return &lres, nil
+	}
+
+	lang := strings.ToUpper(r.FormValue("lang"))
+
+	if !isSupportedLanguage(lang) {
+		lres.BError = true
+		lres.SError, err = trErr(sessionData.Lang, "language.unknown", lang)
+		audit.Log(err, "set-language", err.Error(), "user", sessionData.User.Username)
+		return &lres, nil
+	}
+
+	sessionData.Lang = lang
+	sessionData.LangChosen = true
+
+	// API token requests have no session to save
+	if sessionData.APITokenID <= 0 {
+		err = refreshSessionData(w, r, *sessionData)
+		if err != nil {
+			lres.BError = true
+			lres.SError = err.Error()
+			audit.Log(err, "set-language", lres.SError, "user", sessionData.User.Username)
+			return &lres, nil
+		}
+	}
+
+	// the profile of an impersonated user is theirs
+	if sessionData.LoggedIn && !sessionData.Impersonating() {
+		err = setUserLanguage(sessionData.User.Username, lang)
+		if err != nil {
+			lres.BError = true
+			lres.SError = err.Error()
+			audit.Log(err, "set-language", lres.SError, "user", sessionData.User.Username)
+			return &lres, nil
+		}
+	}
+
+	return &lres, nil
+}
+
 // Register - register
 func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.GenericResponseModel, error) {
 	var lres models.GenericResponseModel
@@ -205,6 +368,7 @@ func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *Resp
 		lres.SErrorURL = res.RedirectOnError
 	}
 
+	lang := requestLanguage(r)
 	user := r.FormValue("username")
 	pass := r.FormValue("password")
 	confirmPass := r.FormValue("confirm_password")
@@ -214,27 +378,24 @@ func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *Resp
 
 	if len(user) == 0 {
 		lres.BError = true
-		lres.SError = "User is empty"
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "register", lres.SError, "user", user, "email", email)
+		lres.SError, err = trErr(lang, "register.user-empty")
+		audit.Log(err, "register", err.Error(), "user", user, "email", email)
 
 		return &lres, nil
 	}
 
 	if len(pass) == 0 || pass != confirmPass {
 		lres.BError = true
-		lres.SError = "Password is empty or is different from it's confirmation."
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "register", lres.SError, "user", user, "email", email)
+		lres.SError, err = trErr(lang, "password.confirmation-mismatch")
+		audit.Log(err, "register", err.Error(), "user", user, "email", email)
 
 		return &lres, nil
 	}
 
 	if len(email) == 0 {
 		lres.BError = true
-		lres.SError = "E-mail is empty"
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "register", lres.SError, "user", user, "email", email)
+		lres.SError, err = trErr(lang, "register.email-empty")
+		audit.Log(err, "register", err.Error(), "user", user, "email", email)
 
 		return &lres, nil
 	}
@@ -242,9 +403,8 @@ func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *Resp
 	tx, err := db.Begin()
 	if err != nil {
 		lres.BError = true
-		lres.SError = "Could not save the user"
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "register", lres.SError, "user", user, "email", email)
+		lres.SError, err = trErr(lang, "register.save-failed")
+		audit.Log(err, "register", err.Error(), "user", user, "email", email)
 		return &lres, nil
 	}
 	defer tx.Rollback()
@@ -270,8 +430,8 @@ func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *Resp
 
 	if err != nil {
 		lres.BError = true
-		lres.SError = err.Error()
-		audit.Log(err, "register", lres.SError, "user", user, "email", email)
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "register", err.Error(), "user", user, "email", email)
 
 		return &lres, err
 	}
@@ -283,7 +443,6 @@ func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *Resp
 		if err == nil {
 			err = u.Activate()
 			err = u.SetUnlimited()
-			err = u.AddToRole("Member")
 		}
 	} else {
 		err = u.AddToRole("Member")
@@ -295,17 +454,57 @@ func (HomeController) Register(w http.ResponseWriter, r *http.Request, res *Resp
 
 	if err != nil {
 		lres.BError = true
-		lres.SError = err.Error()
-		audit.Log(err, "register", lres.SError, "user", user, "email", email)
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "register", err.Error(), "user", user, "email", email)
 
 		return &lres, err
 	}
 
 	lres.BError = false
-	lres.SError = "User registered"
-	audit.Log(nil, "register", lres.SError, "user", user, "email", email)
+	lres.SError = translate(lang, "register.done")
+	audit.Log(nil, "register", translate(auditLanguage, "register.done"), "user", user, "email", email)
 
 	tx.Commit()
+	invalidateAccessCache()
+
+	return &lres, nil
+}
+
+// PasswordStrength - strength of the password being typed in the register and change password forms
+func (HomeController) PasswordStrength(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.PasswordStrengthResponseModel, error) {
+	var lres models.PasswordStrengthResponseModel
+
+	lang := requestLanguage(r)
+	userInputs := []string{
+		r.FormValue("username"),
+		r.FormValue("name"),
+		r.FormValue("surname"),
+		r.FormValue("email"),
+	}
+
+	sessionData, err := getSessionData(r)
+	if err == nil && sessionData.LoggedIn {
+		userInputs = append(userInputs,
+			sessionData.User.Username,
+			sessionData.User.Name,
+			sessionData.User.Surname)
+	}
+
+	strength := estimatePasswordStrength(r.FormValue("password"), userInputs...)
+
+	lres.Score = strength.Score
+	lres.MinScore = config.PasswordRules.MinStrengthScore
+	lres.Acceptable = strength.Score >= lres.MinScore
+	lres.GuessesLog10 = strength.GuessesLog10
+	lres.Label = translate(lang, fmt.Sprintf("strength.score-%d", strength.Score))
+
+	if len(strength.Warning) > 0 {
+		lres.Warning = translate(lang, strength.Warning)
+	}
+
+	for _, s := range strength.Suggestions {
+		lres.Suggestions = append(lres.Suggestions, translate(lang, s))
+	}
 
 	return &lres, nil
 }
@@ -321,12 +520,12 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 	}
 
 	sessionData, _ := getSessionData(r)
+	lang := sessionData.Lang
 
 	if !sessionData.LoggedIn {
 		lres.BError = true
-		lres.SError = "User not logged in."
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "change-password", lres.SError, "user", "", "email", "")
+		lres.SError, err = trErr(lang, "change-password.not-logged-in")
+		audit.Log(err, "change-password", err.Error(), "user", "", "email", "")
 
 		return &lres, nil
 	}
@@ -334,9 +533,8 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 	tx, err := db.Begin()
 	if err != nil {
 		lres.BError = true
-		lres.SError = "Could not change the password"
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "change-password", lres.SError, "user", sessionData.User.Username, "email", "")
+		lres.SError, err = trErr(lang, "change-password.failed")
+		audit.Log(err, "change-password", err.Error(), "user", sessionData.User.Username, "email", "")
 		return &lres, nil
 	}
 	defer tx.Rollback()
@@ -348,8 +546,16 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 
 	if err != nil {
 		lres.BError = true
-		lres.SError = err.Error()
-		audit.Log(err, "change-password", lres.SError, "user", "", "email", "")
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "change-password", err.Error(), "user", "", "email", "")
+
+		return &lres, nil
+	}
+
+	if usr.IsDelegated() {
+		lres.BError = true
+		lres.SError, err = trErr(lang, "password.delegated", usr.PasswordSource)
+		audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 		return &lres, nil
 	}
@@ -360,27 +566,24 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 
 	if len(pass) == 0 {
 		lres.BError = true
-		lres.SError = "Old password cannot be empty"
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+		lres.SError, err = trErr(lang, "change-password.old-empty")
+		audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 		return &lres, nil
 	}
 
 	if len(newPass) == 0 || newPass != confirmPass {
 		lres.BError = true
-		lres.SError = "Password is empty or is different from it's confirmation."
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+		lres.SError, err = trErr(lang, "password.confirmation-mismatch")
+		audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 		return &lres, nil
 	}
 
 	if pass == newPass {
 		lres.BError = true
-		lres.SError = "The new password must be different from the current one."
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+		lres.SError, err = trErr(lang, "change-password.same")
+		audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 		return &lres, nil
 	}
@@ -391,9 +594,8 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 
 	if success != ValidationOK && success != ValidationTemporaryPassword {
 		lres.BError = true
-		lres.SError = "Old password is not valid."
-		err = fmt.Errorf(lres.SError)
-		audit.Log(err, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+		lres.SError, err = trErr(lang, "change-password.old-invalid")
+		audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 		return &lres, nil
 	}
@@ -404,8 +606,8 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 
 	if err != nil {
 		lres.BError = true
-		lres.SError = err.Error()
-		audit.Log(err, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+		lres.SError = translateError(lang, err)
+		audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 		return &lres, err
 	}
@@ -416,16 +618,16 @@ func (HomeController) ChangePassword(w http.ResponseWriter, r *http.Request, res
 		err = refreshSessionData(w, r, *sessionData)
 		if err != nil {
 			lres.BError = true
-			lres.SError = err.Error()
-			audit.Log(err, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+			lres.SError = translateError(lang, err)
+			audit.Log(err, "change-password", err.Error(), "user", usr.Username, "email", usr.Email)
 
 			return &lres, err
 		}
 	}
 
 	lres.BError = false
-	lres.SError = "User password changed"
-	audit.Log(nil, "change-password", lres.SError, "user", usr.Username, "email", usr.Email)
+	lres.SError = translate(lang, "change-password.done")
+	audit.Log(nil, "change-password", translate(auditLanguage, "change-password.done"), "user", usr.Username, "email", usr.Email)
 
 	tx.Commit()
 
@@ -462,7 +664,8 @@ func (HomeController) Users(w http.ResponseWriter, r *http.Request, res *Respons
 			   last_update,
 			   activated,
 			   locked_out,
-			   valid
+			   valid,
+			   password_source
 		  FROM "user"
 		 ORDER BY name,
 				  surname,
@@ -491,6 +694,20 @@ func (HomeController) Users(w http.ResponseWriter, r *http.Request, res *Respons
 	return &lres, nil
 }
 
+// OpenAPI - OpenAPI document of the JSON requests
+func (HomeController) OpenAPI(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.OpenAPIResponseModel, error) {
+	var lres models.OpenAPIResponseModel
+
+	doc, err := buildOpenAPIDocument()
+	if err != nil {
+		return nil, err
+	}
+
+	lres.Document = doc
+
+	return &lres, nil
+}
+
 // GetExchangeRates - get exchange rates
 func (HomeController) GetExchangeRates(w http.ResponseWriter, r *http.Request, res *ResponseHelper) (*models.ExchangeRatesResponseModel, error) {
 	var lres models.ExchangeRatesResponseModel
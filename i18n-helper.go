@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// auditLanguage - language of the messages written to the audit log
+const auditLanguage = "EN"
+
+// messageCatalog - translated messages of one language, from i18n/<lang>.json
+type messageCatalog struct {
+	Language string            `json:"language"`
+	Name     string            `json:"name"`
+	Messages map[string]string `json:"messages"`
+}
+
+var (
+	catalogs         = make(map[string]*messageCatalog)
+	catalogLanguages []*messageCatalog
+)
+
+// loadMessageCatalogs - read every *.json catalog in dir
+func loadMessageCatalogs(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*messageCatalog)
+	var languages []*messageCatalog
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var c messageCatalog
+
+		err = json.Unmarshal(b, &c)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		c.Language = strings.ToUpper(c.Language)
+		if len(c.Language) == 0 {
+			return fmt.Errorf("%s: language is empty", file)
+		}
+
+		if _, ok := loaded[c.Language]; ok {
+			return fmt.Errorf("%s: duplicate catalog for language \"%s\"", file, c.Language)
+		}
+
+		loaded[c.Language] = &c
+		languages = append(languages, &c)
+	}
+
+	lang := strings.ToUpper(config.I18n.DefaultLanguage)
+	if _, ok := loaded[lang]; !ok {
+		return fmt.Errorf("no message catalog for the default language \"%s\" in %s", lang, dir)
+	}
+
+	sort.Slice(languages, func(i, j int) bool {
+		return languages[i].Language < languages[j].Language
+	})
+
+	catalogs = loaded
+	catalogLanguages = languages
+
+	return nil
+}
+
+func isSupportedLanguage(lang string) bool {
+	_, ok := catalogs[strings.ToUpper(lang)]
+	return ok
+}
+
+// translate - message key in lang, falling back to the default language and then to the key itself
+func translate(lang string, key string, args ...interface{}) string {
+	msg, ok := lookupMessage(lang, key)
+	if !ok {
+		msg, ok = lookupMessage(config.I18n.DefaultLanguage, key)
+	}
+	if !ok {
+		msg = key
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+
+	return msg
+}
+
+func lookupMessage(lang string, key string) (string, bool) {
+	c, ok := catalogs[strings.ToUpper(lang)]
+	if !ok {
+		return "", false
+	}
+
+	msg, ok := c.Messages[key]
+	return msg, ok
+}
+
+// localizedError - error whose message comes from the catalogs.
+// Error() is the audit language text, the user gets it translated with translateError.
+type localizedError struct {
+	key  string
+	args []interface{}
+}
+
+func newLocalizedError(key string, args ...interface{}) error {
+	return &localizedError{key: key, args: args}
+}
+
+func (e *localizedError) Error() string {
+	return translate(auditLanguage, e.key, e.args...)
+}
+
+// translateError - err for the user, in lang when it is a localizedError
+func translateError(lang string, err error) string {
+	if lerr, ok := err.(*localizedError); ok {
+		return translate(lang, lerr.key, lerr.args...)
+	}
+
+	return err.Error()
+}
+
+// trErr - message for the user and the same message as an error for the audit log
+func trErr(lang string, key string, args ...interface{}) (string, error) {
+	err := newLocalizedError(key, args...)
+	return translateError(lang, err), err
+}
+
+// negotiateLanguage - best supported language of an Accept-Language header
+func negotiateLanguage(acceptLanguage string) string {
+	best := strings.ToUpper(config.I18n.DefaultLanguage)
+	bestQ := 0.0
+
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+
+		// ro-RO, ro_RO -> RO
+		subtags := strings.FieldsFunc(tag, func(r rune) bool {
+			return r == '-' || r == '_'
+		})
+		if len(subtags) == 0 {
+			continue
+		}
+		lang := strings.ToUpper(subtags[0])
+
+		if q > bestQ && isSupportedLanguage(lang) {
+			best = lang
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// requestLanguage - language of the request's session
+func requestLanguage(r *http.Request) string {
+	sessionData, err := getSessionData(r)
+	if err != nil || sessionData == nil || len(sessionData.Lang) == 0 {
+		return strings.ToUpper(config.I18n.DefaultLanguage)
+	}
+
+	return sessionData.Lang
+}
+
+// getUserLanguage - language saved in the user profile ("" - none)
+func getUserLanguage(user string) (string, error) {
+	var lang string
+
+	pq := dbutl.PQuery(`
+	    SELECT CASE WHEN language IS NULL THEN '-' ELSE language END AS language
+	      FROM "user"
+	     WHERE loweredusername = lower(?)
+	`, user)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&lang)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	if lang == "-" || !isSupportedLanguage(lang) {
+		return "", nil
+	}
+
+	return strings.ToUpper(lang), nil
+}
+
+// setUserLanguage - save the language in the user profile
+func setUserLanguage(user string, lang string) error {
+	pq := dbutl.PQuery(`
+	    UPDATE "user"
+	       SET language = ?
+	     WHERE loweredusername = lower(?)
+	`, strings.ToUpper(lang),
+		user)
+
+	_, err := dbutl.Exec(pq)
+	return err
+}
+
+// localRedirectURL - path of the referring page when it is on this site
+func localRedirectURL(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || len(ref.Path) == 0 || (len(ref.Host) > 0 && ref.Host != r.Host) {
+		return "/"
+	}
+
+	if len(ref.RawQuery) > 0 {
+		return ref.Path + "?" + ref.RawQuery
+	}
+
+	return ref.Path
+}
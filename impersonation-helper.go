@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+)
+
+// An administrator may see the site as a member sees it: the session becomes the member's,
+// with the administrator kept in SessionData.RealUser until the impersonation is stopped.
+
+// Impersonating - an administrator uses the session of another user
+func (d SessionData) Impersonating() bool {
+	return len(d.RealUser.Username) > 0
+}
+
+// isImpersonationBlocked - the request may not be made while impersonating: only the requests marked
+// impersonation_allowed in access-rules.json may, the others would act in the name of someone else
+// and a new request is refused until it is looked at
+func isImpersonationBlocked(requestType string, url string) (bool, error) {
+	rules, err := getAccessRules(&accessCache.requestStats)
+	if err != nil {
+		return true, err
+	}
+
+	req, ok := rules.requests[accessRequestKey(requestType, requestURLKey(url))]
+
+	return !ok || req.ImpersonationAllowed != 1, nil
+}
+
+// startImpersonation - replace the session of the administrator with one of the user
+func startImpersonation(w http.ResponseWriter, r *http.Request, sessionData *SessionData, usr *MembershipUser) (*SessionData, error) {
+	// the temporary password of the user is theirs to change, not the administrator's
+	userSession, err := createSession(w, r, sessionData.Lang, sessionData.LangChosen, usr.Username, usr.Name, usr.Surname, false)
+	if err != nil {
+		return nil, err
+	}
+
+	userSession.RealUser = sessionData.User
+
+	err = refreshSessionData(w, r, *userSession)
+	if err != nil {
+		return nil, err
+	}
+
+	return userSession, nil
+}
+
+// stopImpersonation - give the administrator their own session back
+func stopImpersonation(w http.ResponseWriter, r *http.Request, sessionData *SessionData) (*SessionData, error) {
+	realUser := sessionData.RealUser
+
+	return createSession(w, r, sessionData.Lang, sessionData.LangChosen, realUser.Username, realUser.Name, realUser.Surname, realUser.TempPassword)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// useTestAccessRules - the cached access rules hold only requests, put back at the end of the test
+func useTestAccessRules(t *testing.T, requests ...*accessRequest) {
+	rules := &accessRules{
+		requests:        make(map[string]*accessRequest),
+		rolePermissions: make(map[int][]string),
+	}
+
+	for _, req := range requests {
+		rules.requests[accessRequestKey(req.Type, req.URL)] = req
+	}
+
+	accessCache.Lock()
+	oldRules := accessCache.rules
+	oldNextCheck := accessCache.nextCheck
+	accessCache.rules = rules
+	// no database to read access_change_counter from
+	accessCache.nextCheck = time.Now().UTC().Add(time.Hour)
+	accessCache.Unlock()
+
+	t.Cleanup(func() {
+		accessCache.Lock()
+		accessCache.rules = oldRules
+		accessCache.nextCheck = oldNextCheck
+		accessCache.Unlock()
+	})
+}
+
+// testImpersonatingRequest - a request carrying the session of admin impersonating user
+func testImpersonatingRequest(t *testing.T, method string, target string) *http.Request {
+	oldStore := cookieStore
+	cookieStore = sessions.NewCookieStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+
+	t.Cleanup(func() {
+		cookieStore = oldStore
+	})
+
+	sessionData := &SessionData{
+		Lang:     "EN",
+		LoggedIn: true,
+		User:     User{Username: "member"},
+		RealUser: User{Username: "admin"},
+	}
+
+	r := httptest.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+
+	session, _ := cookieStore.Get(r, authCookieStoreName)
+	session.Values["SessionData"] = sessionData
+
+	err := session.Save(r, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest(method, target, nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	return r
+}
+
+func TestImpersonationRefusesAccountExport(t *testing.T) {
+	useTestAccessRules(t,
+		&accessRequest{Type: "GET", URL: "profile", ImpersonationAllowed: 1},
+		&accessRequest{Type: "GET", URL: "account-export"},
+	)
+
+	r := testImpersonatingRequest(t, http.MethodGet, "/account-export")
+	w := httptest.NewRecorder()
+
+	handler(w, r)
+
+	res := w.Result()
+
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+
+	if location := res.Header.Get("Location"); location != "/" {
+		t.Errorf("redirected to %q, want /", location)
+	}
+
+	errReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range res.Cookies() {
+		errReq.AddCookie(c)
+	}
+
+	bErr, sErr, err := getLastOperationError(httptest.NewRecorder(), errReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bErr || sErr != translate("EN", "impersonation.blocked") {
+		t.Errorf("operation error = %v %q, want the impersonation error", bErr, sErr)
+	}
+}
+
+func TestImpersonationRefused(t *testing.T) {
+	useTestAccessRules(t,
+		&accessRequest{Type: "GET", URL: "profile", ImpersonationAllowed: 1},
+		&accessRequest{Type: "GET", URL: "account-export"},
+		&accessRequest{Type: "POST", URL: "profile"},
+	)
+
+	tests := []struct {
+		method  string
+		url     string
+		refused bool
+	}{
+		{http.MethodGet, "/profile", false},
+		{http.MethodGet, "/account-export", true},
+		{http.MethodGet, "/confirm-email", true},
+		{http.MethodPost, "/profile", true},
+	}
+
+	for _, tt := range tests {
+		r := testImpersonatingRequest(t, tt.method, tt.url)
+		sessionData, err := getSessionData(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		refused := isImpersonationRefused(httptest.NewRecorder(), r, tt.url, sessionData)
+		if refused != tt.refused {
+			t.Errorf("%s %s: refused = %v, want %v", tt.method, tt.url, refused, tt.refused)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 func initializeDatabase() error {
-	var err error
-	var foundNew bool
+	rules, err := loadAccessRules(config.AccessRules.File)
+	if err != nil {
+		return err
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -10,31 +12,35 @@ func initializeDatabase() error {
 	}
 	defer tx.Rollback()
 
-	if foundNew, err = addRequests(tx); foundNew || err != nil {
-		audit.Log(err, "initialize", "requests")
+	err = ensureAccessChangeCounter(tx)
+	if err != nil {
+		return err
 	}
 
-	if foundNew, err = addRoles(tx); foundNew || err != nil {
-		audit.Log(err, "initialize", "roles")
+	summary, err := rules.apply(tx)
+	if err != nil {
+		return err
 	}
 
-	if foundNew, err = addGetRequestsAccessRules(tx); foundNew || err != nil {
-		audit.Log(err, "initialize", "access rules - GET")
+	if summary.hasChanges() {
+		err = bumpAccessChangeCounter(tx)
+		if err != nil {
+			return err
+		}
 	}
 
-	if foundNew, err = addPostRequestsAccessRules(tx); foundNew || err != nil {
-		audit.Log(err, "initialize", "access rules - POST")
+	err = tx.Commit()
+	if err != nil {
+		return err
 	}
 
-	if foundNew, err = addGeneralMemberRequestsAccessRules(tx); foundNew || err != nil {
-		audit.Log(err, "initialize", "access rules - members")
-	}
+	invalidateAccessCache()
 
-	if foundNew, err = addChildRequestAccessRules(tx); foundNew || err != nil {
-		audit.Log(err, "initialize", "access rules - child requests")
+	if summary.hasChanges() {
+		audit.Log(nil, "initialize", "access rules applied",
+			"file", config.AccessRules.File,
+			"summary", summary)
 	}
 
-	tx.Commit()
-
-	return err
+	return nil
 }
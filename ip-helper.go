@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// trustedProxies - networks of the reverse proxies whose X-Forwarded-For is believed
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies - parse config.General.TrustedProxies, a comma separated list of ips and cidr ranges
+func loadTrustedProxies() error {
+	networks, err := parseNetworkList(config.General.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted-proxies: %v", err)
+	}
+
+	trustedProxies = networks
+
+	return nil
+}
+
+// parseIP - ip of an address, without port, brackets or zone; IPv4-mapped IPv6 addresses as IPv4
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+	if idx := strings.Index(addr, "%"); idx >= 0 {
+		addr = addr[:idx]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+// parseNetwork - an ip (a single host network) or a cidr range
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		ip, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\" is not a valid ip or cidr range", s)
+		}
+
+		// ::ffff:10.0.0.0/104 -> 10.0.0.0/8
+		if ip4 := ip.To4(); ip4 != nil && len(network.IP) == net.IPv6len {
+			ones, _ := network.Mask.Size()
+			if ones < 96 {
+				return nil, fmt.Errorf("\"%s\" is not a valid ip or cidr range", s)
+			}
+
+			network = &net.IPNet{IP: ip4.Mask(net.CIDRMask(ones-96, 32)), Mask: net.CIDRMask(ones-96, 32)}
+		}
+
+		return network, nil
+	}
+
+	ip := parseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("\"%s\" is not a valid ip or cidr range", s)
+	}
+
+	bits := 8 * len(ip)
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseNetworkList - comma separated ips and cidr ranges
+func parseNetworkList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, s := range strings.Split(list, ",") {
+		if len(strings.TrimSpace(s)) == 0 {
+			continue
+		}
+
+		network, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// normalizeNetwork - canonical text of an ip or cidr range, as kept in user_ip:
+// a single host as its ip (2001:db8::1), a range with the host bits cleared (10.1.0.0/16)
+func normalizeNetwork(s string) (string, error) {
+	network, err := parseNetwork(s)
+	if err != nil {
+		return "", err
+	}
+
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return network.IP.String(), nil
+	}
+
+	return network.String(), nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP - address of the client: the peer, or when the peer is a trusted proxy,
+// the nearest X-Forwarded-For entry that is not a trusted proxy
+func clientIP(remoteAddr string, forwardedFor string) net.IP {
+	ip := parseIP(remoteAddr)
+
+	if !networksContain(trustedProxies, ip) || len(strings.TrimSpace(forwardedFor)) == 0 {
+		return ip
+	}
+
+	hops := strings.Split(forwardedFor, ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if hop == nil {
+			// garbage in the header, do not go further back than what we can trust
+			return ip
+		}
+
+		ip = hop
+		if !networksContain(trustedProxies, hop) {
+			return hop
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Users with password_source "ldap" are checked by a bind to the directory:
+// the service account (bind-dn, or an anonymous bind) finds the entry of the user with user-filter,
+// then the password is verified by binding as that entry. The password is never kept here.
+
+// ldapUser - entry of a user whose password the directory accepted
+type ldapUser struct {
+	DN      string
+	Name    string
+	Surname string
+	Email   string
+	Groups  []string
+}
+
+// errLDAPInvalidCredentials - the directory refused the password, or does not know the user
+var errLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+
+func dialLDAP() (*ldap.Conn, error) {
+	timeout := time.Duration(config.LDAP.Timeout) * time.Second
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.LDAP.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(config.LDAP.URL,
+		ldap.DialWithTLSConfig(tlsConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(timeout)
+
+	if config.LDAP.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ldapAuthenticate - the entry of the user when the directory accepts the password
+func ldapAuthenticate(user string, pass string) (*ldapUser, error) {
+	// an empty password is an unauthenticated bind, which most servers accept
+	if len(pass) == 0 {
+		return nil, errLDAPInvalidCredentials
+	}
+
+	conn, err := dialLDAP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if len(config.LDAP.BindDN) > 0 {
+		err = conn.Bind(config.LDAP.BindDN, config.LDAP.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: service bind: %v", err)
+	}
+
+	attributes := []string{
+		config.LDAP.NameAttribute,
+		config.LDAP.SurnameAttribute,
+		config.LDAP.EmailAttribute,
+	}
+	if len(config.LDAP.GroupAttribute) > 0 {
+		attributes = append(attributes, config.LDAP.GroupAttribute)
+	}
+
+	search := ldap.NewSearchRequest(
+		config.LDAP.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, config.LDAP.Timeout, false,
+		strings.Replace(config.LDAP.UserFilter, "%s", ldap.EscapeFilter(user), -1),
+		attributes,
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldap: user search: %v", err)
+	}
+
+	if result == nil || len(result.Entries) == 0 {
+		return nil, errLDAPInvalidCredentials
+	}
+
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("ldap: user-filter matches more than one entry for \"%s\"", user)
+	}
+
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, pass)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, errLDAPInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: user bind: %v", err)
+	}
+
+	u := ldapUser{
+		DN:      entry.DN,
+		Name:    entry.GetAttributeValue(config.LDAP.NameAttribute),
+		Surname: entry.GetAttributeValue(config.LDAP.SurnameAttribute),
+		Email:   entry.GetAttributeValue(config.LDAP.EmailAttribute),
+	}
+
+	if len(config.LDAP.GroupAttribute) > 0 {
+		u.Groups = entry.GetAttributeValues(config.LDAP.GroupAttribute)
+	}
+
+	// directories without memberOf: look for the groups listing the user
+	if len(config.LDAP.GroupFilter) > 0 {
+		// the service account reads the groups, not every user may
+		if len(config.LDAP.BindDN) > 0 {
+			err = conn.Bind(config.LDAP.BindDN, config.LDAP.BindPassword)
+			if err != nil {
+				return nil, fmt.Errorf("ldap: service bind: %v", err)
+			}
+		}
+
+		groupBaseDN := config.LDAP.GroupBaseDN
+		if len(groupBaseDN) == 0 {
+			groupBaseDN = config.LDAP.BaseDN
+		}
+
+		search = ldap.NewSearchRequest(
+			groupBaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, config.LDAP.Timeout, false,
+			strings.Replace(config.LDAP.GroupFilter, "%s", ldap.EscapeFilter(entry.DN), -1),
+			[]string{"dn"},
+			nil,
+		)
+
+		result, err = conn.Search(search)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: group search: %v", err)
+		}
+
+		for _, group := range result.Entries {
+			u.Groups = append(u.Groups, group.DN)
+		}
+	}
+
+	return &u, nil
+}
+
+// ldapRoleMapping - role -> groups granting it, from the group-role elements of the config
+func ldapRoleMapping() map[string][]string {
+	mapping := make(map[string][]string)
+
+	for _, gr := range config.LDAP.GroupRoles {
+		group := strings.TrimSpace(gr.Group)
+		role := strings.TrimSpace(gr.Role)
+
+		if len(group) > 0 && len(role) > 0 {
+			mapping[role] = append(mapping[role], group)
+		}
+	}
+
+	return mapping
+}
+
+// ldapAuthenticator - users with password_source "ldap", and with auto-provision the unknown users
+// the directory accepts, who are created from their entry
+type ldapAuthenticator struct {
+}
+
+func (ldapAuthenticator) Name() string {
+	return PasswordSourceLDAP
+}
+
+func (ldapAuthenticator) Authenticate(c *Credentials) (*AuthResult, error) {
+	if len(c.Username) == 0 || len(c.Token) > 0 || c.Request != nil {
+		return nil, errAuthNotApplicable
+	}
+
+	source, err := c.passwordSource()
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := len(source) == 0
+	if source != PasswordSourceLDAP && !(unknown && config.LDAP.Enabled && config.LDAP.AutoProvision) {
+		return nil, errAuthNotApplicable
+	}
+
+	user := c.Username
+
+	if !config.LDAP.Enabled {
+		return nil, fmt.Errorf("username \"%s\" is delegated to ldap, which is not enabled", user)
+	}
+
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT u.user_id,
+	           activated,
+	           locked_out,
+	           CASE WHEN u.locked_until IS NULL THEN 0 ELSE 1 END AS lock_expires,
+	           CASE WHEN u.locked_until IS NULL THEN u.creation_time ELSE u.locked_until END AS locked_until,
+	           u.valid
+	      FROM "user" u
+	     WHERE loweredusername = lower(?)
+	`, user)
+
+	testUser := validateUserUtil{}
+	err = dbutl.RunQuery(pq, &testUser)
+
+	switch {
+	case err == sql.ErrNoRows:
+		testUser.UserID = -1
+	case err != nil:
+		return nil, err
+	}
+
+	if testUser.UserID > 0 {
+		err = checkUserCanLogin(nil, &testUser, user, c.IP, dt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entry, err := ldapAuthenticate(user, c.Password)
+	if err == errLDAPInvalidCredentials {
+		if testUser.UserID > 0 {
+			failedUserPasswordValidation(testUser.UserID, user)
+		}
+
+		return nil, refusedf("wrong password for \"%s\"", user)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	u := MembershipUser{tx: tx}
+
+	if testUser.UserID <= 0 {
+		err = provisionLDAPUser(&u, user, entry)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = u.GetByID(testUser.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = updateLDAPUser(&u, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rolesChanged, err := u.SyncMappedRoles(ldapRoleMapping(), entry.Groups, "ldap")
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if rolesChanged {
+		invalidateAccessCache()
+	}
+
+	return &AuthResult{
+		UserID:   u.UserID,
+		Username: u.Username,
+		Name:     u.Name,
+		Surname:  u.Surname,
+	}, nil
+}
+
+// provisionLDAPUser - new activated Member, delegated to the directory
+func provisionLDAPUser(u *MembershipUser, user string, entry *ldapUser) error {
+	u.UserID = -1
+	u.Username = user
+	u.Name = entry.Name
+	u.Surname = entry.Surname
+	u.Email = entry.Email
+	u.PasswordSource = PasswordSourceLDAP
+	u.Valid = true
+
+	err := u.Save()
+	if err != nil {
+		return err
+	}
+
+	err = u.AddToRole("Member")
+	if err != nil {
+		return err
+	}
+
+	err = u.Activate()
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, "ldap-provision", "User created from the directory", "user", u.Username, "dn", entry.DN)
+
+	return nil
+}
+
+// updateLDAPUser - the directory is the reference for the name, surname and email of delegated users
+func updateLDAPUser(u *MembershipUser, entry *ldapUser) error {
+	if len(entry.Name) > 0 {
+		u.Name = entry.Name
+	}
+
+	if len(entry.Surname) > 0 {
+		u.Surname = entry.Surname
+	}
+
+	if len(entry.Email) > 0 {
+		u.Email = entry.Email
+	}
+
+	return u.Save()
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testLDAPServiceDN   = "cn=service,dc=example,dc=com"
+	testLDAPServicePass = "service-secret"
+	testLDAPPeopleDN    = "ou=people,dc=example,dc=com"
+	testLDAPAdminsDN    = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+// testLDAPEntry - an entry of the directory; password is what a bind as dn needs
+type testLDAPEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// testLDAPServer - binds, searches and unbinds of a directory, in process; it remembers
+// the binds and the values the equality filters looked for
+type testLDAPServer struct {
+	listener net.Listener
+	t        *testing.T
+
+	mu        sync.Mutex
+	entries   []*testLDAPEntry
+	anonymous bool
+	binds     []string
+	equals    []string
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testLDAPServer{listener: listener, t: t}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testLDAPServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) add(dn string, password string, attributes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = append(s.entries, &testLDAPEntry{dn: dn, password: password, attributes: attributes})
+}
+
+// addPerson - a person of ou=people with the uid and groups (memberOf)
+func (s *testLDAPServer) addPerson(uid string, password string, groups ...string) string {
+	dn := "uid=" + ldap.EscapeDN(uid) + "," + testLDAPPeopleDN
+
+	s.add(dn, password, map[string][]string{
+		"objectClass": {"person"},
+		"uid":         {uid},
+		"givenName":   {"Given " + uid},
+		"sn":          {"Surname " + uid},
+		"mail":        {uid + "@example.com"},
+		"memberOf":    groups,
+	})
+
+	return dn
+}
+
+func (s *testLDAPServer) bindsOf(dn string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, bound := range s.binds {
+		if strings.EqualFold(bound, dn) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *testLDAPServer) equalityValues() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.equals...)
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		messageID, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.write(conn, testLDAPResult(messageID, ldap.ApplicationBindResponse, s.bind(op)))
+		case ldap.ApplicationSearchRequest:
+			for _, entry := range s.search(messageID, op) {
+				s.write(conn, entry)
+			}
+
+			s.write(conn, testLDAPResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) write(conn net.Conn, packet *ber.Packet) {
+	_, err := conn.Write(packet.Bytes())
+	if err != nil {
+		s.t.Log(err)
+	}
+}
+
+// bind - simple binds; an empty password is an unauthenticated bind, accepted as most servers do
+func (s *testLDAPServer) bind(op *ber.Packet) uint16 {
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.binds = append(s.binds, dn)
+
+	if len(password) == 0 {
+		if len(dn) == 0 && !s.anonymous {
+			return ldap.LDAPResultInappropriateAuthentication
+		}
+
+		return ldap.LDAPResultSuccess
+	}
+
+	for _, e := range s.entries {
+		if strings.EqualFold(e.dn, dn) {
+			if e.password == password {
+				return ldap.LDAPResultSuccess
+			}
+
+			break
+		}
+	}
+
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (s *testLDAPServer) search(messageID int64, op *ber.Packet) []*ber.Packet {
+	baseDN, _ := op.Children[0].Value.(string)
+	filter := op.Children[6]
+
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		if name, ok := a.Value.(string); ok {
+			attributes = append(attributes, name)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []*ber.Packet
+
+	for _, e := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(baseDN)) || !s.matches(e, filter) {
+			continue
+		}
+
+		found = append(found, testLDAPSearchEntry(messageID, e, attributes))
+	}
+
+	return found
+}
+
+// matches - and, or, not, equality and presence filters; enough for user-filter and group-filter
+func (s *testLDAPServer) matches(e *testLDAPEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, f := range filter.Children {
+			if !s.matches(e, f) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, f := range filter.Children {
+			if s.matches(e, f) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return !s.matches(e, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		name, _ := filter.Children[0].Value.(string)
+		value, _ := filter.Children[1].Value.(string)
+
+		s.equals = append(s.equals, value)
+
+		for _, v := range testLDAPValues(e, name) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterPresent:
+		return len(testLDAPValues(e, filter.Data.String())) > 0
+	}
+
+	s.t.Errorf("ldap test server: unsupported filter %s", ldap.FilterMap[uint64(filter.Tag)])
+	return false
+}
+
+func testLDAPValues(e *testLDAPEntry, name string) []string {
+	for attr, values := range e.attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+
+	return nil
+}
+
+func testLDAPResult(messageID int64, tag ber.Tag, code uint16) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	packet.AppendChild(result)
+
+	return packet
+}
+
+func testLDAPSearchEntry(messageID int64, e *testLDAPEntry, attributes []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+
+	for _, name := range attributes {
+		values := testLDAPValues(e, name)
+		if len(values) == 0 {
+			continue
+		}
+
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+
+	entry.AppendChild(list)
+	packet.AppendChild(entry)
+
+	return packet
+}
+
+// useTestLDAP - config.LDAP for the directory of s, put back at the end of the test
+func useTestLDAP(t *testing.T, s *testLDAPServer) {
+	old := config.LDAP
+
+	config.LDAP.Enabled = true
+	config.LDAP.URL = s.URL()
+	config.LDAP.StartTLS = false
+	config.LDAP.Timeout = 5
+	config.LDAP.BindDN = testLDAPServiceDN
+	config.LDAP.BindPassword = testLDAPServicePass
+	config.LDAP.BaseDN = testLDAPPeopleDN
+	config.LDAP.UserFilter = "(&(objectClass=person)(uid=%s))"
+	config.LDAP.NameAttribute = "givenName"
+	config.LDAP.SurnameAttribute = "sn"
+	config.LDAP.EmailAttribute = "mail"
+	config.LDAP.GroupAttribute = "memberOf"
+	config.LDAP.GroupBaseDN = ""
+	config.LDAP.GroupFilter = ""
+	config.LDAP.AutoProvision = false
+	config.LDAP.GroupRoles = nil
+
+	s.add(testLDAPServiceDN, testLDAPServicePass, map[string][]string{"cn": {"service"}})
+
+	t.Cleanup(func() {
+		config.LDAP = old
+	})
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	dn := s.addPerson("jdoe", "good-password", testLDAPAdminsDN)
+
+	u, err := ldapAuthenticate("jdoe", "good-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.DN != dn || u.Name != "Given jdoe" || u.Surname != "Surname jdoe" || u.Email != "jdoe@example.com" {
+		t.Errorf("unexpected entry %+v", u)
+	}
+
+	if len(u.Groups) != 1 || u.Groups[0] != testLDAPAdminsDN {
+		t.Errorf("groups %v", u.Groups)
+	}
+
+	if s.bindsOf(testLDAPServiceDN) != 1 || s.bindsOf(dn) != 1 {
+		t.Errorf("expected a service bind and a user bind, got %v", s.binds)
+	}
+
+	_, err = ldapAuthenticate("jdoe", "wrong-password")
+	if err != errLDAPInvalidCredentials {
+		t.Errorf("wrong password: got %v", err)
+	}
+
+	_, err = ldapAuthenticate("nobody", "good-password")
+	if err != errLDAPInvalidCredentials {
+		t.Errorf("unknown user: got %v", err)
+	}
+}
+
+func TestLDAPEmptyPassword(t *testing.T) {
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	dn := s.addPerson("jdoe", "good-password")
+
+	// the server would accept it as an unauthenticated bind
+	_, err := ldapAuthenticate("jdoe", "")
+	if err != errLDAPInvalidCredentials {
+		t.Errorf("empty password: got %v", err)
+	}
+
+	if s.bindsOf(dn) != 0 {
+		t.Error("bound with an empty password")
+	}
+}
+
+func TestLDAPServiceBind(t *testing.T) {
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	s.addPerson("jdoe", "good-password")
+
+	config.LDAP.BindPassword = "wrong"
+
+	_, err := ldapAuthenticate("jdoe", "good-password")
+	if err == nil || err == errLDAPInvalidCredentials || !strings.Contains(err.Error(), "service bind") {
+		t.Errorf("wrong service password: got %v", err)
+	}
+
+	// no bind-dn: an anonymous bind finds the user
+	config.LDAP.BindDN = ""
+	config.LDAP.BindPassword = ""
+
+	_, err = ldapAuthenticate("jdoe", "good-password")
+	if err == nil || !strings.Contains(err.Error(), "service bind") {
+		t.Errorf("anonymous bind refused by the server: got %v", err)
+	}
+
+	s.mu.Lock()
+	s.anonymous = true
+	s.mu.Unlock()
+
+	_, err = ldapAuthenticate("jdoe", "good-password")
+	if err != nil {
+		t.Errorf("anonymous bind: %v", err)
+	}
+}
+
+func TestLDAPFilterMatchesMoreThanOneEntry(t *testing.T) {
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	s.addPerson("jdoe", "good-password")
+	s.add("uid=jdoe,ou=contractors,"+testLDAPPeopleDN, "other-password", map[string][]string{
+		"objectClass": {"person"},
+		"uid":         {"jdoe"},
+	})
+
+	_, err := ldapAuthenticate("jdoe", "good-password")
+	if err == nil || !strings.Contains(err.Error(), "more than one entry") {
+		t.Errorf("two entries: got %v", err)
+	}
+
+	if s.bindsOf("uid=jdoe,"+testLDAPPeopleDN) != 0 {
+		t.Error("bound as one of two entries")
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	s.addPerson("jdoe", "good-password")
+	s.addPerson("odd(name)*", "odd-password")
+
+	// the special characters are looked for as they are
+	u, err := ldapAuthenticate("odd(name)*", "odd-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Name != "Given odd(name)*" {
+		t.Errorf("unexpected entry %+v", u)
+	}
+
+	// and do not change the filter: no wildcard, no extra condition
+	for _, user := range []string{"*", "jd*", "x)(uid=*", "jdoe)(|(uid=*"} {
+		_, err = ldapAuthenticate(user, "good-password")
+		if err != errLDAPInvalidCredentials {
+			t.Errorf("%s: got %v", user, err)
+		}
+	}
+
+	values := s.equalityValues()
+	for _, user := range []string{"odd(name)*", "*", "x)(uid=*"} {
+		if !containsString(values, user) {
+			t.Errorf("%s was not searched as a value: %v", user, values)
+		}
+	}
+}
+
+func TestLDAPGroupFilter(t *testing.T) {
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	dn := s.addPerson("o(ne)*", "good-password")
+	s.add(testLDAPAdminsDN, "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"member":      {dn},
+	})
+	s.add("cn=others,ou=groups,dc=example,dc=com", "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"member":      {"uid=someone," + testLDAPPeopleDN},
+	})
+
+	config.LDAP.GroupAttribute = ""
+	config.LDAP.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	config.LDAP.GroupFilter = "(&(objectClass=groupOfNames)(member=%s))"
+
+	u, err := ldapAuthenticate("o(ne)*", "good-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(u.Groups) != 1 || u.Groups[0] != testLDAPAdminsDN {
+		t.Errorf("groups %v", u.Groups)
+	}
+
+	// the groups are read as the service account
+	if s.bindsOf(testLDAPServiceDN) != 2 {
+		t.Errorf("expected two service binds, got %v", s.binds)
+	}
+}
+
+func TestLDAPRoleMapping(t *testing.T) {
+	old := config.LDAP.GroupRoles
+	defer func() { config.LDAP.GroupRoles = old }()
+
+	config.LDAP.GroupRoles = []ConfigurationLDAPGroupRole{
+		{Group: testLDAPAdminsDN, Role: "Administrator"},
+		{Group: " cn=ops,ou=groups,dc=example,dc=com ", Role: " Administrator "},
+		{Group: "", Role: "Member"},
+	}
+
+	mapping := ldapRoleMapping()
+
+	if got := mapping["Administrator"]; len(got) != 2 || got[1] != "cn=ops,ou=groups,dc=example,dc=com" {
+		t.Errorf("Administrator: %v", got)
+	}
+
+	if _, ok := mapping["Member"]; ok {
+		t.Error("a mapping without group")
+	}
+}
+
+// testLDAPLogin - the ldap provider of the authentication chain
+func testLDAPLogin(user string, pass string) (*AuthResult, error) {
+	return ldapAuthenticator{}.Authenticate(&Credentials{
+		Username: user,
+		Password: pass,
+		IP:       "127.0.0.1",
+	})
+}
+
+func TestLDAPSyncMappedRoles(t *testing.T) {
+	requireTestDatabase(t)
+
+	s := newTestLDAPServer(t)
+	useTestLDAP(t, s)
+
+	config.LDAP.AutoProvision = true
+	config.LDAP.GroupRoles = []ConfigurationLDAPGroupRole{
+		{Group: testLDAPAdminsDN, Role: "Administrator"},
+	}
+
+	username := testName("ldap-roles-")
+	s.addPerson(username, "good-password", strings.ToUpper(testLDAPAdminsDN))
+
+	res, err := testLDAPLogin(username, "good-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !testHasRole(t, res.UserID, "Administrator") || !testHasRole(t, res.UserID, "Member") {
+		t.Error("provisioned without Administrator and Member")
+	}
+
+	// out of the group: the mapped role goes, the others stay
+	s.mu.Lock()
+	for _, e := range s.entries {
+		if e.attributes["uid"] != nil && e.attributes["uid"][0] == username {
+			e.attributes["memberOf"] = nil
+		}
+	}
+	s.mu.Unlock()
+
+	res, err = testLDAPLogin(username, "good-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if testHasRole(t, res.UserID, "Administrator") {
+		t.Error("Administrator kept out of the group")
+	}
+
+	if !testHasRole(t, res.UserID, "Member") {
+		t.Error("Member removed by the sync")
+	}
+
+	_, err = testLDAPLogin(username, "wrong-password")
+	if !isCredentialsError(err) {
+		t.Errorf("wrong password: got %v", err)
+	}
+}
+
+func TestLDAPDelegatedPassword(t *testing.T) {
+	requireTestDatabase(t)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// no password and none of the password rules for a delegated user
+	u := MembershipUser{tx: tx}
+	u.UserID = -1
+	u.Username = testName("ldap-delegated-")
+	u.Name = "Delegated"
+	u.Surname = "User"
+	u.Email = u.Username + "@example.com"
+	u.PasswordSource = PasswordSourceLDAP
+	u.Valid = true
+
+	err = u.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a password given with the other details is not kept
+	u.Name = "Changed"
+	u.Password = "x"
+
+	err = u.Save()
+	if err != nil {
+		t.Fatalf("save with a password: %v", err)
+	}
+
+	passwords := -1
+
+	pq := dbutl.PQuery(`
+	    SELECT COUNT(*)
+	      FROM user_password
+	     WHERE user_id = ?
+	`, u.UserID)
+
+	err = tx.QueryRow(pq.Query, pq.Args...).Scan(&passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if passwords != 0 {
+		t.Errorf("%d passwords kept for a delegated user", passwords)
+	}
+
+	err = u.SetTemporaryPassword("Temporary-Passw0rd!")
+	if lerr, ok := err.(*localizedError); !ok || lerr.key != "password.delegated" {
+		t.Errorf("temporary password: got %v", err)
+	}
+
+	// a local user still needs a password
+	local := MembershipUser{tx: tx}
+	local.UserID = -1
+	local.Username = testName("ldap-local-")
+	local.Name = "Local"
+	local.Surname = "User"
+	local.Email = local.Username + "@example.com"
+	local.Valid = true
+
+	err = local.Save()
+	if lerr, ok := err.(*localizedError); !ok || lerr.key != "user.empty-password" {
+		t.Errorf("local user without password: got %v", err)
+	}
+}
@@ -25,15 +25,25 @@ type User struct {
 
 // SessionData - session data
 type SessionData struct {
-	Lang      string
-	LoggedIn  bool
-	SessionID string
-	User      User
+	Lang       string
+	LangChosen bool
+	LoggedIn   bool
+	SessionID  string
+	User       User
+	APITokenID int
+	// RealUser - the administrator impersonating User; empty otherwise
+	RealUser User
 }
 
 func clearSession(w http.ResponseWriter, r *http.Request) error {
 	session, _ := cookieStore.Get(r, authCookieStoreName)
-	sessionData := SessionData{Lang: "EN"}
+	sessionData := SessionData{Lang: config.I18n.DefaultLanguage}
+
+	// keep the language the user picked
+	if old, ok := session.Values["SessionData"].(*SessionData); ok && old.LangChosen {
+		sessionData.Lang = old.Lang
+		sessionData.LangChosen = true
+	}
 
 	session.Values["SessionData"] = sessionData
 
@@ -46,7 +56,7 @@ func clearSession(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func createSession(w http.ResponseWriter, r *http.Request, lang string, user string, name string, surname string, tempPassword bool) (*SessionData, error) {
+func createSession(w http.ResponseWriter, r *http.Request, lang string, langChosen bool, user string, name string, surname string, tempPassword bool) (*SessionData, error) {
 	session, _ := cookieStore.Get(r, authCookieStoreName)
 
 	sessionID, err := uuid.NewV4()
@@ -55,9 +65,10 @@ func createSession(w http.ResponseWriter, r *http.Request, lang string, user str
 	}
 
 	sessionData := SessionData{
-		Lang:      lang,
-		LoggedIn:  true,
-		SessionID: sessionID.String(),
+		Lang:       lang,
+		LangChosen: langChosen,
+		LoggedIn:   true,
+		SessionID:  sessionID.String(),
 		User: User{
 			Name:         name,
 			Surname:      surname,
@@ -74,6 +85,60 @@ func createSession(w http.ResponseWriter, r *http.Request, lang string, user str
 	return &sessionData, nil
 }
 
+// startUserSession - session of a user whose credentials were checked; records the connection time and ip
+func startUserSession(w http.ResponseWriter, r *http.Request, sessionData *SessionData, user string, ip string, tempPassword bool) (*SessionData, error) {
+	var name string
+	var surname string
+
+	pq := dbutl.PQuery(`
+	    SELECT name, surname
+	      FROM "user"
+	     WHERE loweredusername = lower(?)
+	`, user)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&name, &surname)
+	if err != nil {
+		return nil, err
+	}
+
+	// the language saved in the profile wins over the one of the anonymous session
+	lang := sessionData.Lang
+	langChosen := sessionData.LangChosen
+
+	userLang, err := getUserLanguage(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(userLang) > 0 {
+		lang = userLang
+		langChosen = true
+	}
+
+	userSession, err := createSession(w, r, lang, langChosen, user, name, surname, tempPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	dt := time.Now().UTC()
+
+	pq = dbutl.PQuery(`
+	    UPDATE "user"
+	       SET last_connect_time = ?,
+	           last_connect_ip   = ?
+	     WHERE loweredusername = lower(?)
+	`, dt,
+		ip,
+		user)
+
+	_, err = dbutl.Exec(pq)
+	if err != nil {
+		return nil, err
+	}
+
+	return userSession, nil
+}
+
 func refreshSessionData(w http.ResponseWriter, r *http.Request, sessionData SessionData) error {
 	session, _ := cookieStore.Get(r, authCookieStoreName)
 
@@ -100,11 +165,17 @@ func saveSessionData(w http.ResponseWriter, r *http.Request,
 }
 
 func getSessionData(r *http.Request) (*SessionData, error) {
+	// requests authenticated by API token carry no session cookie
+	if data, ok := r.Context().Value(apiTokenSessionKey).(*SessionData); ok {
+		return data, nil
+	}
+
 	session, _ := cookieStore.Get(r, authCookieStoreName)
 
 	// Retrieve our struct and type-assert it
 	val := session.Values["SessionData"]
-	var sessionData = &SessionData{Lang: "EN"}
+	acceptLanguage := r.Header.Get("Accept-Language")
+	var sessionData = &SessionData{Lang: negotiateLanguage(acceptLanguage)}
 
 	if val == nil {
 		return sessionData, nil
@@ -116,6 +187,10 @@ func getSessionData(r *http.Request) (*SessionData, error) {
 		return nil, nil
 	}
 
+	if !data.LangChosen {
+		data.Lang = negotiateLanguage(acceptLanguage)
+	}
+
 	return data, nil
 }
 
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per ip, per username and per ip + username in a sliding window.
+// Reaching a limit refuses the next logins with 429 until enough failures leave the window;
+// below the limits each failure is answered slower than the previous one.
+
+// loginAttemptStore - where the failed logins are kept
+type loginAttemptStore interface {
+	// record - one failed login for each key
+	record(keys []string, at time.Time) error
+	// count - failures of key since the moment, and the oldest of them
+	count(key string, since time.Time) (int, time.Time, error)
+	// reset - forget the failures of key
+	reset(key string) error
+	// prune - forget the failures older than the moment
+	prune(before time.Time) error
+}
+
+// loginLimit - one of the limits and the key it counts failures by
+type loginLimit struct {
+	name string
+	key  string
+	max  int
+}
+
+var (
+	loginAttempts     loginAttemptStore
+	loginAttemptsLock sync.Mutex
+	nextLoginPrune    time.Time
+)
+
+// initLoginRateLimit - choose the store of the failed logins, from config.LoginRateLimit.Storage
+func initLoginRateLimit() error {
+	switch config.LoginRateLimit.Storage {
+	case "memory":
+		loginAttempts = &memoryLoginAttempts{attempts: make(map[string][]time.Time)}
+	case "database":
+		loginAttempts = &dbLoginAttempts{}
+	default:
+		return fmt.Errorf("login-rate-limit: unknown storage \"%s\" (memory or database)", config.LoginRateLimit.Storage)
+	}
+
+	return nil
+}
+
+func loginLimits(ip string, user string) []*loginLimit {
+	user = strings.ToLower(strings.TrimSpace(user))
+
+	limits := []*loginLimit{
+		{"ip", "ip:" + ip, config.LoginRateLimit.MaxPerIP},
+	}
+
+	if len(user) > 0 {
+		limits = append(limits,
+			&loginLimit{"user", "user:" + user, config.LoginRateLimit.MaxPerUser},
+			&loginLimit{"ip-user", "ip-user:" + ip + "|" + user, config.LoginRateLimit.MaxPerIPUser},
+		)
+	}
+
+	return limits
+}
+
+func loginWindow() time.Duration {
+	return time.Duration(config.LoginRateLimit.Window) * time.Second
+}
+
+// checkLoginRateLimit - how long the client has to wait before trying to log in again; 0 - it may try now
+func checkLoginRateLimit(ip string, user string) (time.Duration, error) {
+	if loginAttempts == nil {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	since := now.Add(-loginWindow())
+	var retryAfter time.Duration
+
+	for _, limit := range loginLimits(ip, user) {
+		if limit.max <= 0 {
+			continue
+		}
+
+		n, oldest, err := loginAttempts.count(limit.key, since)
+		if err != nil {
+			return 0, err
+		}
+
+		if n < limit.max {
+			continue
+		}
+
+		// the oldest failure leaving the window brings the count under the limit
+		wait := oldest.Add(loginWindow()).Sub(now)
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	return retryAfter, nil
+}
+
+// recordLoginFailure - count the failure and return how long to delay the answer
+func recordLoginFailure(ip string, user string) (time.Duration, error) {
+	if loginAttempts == nil {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	since := now.Add(-loginWindow())
+	limits := loginLimits(ip, user)
+
+	keys := make([]string, 0, len(limits))
+	for _, limit := range limits {
+		keys = append(keys, limit.key)
+	}
+
+	err := loginAttempts.record(keys, now)
+	if err != nil {
+		return 0, err
+	}
+
+	failures := 0
+
+	for _, limit := range limits {
+		n, _, err := loginAttempts.count(limit.key, since)
+		if err != nil {
+			return 0, err
+		}
+
+		if limit.max > 0 && n == limit.max {
+			msg := fmt.Sprintf("Login rate limit per %s reached: %d failures in %d seconds", limit.name, n, config.LoginRateLimit.Window)
+			audit.Log(nil, "login-rate-limit", msg, "limit", limit.name, "ip", ip, "user", user)
+		}
+
+		if n > failures {
+			failures = n
+		}
+	}
+
+	pruneLoginAttempts(now)
+
+	return loginDelay(failures), nil
+}
+
+// resetLoginFailures - after a successful login the user and the ip + user failures are forgotten.
+// Those of the ip stay, a password spray may have found one good password.
+func resetLoginFailures(ip string, user string) error {
+	if loginAttempts == nil {
+		return nil
+	}
+
+	for _, limit := range loginLimits(ip, user) {
+		if limit.name == "ip" {
+			continue
+		}
+
+		err := loginAttempts.reset(limit.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loginDelay - 0 for the first delay-after failures, then delay-step ms doubled with each failure, at most max-delay ms
+func loginDelay(failures int) time.Duration {
+	rl := config.LoginRateLimit
+
+	over := failures - rl.DelayAfter
+	if over <= 0 || rl.DelayStep <= 0 {
+		return 0
+	}
+
+	delay := float64(rl.DelayStep) * math.Pow(2, float64(over-1))
+	if rl.MaxDelay > 0 && delay > float64(rl.MaxDelay) {
+		delay = float64(rl.MaxDelay)
+	}
+
+	return time.Duration(delay) * time.Millisecond
+}
+
+// pruneLoginAttempts - at most once a minute, drop the failures that left the window
+func pruneLoginAttempts(now time.Time) {
+	loginAttemptsLock.Lock()
+	due := !now.Before(nextLoginPrune)
+	if due {
+		nextLoginPrune = now.Add(time.Minute)
+	}
+	loginAttemptsLock.Unlock()
+
+	if !due {
+		return
+	}
+
+	err := loginAttempts.prune(now.Add(-loginWindow()))
+	if err != nil {
+		audit.Log(err, "login-rate-limit", "Could not prune the failed logins")
+	}
+}
+
+// memoryLoginAttempts - failed logins of this app instance only
+type memoryLoginAttempts struct {
+	sync.Mutex
+	attempts map[string][]time.Time
+}
+
+func (m *memoryLoginAttempts) record(keys []string, at time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, key := range keys {
+		m.attempts[key] = append(m.attempts[key], at)
+	}
+
+	return nil
+}
+
+func (m *memoryLoginAttempts) count(key string, since time.Time) (int, time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	n := 0
+	var oldest time.Time
+
+	for _, at := range m.attempts[key] {
+		if at.After(since) {
+			if n == 0 {
+				oldest = at
+			}
+			n++
+		}
+	}
+
+	return n, oldest, nil
+}
+
+func (m *memoryLoginAttempts) reset(key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.attempts, key)
+
+	return nil
+}
+
+func (m *memoryLoginAttempts) prune(before time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for key, times := range m.attempts {
+		kept := times[:0]
+		for _, at := range times {
+			if at.After(before) {
+				kept = append(kept, at)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(m.attempts, key)
+		} else {
+			m.attempts[key] = kept
+		}
+	}
+
+	return nil
+}
+
+// dbLoginAttempts - failed logins in the login_attempt table, shared by all app instances
+type dbLoginAttempts struct {
+}
+
+func (dbLoginAttempts) record(keys []string, at time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		pq := dbutl.PQuery(`
+		    INSERT INTO login_attempt (limit_key, attempt_time) VALUES (?, ?)
+		`, key,
+			at)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (dbLoginAttempts) count(key string, since time.Time) (int, time.Time, error) {
+	var n int
+	var oldest time.Time
+
+	pq := dbutl.PQuery(`
+	    SELECT count(*) AS attempts,
+	           CASE WHEN min(attempt_time) IS NULL THEN ? ELSE min(attempt_time) END AS oldest
+	      FROM login_attempt
+	     WHERE limit_key = ?
+	       AND attempt_time > ?
+	`, since,
+		key,
+		since)
+
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&n, &oldest)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, since, err
+	}
+
+	return n, oldest, nil
+}
+
+func (dbLoginAttempts) reset(key string) error {
+	pq := dbutl.PQuery(`
+	    DELETE FROM login_attempt WHERE limit_key = ?
+	`, key)
+
+	_, err := dbutl.Exec(pq)
+	return err
+}
+
+func (dbLoginAttempts) prune(before time.Time) error {
+	pq := dbutl.PQuery(`
+	    DELETE FROM login_attempt WHERE attempt_time <= ?
+	`, before)
+
+	_, err := dbutl.Exec(pq)
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// sendMail - plain text utf-8 email through the smtp server of the config
+func sendMail(to string, subject string, body string) error {
+	if len(config.Mail.Host) == 0 {
+		return errors.New("no smtp host in the mail config")
+	}
+
+	if len(to) == 0 {
+		return errors.New("no email address")
+	}
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", config.Mail.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n")
+	msg.WriteString("\r\n")
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+
+	var auth smtp.Auth
+	if len(config.Mail.Username) > 0 {
+		auth = smtp.PlainAuth("", config.Mail.Username, config.Mail.Password, config.Mail.Host)
+	}
+
+	addr := net.JoinHostPort(config.Mail.Host, config.Mail.Port)
+
+	return smtp.SendMail(addr, auth, config.Mail.From, []string{to}, msg.Bytes())
+}
+
+// mailEnabled - an smtp host is configured
+func mailEnabled() bool {
+	return len(strings.TrimSpace(config.Mail.Host)) > 0
+}
@@ -87,6 +87,30 @@ func main() {
 		return
 	}
 
+	err = loadMessageCatalogs(config.I18n.Dir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = loadTrustedProxies()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = loadPasswordBlocklist()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = initLoginRateLimit()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
 	time2wait := 5
 	startTime := time.Now()
 	endWait := startTime.Add(time.Duration(time2wait) * time.Minute)
@@ -129,7 +153,7 @@ func main() {
 		return
 	}
 
-	err = parseArguments()
+	err = parseArguments(&wg)
 	if err != nil {
 		audit.Log(err, "parse arguments", "error while parsing the command line arguments")
 		return
@@ -141,6 +165,9 @@ func main() {
 		return
 	}
 
+	startAuditRetention()
+	startAuditChain()
+
 	// server flags
 	addr = flag.String("addr", ":"+config.General.Port, "http service address")
 
@@ -186,7 +213,7 @@ func main() {
 
 	hs = &http.Server{
 		Addr: ":" + config.General.Port,
-		Handler: csrf.Protect(
+		Handler: apiTokenHandler(router, csrf.Protect(
 			key,
 			csrf.Secure(config.General.IsHTTPS),
 			csrf.Path("/"),
@@ -194,7 +221,7 @@ func main() {
 			csrf.CookieName("csrfCookie"),
 			csrf.HttpOnly(true),
 			csrf.MaxAge(24*3600),
-			csrf.RequestHeader("X-CSRF-Token"))(router),
+			csrf.RequestHeader("X-CSRF-Token"))(router)),
 	}
 
 	go func() {
@@ -228,11 +255,18 @@ func serverStop() {
 	time.Sleep(5 * time.Second)
 }
 
-func parseArguments() error {
-	for i, arg := range os.Args {
-		if i == 0 {
-			continue
-		}
+// exitAfterAudit - exit once the audit log entries are written
+func exitAfterAudit(wg *sync.WaitGroup, code int) {
+	audit.Close()
+	wg.Wait()
+	os.Exit(code)
+}
+
+func parseArguments(wg *sync.WaitGroup) error {
+	args := os.Args[1:]
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
 
 		switch arg {
 		case "--stop":
@@ -244,6 +278,98 @@ func parseArguments() error {
 				return err
 			}
 
+			os.Exit(0)
+		case "--openapi":
+			var file string
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				file = args[i]
+			}
+
+			err := dumpOpenAPI(file)
+			if err != nil {
+				audit.Log(err, "openapi", "Error encountered generating the OpenAPI document...")
+				return err
+			}
+
+			os.Exit(0)
+		case "--explain":
+			if i+3 >= len(args) {
+				err := fmt.Errorf("usage: --explain <user> <method> <url> [yyyy-mm-dd]")
+				audit.Log(err, "access-explain", "Missing --explain arguments...")
+				return err
+			}
+
+			username, method, url := args[i+1], args[i+2], args[i+3]
+			i += 3
+
+			var at time.Time
+			if i+1 < len(args) && utils.IsISODate(args[i+1]) {
+				i++
+
+				dt, err := time.Parse("2006-01-02", args[i][:10])
+				if err != nil {
+					return err
+				}
+				at = dt
+			}
+
+			err := dumpAccessExplain(username, method, url, at)
+			if err != nil {
+				audit.Log(err, "access-explain", "Error encountered explaining the access...")
+				return err
+			}
+
+			os.Exit(0)
+		case "--export-audit":
+			if i+2 >= len(args) || !utils.IsISODate(args[i+1]) || !utils.IsISODate(args[i+2]) {
+				err := fmt.Errorf("usage: --export-audit <yyyy-mm-dd> <yyyy-mm-dd> [file]")
+				audit.Log(err, "audit-export", "Missing --export-audit arguments...")
+				return err
+			}
+
+			from, err := time.Parse("2006-01-02", args[i+1][:10])
+			if err != nil {
+				return err
+			}
+
+			to, err := time.Parse("2006-01-02", args[i+2][:10])
+			if err != nil {
+				return err
+			}
+			i += 2
+
+			var file string
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				file = args[i]
+			}
+
+			err = exportAuditLog(from, to, file)
+			if err != nil {
+				audit.Log(err, "audit-export", "Error encountered exporting the audit log...")
+				return err
+			}
+
+			exitAfterAudit(wg, 0)
+		case "--verify-audit":
+			var file string
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				file = args[i]
+			}
+
+			ok, err := verifyAuditLog(os.Stdout, file)
+			if err != nil {
+				audit.Log(err, "audit-verify", "Error encountered verifying the audit log...")
+				return err
+			}
+
+			if !ok {
+				audit.Log(nil, "audit-verify", "The audit log hash chain is broken.")
+				exitAfterAudit(wg, 1)
+			}
+
 			os.Exit(0)
 		default:
 			err := fmt.Errorf("unknown argument \"%s\"", arg)
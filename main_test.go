@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests that need a database use the one of the app.config named by GO_WEB_APP_TEST_CONFIG,
+// created with the CreTab.sql of its type. Without it they are skipped.
+
+var testDatabase = struct {
+	sync.Once
+	err error
+}{}
+
+func requireTestDatabase(t *testing.T) {
+	cfgFile := os.Getenv("GO_WEB_APP_TEST_CONFIG")
+	if len(cfgFile) == 0 {
+		t.Skip("GO_WEB_APP_TEST_CONFIG is not set")
+	}
+
+	testDatabase.Do(func() {
+		testDatabase.err = openTestDatabase(cfgFile)
+	})
+
+	if testDatabase.err != nil {
+		t.Fatal(testDatabase.err)
+	}
+}
+
+func openTestDatabase(cfgFile string) error {
+	err := config.ReadFromFile(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	err = loadMessageCatalogs(config.I18n.Dir)
+	if err != nil {
+		return err
+	}
+
+	err = loadPasswordBlocklist()
+	if err != nil {
+		return err
+	}
+
+	err = dbutl.Connect2Database(&db, config.Database.DbType, config.Database.DbURL)
+	if err != nil {
+		return err
+	}
+
+	timezone, err = time.LoadLocation(config.General.Timezone)
+	if err != nil {
+		return err
+	}
+
+	audit.SetLogger(appName, appVersion, log, dbutl)
+
+	return initializeDatabase()
+}
+
+// testName - a username or subject not used by an earlier run
+func testName(prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano())
+}
+
+// createTestUser - an activated Member with a local password
+func createTestUser(t *testing.T, username string, email string) *MembershipUser {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	password, err := generateTemporaryPassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := MembershipUser{tx: tx}
+	u.UserID = -1
+	u.Username = username
+	u.Name = "Test"
+	u.Surname = "User"
+	u.Email = email
+	u.Password = password
+	u.Valid = true
+
+	err = u.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = u.AddToRole("Member")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = u.Activate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.tx = nil
+
+	return &u
+}
+
+// testHasRole - the user is a direct member of the role
+func testHasRole(t *testing.T, userID int, role string) bool {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	r := MembershipRole{tx: tx}
+	err = r.GetByName(role)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member, err := r.HasMemberID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return member
+}
+
+// testWithTx - f inside a transaction that is rolled back
+func testWithTx(t *testing.T, f func(tx *sql.Tx)) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	f(tx)
+}
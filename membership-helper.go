@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"math/big"
 	"sync"
 	"time"
 	"unicode"
@@ -12,7 +14,6 @@ import (
 
 	"github.com/geo-stanciu/go-utils/utils"
 	"github.com/gofrs/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -24,6 +25,13 @@ const (
 	ValidationTemporaryPassword int = 2
 )
 
+const (
+	// PasswordSourceLocal - the password is kept in user_password
+	PasswordSourceLocal = "local"
+	// PasswordSourceLDAP - the password is checked by a bind to the LDAP server
+	PasswordSourceLDAP = "ldap"
+)
+
 // MembershipUser - membership user helper
 type MembershipUser struct {
 	sync.RWMutex
@@ -39,6 +47,7 @@ type MembershipUser struct {
 	Activated       bool      `sql:"activated" json:"activated"`
 	LockedOut       bool      `sql:"locked_out" json:"locked_out"`
 	Valid           bool      `sql:"valid" json:"valid"`
+	PasswordSource  string    `sql:"password_source" json:"password_source"`
 	Password        string    `json:"-"`
 }
 
@@ -84,7 +93,8 @@ func (u *MembershipUser) GetByName(user string) error {
 			   last_update,
 			   activated,
 			   locked_out,
-			   valid
+			   valid,
+			   password_source
 	      FROM "user"
 	     WHERE loweredusername = lower(?)
 	`, user)
@@ -117,7 +127,8 @@ func (u *MembershipUser) GetByID(userID int) error {
 			last_update,
 			activated,
 			locked_out,
-			valid
+			valid,
+			password_source
 	     FROM "user"
 	    WHERE user_id = ?
 	`, userID)
@@ -139,8 +150,8 @@ func (u *MembershipUser) testSave() error {
 		return fmt.Errorf("unknown user \"%s\"", u.Username)
 	}
 
-	if u.UserID <= 0 && len(u.Password) == 0 {
-		return fmt.Errorf("cannot create user with empty password")
+	if u.UserID <= 0 && len(u.Password) == 0 && !u.IsDelegated() {
+		return newLocalizedError("user.empty-password")
 	}
 
 	pq := dbutl.PQuery(`
@@ -161,12 +172,48 @@ func (u *MembershipUser) testSave() error {
 	}
 
 	if found == 1 {
-		return fmt.Errorf("duplicate user \"%s\"", u.Username)
+		return newLocalizedError("user.duplicate", u.Username)
+	}
+
+	found, err = u.emailTaken(u.Email)
+	if err != nil {
+		return err
+	}
+
+	if found == 1 {
+		return newLocalizedError("user.duplicate-email", u.Email)
 	}
 
 	return nil
 }
 
+// emailTaken - 1 when another user has the email. user_email_uk enforces it too,
+// for the saves that pass the check at the same time.
+func (u *MembershipUser) emailTaken(email string) (int, error) {
+	if len(strings.TrimSpace(email)) == 0 {
+		return 0, nil
+	}
+
+	pq := dbutl.PQuery(`
+	    SELECT CASE WHEN EXISTS (
+	        SELECT 1
+	          FROM "user"
+	         WHERE loweredemail = LOWER(?)
+	           AND user_id <> ?
+	    ) THEN 1 ELSE 0 END
+	    FROM dual
+	`, email,
+		u.UserID)
+
+	found := 0
+	err := u.tx.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return 0, err
+	}
+
+	return found, nil
+}
+
 // Save - save user details
 func (u *MembershipUser) Save() error {
 	membershipUserLock.Lock()
@@ -179,6 +226,10 @@ func (u *MembershipUser) Save() error {
 
 	dt := time.Now().UTC()
 
+	if len(u.PasswordSource) == 0 {
+		u.PasswordSource = PasswordSourceLocal
+	}
+
 	if u.UserID <= 0 {
 		u.CreationTime = dt
 		u.LastUpdate = dt
@@ -192,9 +243,10 @@ func (u *MembershipUser) Save() error {
 		        email,
 		        loweredemail,
 		        creation_time,
-		        last_update
+		        last_update,
+		        password_source
 		    )
-		    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`, u.Username,
 			strings.ToLower(u.Username),
 			u.Name,
@@ -202,7 +254,8 @@ func (u *MembershipUser) Save() error {
 			u.Email,
 			strings.ToLower(u.Email),
 			u.CreationTime,
-			u.LastUpdate)
+			u.LastUpdate,
+			u.PasswordSource)
 
 		_, err = dbutl.ExecTx(u.tx, pq)
 		if err != nil {
@@ -226,9 +279,12 @@ func (u *MembershipUser) Save() error {
 			return fmt.Errorf("unknown user \"%s\"", u.Username)
 		}
 
-		err = u.changePassword()
-		if err != nil {
-			return err
+		// the directory keeps the password of a delegated user
+		if !u.IsDelegated() {
+			err = u.changePassword()
+			if err != nil {
+				return err
+			}
 		}
 
 		audit.Log(nil, "add-user", "Add new user.", "new", u)
@@ -275,7 +331,7 @@ func (u *MembershipUser) Save() error {
 			audit.Log(nil, "update-user", "Update user.", "old", &old, "new", u)
 		}
 
-		if len(u.Password) > 0 {
+		if len(u.Password) > 0 && !u.IsDelegated() {
 			err = u.changePassword()
 			if err != nil {
 				return err
@@ -396,11 +452,8 @@ func (u *MembershipUser) GetUserRoles() ([]*MembershipRole, error) {
 	return roles, nil
 }
 
-// AddToRole - add user to role
+// AddToRole - add user to role, starting now and without an end date
 func (u *MembershipUser) AddToRole(role string) error {
-	u.Lock()
-	defer u.Unlock()
-
 	r := MembershipRole{tx: u.tx}
 	err := r.GetByName(role)
 	if err != nil {
@@ -416,31 +469,102 @@ func (u *MembershipUser) AddToRole(role string) error {
 		return nil
 	}
 
-	dt := time.Now().UTC()
+	return u.AddToRoleBetween(role, time.Now().UTC(), nil, u.Username)
+}
 
-	pq := dbutl.PQuery(`
-	    INSERT INTO user_role (
-	        user_id,
-	        role_id,
-	        valid_from
-	    )
-	    VALUES (?, ?, ?)
-	`, u.UserID,
-		r.RoleID,
-		dt)
+// AddToRoleBetween - add user to role for the given period (validUntil nil - no end date).
+// An existing membership of the same role gets the new period.
+func (u *MembershipUser) AddToRoleBetween(role string, validFrom time.Time, validUntil *time.Time, changedBy string) error {
+	u.Lock()
+	defer u.Unlock()
 
-	_, err = dbutl.ExecTx(u.tx, pq)
+	r := MembershipRole{tx: u.tx}
+	err := r.GetByName(role)
 	if err != nil {
 		return err
 	}
 
-	audit.Log(nil, "add-user-role", "Add user to role.", "user", u.Username, "role", r.Rolename)
+	if validUntil != nil && !validUntil.After(validFrom) {
+		return fmt.Errorf("the membership must end after it starts")
+	}
+
+	userRoleID, err := u.getUserRoleID(r.RoleID)
+	if err != nil {
+		return err
+	}
+
+	changeType := "add"
+
+	if userRoleID > 0 {
+		changeType = "update"
+
+		pq := dbutl.PQuery(`
+		    UPDATE user_role
+		       SET valid_from = ?,
+		           valid_until = ?,
+		           valid = ?
+		     WHERE user_role_id = ?
+		`, validFrom,
+			validUntil,
+			1,
+			userRoleID)
+
+		_, err = dbutl.ExecTx(u.tx, pq)
+		if err != nil {
+			return err
+		}
+	} else {
+		pq := dbutl.PQuery(`
+		    INSERT INTO user_role (
+		        user_id,
+		        role_id,
+		        valid_from,
+		        valid_until
+		    )
+		    VALUES (?, ?, ?, ?)
+		`, u.UserID,
+			r.RoleID,
+			validFrom,
+			validUntil)
+
+		_, err = dbutl.ExecTx(u.tx, pq)
+		if err != nil {
+			return err
+		}
+
+		userRoleID, err = u.getUserRoleID(r.RoleID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = saveUserRoleHistory(u.tx, userRoleID, changeType, changedBy)
+	if err != nil {
+		return err
+	}
+
+	err = bumpAccessChangeCounter(u.tx)
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, changeType+"-user-role", "Add user to role.",
+		"user", u.Username,
+		"role", r.Rolename,
+		"valid_from", validFrom,
+		"valid_until", validUntil,
+		"changed_by", changedBy)
 
 	return nil
 }
 
 // RemoveFromRole - remove user from role
 func (u *MembershipUser) RemoveFromRole(role string) error {
+	return u.RemoveFromRoleBy(role, u.Username)
+}
+
+// RemoveFromRoleBy - remove user from role, recording who did it
+func (u *MembershipUser) RemoveFromRoleBy(role string, changedBy string) error {
 	u.Lock()
 	defer u.Unlock()
 
@@ -450,12 +574,12 @@ func (u *MembershipUser) RemoveFromRole(role string) error {
 		return err
 	}
 
-	found, err := r.HasMemberID(u.UserID)
+	userRoleID, err := u.getUserRoleID(r.RoleID)
 	if err != nil {
 		return err
 	}
 
-	if !found {
+	if userRoleID <= 0 {
 		return nil
 	}
 
@@ -463,51 +587,124 @@ func (u *MembershipUser) RemoveFromRole(role string) error {
 
 	pq := dbutl.PQuery(`
 	    UPDATE user_role
-		   SET valid_until = ?,
+		   SET valid_until = CASE
+		                       WHEN valid_until IS NULL OR valid_until > ? THEN ?
+		                       ELSE valid_until
+		                     END,
 		       valid = ?
-	     WHERE user_id = ?
-	       AND role_id = ?
+	     WHERE user_role_id = ?
 	`, dt,
+		dt,
 		0,
-		u.UserID,
-		r.RoleID)
+		userRoleID)
 
 	_, err = dbutl.ExecTx(u.tx, pq)
 	if err != nil {
 		return err
 	}
 
-	pq = dbutl.PQuery(`
-	    INSERT INTO user_role_history
-	    SELECT *
-	      FROM user_role
-	     WHERE user_id = ?
-	       AND role_id = ?
-	`, u.UserID,
-		r.RoleID)
-
-	_, err = dbutl.ExecTx(u.tx, pq)
+	err = saveUserRoleHistory(u.tx, userRoleID, "remove", changedBy)
 	if err != nil {
 		return err
 	}
 
 	pq = dbutl.PQuery(`
 	    DELETE FROM user_role
-	     WHERE user_id = ?
-	       AND role_id = ?
-	`, u.UserID,
-		r.RoleID)
+	     WHERE user_role_id = ?
+	`, userRoleID)
 
 	_, err = dbutl.ExecTx(u.tx, pq)
 	if err != nil {
 		return err
 	}
 
-	audit.Log(nil, "remove-user-role", "Remove user from role.", "user", u.Username, "role", r.Rolename)
+	err = bumpAccessChangeCounter(u.tx)
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, "remove-user-role", "Remove user from role.",
+		"user", u.Username,
+		"role", r.Rolename,
+		"changed_by", changedBy)
 
 	return nil
 }
 
+// SyncMappedRoles - mapping is role -> values granting it (groups, claims). The user gets the mapped
+// roles with one of their values among values and loses the other mapped roles; roles missing from
+// the mapping are left alone. Values are compared case insensitively.
+func (u *MembershipUser) SyncMappedRoles(mapping map[string][]string, values []string, changedBy string) (bool, error) {
+	has := make(map[string]bool)
+	for _, v := range values {
+		has[strings.ToLower(v)] = true
+	}
+
+	changed := false
+
+	for role, roleValues := range mapping {
+		want := false
+		for _, v := range roleValues {
+			if has[strings.ToLower(v)] {
+				want = true
+				break
+			}
+		}
+
+		r := MembershipRole{tx: u.tx}
+		err := r.GetByName(role)
+		if err != nil {
+			return false, err
+		}
+
+		member, err := r.HasMemberID(u.UserID)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case want && !member:
+			err = u.AddToRoleBetween(role, time.Now().UTC(), nil, changedBy)
+		case !want && member:
+			err = u.RemoveFromRoleBy(role, changedBy)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// getUserRoleID - membership of the role, whatever its period, or -1
+func (u *MembershipUser) getUserRoleID(roleID int) (int, error) {
+	var userRoleID int
+
+	pq := dbutl.PQuery(`
+	    SELECT user_role_id
+	      FROM user_role
+	     WHERE user_id = ?
+	       AND role_id = ?
+	`, u.UserID,
+		roleID)
+
+	err := u.tx.QueryRow(pq.Query, pq.Args...).Scan(&userRoleID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return -1, nil
+	case err != nil:
+		return -1, err
+	}
+
+	return userRoleID, nil
+}
+
 func (u *MembershipUser) passwordAlreadyUsed() (bool, int, error) {
 	notRepeatPasswords := config.PasswordRules.NotRepeatLastXPasswords
 
@@ -545,16 +742,13 @@ func (u *MembershipUser) passwordAlreadyUsed() (bool, int, error) {
 			return err1
 		}
 
-		passBytes := []byte(passwordSalt + u.Password)
-		hashBytes, err1 := base64.StdEncoding.DecodeString(hashedPassword)
+		used, err1 := verifyPassword(hashedPassword, passwordSalt, u.Password)
 		if err1 != nil {
 			return err1
 		}
 
-		err1 = bcrypt.CompareHashAndPassword(hashBytes, passBytes)
-
-		if err1 == nil {
-			return fmt.Errorf("Password already used")
+		if used {
+			return newLocalizedError("password.already-used", notRepeatPasswords)
 		}
 
 		return nil
@@ -567,14 +761,145 @@ func (u *MembershipUser) passwordAlreadyUsed() (bool, int, error) {
 	return false, notRepeatPasswords, nil
 }
 
+// IsDelegated - the password is checked by another system (LDAP), not kept here
+func (u *MembershipUser) IsDelegated() bool {
+	return len(u.PasswordSource) > 0 && u.PasswordSource != PasswordSourceLocal
+}
+
 func (u *MembershipUser) changePassword() error {
+	return u.savePassword(false)
+}
+
+// SetTemporaryPassword - password chosen by an administrator; the user has to change it at the next login
+func (u *MembershipUser) SetTemporaryPassword(password string) error {
+	u.Lock()
+	defer u.Unlock()
+
+	u.Password = password
+
+	return u.savePassword(true)
+}
+
+// UnlockAccount - end the lockout of the user and forget the failed attempts and the previous lockouts
+func (u *MembershipUser) UnlockAccount() error {
+	u.Lock()
+	defer u.Unlock()
+
+	err := unlockUserAccount(u.tx, u.UserID, true)
+	if err != nil {
+		return err
+	}
+
+	u.LockedOut = false
+
+	return nil
+}
+
+// unlockUserAccount - resetCount forgets the previous lockouts too, so the next one is not longer.
+// tx nil - on its own.
+func unlockUserAccount(tx *sql.Tx, userID int, resetCount bool) error {
+	query := `
+	    UPDATE "user"
+	       SET locked_out = 0,
+	           locked_until = NULL,
+	           failed_password_atmpts = 0,
+	           first_failed_password = NULL
+	     WHERE user_id = ?
+	`
+	if resetCount {
+		query = `
+		    UPDATE "user"
+		       SET locked_out = 0,
+		           locked_until = NULL,
+		           failed_password_atmpts = 0,
+		           first_failed_password = NULL,
+		           lockout_count = 0
+		     WHERE user_id = ?
+		`
+	}
+
+	pq := dbutl.PQuery(query, userID)
+
+	var err error
+	if tx != nil {
+		_, err = dbutl.ExecTx(tx, pq)
+	} else {
+		_, err = dbutl.Exec(pq)
+	}
+
+	return err
+}
+
+// generateTemporaryPassword - random password meeting the password rules, for SetTemporaryPassword
+func generateTemporaryPassword() (string, error) {
+	const lower = "abcdefghijkmnopqrstuvwxyz"
+	const upper = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	const digits = "23456789"
+	const symbols = "!#%+-=?@_"
+
+	length := 16
+	if config.PasswordRules.MinCharacters > length {
+		length = config.PasswordRules.MinCharacters
+	}
+
+	pick := func(set string) (byte, error) {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return 0, err
+		}
+
+		return set[n.Int64()], nil
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		password := make([]byte, length)
+
+		// one of each class, the rest from all of them
+		sets := []string{lower, upper, digits, symbols}
+		for i := range password {
+			set := lower + upper + digits + symbols
+			if i < len(sets) {
+				set = sets[i]
+			}
+
+			c, err := pick(set)
+			if err != nil {
+				return "", err
+			}
+			password[i] = c
+		}
+
+		// shuffle the leading classes into place
+		for i := len(password) - 1; i > 0; i-- {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+			if err != nil {
+				return "", err
+			}
+
+			j := n.Int64()
+			password[i], password[j] = password[j], password[i]
+		}
+
+		if !utils.ContainsRepeatingGroups(string(password)) {
+			return string(password), nil
+		}
+	}
+
+	return "", errors.New("could not generate a temporary password")
+}
+
+func (u *MembershipUser) savePassword(temporary bool) error {
+	if u.IsDelegated() {
+		return newLocalizedError("password.delegated", u.PasswordSource)
+	}
+
 	alreadyUsed, notRepeatPasswords, err := u.passwordAlreadyUsed()
 	if err != nil {
 		return err
 	}
 
 	if alreadyUsed {
-		return fmt.Errorf("Password already used. Can't use the last %d passwords", notRepeatPasswords)
+		return newLocalizedError("password.already-used", notRepeatPasswords)
 	}
 
 	changeInterval := config.PasswordRules.ChangeInterval
@@ -587,7 +912,7 @@ func (u *MembershipUser) changePassword() error {
 	canContainUsername := config.PasswordRules.CanContainUsername
 
 	if minCharacters > 0 && len(u.Password) < minCharacters {
-		return fmt.Errorf("Password must have at least %d characters", minCharacters)
+		return newLocalizedError("password.min-characters", minCharacters)
 	}
 
 	letters := 0
@@ -609,23 +934,23 @@ func (u *MembershipUser) changePassword() error {
 	}
 
 	if minLetters > 0 && letters < minLetters {
-		return fmt.Errorf("Password must contain at least %d letter(s)", minLetters)
+		return newLocalizedError("password.min-letters", minLetters)
 	}
 
 	if minCapitals > 0 && capitals < minCapitals {
-		return fmt.Errorf("Password must contain at least %d capital letter(s)", minCapitals)
+		return newLocalizedError("password.min-capitals", minCapitals)
 	}
 
 	if minDigits > 0 && digits < minDigits {
-		return fmt.Errorf("Password must contain at least %d digit(s)", minDigits)
+		return newLocalizedError("password.min-digits", minDigits)
 	}
 
 	if minNonAlphaNumerics > 0 && nonalphanumerics < minNonAlphaNumerics {
-		return fmt.Errorf("Password must contain at least %d non alpha-numeric character(s)", minNonAlphaNumerics)
+		return newLocalizedError("password.min-non-alpha-numerics", minNonAlphaNumerics)
 	}
 
 	if !allowRepetitiveCharacters && utils.ContainsRepeatingGroups(u.Password) {
-		return fmt.Errorf("Password must not contain repetitive groups of characters")
+		return newLocalizedError("password.repetitive")
 	}
 
 	if !canContainUsername {
@@ -633,23 +958,37 @@ func (u *MembershipUser) changePassword() error {
 		lowerPass := strings.ToLower(u.Password)
 
 		if strings.Contains(lowerPass, lowerUsername) {
-			return fmt.Errorf("Password must not contain the username")
+			return newLocalizedError("password.contains-username")
 		}
 	}
 
+	if minStrengthScore := config.PasswordRules.MinStrengthScore; minStrengthScore > 0 {
+		strength := estimatePasswordStrength(u.Password, u.Username, u.Name, u.Surname, u.Email)
+		if strength.Score < minStrengthScore {
+			return newLocalizedError("password.weak", minStrengthScore)
+		}
+	}
+
+	err = checkPasswordBlocklist(u.Password)
+	if err != nil {
+		return err
+	}
+
 	saltBytes, err := uuid.NewV4()
 	if err != nil {
 		return err
 	}
 	salt := saltBytes.String()
 
-	passwordBytes := []byte(salt + u.Password)
-	hashedPassword, err := bcrypt.GenerateFromPassword(passwordBytes, bcrypt.DefaultCost)
+	password, err := hashPassword(salt, u.Password)
 	if err != nil {
 		return err
 	}
 
-	password := base64.StdEncoding.EncodeToString(hashedPassword)
+	isTemporary := 0
+	if temporary {
+		isTemporary = 1
+	}
 
 	dt := time.Now().UTC()
 
@@ -678,14 +1017,16 @@ func (u *MembershipUser) changePassword() error {
 				password,
 				password_salt,
 				valid_from,
-				valid_until
+				valid_until,
+				temporary
 			)
-			VALUES(?, ?, ?, ?, ?)
+			VALUES(?, ?, ?, ?, ?, ?)
 		`, u.UserID,
 			password,
 			salt,
 			dt,
-			until)
+			until,
+			isTemporary)
 
 		_, err = dbutl.ExecTx(u.tx, pq)
 	} else {
@@ -694,13 +1035,15 @@ func (u *MembershipUser) changePassword() error {
 				user_id,
 				password,
 				password_salt,
-				valid_from
+				valid_from,
+				temporary
 			)
-			VALUES(?, ?, ?, ?)
+			VALUES(?, ?, ?, ?, ?)
 		`, u.UserID,
 			password,
 			salt,
-			dt)
+			dt,
+			isTemporary)
 
 		_, err = dbutl.ExecTx(u.tx, pq)
 	}
@@ -742,122 +1085,124 @@ func (u *MembershipUser) Equals(usr *MembershipUser) bool {
 }
 
 type validateUserUtil struct {
-	UserID         int    `sql:"user_id"`
-	HashedPassword string `sql:"hashed_password"`
-	PasswordSalt   string `sql:"password_salt"`
-	Activated      int    `sql:"activated"`
-	LockedOut      int    `sql:"locked_out"`
-	Valid          int    `sql:"valid"`
-	Temporary      int    `sql:"temporary"`
+	UserID         int       `sql:"user_id"`
+	Username       string    `sql:"username"`
+	Name           string    `sql:"name"`
+	Surname        string    `sql:"surname"`
+	PasswordID     int       `sql:"password_id"`
+	HashedPassword string    `sql:"hashed_password"`
+	PasswordSalt   string    `sql:"password_salt"`
+	Activated      int       `sql:"activated"`
+	LockedOut      int       `sql:"locked_out"`
+	LockExpires    int       `sql:"lock_expires"`
+	LockedUntil    time.Time `sql:"locked_until"`
+	Valid          int       `sql:"valid"`
+	Temporary      int       `sql:"temporary"`
 }
 
-// ValidateUserPassword - check user and password validity
+// ValidateUserPassword - check user and password validity, with the provider of the user (local or LDAP)
 func ValidateUserPassword(user string, pass string, ip string) (int, error) {
-	dt := time.Now().UTC()
+	res, err := authenticate(&Credentials{Username: user, Password: pass, IP: ip})
+	if err != nil {
+		return ValidationFailed, err
+	}
+
+	if res.TemporaryPassword {
+		return ValidationTemporaryPassword, nil
+	}
+
+	return ValidationOK, nil
+}
+
+// getPasswordSource - password_source of the user; empty for an unknown user
+func getPasswordSource(user string) (string, error) {
+	var source string
 
 	pq := dbutl.PQuery(`
-	    SELECT u.user_id,
-	           CASE
-	             WHEN p.password is null THEN
-	               '-'
-	             ELSE
-	               p.password
-	           END AS hashed_password,
-	           CASE
-	             WHEN p.password_salt is null THEN
-	               '-'
-	             ELSE
-	               p.password_salt
-	           END AS password_salt,
-	           activated,
-	           locked_out,
-	           u.valid,
-	           p.temporary
-	      FROM "user" u
-	      LEFT OUTER JOIN user_password p ON (u.user_id = p.user_id)
-		 WHERE loweredusername = lower(?)
-		   AND p.valid = ?
-	       AND p.valid_from <= ?
-	       AND (p.valid_until is null OR p.valid_until > ?)
-	`, user,
-		1,
-		dt,
-		dt)
+	    SELECT password_source
+	      FROM "user"
+	     WHERE loweredusername = lower(?)
+	`, user)
 
-	testUser := validateUserUtil{}
-	err := dbutl.RunQuery(pq, &testUser)
+	err := db.QueryRow(pq.Query, pq.Args...).Scan(&source)
 
 	switch {
 	case err == sql.ErrNoRows:
-		return ValidationFailed, fmt.Errorf("username \"%s\" not found or password expired", user)
+		return "", nil
 	case err != nil:
-		return ValidationFailed, err
-	}
-
-	if testUser.LockedOut > 0 {
-		return ValidationFailed, fmt.Errorf("username \"%s\" is locked out", user)
-	}
-
-	if testUser.Activated <= 0 {
-		return ValidationFailed, fmt.Errorf("username \"%s\" is not activated", user)
+		return "", err
 	}
 
-	if testUser.Valid <= 0 {
-		return ValidationFailed, fmt.Errorf("username \"%s\" is not valid", user)
-	}
+	return source, nil
+}
 
-	hasIPs := false
-	foundIP := false
+// checkUserCanLogin - not locked out (an expired lockout is ended here, in tx when not nil), activated, valid
+// and connecting from one of the allowed networks
+func checkUserCanLogin(tx *sql.Tx, testUser *validateUserUtil, user string, ip string, dt time.Time) error {
+	if testUser.LockedOut > 0 {
+		if testUser.LockExpires <= 0 {
+			return refusedf("username \"%s\" is locked out", user)
+		}
 
-	pq = dbutl.PQuery(`
-		SELECT ip FROM user_ip WHERE user_id = ?
-	`, testUser.UserID)
+		if testUser.LockedUntil.After(dt) {
+			return refusedf("username \"%s\" is locked out until %s", user, testUser.LockedUntil.Format(time.RFC3339))
+		}
 
-	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
-		hasIPs = true
-		var addr string
-		err = row.Scan(&addr)
+		err := unlockUserAccount(tx, testUser.UserID, false)
 		if err != nil {
 			return err
 		}
 
-		if addr == ip {
-			foundIP = true
-		}
-
-		return nil
-	})
+		audit.Log(nil, "unlock", "Lockout period ended", "user", user)
+	}
 
-	if err != nil {
-		return ValidationFailed, err
+	if testUser.Activated <= 0 {
+		return refusedf("username \"%s\" is not activated", user)
 	}
 
-	if hasIPs && !foundIP {
-		return ValidationFailed, fmt.Errorf("IP not accepted for \"%s\"", user)
+	if testUser.Valid <= 0 {
+		return refusedf("username \"%s\" is not valid", user)
 	}
 
-	passBytes := []byte(testUser.PasswordSalt + pass)
-	hashBytes, err := base64.StdEncoding.DecodeString(testUser.HashedPassword)
+	ipAllowed, err := userIPAllowed(testUser.UserID, user, ip)
 	if err != nil {
-		return ValidationFailed, err
+		return err
 	}
 
-	err = bcrypt.CompareHashAndPassword(hashBytes, passBytes)
-	if err != nil {
-		failedUserPasswordValidation(testUser.UserID, user)
-		return ValidationFailed, err
+	if !ipAllowed {
+		return refusedf("IP not accepted for \"%s\"", user)
 	}
 
-	if testUser.Temporary > 0 {
-		return ValidationTemporaryPassword, nil
+	return nil
+}
+
+// rehashUserPassword - store the password with the current hash parameters.
+// The same user_password row is updated: not a password change, the history and the expiry stay.
+func rehashUserPassword(passwordID int, oldHash string, salt string, pass string) error {
+	password, err := hashPassword(salt, pass)
+	if err != nil {
+		return err
 	}
 
-	return ValidationOK, nil
+	pq := dbutl.PQuery(`
+	    UPDATE user_password
+	       SET password = ?
+	     WHERE password_id = ?
+	       AND password = ?
+	`, password,
+		passwordID,
+		oldHash)
+
+	_, err = dbutl.Exec(pq)
+	return err
 }
 
 type failedUserPassword struct {
 	FailedPasswords int       `sql:"failed_password_atmpts"`
 	FirstFail       time.Time `sql:"first_failed_password"`
+	LockoutCount    int       `sql:"lockout_count"`
+	LastLockout     time.Time `sql:"last_lockout"`
+	Email           string    `sql:"email"`
 }
 
 var passFailLock sync.Mutex
@@ -886,10 +1231,19 @@ func failedUserPasswordValidation(userID int, user string) {
 	               TIMESTAMP ?
 	             ELSE
 	               first_failed_password
-	            END AS first_failed_password
+	            END AS first_failed_password,
+	           lockout_count,
+	           CASE
+	             WHEN last_lockout is null then
+	               TIMESTAMP ?
+	             ELSE
+	               last_lockout
+	            END AS last_lockout,
+	           email
 	      FROM "user" u
 	     WHERE user_id = ?
 	`, "1970-01-01 00:00:00",
+		"1970-01-01 00:00:00",
 		userID)
 
 	failedPass := failedUserPassword{}
@@ -962,11 +1316,34 @@ func failedUserPasswordValidation(userID int, user string) {
 	}
 
 	if failedPass.FailedPasswords >= maxAllowedFailedAtmpts {
-		pq = dbutl.PQuery(`
-		    UPDATE "user"
-		       SET locked_out = 1
-		     WHERE user_id = ?
-		`, userID)
+		lockedUntil, permanent := lockoutPeriod(&failedPass, dt)
+
+		if permanent {
+			pq = dbutl.PQuery(`
+			    UPDATE "user"
+			       SET locked_out = 1,
+			           locked_until = NULL,
+			           lockout_count = ?,
+			           last_lockout = ?
+			     WHERE user_id = ?
+			`, failedPass.LockoutCount,
+				dt,
+				userID)
+		} else {
+			pq = dbutl.PQuery(`
+			    UPDATE "user"
+			       SET locked_out = 1,
+			           locked_until = ?,
+			           lockout_count = ?,
+			           last_lockout = ?,
+			           failed_password_atmpts = 0,
+			           first_failed_password = NULL
+			     WHERE user_id = ?
+			`, lockedUntil,
+				failedPass.LockoutCount,
+				dt,
+				userID)
+		}
 
 		_, err = dbutl.ExecTx(tx, pq)
 		if err != nil {
@@ -974,31 +1351,96 @@ func failedUserPasswordValidation(userID int, user string) {
 			// return // commented on purpose - Geo 18.03.2017
 		}
 
-		dt := time.Now().UTC()
+		if permanent {
+			pq = dbutl.PQuery(`
+			    UPDATE user_password
+				   SET valid_until = ?,
+				       valid = ?
+			     WHERE user_id = ?
+			       AND valid = ?
+			`, dt,
+				0,
+				userID,
+				1)
 
-		pq = dbutl.PQuery(`
-		    UPDATE user_password
-			   SET valid_until = ?,
-			       valid = ?
-		     WHERE user_id = ?
-		       AND valid = ?
-		`, dt,
-			0,
-			userID,
-			1)
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				audit.Log(err, "failed-login", "Failed to invalidate user password.", "user", user)
+				// return // commented on purpose - Geo 17.03.2017
+			}
 
-		_, err = dbutl.ExecTx(tx, pq)
-		if err != nil {
-			audit.Log(err, "failed-login", "Failed to invalidate user password.", "user", user)
-			// return // commented on purpose - Geo 17.03.2017
+			msg := "User password invalidated for multiple failed attempts"
+
+			audit.Log(err, "failed-login", msg, "user", user)
+		} else {
+			msg := fmt.Sprintf("User locked out until %s for multiple failed attempts (lockout %d)", lockedUntil.Format(time.RFC3339), failedPass.LockoutCount)
+
+			audit.Log(err, "failed-login", msg, "user", user)
 		}
 
-		msg := "User password invalidated for multiple failed attempts"
+		tx.Commit()
 
-		audit.Log(err, "failed-login", msg, "user", user)
+		go notifyAccountLocked(user, failedPass.Email, lockedUntil, permanent)
+
+		return
 	}
 
 	tx.Commit()
 
 	audit.Log(nil, "failed-login", "Wrong password", "user", user)
 }
+
+// lockoutPeriod - until when the user is locked out, each lockout longer than the previous one.
+// Counts the lockout in failedPass.LockoutCount; the count starts over after lockout-reset-after minutes without lockouts.
+func lockoutPeriod(failedPass *failedUserPassword, dt time.Time) (time.Time, bool) {
+	rules := config.PasswordRules
+
+	if rules.LockoutResetAfter > 0 && failedPass.LastLockout.Before(dt.Add(time.Duration(-1*rules.LockoutResetAfter)*time.Minute)) {
+		failedPass.LockoutCount = 0
+	}
+	failedPass.LockoutCount++
+
+	if rules.LockoutDuration <= 0 || (rules.LockoutPermanentAfter > 0 && failedPass.LockoutCount >= rules.LockoutPermanentAfter) {
+		return dt, true
+	}
+
+	duration := rules.LockoutDuration
+	for i := 1; i < failedPass.LockoutCount; i++ {
+		duration *= rules.LockoutEscalationFactor
+
+		if rules.LockoutMaxDuration > 0 && duration >= rules.LockoutMaxDuration {
+			duration = rules.LockoutMaxDuration
+			break
+		}
+	}
+
+	return dt.Add(time.Duration(duration) * time.Minute), false
+}
+
+// notifyAccountLocked - tell the user by email that their account is locked
+func notifyAccountLocked(user string, email string, lockedUntil time.Time, permanent bool) {
+	if !mailEnabled() {
+		return
+	}
+
+	lang, err := getUserLanguage(user)
+	if err != nil || len(lang) == 0 {
+		lang = config.I18n.DefaultLanguage
+	}
+
+	var body string
+	if permanent {
+		body = translate(lang, "mail.locked.body-permanent", user)
+	} else {
+		until := lockedUntil.In(timezone).Format("2006-01-02 15:04")
+		body = translate(lang, "mail.locked.body", user, until)
+	}
+
+	err = sendMail(email, translate(lang, "mail.locked.subject"), body)
+	if err != nil {
+		audit.Log(err, "failed-login", "Could not send the lockout email", "user", user)
+		return
+	}
+
+	audit.Log(nil, "failed-login", "Lockout email sent", "user", user)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// MenuItem - navigation menu entry
+type MenuItem struct {
+	RequestID   int    `sql:"request_id"`
+	URL         string `sql:"request_url"`
+	Name        string `sql:"name"`
+	IndexLevel  int    `sql:"index_level"`
+	OrderNumber int    `sql:"order_number"`
+	ParentID    int    `sql:"parent_id"`
+	Href        string
+	Children    []*MenuItem
+}
+
+// menuCache - menu trees by language and role set
+type menuCache struct {
+	sync.RWMutex
+	menus      map[string][]*MenuItem
+	generation int64
+}
+
+var menus = menuCache{menus: make(map[string][]*MenuItem)}
+
+func invalidateMenuCache() {
+	menus.Lock()
+	defer menus.Unlock()
+
+	menus.menus = make(map[string][]*MenuItem)
+	menus.generation++
+}
+
+// getMenu - menu tree visible to the session's user and the breadcrumbs of url
+func getMenu(sessionData *SessionData, url string) ([]*MenuItem, []*MenuItem, error) {
+	var user string
+	lang := config.I18n.DefaultLanguage
+
+	if sessionData != nil {
+		if sessionData.LoggedIn {
+			user = sessionData.User.Username
+		}
+
+		if len(sessionData.Lang) > 0 {
+			lang = sessionData.Lang
+		}
+	}
+
+	roleIDs, err := getSessionRoleIDs(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree, err := getMenuTree(lang, roleIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sURL := "index"
+	if url != "/" {
+		sURL = strings.Replace(url[1:], ".html", "", 1)
+	}
+
+	return tree, findBreadcrumbs(tree, sURL), nil
+}
+
+// loadUserRoleIDs - ids of the roles the user holds at dt, plus the "All" role,
+// and of every role they inherit
+func loadUserRoleIDs(user string, dt time.Time) ([]int, error) {
+	var roleIDs []int
+
+	if len(user) == 0 {
+		user = "-"
+	}
+
+	pq := dbutl.PQuery(`
+		SELECT rc.descendant_role_id
+		  FROM role r
+		  JOIN role_closure rc ON (r.role_id = rc.ancestor_role_id)
+		 WHERE r.loweredrole = lower(?)
+		UNION
+		SELECT rc.descendant_role_id
+		  FROM "user" u
+		  JOIN user_role ur ON (u.user_id = ur.user_id)
+		  JOIN role_closure rc ON (ur.role_id = rc.ancestor_role_id)
+		 WHERE u.loweredusername = lower(?)
+		   AND u.valid = ?
+		   AND ur.valid = ?
+		   AND ur.valid_from <= ?
+		   AND (ur.valid_until is null OR ur.valid_until > ?)
+	`, "All",
+		user,
+		1,
+		1,
+		dt,
+		dt)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var roleID int
+
+		err = row.Scan(&roleID)
+		if err != nil {
+			return err
+		}
+
+		roleIDs = append(roleIDs, roleID)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(roleIDs)
+
+	return roleIDs, nil
+}
+
+func getMenuTree(lang string, roleIDs []int) ([]*MenuItem, error) {
+	var ids []string
+	var args []interface{}
+
+	for _, roleID := range roleIDs {
+		ids = append(ids, strconv.Itoa(roleID))
+		args = append(args, roleID)
+	}
+
+	key := lang + "|" + strings.Join(ids, ",")
+
+	menus.RLock()
+	tree, ok := menus.menus[key]
+	generation := menus.generation
+	menus.RUnlock()
+
+	if ok {
+		return tree, nil
+	}
+
+	if len(roleIDs) == 0 {
+		return nil, nil
+	}
+
+	args = append([]interface{}{lang, config.I18n.DefaultLanguage, "GET", "-"}, args...)
+
+	pq := dbutl.PQuery(`
+		SELECT DISTINCT r.request_id,
+		       r.request_url,
+		       CASE
+		         WHEN nm.name IS NOT NULL THEN nm.name
+		         WHEN en.name IS NOT NULL THEN en.name
+		         ELSE r.request_url
+		       END AS name,
+		       r.index_level,
+		       r.order_number,
+		       CASE WHEN r.parent_id IS NULL THEN -1 ELSE r.parent_id END AS parent_id
+		  FROM request r
+		  JOIN request_role rr ON (r.request_id = rr.request_id)
+		  LEFT OUTER JOIN request_name nm ON (r.request_id = nm.request_id AND nm.language = ?)
+		  LEFT OUTER JOIN request_name en ON (r.request_id = en.request_id AND en.language = ?)
+		 WHERE r.request_type = ?
+		   AND r.request_template <> ?
+		   AND r.index_level IS NOT NULL
+		   AND rr.role_id IN (`+strings.Repeat("?, ", len(roleIDs)-1)+`?)
+		 ORDER BY r.index_level, r.order_number
+	`, args...)
+
+	var items []*MenuItem
+	var err error
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var item MenuItem
+		err = sc.Scan(dbutl, row, &item)
+		if err != nil {
+			return err
+		}
+
+		item.Href = "/" + item.URL
+		if item.URL == "index" {
+			item.Href = "/"
+		}
+
+		items = append(items, &item)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	tree = buildMenuTree(items)
+
+	menus.Lock()
+	if menus.generation == generation {
+		menus.menus[key] = tree
+	}
+	menus.Unlock()
+
+	return tree, nil
+}
+
+// buildMenuTree - items come ordered; children whose parent is not visible go to the top level
+func buildMenuTree(items []*MenuItem) []*MenuItem {
+	var tree []*MenuItem
+	byID := make(map[int]*MenuItem)
+
+	for _, item := range items {
+		byID[item.RequestID] = item
+	}
+
+	for _, item := range items {
+		if parent, ok := byID[item.ParentID]; ok && item.ParentID != item.RequestID {
+			parent.Children = append(parent.Children, item)
+		} else {
+			tree = append(tree, item)
+		}
+	}
+
+	return tree
+}
+
+// findBreadcrumbs - path from the top of the menu to url
+func findBreadcrumbs(items []*MenuItem, url string) []*MenuItem {
+	for _, item := range items {
+		if item.URL == url {
+			return []*MenuItem{item}
+		}
+
+		if path := findBreadcrumbs(item.Children, url); path != nil {
+			return append([]*MenuItem{item}, path...)
+		}
+	}
+
+	return nil
+}
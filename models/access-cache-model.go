@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// AccessCacheStatsModel - hits and misses of one access cache
+type AccessCacheStatsModel struct {
+	Cache    string  `json:"cache"`
+	Entries  int     `json:"entries"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// AccessCacheResponseModel - access cache statistics
+type AccessCacheResponseModel struct {
+	GenericResponseModel
+	Counter          int64                    `json:"counter"`
+	LastCheck        time.Time                `json:"last_check"`
+	Invalidations    uint64                   `json:"invalidations"`
+	LastInvalidation time.Time                `json:"last_invalidation"`
+	Caches           []*AccessCacheStatsModel `json:"caches"`
+}
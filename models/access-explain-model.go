@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// AccessExplainRoleModel - role membership of the explained user
+type AccessExplainRoleModel struct {
+	RoleID     int       `json:"role_id" sql:"role_id"`
+	Role       string    `json:"role" sql:"role"`
+	ValidFrom  time.Time `json:"valid_from" sql:"valid_from"`
+	Expires    bool      `json:"expires" sql:"expires"`
+	ValidUntil time.Time `json:"valid_until" sql:"valid_until"`
+	Valid      bool      `json:"valid" sql:"valid"`
+	Active     bool      `json:"active"`
+	Status     string    `json:"status"`
+	Implicit   bool      `json:"implicit"`
+}
+
+// AccessExplainGrantModel - request_role row of the explained request
+type AccessExplainGrantModel struct {
+	RoleID  int    `json:"role_id" sql:"role_id"`
+	Role    string `json:"role" sql:"role"`
+	Matched bool   `json:"matched"`
+	Via     string `json:"via"`
+	Reason  string `json:"reason"`
+}
+
+// AccessExplainModel - why a user may or may not call a request
+type AccessExplainModel struct {
+	Username       string                     `json:"username"`
+	URL            string                     `json:"url"`
+	Method         string                     `json:"method"`
+	RequestURL     string                     `json:"request_url"`
+	At             time.Time                  `json:"at"`
+	RequestFound   bool                       `json:"request_found"`
+	RequestID      int                        `json:"request_id"`
+	Template       string                     `json:"template"`
+	Controller     string                     `json:"controller"`
+	Action         string                     `json:"action"`
+	Permission     string                     `json:"permission"`
+	UserFound      bool                       `json:"user_found"`
+	UserValid      bool                       `json:"user_valid"`
+	UserActivated  bool                       `json:"user_activated"`
+	UserLockedOut  bool                       `json:"user_locked_out"`
+	Memberships    []*AccessExplainRoleModel  `json:"memberships"`
+	EffectiveRoles []string                   `json:"effective_roles"`
+	Grants         []*AccessExplainGrantModel `json:"grants"`
+	Allowed        bool                       `json:"allowed"`
+	Decision       string                     `json:"decision"`
+	Notes          []string                   `json:"notes"`
+}
+
+// AccessExplainResponseModel - access explain page model
+type AccessExplainResponseModel struct {
+	GenericResponseModel
+	Explain *AccessExplainModel `json:"explain"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// AccountDeletionRequestModel - request of a user to have their account anonymized
+type AccountDeletionRequestModel struct {
+	DeletionRequestID int       `json:"deletion_request_id" sql:"deletion_request_id"`
+	UserID            int       `json:"user_id" sql:"user_id"`
+	Username          string    `json:"username" sql:"username"`
+	Name              string    `json:"name" sql:"name"`
+	Surname           string    `json:"surname" sql:"surname"`
+	RequestTime       time.Time `json:"request_time" sql:"request_time"`
+	Reason            string    `json:"reason" sql:"reason"`
+	Status            string    `json:"status" sql:"status"`
+	DecidedBy         string    `json:"decided_by" sql:"decided_by"`
+	DecisionTime      time.Time `json:"decision_time" sql:"decision_time"`
+}
+
+// AccountDeletionRequestsResponseModel - deletion requests page model
+type AccountDeletionRequestsResponseModel struct {
+	GenericResponseModel
+	Pending []*AccountDeletionRequestModel `json:"pending"`
+	Decided []*AccountDeletionRequestModel `json:"decided"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// APITokenModel - API token (the token itself is never returned)
+type APITokenModel struct {
+	APITokenID   int       `json:"api_token_id" sql:"api_token_id"`
+	Name         string    `json:"name" sql:"name"`
+	TokenPrefix  string    `json:"token_prefix" sql:"token_prefix"`
+	CreationTime time.Time `json:"creation_time" sql:"creation_time"`
+	Expires      bool      `json:"expires" sql:"expires"`
+	ValidUntil   time.Time `json:"valid_until" sql:"valid_until"`
+	Used         bool      `json:"used" sql:"used"`
+	LastUsedTime time.Time `json:"last_used_time" sql:"last_used_time"`
+	LastUsedIP   string    `json:"last_used_ip" sql:"last_used_ip"`
+}
+
+// APITokenRequestModel - request a token can be scoped to
+type APITokenRequestModel struct {
+	RequestID   int    `json:"request_id" sql:"request_id"`
+	RequestType string `json:"request_type" sql:"request_type"`
+	RequestURL  string `json:"request_url" sql:"request_url"`
+}
+
+// APITokensResponseModel - API tokens page model
+type APITokensResponseModel struct {
+	GenericResponseModel
+	Tokens   []*APITokenModel        `json:"tokens"`
+	Roles    []string                `json:"roles"`
+	Requests []*APITokenRequestModel `json:"requests"`
+}
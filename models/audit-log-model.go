@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// AuditLogModel - audit log entry, with the common fields of log_msg taken out
+type AuditLogModel struct {
+	AuditLogID int64                  `json:"audit_log_id"`
+	Source     string                 `json:"source"`
+	LogTime    time.Time              `json:"log_time"`
+	Level      string                 `json:"level"`
+	Message    string                 `json:"msg"`
+	Error      string                 `json:"error"`
+	IsError    bool                   `json:"is_error"`
+	User       string                 `json:"user"`
+	IP         string                 `json:"ip"`
+	Details    map[string]interface{} `json:"details"`
+}
+
+// AuditLogResponseModel - audit log page model
+type AuditLogResponseModel struct {
+	GenericResponseModel
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Operation string           `json:"operation"`
+	User      string           `json:"user"`
+	IP        string           `json:"ip"`
+	Status    string           `json:"status"`
+	Text      string           `json:"text"`
+	Entries   []*AuditLogModel `json:"entries"`
+	Rows      int              `json:"rows"`
+	Page      int              `json:"page"`
+	PrevPage  int              `json:"prev_page"`
+	NextPage  int              `json:"next_page"`
+}
@@ -0,0 +1,9 @@
+package models
+
+// FileResponseModel - a download: the content is sent as is instead of a page or json
+type FileResponseModel struct {
+	GenericResponseModel
+	FileName    string `json:"-"`
+	ContentType string `json:"-"`
+	Content     []byte `json:"-"`
+}
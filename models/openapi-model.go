@@ -0,0 +1,14 @@
+package models
+
+import "encoding/json"
+
+// OpenAPIResponseModel - OpenAPI document
+type OpenAPIResponseModel struct {
+	GenericResponseModel
+	Document interface{}
+}
+
+// MarshalJSON - only the document itself is sent to the client
+func (r *OpenAPIResponseModel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Document)
+}
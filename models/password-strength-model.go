@@ -0,0 +1,13 @@
+package models
+
+// PasswordStrengthResponseModel - estimated strength of a password, for live feedback while typing it
+type PasswordStrengthResponseModel struct {
+	GenericResponseModel
+	Score        int      `json:"score"`
+	MinScore     int      `json:"min_score"`
+	Acceptable   bool     `json:"acceptable"`
+	GuessesLog10 float64  `json:"guesses_log10"`
+	Label        string   `json:"label"`
+	Warning      string   `json:"warning"`
+	Suggestions  []string `json:"suggestions"`
+}
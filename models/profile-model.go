@@ -0,0 +1,14 @@
+package models
+
+// ProfileResponseModel - own profile page model
+type ProfileResponseModel struct {
+	GenericResponseModel
+	Username       string `json:"username"`
+	Name           string `json:"name"`
+	Surname        string `json:"surname"`
+	Email          string `json:"email"`
+	PendingEmail   string `json:"pending_email"`
+	PasswordSource string `json:"password_source"`
+	// DeletionRequested - the user asked for their account to be deleted, an administrator has not decided yet
+	DeletionRequested bool `json:"deletion_requested"`
+}
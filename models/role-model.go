@@ -0,0 +1,68 @@
+package models
+
+import "time"
+
+// RoleModel - role with its current member count
+type RoleModel struct {
+	RoleID  int    `json:"role_id" sql:"role_id"`
+	Role    string `json:"role" sql:"role"`
+	Members int    `json:"members" sql:"members"`
+	Managed bool   `json:"managed" sql:"managed"`
+}
+
+// RoleMemberModel - user membership of a role
+type RoleMemberModel struct {
+	UserRoleID int       `json:"user_role_id" sql:"user_role_id"`
+	RoleID     int       `json:"role_id" sql:"role_id"`
+	Role       string    `json:"role" sql:"role"`
+	UserID     int       `json:"user_id" sql:"user_id"`
+	Username   string    `json:"username" sql:"username"`
+	Name       string    `json:"name" sql:"name"`
+	Surname    string    `json:"surname" sql:"surname"`
+	ValidFrom  time.Time `json:"valid_from" sql:"valid_from"`
+	Expires    bool      `json:"expires" sql:"expires"`
+	ValidUntil time.Time `json:"valid_until" sql:"valid_until"`
+	Valid      bool      `json:"valid" sql:"valid"`
+	Active     bool      `json:"active" sql:"active"`
+}
+
+// RoleHistoryModel - membership change
+type RoleHistoryModel struct {
+	UserRoleHistoryID int       `json:"user_role_history_id" sql:"user_role_history_id"`
+	RoleID            int       `json:"role_id" sql:"role_id"`
+	Role              string    `json:"role" sql:"role"`
+	Username          string    `json:"username" sql:"username"`
+	ValidFrom         time.Time `json:"valid_from" sql:"valid_from"`
+	Expires           bool      `json:"expires" sql:"expires"`
+	ValidUntil        time.Time `json:"valid_until" sql:"valid_until"`
+	ChangeType        string    `json:"change_type" sql:"change_type"`
+	ChangeTime        time.Time `json:"change_time" sql:"change_time"`
+	ChangedBy         string    `json:"changed_by" sql:"changed_by"`
+}
+
+// RolesResponseModel - roles page model
+type RolesResponseModel struct {
+	GenericResponseModel
+	Roles     []*RoleModel       `json:"roles"`
+	Upcoming  []*RoleMemberModel `json:"upcoming"`
+	Expiring  []*RoleMemberModel `json:"expiring"`
+	DaysAhead int                `json:"days_ahead"`
+}
+
+// RoleMembersResponseModel - role members page model
+type RoleMembersResponseModel struct {
+	GenericResponseModel
+	Role    RoleModel          `json:"role"`
+	Members []*RoleMemberModel `json:"members"`
+}
+
+// RoleHistoryResponseModel - role membership history page model
+type RoleHistoryResponseModel struct {
+	GenericResponseModel
+	RoleID   int                 `json:"role_id"`
+	Role     string              `json:"role"`
+	History  []*RoleHistoryModel `json:"history"`
+	Page     int                 `json:"page"`
+	PrevPage int                 `json:"prev_page"`
+	NextPage int                 `json:"next_page"`
+}
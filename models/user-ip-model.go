@@ -0,0 +1,17 @@
+package models
+
+// UserIPModel - network a user may log in from
+type UserIPModel struct {
+	UserIPID int    `json:"user_ip_id" sql:"user_ip_id"`
+	Network  string `json:"network" sql:"ip"`
+	// Valid - false for rows that are neither an ip nor a cidr range, they match no address
+	Valid bool `json:"valid"`
+}
+
+// UserIPsResponseModel - allowed networks page model
+type UserIPsResponseModel struct {
+	GenericResponseModel
+	User     UserModel      `json:"user"`
+	Networks []*UserIPModel `json:"networks"`
+	ClientIP string         `json:"client_ip"`
+}
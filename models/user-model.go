@@ -15,5 +15,6 @@ type UserModel struct {
 	Activated       bool      `sql:"activated" json:"activated"`
 	LockedOut       bool      `sql:"locked_out" json:"locked_out"`
 	Valid           bool      `sql:"valid" json:"valid"`
+	PasswordSource  string    `sql:"password_source" json:"password_source"`
 	Password        string    `json:"-"`
 }
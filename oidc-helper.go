@@ -0,0 +1,864 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Login through an OpenID Connect provider, authorization code flow with PKCE:
+//   - /login-oidc keeps a random state, nonce and code verifier in a short lived cookie
+//     and sends the browser to the authorization endpoint of the provider
+//   - /login-oidc-callback checks the state, exchanges the code (with the verifier) for tokens
+//     and verifies the RS256 signed ID token against the keys of the provider
+// The identity (issuer + subject) is linked to a local user in user_external_identity.
+
+const oidcFlowMaxAge = 10 * time.Minute
+const oidcClockSkew = time.Minute
+const oidcDiscoveryTTL = time.Hour
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider - the discovery document of the provider and its signing keys
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	discovered            time.Time
+	keys                  map[string]*rsa.PublicKey
+	keysFetched           time.Time
+}
+
+var oidcState = struct {
+	sync.Mutex
+	provider *oidcProvider
+}{}
+
+// oidcClaims - claims of a verified ID token
+type oidcClaims map[string]interface{}
+
+func oidcCookieStoreName() string {
+	return authCookieStoreName + "OIDC"
+}
+
+// getOIDCProvider - discovery document of config.OIDC.Issuer, cached for an hour
+func getOIDCProvider() (*oidcProvider, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+
+	if p := oidcState.provider; p != nil && time.Since(p.discovered) < oidcDiscoveryTTL {
+		return p, nil
+	}
+
+	issuer := strings.TrimSuffix(config.OIDC.Issuer, "/")
+
+	var p oidcProvider
+	err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &p)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer \"%s\" does not match the configured \"%s\"", p.Issuer, config.OIDC.Issuer)
+	}
+
+	if len(p.AuthorizationEndpoint) == 0 || len(p.TokenEndpoint) == 0 || len(p.JWKSURI) == 0 {
+		return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+
+	p.discovered = time.Now()
+
+	// keep the keys we have, the provider did not change them because we looked again
+	if old := oidcState.provider; old != nil && old.JWKSURI == p.JWKSURI {
+		p.keys = old.keys
+		p.keysFetched = old.keysFetched
+	}
+
+	oidcState.provider = &p
+
+	return &p, nil
+}
+
+// oidcSigningKey - the RSA key with the kid; the key set is fetched again
+// (at most once a minute) when the provider signs with a key we do not know yet
+func oidcSigningKey(p *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+
+	key := findOIDCKey(p.keys, kid)
+	if key != nil {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("oidc: unknown signing key \"%s\"", kid)
+	}
+
+	keys, err := fetchOIDCKeys(p.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	key = findOIDCKey(p.keys, kid)
+	if key == nil {
+		return nil, fmt.Errorf("oidc: unknown signing key \"%s\"", kid)
+	}
+
+	return key, nil
+}
+
+// findOIDCKey - a token without kid can only be checked when the provider has a single key
+func findOIDCKey(keys map[string]*rsa.PublicKey, kid string) *rsa.PublicKey {
+	if len(kid) == 0 && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+
+	return keys[kid]
+}
+
+func fetchOIDCKeys(jwksURI string) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	err := oidcGetJSON(jwksURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (len(k.Use) > 0 && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("oidc keys: key \"%s\": %v", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("oidc keys: key \"%s\": %v", k.Kid, err)
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("oidc keys: key \"%s\": invalid exponent", k.Kid)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+
+	return keys, nil
+}
+
+func oidcGetJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func oidcRandom() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcRedirectURL - redirect-url of the config, or /login-oidc-callback of the host the browser used
+func oidcRedirectURL(r *http.Request) string {
+	if len(config.OIDC.RedirectURL) > 0 {
+		return config.OIDC.RedirectURL
+	}
+
+	return siteURL(r, "/login-oidc-callback")
+}
+
+// oidcAuthorizationURL - start a login: remember state, nonce and code verifier,
+// and return the url of the provider to send the browser to
+func oidcAuthorizationURL(w http.ResponseWriter, r *http.Request) (string, error) {
+	p, err := getOIDCProvider()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := oidcRandom()
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := oidcRandom()
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := oidcRandom()
+	if err != nil {
+		return "", err
+	}
+
+	session, _ := cookieStore.Get(r, oidcCookieStoreName())
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+	session.Values["started"] = time.Now().Unix()
+
+	err = session.Save(r, w)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := neturl.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", config.OIDC.ClientID)
+	q.Set("redirect_uri", oidcRedirectURL(r))
+	q.Set("scope", config.OIDC.Scopes)
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return p.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// oidcAuthenticate - finish a login on the callback: the claims of the verified ID token
+func oidcAuthenticate(w http.ResponseWriter, r *http.Request) (oidcClaims, error) {
+	session, _ := cookieStore.Get(r, oidcCookieStoreName())
+
+	state, _ := session.Values["state"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	verifier, _ := session.Values["verifier"].(string)
+	started, _ := session.Values["started"].(int64)
+
+	// a state is good for one callback only
+	session.Options.MaxAge = -1
+	err := session.Save(r, w)
+	if err != nil {
+		return nil, err
+	}
+
+	if errCode := r.FormValue("error"); len(errCode) > 0 {
+		return nil, fmt.Errorf("oidc: the provider answered \"%s\": %s", errCode, r.FormValue("error_description"))
+	}
+
+	if len(state) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		return nil, errors.New("oidc: unknown or reused state")
+	}
+
+	if time.Since(time.Unix(started, 0)) > oidcFlowMaxAge {
+		return nil, errors.New("oidc: the login took too long")
+	}
+
+	code := r.FormValue("code")
+	if len(code) == 0 {
+		return nil, errors.New("oidc: no authorization code")
+	}
+
+	p, err := getOIDCProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := oidcExchangeCode(p, code, verifier, oidcRedirectURL(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyOIDCToken(p, idToken, nonce)
+}
+
+// oidcExchangeCode - the ID token for the authorization code
+func oidcExchangeCode(p *oidcProvider, code string, verifier string, redirectURL string) (string, error) {
+	form := neturl.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", config.OIDC.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	// public clients have no secret, PKCE is their proof
+	if len(config.OIDC.ClientSecret) > 0 {
+		req.SetBasicAuth(neturl.QueryEscape(config.OIDC.ClientID), neturl.QueryEscape(config.OIDC.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", fmt.Errorf("oidc token: %s: %v", resp.Status, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(token.Error) > 0 {
+		return "", fmt.Errorf("oidc token: %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+
+	if len(token.IDToken) == 0 {
+		return "", errors.New("oidc token: no id_token in the answer")
+	}
+
+	return token.IDToken, nil
+}
+
+// verifyOIDCToken - signature, issuer, audience, expiry and nonce of an ID token
+func verifyOIDCToken(p *oidcProvider, idToken string, nonce string) (oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: unsupported id token algorithm \"%s\"", header.Alg)
+	}
+
+	key, err := oidcSigningKey(p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed id token signature")
+	}
+
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return nil, errors.New("oidc: invalid id token signature")
+	}
+
+	var claims oidcClaims
+
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if strings.TrimSuffix(claims.String("iss"), "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("oidc: id token of another issuer \"%s\"", claims.String("iss"))
+	}
+
+	audience := claims.Strings("aud")
+	if !containsString(audience, config.OIDC.ClientID) {
+		return nil, errors.New("oidc: id token for another client")
+	}
+
+	if len(audience) > 1 && claims.String("azp") != config.OIDC.ClientID {
+		return nil, errors.New("oidc: id token authorized for another client")
+	}
+
+	exp, ok := claims.Time("exp")
+	if !ok || now.After(exp.Add(oidcClockSkew)) {
+		return nil, errors.New("oidc: id token expired")
+	}
+
+	if iat, ok := claims.Time("iat"); ok && iat.After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("oidc: id token issued in the future")
+	}
+
+	if len(nonce) == 0 || subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return nil, errors.New("oidc: id token nonce mismatch")
+	}
+
+	if len(claims.String("sub")) == 0 {
+		return nil, errors.New("oidc: id token without subject")
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("oidc: malformed id token")
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return errors.New("oidc: malformed id token")
+	}
+
+	return nil
+}
+
+// value - claim by name; a dotted name looks into nested objects (realm_access.roles)
+func (c oidcClaims) value(name string) interface{} {
+	var v interface{} = map[string]interface{}(c)
+
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		v = m[part]
+	}
+
+	return v
+}
+
+// String - claim as text
+func (c oidcClaims) String(name string) string {
+	switch v := c.value(name).(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%v", v)
+	}
+
+	return ""
+}
+
+// Strings - claim as a list: a json array, or a text of space or comma separated values
+func (c oidcClaims) Strings(name string) []string {
+	var list []string
+
+	switch v := c.value(name).(type) {
+	case string:
+		list = strings.FieldsFunc(v, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+
+	return list
+}
+
+// Bool - claim as boolean; some providers send "true" as text
+func (c oidcClaims) Bool(name string) bool {
+	switch v := c.value(name).(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+
+	return false
+}
+
+// Time - NumericDate claim
+func (c oidcClaims) Time(name string) (time.Time, bool) {
+	v, ok := c.value(name).(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(v), 0), true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oidcLoginUser - local user of the verified identity: the linked one, else the one with the
+// same verified email (link-by-email), else a new one (auto-provision). Syncs the mapped roles.
+func oidcLoginUser(claims oidcClaims, ip string) (*AuthResult, error) {
+	issuer := claims.String("iss")
+	subject := claims.String("sub")
+	email := claims.String("email")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	dt := time.Now().UTC()
+
+	userID, err := getExternalIdentityUser(tx, issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID > 0 {
+		pq := dbutl.PQuery(`
+		    UPDATE user_external_identity
+		       SET last_login = ?,
+		           email = ?
+		     WHERE issuer = ?
+		       AND subject = ?
+		`, dt,
+			email,
+			issuer,
+			subject)
+
+		_, err = dbutl.ExecTx(tx, pq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if userID <= 0 && config.OIDC.LinkByEmail && len(email) > 0 && claims.Bool("email_verified") {
+		userID, err = getUserIDByEmail(tx, email)
+		if err != nil {
+			return nil, err
+		}
+
+		if userID > 0 {
+			err = linkExternalIdentity(tx, userID, issuer, subject, email, dt)
+			if err != nil {
+				return nil, err
+			}
+
+			audit.Log(nil, "oidc-link", "External identity linked by email", "user_id", userID, "issuer", issuer, "subject", subject, "email", email)
+		}
+	}
+
+	u := MembershipUser{tx: tx}
+
+	if userID <= 0 {
+		if !config.OIDC.AutoProvision {
+			return nil, newLocalizedError("oidc.no-account")
+		}
+
+		err = provisionOIDCUser(&u, claims)
+		if err != nil {
+			return nil, err
+		}
+
+		err = linkExternalIdentity(tx, u.UserID, issuer, subject, email, dt)
+		if err != nil {
+			return nil, err
+		}
+
+		audit.Log(nil, "oidc-provision", "User created from an external identity", "user", u.Username, "issuer", issuer, "subject", subject, "email", email)
+	} else {
+		err = u.GetByID(userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	testUser, err := getOIDCLoginCheck(tx, u.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkUserCanLogin(tx, testUser, u.Username, ip, dt)
+	if err != nil {
+		return nil, err
+	}
+
+	rolesChanged, err := syncOIDCRoles(&u, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if rolesChanged {
+		invalidateAccessCache()
+	}
+
+	return &AuthResult{
+		UserID:   u.UserID,
+		Username: u.Username,
+		Name:     u.Name,
+		Surname:  u.Surname,
+	}, nil
+}
+
+// getOIDCLoginCheck - what checkUserCanLogin needs of the user
+func getOIDCLoginCheck(tx *sql.Tx, userID int) (*validateUserUtil, error) {
+	pq := dbutl.PQuery(`
+	    SELECT u.user_id,
+	           activated,
+	           locked_out,
+	           CASE WHEN u.locked_until IS NULL THEN 0 ELSE 1 END AS lock_expires,
+	           CASE WHEN u.locked_until IS NULL THEN u.creation_time ELSE u.locked_until END AS locked_until,
+	           u.valid
+	      FROM "user" u
+	     WHERE u.user_id = ?
+	`, userID)
+
+	testUser := validateUserUtil{}
+
+	err := dbutl.RunQueryTx(tx, pq, &testUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testUser, nil
+}
+
+// oidcAuthenticator - the callback of the OpenID Connect provider
+type oidcAuthenticator struct {
+}
+
+func (oidcAuthenticator) Name() string {
+	return "oidc"
+}
+
+func (oidcAuthenticator) Authenticate(c *Credentials) (*AuthResult, error) {
+	if c.Request == nil || !config.OIDC.Enabled {
+		return nil, errAuthNotApplicable
+	}
+
+	claims, err := oidcAuthenticate(c.Response, c.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	return oidcLoginUser(claims, c.IP)
+}
+
+func getExternalIdentityUser(tx *sql.Tx, issuer string, subject string) (int, error) {
+	var userID int
+
+	pq := dbutl.PQuery(`
+	    SELECT user_id
+	      FROM user_external_identity
+	     WHERE issuer = ?
+	       AND subject = ?
+	`, issuer,
+		subject)
+
+	err := tx.QueryRow(pq.Query, pq.Args...).Scan(&userID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return -1, nil
+	case err != nil:
+		return -1, err
+	}
+
+	return userID, nil
+}
+
+// getUserIDByEmail - the only user with the email, or -1 (no user, or more than one)
+func getUserIDByEmail(tx *sql.Tx, email string) (int, error) {
+	userID := -1
+	found := 0
+
+	pq := dbutl.PQuery(`
+	    SELECT user_id
+	      FROM "user"
+	     WHERE loweredemail = lower(?)
+	`, email)
+
+	rows, err := tx.Query(pq.Query, pq.Args...)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		found++
+
+		err = rows.Scan(&userID)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return -1, err
+	}
+
+	if found != 1 {
+		return -1, nil
+	}
+
+	return userID, nil
+}
+
+func linkExternalIdentity(tx *sql.Tx, userID int, issuer string, subject string, email string, dt time.Time) error {
+	pq := dbutl.PQuery(`
+	    INSERT INTO user_external_identity (
+	        user_id,
+	        issuer,
+	        subject,
+	        email,
+	        creation_time,
+	        last_login
+	    )
+	    VALUES (?, ?, ?, ?, ?, ?)
+	`, userID,
+		issuer,
+		subject,
+		email,
+		dt,
+		dt)
+
+	_, err := dbutl.ExecTx(tx, pq)
+	return err
+}
+
+// provisionOIDCUser - new activated Member from the claims. It gets a random password
+// nobody knows; an administrator can give it a temporary one for local logins.
+func provisionOIDCUser(u *MembershipUser, claims oidcClaims) error {
+	username := claims.String(config.OIDC.UsernameClaim)
+	if len(username) == 0 {
+		username = claims.String("email")
+	}
+
+	if len(username) == 0 {
+		return newLocalizedError("oidc.no-username", config.OIDC.UsernameClaim)
+	}
+
+	exists, err := u.Exists(username)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return newLocalizedError("oidc.username-taken", username)
+	}
+
+	password, err := generateTemporaryPassword()
+	if err != nil {
+		return err
+	}
+
+	u.UserID = -1
+	u.Username = username
+	u.Name = claims.String("given_name")
+	u.Surname = claims.String("family_name")
+	u.Email = claims.String("email")
+	u.Password = password
+	u.Valid = true
+
+	err = u.Save()
+	if err != nil {
+		return err
+	}
+
+	err = u.AddToRole("Member")
+	if err != nil {
+		return err
+	}
+
+	err = u.Activate()
+	if err != nil {
+		return err
+	}
+
+	return u.GetByID(u.UserID)
+}
+
+// oidcRoleMapping - role-mapping of the config: "claim value=Role,claim value=Role"
+func oidcRoleMapping() map[string][]string {
+	mapping := make(map[string][]string)
+
+	for _, pair := range strings.Split(config.OIDC.RoleMapping, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(kv[0])
+		role := strings.TrimSpace(kv[1])
+
+		if len(value) > 0 && len(role) > 0 {
+			mapping[role] = append(mapping[role], value)
+		}
+	}
+
+	return mapping
+}
+
+// syncOIDCRoles - the roles of role-mapping follow the values of roles-claim
+func syncOIDCRoles(u *MembershipUser, claims oidcClaims) (bool, error) {
+	if len(config.OIDC.RolesClaim) == 0 {
+		return false, nil
+	}
+
+	return u.SyncMappedRoles(oidcRoleMapping(), claims.Strings(config.OIDC.RolesClaim), "oidc")
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const testOIDCClientID = "go-web-app"
+
+var testOIDCKeys = struct {
+	sync.Once
+	signing *rsa.PrivateKey
+	other   *rsa.PrivateKey
+}{}
+
+// testOIDCSigningKeys - the key of the provider and one it does not know
+func testOIDCSigningKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	testOIDCKeys.Do(func() {
+		testOIDCKeys.signing, _ = rsa.GenerateKey(rand.Reader, 2048)
+		testOIDCKeys.other, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+
+	if testOIDCKeys.signing == nil || testOIDCKeys.other == nil {
+		t.Fatal("could not generate the rsa keys")
+	}
+
+	return testOIDCKeys.signing, testOIDCKeys.other
+}
+
+// testOIDCGrant - what the provider remembers of an authorization
+type testOIDCGrant struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+// testOIDCProvider - discovery, keys and token endpoint of a provider; authorize stands
+// for the user logging in at the provider
+type testOIDCProvider struct {
+	*httptest.Server
+	t      *testing.T
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]testOIDCGrant
+	claims map[string]interface{}
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, _ := testOIDCSigningKeys(t)
+
+	p := &testOIDCProvider{
+		t:      t,
+		key:    key,
+		grants: make(map[string]testOIDCGrant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *testOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+	})
+}
+
+func (p *testOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// token - the code is good once, for the verifier of its challenge and the same redirect uri
+func (p *testOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grant, ok := p.grants[r.FormValue("code")]
+	delete(p.grants, r.FormValue("code"))
+	claims := p.claims
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+
+	switch {
+	case !ok || r.FormValue("grant_type") != "authorization_code":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	case r.FormValue("redirect_uri") != grant.redirectURI:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "redirect_uri mismatch"})
+		return
+	}
+
+	idClaims := p.idClaims(map[string]interface{}{"nonce": grant.nonce})
+	for k, v := range claims {
+		idClaims[k] = v
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"token_type": "Bearer",
+		"id_token":   signTestIDToken(p.t, p.key, "k1", idClaims),
+	})
+}
+
+// idClaims - the claims of a good ID token, changed by extra
+func (p *testOIDCProvider) idClaims(extra map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+
+	claims := map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   "subject-1",
+		"aud":   testOIDCClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": "nonce-1",
+	}
+
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	return claims
+}
+
+// authorize - the user logs in at the provider, which redirects back with a code
+func (p *testOIDCProvider) authorize(authURL string) neturl.Values {
+	u, err := neturl.Parse(authURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	q := u.Query()
+
+	if q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0 {
+		p.t.Fatalf("authorization without a S256 code challenge: %s", authURL)
+	}
+
+	if q.Get("client_id") != testOIDCClientID || q.Get("response_type") != "code" {
+		p.t.Fatalf("unexpected authorization request: %s", authURL)
+	}
+
+	code, err := oidcRandom()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	p.grants[code] = testOIDCGrant{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	p.mu.Unlock()
+
+	callback := neturl.Values{}
+	callback.Set("state", q.Get("state"))
+	callback.Set("code", code)
+
+	return callback
+}
+
+func signTestIDToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// useTestOIDCProvider - config.OIDC and the cookie store for p, put back at the end of the test
+func useTestOIDCProvider(t *testing.T, p *testOIDCProvider) {
+	oldConfig := config.OIDC
+	oldStore := cookieStore
+
+	config.OIDC.Enabled = true
+	config.OIDC.Issuer = p.URL
+	config.OIDC.ClientID = testOIDCClientID
+	config.OIDC.ClientSecret = ""
+	config.OIDC.RedirectURL = "https://app.example.com/login-oidc-callback"
+	config.OIDC.Scopes = "openid profile email"
+	config.OIDC.UsernameClaim = "preferred_username"
+
+	cookieStore = sessions.NewCookieStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+
+	oidcState.Lock()
+	oidcState.provider = nil
+	oidcState.Unlock()
+
+	t.Cleanup(func() {
+		config.OIDC = oldConfig
+		cookieStore = oldStore
+
+		oidcState.Lock()
+		oidcState.provider = nil
+		oidcState.Unlock()
+	})
+}
+
+// testOIDCStart - /login-oidc: the url of the provider and the cookies of the flow
+func testOIDCStart(t *testing.T) (string, []*http.Cookie) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login-oidc", nil)
+
+	authURL, err := oidcAuthorizationURL(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return authURL, w.Result().Cookies()
+}
+
+// testOIDCCallback - /login-oidc-callback with the query and cookies
+func testOIDCCallback(q neturl.Values, cookies []*http.Cookie) (oidcClaims, error) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login-oidc-callback?"+q.Encode(), nil)
+
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	return oidcAuthenticate(w, r)
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	useTestOIDCProvider(t, p)
+
+	authURL, cookies := testOIDCStart(t)
+
+	claims, err := testOIDCCallback(p.authorize(authURL), cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.String("sub") != "subject-1" || claims.String("iss") != p.URL {
+		t.Errorf("unexpected claims %v", claims)
+	}
+}
+
+func TestOIDCState(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	useTestOIDCProvider(t, p)
+
+	authURL, cookies := testOIDCStart(t)
+	callback := p.authorize(authURL)
+
+	wrongState := neturl.Values{}
+	wrongState.Set("state", "forged")
+	wrongState.Set("code", callback.Get("code"))
+
+	_, err := testOIDCCallback(wrongState, cookies)
+	if err == nil || !strings.Contains(err.Error(), "state") {
+		t.Errorf("wrong state: got %v", err)
+	}
+
+	// the browser that started no login has no state
+	_, err = testOIDCCallback(callback, nil)
+	if err == nil || !strings.Contains(err.Error(), "state") {
+		t.Errorf("no state cookie: got %v", err)
+	}
+
+	providerError := neturl.Values{}
+	providerError.Set("state", callback.Get("state"))
+	providerError.Set("error", "access_denied")
+
+	_, err = testOIDCCallback(providerError, cookies)
+	if err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("provider error: got %v", err)
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	useTestOIDCProvider(t, p)
+
+	// a code given to another login (another verifier) is refused by the provider
+	authURL, _ := testOIDCStart(t)
+	stolen := p.authorize(authURL)
+
+	authURL, cookies := testOIDCStart(t)
+	own := p.authorize(authURL)
+
+	injected := neturl.Values{}
+	injected.Set("state", own.Get("state"))
+	injected.Set("code", stolen.Get("code"))
+
+	_, err := testOIDCCallback(injected, cookies)
+	if err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Errorf("code of another login: got %v", err)
+	}
+}
+
+func TestOIDCNonce(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	useTestOIDCProvider(t, p)
+
+	// an ID token replayed from another login carries the nonce of that login
+	p.claims = map[string]interface{}{"nonce": "nonce-of-another-login"}
+
+	authURL, cookies := testOIDCStart(t)
+
+	_, err := testOIDCCallback(p.authorize(authURL), cookies)
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("nonce of another login: got %v", err)
+	}
+}
+
+func TestVerifyOIDCToken(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	useTestOIDCProvider(t, p)
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherKey := testOIDCSigningKeys(t)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+		fail  string
+	}{
+		{"valid", signTestIDToken(t, p.key, "k1", p.idClaims(nil)), ""},
+		{"bad signature", signTestIDToken(t, otherKey, "k1", p.idClaims(nil)), "signature"},
+		{"unknown key", signTestIDToken(t, p.key, "k2", p.idClaims(nil)), "signing key"},
+		{"wrong aud", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"aud": "another-client"})), "another client"},
+		{"aud without azp", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"aud": []string{testOIDCClientID, "another-client"}})), "authorized for another client"},
+		{"wrong issuer", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"iss": "https://evil.example.com"})), "issuer"},
+		{"expired", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"iat": past.Add(-time.Hour).Unix(), "exp": past.Unix()})), "expired"},
+		{"no exp", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"exp": nil})), "expired"},
+		{"wrong nonce", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"nonce": "nonce-2"})), "nonce"},
+		{"no subject", signTestIDToken(t, p.key, "k1", p.idClaims(map[string]interface{}{"sub": ""})), "subject"},
+		{"malformed", "not-a-token", "malformed"},
+	}
+
+	for _, test := range tests {
+		_, err := verifyOIDCToken(provider, test.token, "nonce-1")
+
+		switch {
+		case len(test.fail) == 0 && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case len(test.fail) > 0 && (err == nil || !strings.Contains(err.Error(), test.fail)):
+			t.Errorf("%s: got %v, expected an error with \"%s\"", test.name, err, test.fail)
+		}
+	}
+
+	// alg none is never accepted, whatever the signature
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(p.idClaims(nil))
+
+	_, err = verifyOIDCToken(provider, header+"."+base64.RawURLEncoding.EncodeToString(payload)+".", "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "algorithm") {
+		t.Errorf("alg none: got %v", err)
+	}
+}
+
+func TestOIDCClaims(t *testing.T) {
+	var claims oidcClaims
+
+	err := json.Unmarshal([]byte(`{
+		"groups": ["admins", "users"],
+		"scope": "a b,c",
+		"realm_access": {"roles": ["editor"]},
+		"email_verified": "true",
+		"exp": 1500000000
+	}`), &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := claims.Strings("groups"); len(got) != 2 || got[0] != "admins" {
+		t.Errorf("groups: %v", got)
+	}
+
+	if got := claims.Strings("scope"); len(got) != 3 {
+		t.Errorf("scope: %v", got)
+	}
+
+	if got := claims.Strings("realm_access.roles"); len(got) != 1 || got[0] != "editor" {
+		t.Errorf("realm_access.roles: %v", got)
+	}
+
+	if !claims.Bool("email_verified") {
+		t.Error("email_verified sent as text")
+	}
+
+	if exp, ok := claims.Time("exp"); !ok || exp.Unix() != 1500000000 {
+		t.Errorf("exp: %v", exp)
+	}
+}
+
+func TestOIDCRoleMapping(t *testing.T) {
+	old := config.OIDC.RoleMapping
+	defer func() { config.OIDC.RoleMapping = old }()
+
+	config.OIDC.RoleMapping = " admins = Administrator , ops=Administrator,staff=Member,broken, =Member"
+
+	mapping := oidcRoleMapping()
+
+	if got := mapping["Administrator"]; len(got) != 2 || got[0] != "admins" || got[1] != "ops" {
+		t.Errorf("Administrator: %v", got)
+	}
+
+	if got := mapping["Member"]; len(got) != 1 || got[0] != "staff" {
+		t.Errorf("Member: %v", got)
+	}
+}
+
+// testOIDCLogin - oidcLoginUser with the claims of a verified token of issuer
+func testOIDCLogin(issuer string, subject string, extra map[string]interface{}) (*AuthResult, error) {
+	claims := oidcClaims{
+		"iss": issuer,
+		"sub": subject,
+	}
+
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	return oidcLoginUser(claims, "127.0.0.1")
+}
+
+func useTestOIDCAccounts(t *testing.T, linkByEmail bool, autoProvision bool) string {
+	old := config.OIDC
+
+	config.OIDC.Enabled = true
+	config.OIDC.Issuer = "https://idp.example.com"
+	config.OIDC.UsernameClaim = "preferred_username"
+	config.OIDC.LinkByEmail = linkByEmail
+	config.OIDC.AutoProvision = autoProvision
+	config.OIDC.RolesClaim = ""
+	config.OIDC.RoleMapping = ""
+
+	t.Cleanup(func() {
+		config.OIDC = old
+	})
+
+	return config.OIDC.Issuer
+}
+
+func TestOIDCLinkByEmail(t *testing.T) {
+	requireTestDatabase(t)
+	issuer := useTestOIDCAccounts(t, true, false)
+
+	username := testName("oidc-link-")
+	email := username + "@example.com"
+	u := createTestUser(t, username, email)
+
+	// an unverified email is not enough
+	_, err := testOIDCLogin(issuer, testName("sub-"), map[string]interface{}{
+		"email":          email,
+		"email_verified": false,
+	})
+	if lerr, ok := err.(*localizedError); !ok || lerr.key != "oidc.no-account" {
+		t.Errorf("unverified email: got %v", err)
+	}
+
+	subject := testName("sub-")
+
+	res, err := testOIDCLogin(issuer, subject, map[string]interface{}{
+		"email":          strings.ToUpper(email),
+		"email_verified": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UserID != u.UserID {
+		t.Errorf("linked to user %d, expected %d", res.UserID, u.UserID)
+	}
+
+	// the identity stays linked, whatever the email says later
+	res, err = testOIDCLogin(issuer, subject, map[string]interface{}{
+		"email":          "changed-" + email,
+		"email_verified": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UserID != u.UserID {
+		t.Errorf("second login as user %d, expected %d", res.UserID, u.UserID)
+	}
+}
+
+func TestOIDCAutoProvision(t *testing.T) {
+	requireTestDatabase(t)
+	issuer := useTestOIDCAccounts(t, false, false)
+
+	username := testName("oidc-new-")
+	subject := testName("sub-")
+	claims := map[string]interface{}{
+		"preferred_username": username,
+		"given_name":         "New",
+		"family_name":        "User",
+		"email":              username + "@example.com",
+	}
+
+	_, err := testOIDCLogin(issuer, subject, claims)
+	if lerr, ok := err.(*localizedError); !ok || lerr.key != "oidc.no-account" {
+		t.Errorf("auto-provision off: got %v", err)
+	}
+
+	testWithTx(t, func(tx *sql.Tx) {
+		u := MembershipUser{tx: tx}
+
+		exists, err := u.Exists(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists {
+			t.Fatalf("user %s created with auto-provision off", username)
+		}
+	})
+
+	config.OIDC.AutoProvision = true
+
+	res, err := testOIDCLogin(issuer, subject, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Username != username || res.Name != "New" || res.Surname != "User" {
+		t.Errorf("provisioned %+v", res)
+	}
+
+	if !testHasRole(t, res.UserID, "Member") {
+		t.Error("the provisioned user is not a Member")
+	}
+
+	again, err := testOIDCLogin(issuer, subject, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.UserID != res.UserID {
+		t.Errorf("second login as user %d, expected %d", again.UserID, res.UserID)
+	}
+
+	// another subject with the same username is not given the account
+	_, err = testOIDCLogin(issuer, testName("sub-"), claims)
+	if lerr, ok := err.(*localizedError); !ok || lerr.key != "oidc.username-taken" {
+		t.Errorf("username of another identity: got %v", err)
+	}
+}
+
+func TestSyncOIDCRoles(t *testing.T) {
+	requireTestDatabase(t)
+	issuer := useTestOIDCAccounts(t, false, true)
+
+	config.OIDC.RolesClaim = "realm_access.roles"
+	config.OIDC.RoleMapping = "admins=Administrator"
+
+	username := testName("oidc-roles-")
+	subject := testName("sub-")
+
+	login := func(roles ...string) *AuthResult {
+		list := make([]interface{}, 0, len(roles))
+		for _, role := range roles {
+			list = append(list, role)
+		}
+
+		res, err := testOIDCLogin(issuer, subject, map[string]interface{}{
+			"preferred_username": username,
+			"realm_access":       map[string]interface{}{"roles": list},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	res := login("ADMINS", "users")
+	if !testHasRole(t, res.UserID, "Administrator") {
+		t.Error("admins did not give Administrator")
+	}
+
+	res = login("users")
+	if testHasRole(t, res.UserID, "Administrator") {
+		t.Error("Administrator kept without admins")
+	}
+
+	// roles missing from the mapping are left alone
+	if !testHasRole(t, res.UserID, "Member") {
+		t.Error("Member removed by the sync")
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security"`
+	Permission  string                      `json:"x-permission,omitempty"`
+	Roles       []string                    `json:"x-roles"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIHeader struct {
+	Description string         `json:"description,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Headers     map[string]*openAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Format      string                    `json:"format,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Items       *openAPISchema            `json:"items,omitempty"`
+	Properties  map[string]*openAPISchema `json:"properties,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]*openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// apiParameter - a query or form parameter read by a controller action
+type apiParameter struct {
+	name        string
+	typ         string
+	format      string
+	array       bool
+	required    bool
+	description string
+}
+
+// requestParameters - parameters of the JSON requests, by "Controller.Action".
+// The request table knows routes and roles, but not what the actions read.
+var requestParameters = map[string][]apiParameter{
+	"Home.Login": {
+		{"username", "string", "", false, true, ""},
+		{"password", "string", "password", false, true, ""},
+	},
+	"Home.LoginOIDCCallback": {
+		{"code", "string", "", false, false, "authorization code of the OpenID Connect provider"},
+		{"state", "string", "", false, true, "state sent to the provider by /login-oidc"},
+		{"error", "string", "", false, false, "error code of the provider, instead of code"},
+		{"error_description", "string", "", false, false, ""},
+	},
+	"Home.Register": {
+		{"username", "string", "", false, true, ""},
+		{"password", "string", "password", false, true, ""},
+		{"confirm_password", "string", "password", false, true, ""},
+		{"name", "string", "", false, false, ""},
+		{"surname", "string", "", false, false, ""},
+		{"email", "string", "email", false, true, ""},
+	},
+	"Account.SaveProfile": {
+		{"name", "string", "", false, false, ""},
+		{"surname", "string", "", false, false, ""},
+		{"email", "string", "email", false, true, "a new email is set after the link mailed to it is opened"},
+	},
+	"Account.RequestDeletion": {
+		{"confirm_username", "string", "", false, true, "own username, to confirm"},
+		{"reason", "string", "", false, false, ""},
+	},
+	"Account.ConfirmEmail": {
+		{"token", "string", "", false, true, "token of the link mailed to the new email"},
+	},
+	"Home.SetLanguage": {
+		{"lang", "string", "", false, true, "language code with a message catalog, e.g. EN or RO"},
+	},
+	"Home.PasswordStrength": {
+		{"password", "string", "password", false, true, ""},
+		{"username", "string", "", false, false, "words the password should not be built on; the session user when logged in"},
+		{"name", "string", "", false, false, ""},
+		{"surname", "string", "", false, false, ""},
+		{"email", "string", "email", false, false, ""},
+	},
+	"Home.ChangePassword": {
+		{"password", "string", "password", false, true, "current password"},
+		{"new_password", "string", "password", false, true, ""},
+		{"confirm_password", "string", "password", false, true, ""},
+	},
+	"Home.GetExchangeRates": {
+		{"date", "string", "date", false, false, "latest rates up to this date (default today)"},
+		{"date1", "string", "date", false, false, "start of interval, used together with date2"},
+		{"date2", "string", "date", false, false, "end of interval, used together with date1"},
+	},
+	"Account.CreateAPIToken": {
+		{"name", "string", "", false, true, ""},
+		{"valid_days", "integer", "", false, false, "0 = no expiry"},
+		{"role", "string", "", true, false, "limit the token to these roles"},
+		{"request", "integer", "", true, false, "limit the token to these request ids"},
+	},
+	"Account.RevokeAPIToken": {
+		{"token_id", "integer", "", false, true, ""},
+	},
+	"Admin.CreateRole": {
+		{"role", "string", "", false, true, ""},
+	},
+	"Admin.RenameRole": {
+		{"role_id", "integer", "", false, true, ""},
+		{"role", "string", "", false, true, "new name"},
+	},
+	"Admin.DeleteRole": {
+		{"role_id", "integer", "", false, true, ""},
+	},
+	"Admin.AddRoleMember": {
+		{"role_id", "integer", "", false, true, ""},
+		{"username", "string", "", false, true, ""},
+		{"valid_from", "string", "date", false, false, "default today"},
+		{"valid_until", "string", "date", false, false, "empty = no end date"},
+	},
+	"Admin.RemoveRoleMember": {
+		{"role_id", "integer", "", false, true, ""},
+		{"username", "string", "", false, true, ""},
+	},
+	"Admin.UserIPs": {
+		{"username", "string", "", false, true, ""},
+	},
+	"Admin.AddUserIP": {
+		{"username", "string", "", false, true, ""},
+		{"network", "string", "", false, true, "ip or cidr range, IPv4 or IPv6"},
+	},
+	"Admin.RemoveUserIP": {
+		{"username", "string", "", false, true, ""},
+		{"user_ip_id", "integer", "", false, true, ""},
+	},
+	"Admin.UnlockUser": {
+		{"username", "string", "", false, true, "the temporary password is returned in serr"},
+	},
+	"Admin.AuditLog": {
+		{"from", "string", "date", false, false, "entries logged on or after this date"},
+		{"to", "string", "date", false, false, "entries logged on or before this date"},
+		{"operation", "string", "", false, false, "operation name, as given to the audit log"},
+		{"user", "string", "", false, false, ""},
+		{"ip", "string", "", false, false, ""},
+		{"status", "string", "", false, false, "error or ok; empty - both"},
+		{"text", "string", "", false, false, "text anywhere in the entry"},
+		{"rows", "integer", "", false, false, "entries on a page (default 50, at most 500)"},
+		{"lpage", "integer", "", false, false, "page number, from 1"},
+	},
+	"Admin.ApproveDeletion": {
+		{"deletion_request_id", "integer", "", false, true, "the account is anonymized"},
+	},
+	"Admin.RejectDeletion": {
+		{"deletion_request_id", "integer", "", false, true, ""},
+	},
+	"Admin.Impersonate": {
+		{"username", "string", "", false, true, "user whose session the administrator continues in"},
+	},
+	"Admin.ResetPassword": {
+		{"username", "string", "", false, true, ""},
+		{"password", "string", "password", false, true, "temporary password, to be changed at the next login"},
+	},
+}
+
+type openAPIRequest struct {
+	RequestID   int    `sql:"request_id"`
+	RequestType string `sql:"request_type"`
+	RequestURL  string `sql:"request_url"`
+	Controller  string `sql:"controller"`
+	Action      string `sql:"action"`
+	RedirectURL string `sql:"redirect_url"`
+	Name        string `sql:"name"`
+	Permission  string `sql:"permission"`
+	Roles       []string
+}
+
+func getOpenAPIRequests() ([]*openAPIRequest, error) {
+	var requests []*openAPIRequest
+	byID := make(map[int]*openAPIRequest)
+
+	pq := dbutl.PQuery(`
+		SELECT r.request_id,
+		       r.request_type,
+		       r.request_url,
+		       r.controller,
+		       r.action,
+		       r.redirect_url,
+		       CASE WHEN nm.name IS NULL THEN '-' ELSE nm.name END AS name,
+		       CASE WHEN p.permission IS NULL THEN '-' ELSE p.permission END AS permission
+		  FROM request r
+		  LEFT OUTER JOIN request_name nm ON (r.request_id = nm.request_id AND nm.language = ?)
+		  LEFT OUTER JOIN request_permission rp ON (r.request_id = rp.request_id)
+		  LEFT OUTER JOIN permission p ON (rp.permission_id = p.permission_id)
+		 WHERE r.request_template = ?
+		   AND r.action <> ?
+		 ORDER BY r.request_url, r.request_type
+	`, "EN",
+		"-",
+		"-")
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var req openAPIRequest
+		err = sc.Scan(dbutl, row, &req)
+		if err != nil {
+			return err
+		}
+
+		requests = append(requests, &req)
+		byID[req.RequestID] = &req
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	pq = dbutl.PQuery(`
+		SELECT rr.request_id,
+		       r.role
+		  FROM request_role rr
+		  JOIN role r ON (rr.role_id = r.role_id)
+		 ORDER BY rr.request_id, r.role
+	`)
+
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var requestID int
+		var role string
+
+		err = row.Scan(&requestID, &role)
+		if err != nil {
+			return err
+		}
+
+		if req, ok := byID[requestID]; ok {
+			req.Roles = append(req.Roles, role)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// buildOpenAPIDocument - OpenAPI 3 document of the JSON requests
+func buildOpenAPIDocument() (*openAPIDocument, error) {
+	requests, err := getOpenAPIRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:       appName,
+			Version:     appVersion,
+			Description: "Generated from the request, request_permission and request_role tables.",
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*openAPISchema),
+			SecuritySchemes: map[string]*openAPISecurityScheme{
+				"cookieAuth": {Type: "apiKey", In: "cookie", Name: authCookieStoreName},
+				"bearerAuth": {Type: "http", Scheme: "bearer"},
+			},
+		},
+	}
+
+	for _, req := range requests {
+		path := "/" + req.RequestURL
+		if req.RequestURL == "index" {
+			path = "/"
+		}
+
+		if _, ok := doc.Paths[path]; !ok {
+			doc.Paths[path] = make(map[string]*openAPIOperation)
+		}
+
+		doc.Paths[path][strings.ToLower(req.RequestType)] = buildOpenAPIOperation(req, doc.Components.Schemas)
+	}
+
+	return &doc, nil
+}
+
+func buildOpenAPIOperation(req *openAPIRequest, schemas map[string]*openAPISchema) *openAPIOperation {
+	op := openAPIOperation{
+		OperationID: req.RequestType + "." + req.Controller + "." + req.Action,
+		Tags:        []string{req.Controller},
+		Responses:   make(map[string]*openAPIResponse),
+		Roles:       req.Roles,
+		Security:    []map[string][]string{},
+	}
+
+	if req.Name != "-" {
+		op.Summary = req.Name
+	}
+
+	if len(req.Roles) > 0 {
+		op.Description = "Roles: " + strings.Join(req.Roles, ", ")
+	} else {
+		op.Description = "No role may call this request."
+	}
+
+	if req.Permission != "-" {
+		op.Permission = req.Permission
+		op.Description = "Permission: " + req.Permission + ". " + op.Description
+	}
+
+	isPublic := false
+	for _, role := range req.Roles {
+		if role == "All" {
+			isPublic = true
+			break
+		}
+	}
+
+	if !isPublic {
+		op.Security = []map[string][]string{
+			{"cookieAuth": {}},
+			{"bearerAuth": {}},
+		}
+	}
+
+	params := requestParameters[req.Controller+"."+req.Action]
+
+	if req.RequestType == "GET" {
+		for _, p := range params {
+			op.Parameters = append(op.Parameters, &openAPIParameter{
+				Name:        p.name,
+				In:          "query",
+				Description: p.description,
+				Required:    p.required,
+				Schema:      p.schema(),
+			})
+		}
+	} else if len(params) > 0 {
+		form := openAPISchema{
+			Type:       "object",
+			Properties: make(map[string]*openAPISchema),
+		}
+
+		for _, p := range params {
+			form.Properties[p.name] = p.schema()
+
+			if p.required {
+				form.Required = append(form.Required, p.name)
+			}
+		}
+
+		op.RequestBody = &openAPIRequestBody{
+			Required: len(form.Required) > 0,
+			Content: map[string]*openAPIMediaType{
+				"application/x-www-form-urlencoded": {Schema: &form},
+			},
+		}
+	}
+
+	if req.RedirectURL != "-" {
+		op.Responses["303"] = &openAPIResponse{
+			Description: "Redirect; the result message is kept for the next page.",
+			Headers: map[string]*openAPIHeader{
+				"Location": {Schema: &openAPISchema{Type: "string"}},
+			},
+		}
+	} else {
+		response := openAPIResponse{Description: "OK"}
+
+		if t := getActionResponseType(req.Controller, req.Action); t != nil {
+			response.Content = map[string]*openAPIMediaType{
+				"application/json": {Schema: openAPISchemaOf(t, schemas)},
+			}
+		}
+
+		op.Responses["200"] = &response
+	}
+
+	op.Responses["404"] = &openAPIResponse{Description: "Not found or access denied"}
+
+	return &op
+}
+
+func (p apiParameter) schema() *openAPISchema {
+	s := openAPISchema{
+		Type:   p.typ,
+		Format: p.format,
+	}
+
+	if p.array {
+		return &openAPISchema{Type: "array", Items: &s}
+	}
+
+	return &s
+}
+
+// getActionResponseType - the response model type returned by a controller action
+func getActionResponseType(controllerName string, action string) reflect.Type {
+	controller := getController(controllerName)
+	if controller == nil {
+		return nil
+	}
+
+	method := reflect.ValueOf(controller).MethodByName(action)
+	if !method.IsValid() || method.Type().NumOut() == 0 {
+		return nil
+	}
+
+	return method.Type().Out(0)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPISchemaOf - schema of a models type, following the encoding/json rules
+func openAPISchemaOf(t reflect.Type, schemas map[string]*openAPISchema) *openAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: openAPISchemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return &openAPISchema{Type: "object"}
+	case reflect.Struct:
+		name := t.Name()
+		ref := openAPISchema{Ref: "#/components/schemas/" + name}
+
+		if _, ok := schemas[name]; ok {
+			return &ref
+		}
+
+		s := openAPISchema{
+			Type:       "object",
+			Properties: make(map[string]*openAPISchema),
+		}
+
+		// register before walking the fields, for recursive types
+		schemas[name] = &s
+		addOpenAPIProperties(t, &s, schemas)
+
+		return &ref
+	default:
+		return &openAPISchema{}
+	}
+}
+
+func addOpenAPIProperties(t reflect.Type, s *openAPISchema, schemas map[string]*openAPISchema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if len(f.PkgPath) > 0 && !f.Anonymous {
+			continue
+		}
+
+		name := f.Name
+		tag := f.Tag.Get("json")
+
+		if tag == "-" {
+			continue
+		}
+
+		if len(tag) > 0 {
+			if idx := strings.Index(tag, ","); idx >= 0 {
+				tag = tag[:idx]
+			}
+
+			if len(tag) > 0 {
+				name = tag
+			}
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if f.Anonymous && len(f.Tag.Get("json")) == 0 && ft.Kind() == reflect.Struct {
+			addOpenAPIProperties(ft, s, schemas)
+			continue
+		}
+
+		s.Properties[name] = openAPISchemaOf(f.Type, schemas)
+	}
+}
+
+// dumpOpenAPI - write the document to a file, or to stdout when no file is given
+func dumpOpenAPI(file string) error {
+	doc, err := buildOpenAPIDocument()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if len(file) == 0 {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	return ioutil.WriteFile(file, b, 0644)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// commonPasswords - lowered passwords of PasswordRules.CommonPasswordsFile with their rank
+// (line order, the most common first)
+var commonPasswords = struct {
+	sync.RWMutex
+	words map[string]int
+}{words: make(map[string]int)}
+
+// loadPasswordBlocklist - read the common passwords file, one password per line.
+// Empty lines and lines starting with # are skipped.
+func loadPasswordBlocklist() error {
+	file := config.PasswordRules.CommonPasswordsFile
+	words := make(map[string]int)
+
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			word := strings.TrimSpace(scanner.Text())
+			if len(word) == 0 || strings.HasPrefix(word, "#") {
+				continue
+			}
+
+			word = strings.ToLower(word)
+			if _, ok := words[word]; !ok {
+				words[word] = len(words) + 1
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	commonPasswords.Lock()
+	commonPasswords.words = words
+	commonPasswords.Unlock()
+
+	return nil
+}
+
+// isCommonPassword - the password, or the password stripped of the digits and
+// symbols around it ("Password123!" -> "password"), is in the common passwords list
+func isCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+
+	core := strings.TrimFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	commonPasswords.RLock()
+	defer commonPasswords.RUnlock()
+
+	if _, ok := commonPasswords.words[lower]; ok {
+		return true
+	}
+
+	_, ok := commonPasswords.words[core]
+	return len(core) >= 4 && ok
+}
+
+// pwnedPasswordCount - how many times the password appears in the breach corpus.
+// PasswordRules.PwnedPasswordsDir holds the Have I Been Pwned range files:
+// <first 5 hex chars of the SHA-1>[.txt], with "SUFFIX:COUNT" lines.
+// Only the hash prefix selects the file, the password never leaves the process.
+func pwnedPasswordCount(password string) (int, error) {
+	dir := config.PasswordRules.PwnedPasswordsDir
+	if len(dir) == 0 {
+		return 0, nil
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(dir, prefix))
+	}
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		sep := strings.Index(line, ":")
+		if sep < 0 || !strings.EqualFold(line[:sep], suffix) {
+			continue
+		}
+
+		count, err := strconv.Atoi(strings.TrimSpace(line[sep+1:]))
+		if err != nil {
+			return 0, err
+		}
+
+		return count, nil
+	}
+
+	return 0, scanner.Err()
+}
+
+// checkPasswordBlocklist - reject common passwords and passwords seen in breaches
+func checkPasswordBlocklist(password string) error {
+	if isCommonPassword(password) {
+		return newLocalizedError("password.common")
+	}
+
+	count, err := pwnedPasswordCount(password)
+	if err != nil {
+		return err
+	}
+
+	if count >= config.PasswordRules.PwnedMinCount {
+		return newLocalizedError("password.breached", count)
+	}
+
+	return nil
+}
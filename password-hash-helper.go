@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Formats of user_password.password, all over password_salt + password:
+//   - legacy:   base64 of a bcrypt hash with bcrypt.DefaultCost
+//   - bcrypt:   the bcrypt hash itself, $2a$<cost>$...
+//   - argon2id: $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<key>, unpadded base64
+// The leading $ tells the versioned formats from the legacy one.
+
+const argon2KeyLength = 32
+const argon2SaltLength = 16
+
+// argon2Params - parameters of an argon2id hash
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// hashPassword - hash of salt + password with the configured algorithm
+func hashPassword(salt string, password string) (string, error) {
+	passBytes := []byte(salt + password)
+
+	switch config.PasswordHash.Algorithm {
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword(passBytes, config.PasswordHash.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+
+		return string(hash), nil
+	case "argon2id":
+		p := argon2Params{
+			memory:      config.PasswordHash.Argon2Memory,
+			iterations:  config.PasswordHash.Argon2Iterations,
+			parallelism: config.PasswordHash.Argon2Parallelism,
+			salt:        make([]byte, argon2SaltLength),
+		}
+
+		_, err := rand.Read(p.salt)
+		if err != nil {
+			return "", err
+		}
+
+		p.key = argon2.IDKey(passBytes, p.salt, p.iterations, p.memory, p.parallelism, argon2KeyLength)
+
+		return p.String(), nil
+	}
+
+	return "", fmt.Errorf("unknown password hash algorithm \"%s\"", config.PasswordHash.Algorithm)
+}
+
+// verifyPassword - salt + password matches the stored hash, in any of the known formats
+func verifyPassword(hashed string, salt string, password string) (bool, error) {
+	passBytes := []byte(salt + password)
+
+	switch {
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		p, err := parseArgon2Hash(hashed)
+		if err != nil {
+			return false, err
+		}
+
+		key := argon2.IDKey(passBytes, p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+
+		return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+	case strings.HasPrefix(hashed, "$2"):
+		return compareBcrypt([]byte(hashed), passBytes)
+	case strings.HasPrefix(hashed, "$"):
+		return false, fmt.Errorf("unknown password hash format \"%s\"", strings.SplitN(hashed[1:], "$", 2)[0])
+	}
+
+	// legacy
+	hashBytes, err := base64.StdEncoding.DecodeString(hashed)
+	if err != nil {
+		return false, err
+	}
+
+	return compareBcrypt(hashBytes, passBytes)
+}
+
+func compareBcrypt(hash []byte, passBytes []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, passBytes)
+
+	switch {
+	case err == bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+// passwordNeedsRehash - the hash is not in the configured algorithm or uses other parameters
+func passwordNeedsRehash(hashed string) bool {
+	switch config.PasswordHash.Algorithm {
+	case "bcrypt":
+		if !strings.HasPrefix(hashed, "$2") {
+			return true
+		}
+
+		cost, err := bcrypt.Cost([]byte(hashed))
+		return err != nil || cost != config.PasswordHash.BcryptCost
+	case "argon2id":
+		p, err := parseArgon2Hash(hashed)
+		if err != nil {
+			return true
+		}
+
+		return p.memory != config.PasswordHash.Argon2Memory ||
+			p.iterations != config.PasswordHash.Argon2Iterations ||
+			p.parallelism != config.PasswordHash.Argon2Parallelism ||
+			len(p.key) != argon2KeyLength
+	}
+
+	return false
+}
+
+func (p *argon2Params) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.memory,
+		p.iterations,
+		p.parallelism,
+		base64.RawStdEncoding.EncodeToString(p.salt),
+		base64.RawStdEncoding.EncodeToString(p.key))
+}
+
+func parseArgon2Hash(hashed string) (*argon2Params, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	var p argon2Params
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
+	if err != nil {
+		return nil, err
+	}
+
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Password strength estimation in the spirit of zxcvbn: the password is split in
+// the sequence of patterns (dictionary words, keyboard walks, sequences, repeats,
+// dates, brute force) an attacker would need the fewest guesses to try,
+// and the score is the order of magnitude of those guesses.
+
+const (
+	// passwordStrengthMaxLength - longer passwords are estimated on their first characters only
+	passwordStrengthMaxLength = 100
+	// referenceYear - dates close to it are guessed first
+	referenceYear = 2020
+	minYearSpace  = 20
+	// bruteforceCardinality - guesses per brute forced character
+	bruteforceCardinality = 10
+	minSubmatchGuesses    = 50
+)
+
+// passwordMatch - a pattern found between runes i (inclusive) and j (exclusive)
+type passwordMatch struct {
+	i, j    int
+	pattern string
+	guesses float64
+	// personal - the dictionary word is the user's name, username or email
+	personal bool
+}
+
+// passwordStrength - estimated strength of a password
+type passwordStrength struct {
+	Score        int
+	GuessesLog10 float64
+	// Warning and Suggestions are message keys
+	Warning     string
+	Suggestions []string
+	sequence    []*passwordMatch
+}
+
+// estimatePasswordStrength - score from 0 (too guessable) to 4 (very unguessable).
+// userInputs - username, name, surname, email: words the password should not be built on.
+func estimatePasswordStrength(password string, userInputs ...string) *passwordStrength {
+	runes := []rune(password)
+	if len(runes) > passwordStrengthMaxLength {
+		runes = runes[:passwordStrengthMaxLength]
+	}
+
+	s := passwordStrength{}
+
+	if len(runes) == 0 {
+		s.Warning = "strength.warning.empty"
+		return &s
+	}
+
+	matches := omnimatch(runes, userInputs)
+	s.sequence, s.GuessesLog10 = mostGuessableSequence(runes, matches)
+
+	switch {
+	case s.GuessesLog10 < 3:
+		s.Score = 0
+	case s.GuessesLog10 < 6:
+		s.Score = 1
+	case s.GuessesLog10 < 8:
+		s.Score = 2
+	case s.GuessesLog10 < 10:
+		s.Score = 3
+	default:
+		s.Score = 4
+	}
+
+	s.feedback(runes)
+
+	return &s
+}
+
+// feedback - warning about the longest pattern and what would help
+func (s *passwordStrength) feedback(runes []rune) {
+	if s.Score >= 3 {
+		return
+	}
+
+	s.Suggestions = append(s.Suggestions, "strength.suggest.words")
+
+	var longest *passwordMatch
+	for _, m := range s.sequence {
+		if m.pattern != "bruteforce" && (longest == nil || m.j-m.i > longest.j-longest.i) {
+			longest = m
+		}
+	}
+
+	if longest == nil {
+		s.Suggestions = append(s.Suggestions, "strength.suggest.longer")
+		return
+	}
+
+	switch longest.pattern {
+	case "dictionary":
+		if longest.personal {
+			s.Warning = "strength.warning.personal"
+		} else {
+			s.Warning = "strength.warning.common"
+		}
+
+		word := runes[longest.i:longest.j]
+		if unicode.IsUpper(word[0]) {
+			s.Suggestions = append(s.Suggestions, "strength.suggest.capitals")
+		}
+	case "keyboard":
+		s.Warning = "strength.warning.keyboard"
+		s.Suggestions = append(s.Suggestions, "strength.suggest.longer-keyboard")
+	case "sequence":
+		s.Warning = "strength.warning.sequence"
+	case "repeat":
+		s.Warning = "strength.warning.repeat"
+	case "date":
+		s.Warning = "strength.warning.date"
+		s.Suggestions = append(s.Suggestions, "strength.suggest.dates")
+	}
+}
+
+func omnimatch(runes []rune, userInputs []string) []*passwordMatch {
+	var matches []*passwordMatch
+
+	matches = append(matches, dictionaryMatches(runes, userInputs)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes, userInputs)...)
+	matches = append(matches, dateMatches(runes)...)
+
+	return matches
+}
+
+// mostGuessableSequence - the cover of the password with the fewest guesses:
+// segments! * product of the guesses of the segments, brute force filling the gaps
+func mostGuessableSequence(runes []rune, matches []*passwordMatch) ([]*passwordMatch, float64) {
+	n := len(runes)
+
+	byEnd := make([][]*passwordMatch, n+1)
+	for _, m := range matches {
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+
+	// best[j][k] - log10 of the product of the guesses of a cover of runes[:j] with k segments
+	best := make([][]float64, n+1)
+	prev := make([][]*passwordMatch, n+1)
+	for j := range best {
+		best[j] = make([]float64, n+1)
+		prev[j] = make([]*passwordMatch, n+1)
+		for k := range best[j] {
+			best[j][k] = math.Inf(1)
+		}
+	}
+	best[0][0] = 0
+
+	for j := 1; j <= n; j++ {
+		candidates := byEnd[j]
+		for i := 0; i < j; i++ {
+			candidates = append(candidates, &passwordMatch{
+				i:       i,
+				j:       j,
+				pattern: "bruteforce",
+				guesses: bruteforceGuesses(j - i),
+			})
+		}
+
+		for _, m := range candidates {
+			g := math.Log10(m.guesses)
+
+			for k := 1; k <= j; k++ {
+				if math.IsInf(best[m.i][k-1], 1) {
+					continue
+				}
+
+				// two brute force segments in a row are one segment
+				if m.pattern == "bruteforce" && prev[m.i][k-1] != nil && prev[m.i][k-1].pattern == "bruteforce" {
+					continue
+				}
+
+				if v := best[m.i][k-1] + g; v < best[j][k] {
+					best[j][k] = v
+					prev[j][k] = m
+				}
+			}
+		}
+	}
+
+	bestK := 0
+	bestLog := math.Inf(1)
+	for k := 1; k <= n; k++ {
+		if math.IsInf(best[n][k], 1) {
+			continue
+		}
+
+		lgamma, _ := math.Lgamma(float64(k + 1))
+		if v := best[n][k] + lgamma/math.Ln10; v < bestLog {
+			bestLog = v
+			bestK = k
+		}
+	}
+
+	sequence := make([]*passwordMatch, bestK)
+	for j, k := n, bestK; k > 0; k-- {
+		m := prev[j][k]
+		sequence[k-1] = m
+		j = m.i
+	}
+
+	return sequence, bestLog
+}
+
+func bruteforceGuesses(length int) float64 {
+	g := math.Pow(bruteforceCardinality, float64(length))
+
+	min := float64(minSubmatchGuesses + 1)
+	if length == 1 {
+		min = bruteforceCardinality + 1
+	}
+
+	return math.Max(g, min)
+}
+
+// dictionary
+
+var leetSubstitutions = map[rune][]rune{
+	'4': {'a'},
+	'@': {'a'},
+	'8': {'b'},
+	'(': {'c'},
+	'3': {'e'},
+	'6': {'g'},
+	'9': {'g'},
+	'1': {'i', 'l'},
+	'!': {'i'},
+	'|': {'i', 'l'},
+	'0': {'o'},
+	'$': {'s'},
+	'5': {'s'},
+	'7': {'t'},
+	'+': {'t'},
+	'2': {'z'},
+}
+
+// personalWords - lowered words of the user inputs with their rank
+func personalWords(userInputs []string) map[string]int {
+	words := make(map[string]int)
+
+	add := func(word string) {
+		if len([]rune(word)) < 3 {
+			return
+		}
+
+		if _, ok := words[word]; !ok {
+			words[word] = len(words) + 1
+		}
+	}
+
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		add(input)
+
+		for _, part := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			add(part)
+		}
+	}
+
+	return words
+}
+
+func dictionaryMatches(runes []rune, userInputs []string) []*passwordMatch {
+	var matches []*passwordMatch
+
+	personal := personalWords(userInputs)
+	lower := []rune(strings.ToLower(string(runes)))
+
+	commonPasswords.RLock()
+	defer commonPasswords.RUnlock()
+
+	lookup := func(word string) (int, bool, bool) {
+		if rank, ok := personal[word]; ok {
+			return rank, true, true
+		}
+
+		if rank, ok := commonPasswords.words[word]; ok {
+			return rank, false, true
+		}
+
+		return 0, false, false
+	}
+
+	for i := 0; i < len(lower); i++ {
+		for j := i + 3; j <= len(lower) && j-i <= 32; j++ {
+			word := lower[i:j]
+			variations := uppercaseVariations(runes[i:j])
+
+			candidates := []struct {
+				word   string
+				factor float64
+			}{
+				{string(word), 1},
+				{reverseString(string(word)), 2},
+			}
+
+			for _, unleet := range unleetVariants(word) {
+				if unleet != string(word) {
+					candidates = append(candidates, struct {
+						word   string
+						factor float64
+					}{unleet, 2})
+				}
+			}
+
+			for _, c := range candidates {
+				rank, isPersonal, ok := lookup(c.word)
+				if !ok {
+					continue
+				}
+
+				matches = append(matches, &passwordMatch{
+					i:        i,
+					j:        j,
+					pattern:  "dictionary",
+					guesses:  math.Max(float64(rank)*variations*c.factor, minSubmatchGuesses),
+					personal: isPersonal,
+				})
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// unleetVariants - the word with the leet substitutions undone, one variant per ambiguous letter choice
+func unleetVariants(word []rune) []string {
+	variants := []string{""}
+
+	for _, r := range word {
+		subs, ok := leetSubstitutions[r]
+		if !ok {
+			for k := range variants {
+				variants[k] += string(r)
+			}
+			continue
+		}
+
+		var next []string
+		for _, v := range variants {
+			for _, s := range subs {
+				next = append(next, v+string(s))
+			}
+		}
+
+		if len(next) > 8 {
+			next = next[:8]
+		}
+		variants = next
+	}
+
+	return variants
+}
+
+// uppercaseVariations - how many capitalizations of the word an attacker tries before this one
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	if upper == 0 {
+		return 1
+	}
+
+	// Word, wORD, WORD, worD
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return 2
+	}
+
+	variations := 0.0
+	for k := 1; k <= upper && k <= lower; k++ {
+		variations += binomial(upper+lower, k)
+	}
+
+	return variations
+}
+
+func binomial(n, k int) float64 {
+	if k > n {
+		return 0
+	}
+
+	r := 1.0
+	for d := 1; d <= k; d++ {
+		r = r * float64(n-k+d) / float64(d)
+	}
+
+	return r
+}
+
+func reverseString(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+
+	return string(r)
+}
+
+// keyboard walks on a qwerty keyboard
+
+type keyPosition struct {
+	row, col int
+}
+
+var qwertyRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+var qwertyShifted = map[rune]rune{
+	'~': '`', '!': '1', '@': '2', '#': '3', '$': '4', '%': '5', '^': '6', '&': '7', '*': '8', '(': '9', ')': '0',
+	'_': '-', '+': '=', '{': '[', '}': ']', '|': '\\', ':': ';', '"': '\'', '<': ',', '>': '.', '?': '/',
+}
+
+var qwertyKeys = func() map[rune]keyPosition {
+	keys := make(map[rune]keyPosition)
+	for row, keysOfRow := range qwertyRows {
+		for col, k := range keysOfRow {
+			keys[k] = keyPosition{row, col}
+		}
+	}
+
+	return keys
+}()
+
+// keyboard starting positions and average neighbours, as in zxcvbn
+const (
+	keyboardStartingPositions = 94
+	keyboardAverageDegree     = 4.6
+)
+
+// keyPositionOf - position of the key, and if shift is needed
+func keyPositionOf(r rune) (keyPosition, bool, bool) {
+	shifted := false
+	if base, ok := qwertyShifted[r]; ok {
+		r = base
+		shifted = true
+	} else if unicode.IsUpper(r) {
+		r = unicode.ToLower(r)
+		shifted = true
+	}
+
+	p, ok := qwertyKeys[r]
+	return p, shifted, ok
+}
+
+// keyDirection - direction from key a to the neighbouring key b (0 - not neighbours).
+// Each row is shifted half a key to the right of the one above.
+func keyDirection(a, b keyPosition) int {
+	switch {
+	case b.row == a.row && b.col == a.col-1:
+		return 1
+	case b.row == a.row && b.col == a.col+1:
+		return 2
+	case b.row == a.row-1 && b.col == a.col:
+		return 3
+	case b.row == a.row-1 && b.col == a.col+1:
+		return 4
+	case b.row == a.row+1 && b.col == a.col-1:
+		return 5
+	case b.row == a.row+1 && b.col == a.col:
+		return 6
+	}
+
+	return 0
+}
+
+func keyboardMatches(runes []rune) []*passwordMatch {
+	var matches []*passwordMatch
+
+	for i := 0; i < len(runes)-2; {
+		p, shifted, ok := keyPositionOf(runes[i])
+		if !ok {
+			i++
+			continue
+		}
+
+		j := i + 1
+		turns := 0
+		shiftedCount := 0
+		if shifted {
+			shiftedCount++
+		}
+		lastDirection := -1
+
+		for ; j < len(runes); j++ {
+			q, s, ok := keyPositionOf(runes[j])
+			if !ok {
+				break
+			}
+
+			d := keyDirection(p, q)
+			if d == 0 {
+				break
+			}
+
+			if d != lastDirection {
+				turns++
+				lastDirection = d
+			}
+
+			if s {
+				shiftedCount++
+			}
+			p = q
+		}
+
+		if j-i >= 3 {
+			matches = append(matches, &passwordMatch{
+				i:       i,
+				j:       j,
+				pattern: "keyboard",
+				guesses: keyboardGuesses(j-i, turns, shiftedCount),
+			})
+			i = j
+			continue
+		}
+
+		i++
+	}
+
+	return matches
+}
+
+func keyboardGuesses(length int, turns int, shifted int) float64 {
+	guesses := 0.0
+
+	for i := 2; i <= length; i++ {
+		for j := 1; j <= turns && j <= i-1; j++ {
+			guesses += binomial(i-1, j-1) * keyboardStartingPositions * math.Pow(keyboardAverageDegree, float64(j))
+		}
+	}
+
+	if shifted > 0 {
+		unshifted := length - shifted
+		if unshifted == 0 {
+			guesses *= 2
+		} else {
+			variations := 0.0
+			for k := 1; k <= shifted && k <= unshifted; k++ {
+				variations += binomial(length, k)
+			}
+			guesses *= variations
+		}
+	}
+
+	return math.Max(guesses, minSubmatchGuesses)
+}
+
+// sequences: abcd, 7531, zyx
+
+func sequenceMatches(runes []rune) []*passwordMatch {
+	var matches []*passwordMatch
+
+	for i := 0; i < len(runes)-2; {
+		delta := int(runes[i+1]) - int(runes[i])
+		if delta == 0 || delta > 5 || delta < -5 {
+			i++
+			continue
+		}
+
+		j := i + 2
+		for j < len(runes) && int(runes[j])-int(runes[j-1]) == delta {
+			j++
+		}
+
+		if j-i >= 3 {
+			matches = append(matches, &passwordMatch{
+				i:       i,
+				j:       j,
+				pattern: "sequence",
+				guesses: sequenceGuesses(runes[i:j], delta),
+			})
+			i = j - 1
+			continue
+		}
+
+		i++
+	}
+
+	return matches
+}
+
+func sequenceGuesses(seq []rune, delta int) float64 {
+	first := seq[0]
+
+	var base float64
+	switch {
+	case strings.ContainsRune("aAzZ019", first):
+		base = 4
+	case unicode.IsDigit(first):
+		base = 10
+	default:
+		base = 26
+	}
+
+	if delta < 0 {
+		base *= 2
+	}
+
+	return base * float64(len(seq))
+}
+
+// repeats: aaaa, abcabc
+
+func repeatMatches(runes []rune, userInputs []string) []*passwordMatch {
+	var matches []*passwordMatch
+
+	for i := 0; i < len(runes)-1; {
+		bestEnd := i
+		bestBase := 0
+
+		for base := 1; i+2*base <= len(runes); base++ {
+			end := i + base
+			for end+base <= len(runes) && string(runes[end:end+base]) == string(runes[i:i+base]) {
+				end += base
+			}
+
+			if end-i >= 2*base && end > bestEnd {
+				bestEnd = end
+				bestBase = base
+			}
+		}
+
+		if bestBase == 0 || bestEnd-i < 3 {
+			i++
+			continue
+		}
+
+		base := runes[i : i+bestBase]
+		baseMatches := omnimatch(base, userInputs)
+		_, baseLog := mostGuessableSequence(base, baseMatches)
+
+		matches = append(matches, &passwordMatch{
+			i:       i,
+			j:       bestEnd,
+			pattern: "repeat",
+			guesses: math.Pow(10, baseLog) * float64((bestEnd-i)/bestBase),
+		})
+		i = bestEnd
+	}
+
+	return matches
+}
+
+// dates: 1987, 19870412, 12.04.87, 4/12/1987
+
+func dateMatches(runes []rune) []*passwordMatch {
+	var matches []*passwordMatch
+
+	for i := 0; i < len(runes); i++ {
+		for j := i + 4; j <= len(runes) && j-i <= 10; j++ {
+			guesses, ok := dateGuesses(string(runes[i:j]))
+			if !ok {
+				continue
+			}
+
+			matches = append(matches, &passwordMatch{
+				i:       i,
+				j:       j,
+				pattern: "date",
+				guesses: guesses,
+			})
+		}
+	}
+
+	return matches
+}
+
+func yearSpace(year int) float64 {
+	return math.Max(math.Abs(float64(year-referenceYear)), minYearSpace)
+}
+
+func twoToFourDigitYear(year int, digits int) int {
+	if digits > 2 {
+		return year
+	}
+
+	if year > 50 {
+		return 1900 + year
+	}
+
+	return 2000 + year
+}
+
+func isDay(d int) bool   { return d >= 1 && d <= 31 }
+func isMonth(m int) bool { return m >= 1 && m <= 12 }
+func isYear(y int) bool  { return y >= 1900 && y <= 2050 }
+
+// dateGuesses - guesses for s when it is a year or a day, month and year
+func dateGuesses(s string) (float64, bool) {
+	separator := ""
+	var parts []string
+
+	for _, sep := range []string{"/", "-", ".", "_", " "} {
+		if strings.Count(s, sep) == 2 {
+			separator = sep
+			parts = strings.Split(s, sep)
+			break
+		}
+	}
+
+	if len(separator) == 0 {
+		for _, r := range s {
+			if !unicode.IsDigit(r) {
+				return 0, false
+			}
+		}
+	}
+
+	if len(separator) == 0 && len(s) == 4 {
+		year, _ := strconv.Atoi(s)
+		if isYear(year) {
+			return math.Max(yearSpace(year), minSubmatchGuesses), true
+		}
+	}
+
+	// day, month, year in any of the usual orders
+	var splits [][]string
+	if len(separator) > 0 {
+		splits = [][]string{parts}
+	} else {
+		switch len(s) {
+		case 6:
+			splits = [][]string{{s[:2], s[2:4], s[4:]}}
+		case 8:
+			splits = [][]string{{s[:2], s[2:4], s[4:]}, {s[:4], s[4:6], s[6:]}}
+		}
+	}
+
+	for _, p := range splits {
+		if len(p) != 3 {
+			continue
+		}
+
+		for _, order := range [][3]int{{0, 1, 2}, {1, 0, 2}, {2, 1, 0}} {
+			d, m, y := p[order[0]], p[order[1]], p[order[2]]
+			if len(d) == 0 || len(d) > 2 || len(m) == 0 || len(m) > 2 || (len(y) != 2 && len(y) != 4) {
+				continue
+			}
+
+			day, err1 := strconv.Atoi(d)
+			month, err2 := strconv.Atoi(m)
+			year, err3 := strconv.Atoi(y)
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue
+			}
+
+			year = twoToFourDigitYear(year, len(y))
+			if !isDay(day) || !isMonth(month) || !isYear(year) {
+				continue
+			}
+
+			guesses := yearSpace(year) * 365
+			if len(separator) > 0 {
+				guesses *= 4
+			}
+
+			return math.Max(guesses, minSubmatchGuesses), true
+		}
+	}
+
+	return 0, false
+}
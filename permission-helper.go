@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// legacyPermissionPrefix - prefix of the permissions generated for requests that list roles directly
+const legacyPermissionPrefix = "request."
+
+var permissionNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// Permission - named permission, granted to roles in access-rules.json
+type Permission struct {
+	sync.RWMutex
+	tx           *sql.Tx
+	PermissionID int    `sql:"permission_id"`
+	Name         string `sql:"permission"`
+	Description  string `sql:"description"`
+}
+
+var permissionLock sync.RWMutex
+
+// Save - save permission details
+func (p *Permission) Save() error {
+	permissionLock.Lock()
+	defer permissionLock.Unlock()
+
+	if !permissionNameRegex.MatchString(p.Name) {
+		return fmt.Errorf("invalid permission name \"%s\"", p.Name)
+	}
+
+	if p.PermissionID <= 0 {
+		pq := dbutl.PQuery(`
+		    INSERT INTO permission (permission, description) VALUES (?, ?)
+		`, p.Name,
+			p.Description)
+
+		_, err := dbutl.ExecTx(p.tx, pq)
+		if err != nil {
+			return err
+		}
+
+		pq = dbutl.PQuery(`
+		    SELECT permission_id FROM permission WHERE permission = ?
+		`, p.Name)
+
+		err = p.tx.QueryRow(pq.Query, pq.Args...).Scan(&p.PermissionID)
+		if err != nil {
+			return err
+		}
+
+		audit.Log(nil, "add-permission", "Add new permission.", "new", p)
+	} else {
+		pq := dbutl.PQuery(`
+		    UPDATE permission
+		       SET permission = ?,
+		           description = ?
+		     WHERE permission_id = ?
+		`, p.Name,
+			p.Description,
+			p.PermissionID)
+
+		_, err := dbutl.ExecTx(p.tx, pq)
+		if err != nil {
+			return err
+		}
+
+		audit.Log(nil, "update-permission", "Update permission.", "new", p)
+	}
+
+	return nil
+}
+
+// Delete - delete the permission and its grants
+func (p *Permission) Delete() error {
+	permissionLock.Lock()
+	defer permissionLock.Unlock()
+
+	queries := []*utils.PreparedQuery{
+		dbutl.PQuery(`DELETE FROM role_permission WHERE permission_id = ?`, p.PermissionID),
+		dbutl.PQuery(`DELETE FROM request_permission WHERE permission_id = ?`, p.PermissionID),
+		dbutl.PQuery(`DELETE FROM permission WHERE permission_id = ?`, p.PermissionID),
+	}
+
+	for _, pq := range queries {
+		_, err := dbutl.ExecTx(p.tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	audit.Log(nil, "delete-permission", "Delete permission.", "permission", p.Name)
+
+	return nil
+}
+
+// getRolePermissions - permissions held by any of the roles
+func getRolePermissions(roleIDs []int) (map[string]bool, error) {
+	perms := make(map[string]bool)
+
+	if len(roleIDs) == 0 {
+		return perms, nil
+	}
+
+	rules, err := getAccessRules(&accessCache.permissionStats)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, roleID := range roleIDs {
+		for _, perm := range rules.rolePermissions[roleID] {
+			perms[perm] = true
+		}
+	}
+
+	return perms, nil
+}
+
+// getAPITokenRoleIDs - roles a token is limited to, with the roles they inherit (none - not limited)
+func getAPITokenRoleIDs(tokenID int) ([]int, error) {
+	var roleIDs []int
+
+	pq := dbutl.PQuery(`
+		SELECT DISTINCT rc.descendant_role_id
+		  FROM user_api_token_role tr
+		  JOIN role_closure rc ON (tr.role_id = rc.ancestor_role_id)
+		 WHERE tr.api_token_id = ?
+	`, tokenID)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var roleID int
+		err = row.Scan(&roleID)
+		if err != nil {
+			return err
+		}
+
+		roleIDs = append(roleIDs, roleID)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return roleIDs, nil
+}
+
+// getSessionPermissions - permissions of the session's user.
+// A session opened with an API token limited to roles only gets the permissions of those roles.
+func getSessionPermissions(sessionData *SessionData) (map[string]bool, error) {
+	var user string
+
+	if sessionData != nil && sessionData.LoggedIn {
+		user = sessionData.User.Username
+	}
+
+	roleIDs, err := getSessionRoleIDs(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if sessionData != nil && sessionData.APITokenID > 0 {
+		tokenRoleIDs, err := getAPITokenRoleIDs(sessionData.APITokenID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokenRoleIDs) > 0 {
+			allowed := make(map[int]bool)
+			for _, roleID := range tokenRoleIDs {
+				allowed[roleID] = true
+			}
+
+			var limited []int
+			for _, roleID := range roleIDs {
+				if allowed[roleID] {
+					limited = append(limited, roleID)
+				}
+			}
+
+			roleIDs = limited
+		}
+	}
+
+	return getRolePermissions(roleIDs)
+}
+
+// HasPermission - user holds the permission through one of their current roles
+func HasPermission(user string, permission string) (bool, error) {
+	roleIDs, err := getSessionRoleIDs(user)
+	if err != nil {
+		return false, err
+	}
+
+	perms, err := getRolePermissions(roleIDs)
+	if err != nil {
+		return false, err
+	}
+
+	return perms[permission], nil
+}
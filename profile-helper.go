@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// A new email is kept in user_email_change until the link mailed to it is opened;
+// only then email and loweredemail of the user change.
+
+const emailChangeValidity = 24 * time.Hour
+
+func newEmailChangeToken() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requestEmailChange - remember the new email of the user and mail the confirmation link to it.
+// Earlier requests of the user stop working.
+func requestEmailChange(r *http.Request, u *MembershipUser, email string, lang string) error {
+	taken, err := u.emailTaken(email)
+	if err != nil {
+		return err
+	}
+
+	if taken == 1 {
+		return newLocalizedError("user.duplicate-email", email)
+	}
+
+	token, err := newEmailChangeToken()
+	if err != nil {
+		return err
+	}
+
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    UPDATE user_email_change
+	       SET valid = 0
+	     WHERE user_id = ?
+	       AND valid = 1
+	`, u.UserID)
+
+	_, err = dbutl.ExecTx(u.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	pq = dbutl.PQuery(`
+	    INSERT INTO user_email_change (
+	        user_id,
+	        new_email,
+	        token_hash,
+	        creation_time,
+	        valid_until
+	    )
+	    VALUES (?, ?, ?, ?, ?)
+	`, u.UserID,
+		email,
+		hashAPIToken(token),
+		dt,
+		dt.Add(emailChangeValidity))
+
+	_, err = dbutl.ExecTx(u.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	link := siteURL(r, "/confirm-email?token="+neturl.QueryEscape(token))
+	hours := int(emailChangeValidity / time.Hour)
+
+	return sendMail(email,
+		translate(lang, "mail.email-change.subject"),
+		translate(lang, "mail.email-change.body", u.Username, link, hours))
+}
+
+// confirmEmailChange - set the email waiting for the token; returns the user and the email replaced
+func confirmEmailChange(token string) (*MembershipUser, string, error) {
+	var emailChangeID int
+	var userID int
+	var email string
+
+	if len(token) == 0 {
+		return nil, "", newLocalizedError("profile.email-link-invalid")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	pq := dbutl.PQuery(`
+	    SELECT email_change_id,
+	           user_id,
+	           new_email
+	      FROM user_email_change
+	     WHERE token_hash = ?
+	       AND valid = 1
+	       AND valid_until > ?
+	`, hashAPIToken(token),
+		time.Now().UTC())
+
+	err = tx.QueryRow(pq.Query, pq.Args...).Scan(&emailChangeID, &userID, &email)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, "", newLocalizedError("profile.email-link-invalid")
+	case err != nil:
+		return nil, "", err
+	}
+
+	u := MembershipUser{tx: tx}
+	err = u.GetByID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	oldEmail := u.Email
+	u.Email = email
+
+	// the email may have been taken since the link was sent
+	err = u.Save()
+	if err != nil {
+		return nil, "", err
+	}
+
+	pq = dbutl.PQuery(`
+	    UPDATE user_email_change
+	       SET valid = 0
+	     WHERE user_id = ?
+	       AND valid = 1
+	`, userID)
+
+	_, err = dbutl.ExecTx(tx, pq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &u, oldEmail, nil
+}
+
+// getPendingEmailChange - the new email waiting for confirmation; empty when there is none
+func getPendingEmailChange(tx *sql.Tx, userID int) (string, error) {
+	var email string
+
+	pq := dbutl.PQuery(`
+	    SELECT new_email
+	      FROM user_email_change
+	     WHERE user_id = ?
+	       AND valid = 1
+	       AND valid_until > ?
+	`, userID,
+		time.Now().UTC())
+
+	err := tx.QueryRow(pq.Query, pq.Args...).Scan(&email)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	return email, nil
+}
+
+// notifyEmailChanged - tell the old address that the email of the account changed
+func notifyEmailChanged(u *MembershipUser, oldEmail string) {
+	if !mailEnabled() || len(oldEmail) == 0 || strings.EqualFold(oldEmail, u.Email) {
+		return
+	}
+
+	lang, err := getUserLanguage(u.Username)
+	if err != nil || len(lang) == 0 {
+		lang = config.I18n.DefaultLanguage
+	}
+
+	err = sendMail(oldEmail,
+		translate(lang, "mail.email-changed.subject"),
+		translate(lang, "mail.email-changed.body", u.Username, u.Email))
+	if err != nil {
+		audit.Log(err, "profile", "Could not send the email change notice", "user", u.Username)
+	}
+}
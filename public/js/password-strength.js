@@ -0,0 +1,87 @@
+// Live password strength feedback.
+// Usage: <div class="password-strength" data-password="new_password"></div>
+// next to the password input; the other inputs of the form named username, name,
+// surname and email are sent too, the password should not be built on them.
+
+function initPasswordStrength() {
+    var meters = document.getElementsByClassName("password-strength");
+
+    for (var i = 0; i < meters.length; i++) {
+        bindPasswordStrength(meters[i]);
+    }
+}
+
+function bindPasswordStrength(meter) {
+    var form = meter.closest("form");
+    var input = form.elements[meter.getAttribute("data-password")];
+    var timer = null;
+
+    if (input == undefined) {
+        return;
+    }
+
+    input.addEventListener("input", function() {
+        if (timer != null) {
+            clearTimeout(timer);
+        }
+
+        timer = setTimeout(function() {
+            checkPasswordStrength(form, input, meter);
+        }, 300);
+    });
+}
+
+function checkPasswordStrength(form, input, meter) {
+    if (input.value.length == 0) {
+        meter.innerHTML = "";
+        return;
+    }
+
+    var params = { password: input.value };
+    var fields = ["username", "name", "surname", "email"];
+
+    for (var i = 0; i < fields.length; i++) {
+        var field = form.elements[fields[i]];
+        if (field != undefined) {
+            params[fields[i]] = field.value;
+        }
+    }
+
+    postAJAX("/password-strength", params, function(data) {
+        showPasswordStrength(meter, JSON.parse(data));
+    });
+}
+
+function showPasswordStrength(meter, strength) {
+    meter.innerHTML = "";
+
+    var bar = document.createElement("div");
+    bar.className = "password-strength-bar score-" + strength.score;
+
+    var label = document.createElement("div");
+    label.className = strength.acceptable ? "password-strength-ok" : "password-strength-weak";
+    label.textContent = strength.label;
+
+    meter.appendChild(bar);
+    meter.appendChild(label);
+
+    if (strength.warning) {
+        var warning = document.createElement("div");
+        warning.textContent = strength.warning;
+        meter.appendChild(warning);
+    }
+
+    if (strength.suggestions) {
+        var list = document.createElement("ul");
+
+        for (var i = 0; i < strength.suggestions.length; i++) {
+            var item = document.createElement("li");
+            item.textContent = strength.suggestions[i];
+            list.appendChild(item);
+        }
+
+        meter.appendChild(list);
+    }
+}
+
+document.addEventListener("DOMContentLoaded", initPasswordStrength);
@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -18,18 +17,19 @@ type RequestHelper struct {
 }
 
 type urlRequest struct {
-	RequestType     string `sql:"request_type"`
-	RequestURL      string `sql:"request_url"`
-	RequestTemplate string `sql:"request_template"`
-	Controller      string `sql:"controller"`
-	Action          string `sql:"action"`
-	RedirectURL     string `sql:"redirect_url"`
-	RedirectOnError string `sql:"redirect_on_error"`
-	IndexLevel      int    `sql:"index_level"`
-	OrderNumber     int    `sql:"order_number"`
-	FireEvent       int    `sql:"fire_event"`
-	ParentURL       string
-	ParentID        int `sql:"parent_id"`
+	RequestType          string `sql:"request_type"`
+	RequestURL           string `sql:"request_url"`
+	RequestTemplate      string `sql:"request_template"`
+	Controller           string `sql:"controller"`
+	Action               string `sql:"action"`
+	RedirectURL          string `sql:"redirect_url"`
+	RedirectOnError      string `sql:"redirect_on_error"`
+	IndexLevel           int    `sql:"index_level"`
+	OrderNumber          int    `sql:"order_number"`
+	FireEvent            int    `sql:"fire_event"`
+	ImpersonationAllowed int    `sql:"impersonation_allowed"`
+	ParentURL            string
+	ParentID             int `sql:"parent_id"`
 }
 
 var requestLock sync.RWMutex
@@ -79,6 +79,7 @@ func (r *RequestHelper) GetByURL(requestType string, requestURL string) error {
 			   case when index_level is null then -1 else index_level end AS index_level,
 			   case when order_number is null then -1 else order_number end AS order_number,
 			   fire_event,
+			   impersonation_allowed,
 			   case when parent_id is null then -1 else parent_id end AS parent_id
 	      from request
 		 where request_url = ?
@@ -115,6 +116,7 @@ func (r *RequestHelper) GetByID(requestID int) error {
 			   case when index_level is null then -1 else index_level end AS index_level,
 			   case when order_number is null then -1 else order_number end AS order_number,
 			   fire_event,
+			   impersonation_allowed,
 			   case when parent_id is null then -1 else parent_id end AS parent_id
 	      from request
 	     where request_id = ?
@@ -144,6 +146,7 @@ func (r *RequestHelper) Load(req *urlRequest) {
 	r.IndexLevel = req.IndexLevel
 	r.OrderNumber = req.OrderNumber
 	r.FireEvent = req.FireEvent
+	r.ImpersonationAllowed = req.ImpersonationAllowed
 }
 
 func (r *RequestHelper) testSave() error {
@@ -189,7 +192,7 @@ func (r *RequestHelper) Save() error {
 	}
 
 	if r.ParentID <= 0 && len(r.ParentURL) > 0 {
-		parent := RequestHelper{}
+		parent := RequestHelper{tx: r.tx}
 		err = parent.GetByURL("GET", r.ParentURL)
 		if err != nil {
 			return err
@@ -210,6 +213,7 @@ func (r *RequestHelper) Save() error {
 				index_level,
 				order_number,
 				fire_event,
+				impersonation_allowed,
 				parent_id
 			)
 			values (
@@ -217,7 +221,7 @@ func (r *RequestHelper) Save() error {
 				?, ?,
 				case when ? <= 0 then CAST(null AS int) else ? end,
 				case when ? <= 0 then CAST(null AS int) else ? end,
-				?,
+				?, ?,
 				case when ? <= 0 then CAST(null AS int) else ? end
 			)
 		`, r.RequestTemplate,
@@ -232,6 +236,7 @@ func (r *RequestHelper) Save() error {
 			r.OrderNumber,
 			r.OrderNumber,
 			r.FireEvent,
+			r.ImpersonationAllowed,
 			r.ParentID,
 			r.ParentID,
 		)
@@ -279,10 +284,11 @@ func (r *RequestHelper) Save() error {
 				   index_level = case when ? <= 0 then CAST(null AS int) else ? end,
 				   order_number = case when ? <= 0 then CAST(null AS int) else ? end,
 				   fire_event = ?,
+				   impersonation_allowed = ?,
 				   parent_id = case when ? <= 0 then CAST(null AS int) else ? end
 			     WHERE request_id = ?
 			`, r.RequestTemplate,
-				r.RedirectURL,
+				r.RequestURL,
 				r.RequestType,
 				r.Controller,
 				r.Action,
@@ -293,9 +299,10 @@ func (r *RequestHelper) Save() error {
 				r.OrderNumber,
 				r.OrderNumber,
 				r.FireEvent,
-				r.RequestID,
+				r.ImpersonationAllowed,
 				r.ParentID,
 				r.ParentID,
+				r.RequestID,
 			)
 
 			_, err = dbutl.ExecTx(r.tx, pq)
@@ -325,6 +332,7 @@ func (r *RequestHelper) Equals(r1 *RequestHelper) bool {
 		r.IndexLevel != r1.IndexLevel ||
 		r.OrderNumber != r1.OrderNumber ||
 		r.FireEvent != r1.FireEvent ||
+		r.ImpersonationAllowed != r1.ImpersonationAllowed ||
 		r.ParentID != r1.ParentID {
 
 		return false
@@ -333,39 +341,42 @@ func (r *RequestHelper) Equals(r1 *RequestHelper) bool {
 	return true
 }
 
-func getClientIP(r *http.Request) string {
-	ips := r.Header.Get("X-Forwarded-For")
-
-	ipList := strings.Split(ips, ", ")
+// siteURL - absolute url of path on this site: public-url of the config, or the host the browser used
+func siteURL(r *http.Request, path string) string {
+	if len(config.General.PublicURL) > 0 {
+		return strings.TrimSuffix(config.General.PublicURL, "/") + path
+	}
 
-	if len(ipList) > 0 && len(ipList[0]) > 0 {
-		return ipList[0]
+	scheme := "http"
+	if config.General.IsHTTPS {
+		scheme = "https"
 	}
 
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return scheme + "://" + r.Host + path
+}
 
-	return ip
+// getClientIP - normalized ip of the client; X-Forwarded-For is honored only from trusted proxies
+func getClientIP(r *http.Request) string {
+	ip := clientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
 }
 
 func isRequestFromLocalhost(r *http.Request) bool {
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-
-	if ip == "127.0.0.1" || ip == "::1" {
-		return true
-	}
+	ip := clientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
 
-	return false
+	return ip != nil && ip.IsLoopback()
 }
 
 func isRequestFromAdminIP(r *http.Request) bool {
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	ipList := strings.Split(config.General.AdminIP, ",")
-
-	for _, addr := range ipList {
-		if ip == addr {
-			return true
-		}
+	networks, err := parseNetworkList(config.General.AdminIP)
+	if err != nil {
+		audit.Log(err, "admin-ip", "Invalid admin-ip in the config")
+		return false
 	}
 
-	return false
+	return networksContain(networks, clientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For")))
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
@@ -20,15 +19,29 @@ type ResponseHelper struct {
 	RedirectOnError string `sql:"redirect_on_error"`
 }
 
-func (res *ResponseHelper) getResponse(w http.ResponseWriter, r *http.Request) (models.ResponseModel, error) {
-	switch res.Controller {
+func getController(name string) interface{} {
+	switch name {
 	case "Home":
-		home := HomeController{}
-		return res.getResponseValue(home, w, r)
+		return HomeController{}
+
+	case "Account":
+		return AccountController{}
+
+	case "Admin":
+		return AdminController{}
 
 	default:
+		return nil
+	}
+}
+
+func (res *ResponseHelper) getResponse(w http.ResponseWriter, r *http.Request) (models.ResponseModel, error) {
+	controller := getController(res.Controller)
+	if controller == nil {
 		return nil, nil
 	}
+
+	return res.getResponseValue(controller, w, r)
 }
 
 func (res *ResponseHelper) getResponseValue(controller interface{}, w http.ResponseWriter, r *http.Request) (models.ResponseModel, error) {
@@ -56,16 +69,18 @@ func (res *ResponseHelper) getResponseValue(controller interface{}, w http.Respo
 	return nil, fmt.Errorf("Function does not return the requested number of values")
 }
 
-func getResponseHelperByURL(sessionData *SessionData, url string, requestType string) (*ResponseHelper, error) {
-	var res ResponseHelper
-	var sURL string
-
+// requestURLKey - request_url of the path
+func requestURLKey(url string) string {
 	if url == "/" {
-		sURL = "index"
-	} else {
-		sURL = strings.Replace(url[1:], ".html", "", 1)
+		return "index"
 	}
 
+	return strings.Replace(url[1:], ".html", "", 1)
+}
+
+func getResponseHelperByURL(sessionData *SessionData, url string, requestType string) (*ResponseHelper, error) {
+	sURL := requestURLKey(url)
+
 	var suser string
 	var lang string
 	if sessionData != nil {
@@ -76,56 +91,64 @@ func getResponseHelperByURL(sessionData *SessionData, url string, requestType st
 		suser = "-"
 	}
 	if len(lang) == 0 {
-		lang = "EN"
-	}
-
-	pq := dbutl.PQuery(`
-		WITH access AS (
-			SELECT rr.request_id
-			  FROM "user" u, user_role ur, request_role rr
-			 WHERE u.user_id = ur.user_id
-			   AND ur.role_id = rr.role_id
-			   AND u.loweredusername = lower(?)
-			   AND u.valid  = 1
-			   AND ur.valid = 1
-			UNION ALL
-			SELECT rr.request_id 
-              FROM role r, request_role rr
-			 WHERE r.role_id = rr.role_id
-			   AND r.loweredrole = lower(?)
-		),
-		name AS (
-			SELECT request_id, name
-			  FROM request_name
-			 WHERE language = ?
-		)
-		SELECT case when nm.name is null then '-' else nm.name end AS name,
-			r.request_template,
-			r.controller,
-			r.action,
-			r.redirect_url,
-			r.redirect_on_error
-		FROM request r
-		JOIN access a ON (r.request_id = a.request_id)
-		LEFT OUTER JOIN name nm ON (r.request_id = nm.request_id)
-		WHERE r.request_url = ?
-		  AND r.request_type = ?
-		LIMIT 1
-	`, suser,
-		"All",
-		lang,
-		sURL,
-		requestType)
-
-	err := dbutl.RunQuery(pq, &res)
-
-	switch {
-	case err == sql.ErrNoRows:
+		lang = config.I18n.DefaultLanguage
+	}
+
+	rules, err := getAccessRules(&accessCache.requestStats)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := rules.requests[accessRequestKey(requestType, sURL)]
+	if !ok {
 		err = fmt.Errorf("request \"%s\" - not found or access denied", url)
 		return nil, err
-	case err != nil:
+	}
+
+	roleIDs, err := getSessionRoleIDs(suser)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := false
+	for _, roleID := range roleIDs {
+		if req.roleIDs[roleID] {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		err = fmt.Errorf("request \"%s\" - not found or access denied", url)
 		return nil, err
 	}
 
+	res := ResponseHelper{
+		Title:           "-",
+		Template:        req.Template,
+		Controller:      req.Controller,
+		Action:          req.Action,
+		RedirectURL:     req.RedirectURL,
+		RedirectOnError: req.RedirectOnError,
+	}
+
+	if name, ok := req.names[lang]; ok {
+		res.Title = name
+	} else if name, ok := req.names[config.I18n.DefaultLanguage]; ok {
+		res.Title = name
+	}
+
+	if sessionData != nil && sessionData.APITokenID > 0 {
+		allowed, err := apiTokenAllowsRequest(sessionData.APITokenID, sURL, requestType)
+		if err != nil {
+			return nil, err
+		}
+
+		if !allowed {
+			err = fmt.Errorf("request \"%s\" - not in the API token scope", url)
+			return nil, err
+		}
+	}
+
 	return &res, nil
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+type userRoleHistoryUtil struct {
+	UserRoleID int       `sql:"user_role_id"`
+	UserID     int       `sql:"user_id"`
+	RoleID     int       `sql:"role_id"`
+	Role       string    `sql:"role"`
+	ValidFrom  time.Time `sql:"valid_from"`
+	Expires    bool      `sql:"expires"`
+	ValidUntil time.Time `sql:"valid_until"`
+	Valid      int       `sql:"valid"`
+}
+
+// saveUserRoleHistory - copy the current state of a membership into user_role_history
+func saveUserRoleHistory(tx *sql.Tx, userRoleID int, changeType string, changedBy string) error {
+	var h userRoleHistoryUtil
+
+	pq := dbutl.PQuery(`
+	    SELECT ur.user_role_id,
+	           ur.user_id,
+	           ur.role_id,
+	           r.role,
+	           ur.valid_from,
+	           CASE WHEN ur.valid_until IS NULL THEN 0 ELSE 1 END AS expires,
+	           CASE WHEN ur.valid_until IS NULL THEN ur.valid_from ELSE ur.valid_until END AS valid_until,
+	           ur.valid
+	      FROM user_role ur
+	      JOIN role r ON (ur.role_id = r.role_id)
+	     WHERE ur.user_role_id = ?
+	`, userRoleID)
+
+	err := dbutl.RunQueryTx(tx, pq, &h)
+	if err != nil {
+		return err
+	}
+
+	var validUntil *time.Time
+	if h.Expires {
+		validUntil = &h.ValidUntil
+	}
+
+	pq = dbutl.PQuery(`
+	    INSERT INTO user_role_history (
+	        user_role_id,
+	        user_id,
+	        role_id,
+	        role,
+	        valid_from,
+	        valid_until,
+	        valid,
+	        change_type,
+	        change_time,
+	        changed_by
+	    )
+	    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, h.UserRoleID,
+		h.UserID,
+		h.RoleID,
+		h.Role,
+		h.ValidFrom,
+		validUntil,
+		h.Valid,
+		changeType,
+		time.Now().UTC(),
+		changedBy)
+
+	_, err = dbutl.ExecTx(tx, pq)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IsManaged - role holds permissions or inherits roles, so it is owned by access-rules.json
+func (r *MembershipRole) IsManaged() (bool, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	found := 0
+
+	pq := dbutl.PQuery(`
+	    SELECT CASE WHEN EXISTS (
+	        SELECT 1 FROM role_permission WHERE role_id = ?
+	    ) OR EXISTS (
+	        SELECT 1 FROM role_inheritance WHERE parent_role_id = ? OR child_role_id = ?
+	    ) THEN 1 ELSE 0 END
+	    FROM dual
+	`, r.RoleID,
+		r.RoleID,
+		r.RoleID)
+
+	err := r.tx.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return false, err
+	}
+
+	return found == 1, nil
+}
+
+// Delete - delete the role, ending all its memberships.
+// API tokens limited to the role are revoked, so their scope does not widen.
+func (r *MembershipRole) Delete(changedBy string) error {
+	managed, err := r.IsManaged()
+	if err != nil {
+		return err
+	}
+
+	if managed {
+		return fmt.Errorf("role \"%s\" is used in access-rules.json and cannot be deleted", r.Rolename)
+	}
+
+	membershipRoleLock.Lock()
+	defer membershipRoleLock.Unlock()
+
+	var userRoleIDs []int
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT user_role_id FROM user_role WHERE role_id = ?
+	`, r.RoleID)
+
+	err = dbutl.ForEachRowTx(r.tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var userRoleID int
+		err = row.Scan(&userRoleID)
+		if err != nil {
+			return err
+		}
+
+		userRoleIDs = append(userRoleIDs, userRoleID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, userRoleID := range userRoleIDs {
+		pq = dbutl.PQuery(`
+		    UPDATE user_role
+		       SET valid_until = CASE
+		                           WHEN valid_until IS NULL OR valid_until > ? THEN ?
+		                           ELSE valid_until
+		                         END,
+		           valid = ?
+		     WHERE user_role_id = ?
+		`, dt,
+			dt,
+			0,
+			userRoleID)
+
+		_, err = dbutl.ExecTx(r.tx, pq)
+		if err != nil {
+			return err
+		}
+
+		err = saveUserRoleHistory(r.tx, userRoleID, "delete-role", changedBy)
+		if err != nil {
+			return err
+		}
+	}
+
+	pq = dbutl.PQuery(`
+	    UPDATE user_api_token
+	       SET valid = ?
+	     WHERE api_token_id IN (
+	         SELECT api_token_id FROM user_api_token_role WHERE role_id = ?
+	     )
+	`, 0,
+		r.RoleID)
+
+	_, err = dbutl.ExecTx(r.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	queries := []*utils.PreparedQuery{
+		dbutl.PQuery(`DELETE FROM user_api_token_role WHERE role_id = ?`, r.RoleID),
+		dbutl.PQuery(`DELETE FROM user_role WHERE role_id = ?`, r.RoleID),
+		dbutl.PQuery(`DELETE FROM role_closure WHERE ancestor_role_id = ? OR descendant_role_id = ?`, r.RoleID, r.RoleID),
+		dbutl.PQuery(`DELETE FROM role WHERE role_id = ?`, r.RoleID),
+	}
+
+	for _, pq = range queries {
+		_, err = dbutl.ExecTx(r.tx, pq)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = bumpAccessChangeCounter(r.tx)
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, "delete-role", "Delete role.", "role", r, "members", len(userRoleIDs), "changed_by", changedBy)
+
+	return nil
+}
+
+// GetRoles - all roles with their current member count
+func GetRoles() ([]*models.RoleModel, error) {
+	var roles []*models.RoleModel
+	dt := time.Now().UTC()
+
+	pq := dbutl.PQuery(`
+	    SELECT r.role_id,
+	           r.role,
+	           (SELECT count(*)
+	              FROM user_role ur
+	             WHERE ur.role_id = r.role_id
+	               AND ur.valid = ?
+	               AND ur.valid_from <= ?
+	               AND (ur.valid_until IS NULL OR ur.valid_until > ?)) AS members,
+	           CASE WHEN EXISTS (
+	               SELECT 1 FROM role_permission rp WHERE rp.role_id = r.role_id
+	           ) OR EXISTS (
+	               SELECT 1 FROM role_inheritance ri WHERE ri.parent_role_id = r.role_id OR ri.child_role_id = r.role_id
+	           ) THEN 1 ELSE 0 END AS managed
+	      FROM role r
+	     ORDER BY r.role
+	`, 1,
+		dt,
+		dt)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var role models.RoleModel
+		err = sc.Scan(dbutl, row, &role)
+		if err != nil {
+			return err
+		}
+
+		roles = append(roles, &role)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// getRoleMemberships - memberships matching the filter, oldest start first
+func getRoleMemberships(filter string, args ...interface{}) ([]*models.RoleMemberModel, error) {
+	var members []*models.RoleMemberModel
+	dt := time.Now().UTC()
+
+	args = append([]interface{}{1, dt, dt}, args...)
+
+	pq := dbutl.PQuery(`
+	    SELECT ur.user_role_id,
+	           ur.role_id,
+	           r.role,
+	           u.user_id,
+	           u.username,
+	           u.name,
+	           u.surname,
+	           ur.valid_from,
+	           CASE WHEN ur.valid_until IS NULL THEN 0 ELSE 1 END AS expires,
+	           CASE WHEN ur.valid_until IS NULL THEN ur.valid_from ELSE ur.valid_until END AS valid_until,
+	           ur.valid,
+	           CASE
+	             WHEN ur.valid = ?
+	              AND ur.valid_from <= ?
+	              AND (ur.valid_until IS NULL OR ur.valid_until > ?) THEN 1
+	             ELSE 0
+	           END AS active
+	      FROM user_role ur
+	      JOIN role r ON (ur.role_id = r.role_id)
+	      JOIN "user" u ON (ur.user_id = u.user_id)
+	     WHERE `+filter+`
+	     ORDER BY ur.valid_from, u.username
+	`, args...)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var member models.RoleMemberModel
+		err = sc.Scan(dbutl, row, &member)
+		if err != nil {
+			return err
+		}
+
+		members = append(members, &member)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// GetRoleMembers - current, future and expired members of a role
+func GetRoleMembers(roleID int) ([]*models.RoleMemberModel, error) {
+	return getRoleMemberships("ur.role_id = ?", roleID)
+}
+
+// GetUpcomingRoleMemberships - memberships starting within the next days
+func GetUpcomingRoleMemberships(days int) ([]*models.RoleMemberModel, error) {
+	dt := time.Now().UTC()
+
+	return getRoleMemberships(
+		"ur.valid = ? AND ur.valid_from > ? AND ur.valid_from <= ?",
+		1,
+		dt,
+		dt.AddDate(0, 0, days))
+}
+
+// GetExpiringRoleMemberships - active memberships ending within the next days
+func GetExpiringRoleMemberships(days int) ([]*models.RoleMemberModel, error) {
+	dt := time.Now().UTC()
+
+	return getRoleMemberships(
+		"ur.valid = ? AND ur.valid_from <= ? AND ur.valid_until > ? AND ur.valid_until <= ?",
+		1,
+		dt,
+		dt,
+		dt.AddDate(0, 0, days))
+}
+
+// GetRoleHistory - membership changes, newest first (roleID <= 0 - all roles)
+func GetRoleHistory(roleID int, page int, rowsOnPage int) ([]*models.RoleHistoryModel, error) {
+	var history []*models.RoleHistoryModel
+
+	lmin := 0
+	if page > 1 {
+		lmin = (page - 1) * rowsOnPage
+	}
+
+	pq := dbutl.PQuery(`
+	    SELECT h.user_role_history_id,
+	           h.role_id,
+	           h.role,
+	           u.username,
+	           h.valid_from,
+	           CASE WHEN h.valid_until IS NULL THEN 0 ELSE 1 END AS expires,
+	           CASE WHEN h.valid_until IS NULL THEN h.valid_from ELSE h.valid_until END AS valid_until,
+	           h.change_type,
+	           h.change_time,
+	           h.changed_by
+	      FROM user_role_history h
+	      JOIN "user" u ON (h.user_id = u.user_id)
+	     WHERE (h.role_id = ? OR ? <= 0)
+	     ORDER BY h.change_time DESC, h.user_role_history_id DESC
+	     LIMIT ? OFFSET ?
+	`, roleID,
+		roleID,
+		rowsOnPage,
+		lmin)
+
+	var err error
+	err = dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var h models.RoleHistoryModel
+		err = sc.Scan(dbutl, row, &h)
+		if err != nil {
+			return err
+		}
+
+		history = append(history, &h)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
@@ -153,6 +153,15 @@ func (r *MembershipRole) Save() error {
 			return err
 		}
 
+		pq = dbutl.PQuery(`
+			INSERT INTO role_closure (ancestor_role_id, descendant_role_id, depth) VALUES (?, ?, ?)
+		`, r.RoleID, r.RoleID, 0)
+
+		_, err = dbutl.ExecTx(r.tx, pq)
+		if err != nil {
+			return err
+		}
+
 		audit.Log(nil, "add-role", "Add new role.", "new", r)
 	} else {
 		old := MembershipRole{tx: r.tx}
@@ -181,7 +190,7 @@ func (r *MembershipRole) Save() error {
 	return nil
 }
 
-// HasMember - role has member
+// HasMember - role has member, directly or through an inheriting role
 func (r *MembershipRole) HasMember(user string) (bool, error) {
 	r.RLock()
 	defer r.RUnlock()
@@ -195,10 +204,11 @@ func (r *MembershipRole) HasMember(user string) (bool, error) {
 	        SELECT 1
 	          FROM user_role ur
 	          JOIN "user" u ON (ur.user_id = u.user_id)
-	         WHERE u.loweredusername =  lower(?)
-			   AND ur.role_id        =  ?
-			   AND ur.valid          =  ?
-	           AND ur.valid_from     <= ?
+	          JOIN role_closure rc ON (ur.role_id = rc.ancestor_role_id)
+	         WHERE u.loweredusername      =  lower(?)
+			   AND rc.descendant_role_id =  ?
+			   AND ur.valid              =  ?
+	           AND ur.valid_from         <= ?
 	           AND (ur.valid_until is null OR ur.valid_until > ?)
 	    ) THEN 1 ELSE 0 END
 	    FROM dual
@@ -220,7 +230,7 @@ func (r *MembershipRole) HasMember(user string) (bool, error) {
 	return true, nil
 }
 
-// HasMemberID - has member ID
+// HasMemberID - has direct member ID
 func (r *MembershipRole) HasMemberID(userID int) (bool, error) {
 	r.RLock()
 	defer r.RUnlock()
@@ -258,7 +268,7 @@ func (r *MembershipRole) HasMemberID(userID int) (bool, error) {
 	return true, nil
 }
 
-// IsUserInRole - Is user in role
+// IsUserInRole - Is user in role, directly or through an inheriting role
 func IsUserInRole(user string, role string) (bool, error) {
 	found := 0
 	dt := time.Now().UTC()
@@ -268,7 +278,8 @@ func IsUserInRole(user string, role string) (bool, error) {
 	        SELECT 1
 	          FROM user_role ur
 	          JOIN "user" u ON (ur.user_id = u.user_id)
-	          JOIN role r ON (ur.role_id = r.role_id)
+	          JOIN role_closure rc ON (ur.role_id = rc.ancestor_role_id)
+	          JOIN role r ON (rc.descendant_role_id = r.role_id)
 	         WHERE u.loweredusername =  lower(?)
 			   AND lower(r.role)     =  lower(?)
 			   AND ur.valid          =  ?
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// roleEdge - parent role inherits the grants of child role
+type roleEdge struct {
+	ParentRoleID int `sql:"parent_role_id"`
+	ChildRoleID  int `sql:"child_role_id"`
+}
+
+// GetChildRoles - roles directly inherited by this role
+func (r *MembershipRole) GetChildRoles() ([]*MembershipRole, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	var roles []*MembershipRole
+
+	pq := dbutl.PQuery(`
+	    SELECT c.role_id,
+	           c.role
+	      FROM role_inheritance ri
+	      JOIN role c ON (ri.child_role_id = c.role_id)
+	     WHERE ri.parent_role_id = ?
+	     ORDER BY c.role
+	`, r.RoleID)
+
+	var err error
+	err = dbutl.ForEachRowTx(r.tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		role := MembershipRole{tx: r.tx}
+		err = sc.Scan(dbutl, row, &role)
+		if err != nil {
+			return err
+		}
+
+		roles = append(roles, &role)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// AddChildRole - this role inherits everything the child role grants
+func (r *MembershipRole) AddChildRole(child string) error {
+	membershipRoleLock.Lock()
+	defer membershipRoleLock.Unlock()
+
+	c := MembershipRole{tx: r.tx}
+	err := c.GetByName(child)
+	if err != nil {
+		return err
+	}
+
+	found := 0
+
+	// the child, or one of its descendants, already inherits this role
+	pq := dbutl.PQuery(`
+	    SELECT CASE WHEN EXISTS (
+	        SELECT 1
+	          FROM role_closure
+	         WHERE ancestor_role_id   = ?
+	           AND descendant_role_id = ?
+	    ) THEN 1 ELSE 0 END
+	    FROM dual
+	`, c.RoleID,
+		r.RoleID)
+
+	err = r.tx.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found == 1 || c.RoleID == r.RoleID {
+		return fmt.Errorf("role \"%s\" cannot inherit \"%s\": cycle detected", r.Rolename, c.Rolename)
+	}
+
+	pq = dbutl.PQuery(`
+	    SELECT CASE WHEN EXISTS (
+	        SELECT 1
+	          FROM role_inheritance
+	         WHERE parent_role_id = ?
+	           AND child_role_id  = ?
+	    ) THEN 1 ELSE 0 END
+	    FROM dual
+	`, r.RoleID,
+		c.RoleID)
+
+	err = r.tx.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found == 1 {
+		return nil
+	}
+
+	pq = dbutl.PQuery(`
+	    INSERT INTO role_inheritance (parent_role_id, child_role_id) VALUES (?, ?)
+	`, r.RoleID,
+		c.RoleID)
+
+	_, err = dbutl.ExecTx(r.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	err = rebuildRoleClosure(r.tx)
+	if err != nil {
+		return err
+	}
+
+	err = bumpAccessChangeCounter(r.tx)
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, "add-role-inheritance", "Role inherits role.", "role", r.Rolename, "child", c.Rolename)
+
+	return nil
+}
+
+// RemoveChildRole - this role no longer inherits the child role
+func (r *MembershipRole) RemoveChildRole(child string) error {
+	membershipRoleLock.Lock()
+	defer membershipRoleLock.Unlock()
+
+	c := MembershipRole{tx: r.tx}
+	err := c.GetByName(child)
+	if err != nil {
+		return err
+	}
+
+	pq := dbutl.PQuery(`
+	    DELETE FROM role_inheritance
+	     WHERE parent_role_id = ?
+	       AND child_role_id  = ?
+	`, r.RoleID,
+		c.RoleID)
+
+	_, err = dbutl.ExecTx(r.tx, pq)
+	if err != nil {
+		return err
+	}
+
+	err = rebuildRoleClosure(r.tx)
+	if err != nil {
+		return err
+	}
+
+	err = bumpAccessChangeCounter(r.tx)
+	if err != nil {
+		return err
+	}
+
+	audit.Log(nil, "remove-role-inheritance", "Role no longer inherits role.", "role", r.Rolename, "child", c.Rolename)
+
+	return nil
+}
+
+// findRoleCycle - a cycle in the inheritance graph, or nil.
+// Nodes are visited in sorted order so the reported cycle is stable.
+func findRoleCycle(children map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := make(map[string]int)
+	var path []string
+	var cycle []string
+
+	var visit func(node string) bool
+	visit = func(node string) bool {
+		state[node] = visiting
+		path = append(path, node)
+
+		for _, child := range children[node] {
+			switch state[child] {
+			case visiting:
+				for i, n := range path {
+					if n == child {
+						cycle = append(append([]string{}, path[i:]...), child)
+						break
+					}
+				}
+				return true
+			case unvisited:
+				if visit(child) {
+					return true
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[node] = done
+		return false
+	}
+
+	var nodes []string
+	for node := range children {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	for _, node := range nodes {
+		if state[node] == unvisited && visit(node) {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+// rebuildRoleClosure - recompute role_closure from role_inheritance.
+// The role graph is small, so the closure is rebuilt as a whole.
+func rebuildRoleClosure(tx *sql.Tx) error {
+	var roleIDs []int
+	children := make(map[int][]int)
+	names := make(map[string][]string)
+
+	pq := dbutl.PQuery(`SELECT role_id FROM role`)
+
+	var err error
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var roleID int
+		err = row.Scan(&roleID)
+		if err != nil {
+			return err
+		}
+
+		roleIDs = append(roleIDs, roleID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pq = dbutl.PQuery(`SELECT parent_role_id, child_role_id FROM role_inheritance`)
+
+	err = dbutl.ForEachRowTx(tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var e roleEdge
+		err = sc.Scan(dbutl, row, &e)
+		if err != nil {
+			return err
+		}
+
+		children[e.ParentRoleID] = append(children[e.ParentRoleID], e.ChildRoleID)
+
+		parent := strconv.Itoa(e.ParentRoleID)
+		names[parent] = append(names[parent], strconv.Itoa(e.ChildRoleID))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if cycle := findRoleCycle(names); cycle != nil {
+		return fmt.Errorf("role inheritance cycle detected (role ids %s)", strings.Join(cycle, " -> "))
+	}
+
+	_, err = dbutl.ExecTx(tx, dbutl.PQuery(`DELETE FROM role_closure`))
+	if err != nil {
+		return err
+	}
+
+	for _, roleID := range roleIDs {
+		// breadth first, so depth is the shortest inheritance path
+		depths := map[int]int{roleID: 0}
+		queue := []int{roleID}
+
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+
+			for _, child := range children[current] {
+				if _, ok := depths[child]; !ok {
+					depths[child] = depths[current] + 1
+					queue = append(queue, child)
+				}
+			}
+		}
+
+		for descendantID, depth := range depths {
+			pq = dbutl.PQuery(`
+			    INSERT INTO role_closure (
+			        ancestor_role_id,
+			        descendant_role_id,
+			        depth
+			    )
+			    VALUES (?, ?, ?)
+			`, roleID,
+				descendantID,
+				depth)
+
+			_, err = dbutl.ExecTx(tx, pq)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
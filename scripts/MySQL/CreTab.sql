@@ -25,7 +25,9 @@ create table if not exists audit_log (
     source         varchar(64) not null,
     source_version varchar(16) not null,
     log_time       datetime(3) not null,
-    log_msg        JSON not null
+    log_msg        JSON not null,
+    msg_hash       varchar(64),
+    entry_hash     varchar(64)
 );
 
 create index idx_time_audit_log on audit_log (log_time);
@@ -44,11 +46,13 @@ CREATE TABLE request (
   index_level       int,
   order_number      int,
   fire_event        int          not null DEFAULT 1,
+  impersonation_allowed int     not null DEFAULT 0,
   parent_id       int,
   constraint request_url_uk unique (request_url, request_type),
   constraint request_type_chk check (request_type in ('GET', 'POST')),
   constraint request_idx_uk unique (index_level, order_number),
   constraint request_event_chk check (fire_event in (0, 1)),
+  constraint request_impersonation_chk check (impersonation_allowed in (0, 1)),
     constraint request_parent foreign key (parent_id)
         references request (request_id)
 );
@@ -88,6 +92,65 @@ CREATE TABLE IF NOT EXISTS request_role (
 create index if not exists idx_request_role_id on request_role (role_id);
 create index if not exists idx_request_role_re1_id on request_role (request_id);
 
+CREATE TABLE IF NOT EXISTS role_inheritance (
+    parent_role_id int NOT NULL,
+    child_role_id  int NOT NULL,
+    constraint role_inheritance_pk PRIMARY KEY (parent_role_id, child_role_id),
+    constraint role_inheritance_parent_fk FOREIGN KEY (parent_role_id)
+      REFERENCES role (role_id),
+    constraint role_inheritance_child_fk FOREIGN KEY (child_role_id)
+      REFERENCES role (role_id)
+);
+
+create index if not exists idx_role_inh_child_id on role_inheritance (child_role_id);
+
+-- transitive closure of role_inheritance, maintained by the application
+-- every role is its own ancestor (depth 0)
+CREATE TABLE IF NOT EXISTS role_closure (
+    ancestor_role_id   int NOT NULL,
+    descendant_role_id int NOT NULL,
+    depth              int NOT NULL,
+    constraint role_closure_pk PRIMARY KEY (ancestor_role_id, descendant_role_id),
+    constraint role_closure_anc_fk FOREIGN KEY (ancestor_role_id)
+      REFERENCES role (role_id),
+    constraint role_closure_desc_fk FOREIGN KEY (descendant_role_id)
+      REFERENCES role (role_id)
+);
+
+create index if not exists idx_role_closure_desc_id on role_closure (descendant_role_id);
+
+CREATE TABLE IF NOT EXISTS permission (
+    permission_id int AUTO_INCREMENT PRIMARY KEY,
+    permission    varchar(64) not null,
+    description   varchar(256)
+);
+
+CREATE UNIQUE INDEX if not exists permission_uk ON permission (permission);
+
+CREATE TABLE IF NOT EXISTS role_permission (
+    role_id       int NOT NULL,
+    permission_id int NOT NULL,
+    constraint role_permission_pk PRIMARY KEY (role_id, permission_id),
+    constraint role_permission_role_fk FOREIGN KEY (role_id)
+      REFERENCES role (role_id),
+    constraint role_permission_perm_fk FOREIGN KEY (permission_id)
+      REFERENCES permission (permission_id)
+);
+
+create index if not exists idx_role_permission_perm_id on role_permission (permission_id);
+
+CREATE TABLE IF NOT EXISTS request_permission (
+    request_id    int NOT NULL,
+    permission_id int NOT NULL,
+    constraint request_permission_pk PRIMARY KEY (request_id, permission_id),
+    constraint request_permission_req_fk FOREIGN KEY (request_id)
+      REFERENCES request (request_id),
+    constraint request_permission_perm_fk FOREIGN KEY (permission_id)
+      REFERENCES permission (permission_id)
+);
+
+create index if not exists idx_request_perm_perm_id on request_permission (permission_id);
+
 CREATE TABLE user (
   user_id                bigint AUTO_INCREMENT PRIMARY KEY,
   username               varchar(64) not null,
@@ -96,6 +159,7 @@ CREATE TABLE user (
   surname                varchar(64) not null,
   email                  varchar(64) not null,
   loweredemail           varchar(64) not null,
+  unique_email           varchar(64) as (nullif(loweredemail, '')) persistent,
   creation_time          datetime(3) not null,
   last_update            datetime(3) not null,
   activated              int         not null DEFAULT 0,
@@ -108,10 +172,19 @@ CREATE TABLE user (
   last_connect_ip        varchar(128),
   valid                  int         not null DEFAULT 1,
   locked_out             int         not null DEFAULT 0,
+  locked_until           datetime(3),
+  lockout_count          int         not null DEFAULT 0,
+  last_lockout           datetime(3),
   password_expires       int         not null DEFAULT 1,
+  password_source        varchar(16) not null DEFAULT 'local',
+  language               varchar(8),
   CONSTRAINT user_uk unique(loweredusername)
 );
 
+-- one user per email; blank emails (users from a directory or a provider without one) are not checked
+create unique index if not exists user_email_uk on user (unique_email);
+create index if not exists idx_user_loweredemail on user (loweredemail);
+
 CREATE TABLE user_password (
   password_id   bigint       AUTO_INCREMENT PRIMARY KEY,
   user_id       bigint       NOT NULL,
@@ -142,22 +215,27 @@ CREATE TABLE user_role (
 
 create index if not exists idx_user_role_role_id on user_role (role_id);
 create index if not exists idx_user_role_usr_id on user_role (user_id);
+create unique index if not exists user_role_uk on user_role (user_id, role_id);
 
 CREATE TABLE user_role_history (
-  user_role_id bigint PRIMARY KEY,
-  user_id      bigint not null,
-  role_id      int not null,
-  valid_from   datetime(3) not null,
-  valid_until  datetime(3),
-  valid        int not null,
-  constraint user_role_h_fk foreign key (role_id)
-    references role(role_id),
-  constraint user_role_h_usr_fk foreign key (user_id)
-    references user(user_id)
+    user_role_history_id bigint AUTO_INCREMENT PRIMARY KEY,
+    user_role_id         bigint not null,
+    user_id              bigint not null,
+    role_id              int not null,
+    role                 varchar(64) not null,
+    valid_from           datetime(3) not null,
+    valid_until          datetime(3),
+    valid                int not null,
+    change_type          varchar(16) not null,
+    change_time          datetime(3) not null,
+    changed_by           varchar(64) not null,
+    constraint user_role_h_usr_fk foreign key (user_id)
+      references user(user_id)
 );
 
 create index if not exists idx_user_role_h_role_id on user_role_history (role_id);
 create index if not exists idx_user_role_h_usr_id on user_role_history (user_id);
+create index if not exists idx_user_role_h_time on user_role_history (change_time);
 
 CREATE TABLE user_ip (
   user_ip_id bigint       AUTO_INCREMENT PRIMARY KEY,
@@ -175,3 +253,136 @@ CREATE TABLE cookie_encode_key (
   valid_from           datetime(3) not null,
   valid_until          datetime(3) not null
 );
+
+CREATE TABLE user_api_token (
+  api_token_id   bigint       AUTO_INCREMENT PRIMARY KEY,
+  user_id        bigint       not null,
+  name           varchar(64)  not null,
+  token_hash     varchar(128) not null,
+  token_prefix   varchar(16)  not null,
+  creation_time  datetime(3)  not null,
+  valid_until    datetime(3),
+  last_used_time datetime(3),
+  last_used_ip   varchar(128),
+  valid          int          not null DEFAULT 1,
+  constraint user_api_token_hash_uk unique (token_hash),
+  constraint user_api_token_usr_fk foreign key (user_id)
+    references user(user_id)
+);
+
+create index if not exists idx_user_api_token_usr_id on user_api_token (user_id);
+
+CREATE TABLE user_api_token_role (
+  api_token_id bigint not null,
+  role_id      int    not null,
+  constraint user_api_token_role_pk primary key (api_token_id, role_id),
+  constraint user_api_token_role_tk_fk foreign key (api_token_id)
+    references user_api_token(api_token_id),
+  constraint user_api_token_role_fk foreign key (role_id)
+    references role(role_id)
+);
+
+CREATE TABLE user_api_token_request (
+  api_token_id bigint not null,
+  request_id   int    not null,
+  constraint user_api_token_request_pk primary key (api_token_id, request_id),
+  constraint user_api_token_req_tk_fk foreign key (api_token_id)
+    references user_api_token(api_token_id),
+  constraint user_api_token_req_fk foreign key (request_id)
+    references request(request_id)
+);
+
+CREATE TABLE access_rules_version (
+  access_rules_version_id int          AUTO_INCREMENT PRIMARY KEY,
+  version                 int          not null,
+  checksum                varchar(64)  not null,
+  rules_file              varchar(256) not null,
+  applied_time            datetime(3)  not null
+);
+
+CREATE TABLE access_change_counter (
+  counter_id  int         PRIMARY KEY,
+  counter     bigint      not null,
+  change_time datetime(3) not null
+);
+
+CREATE TABLE login_attempt (
+  login_attempt_id bigint       AUTO_INCREMENT PRIMARY KEY,
+  limit_key        varchar(512) not null,
+  attempt_time     datetime(3)  not null
+);
+
+create index if not exists idx_login_attempt_key on login_attempt (limit_key, attempt_time);
+create index if not exists idx_login_attempt_time on login_attempt (attempt_time);
+
+CREATE TABLE user_external_identity (
+  external_identity_id bigint       AUTO_INCREMENT PRIMARY KEY,
+  user_id              bigint       not null,
+  issuer               varchar(256) not null,
+  subject              varchar(256) not null,
+  email                varchar(256),
+  creation_time        datetime(3)  not null,
+  last_login           datetime(3)  not null,
+  constraint user_external_identity_fk foreign key (user_id)
+    references user(user_id)
+);
+
+create unique index if not exists idx_user_ext_identity_sub on user_external_identity (issuer, subject);
+create index if not exists idx_user_ext_identity_usr on user_external_identity (user_id);
+
+CREATE TABLE user_email_change (
+  email_change_id bigint       AUTO_INCREMENT PRIMARY KEY,
+  user_id         bigint       not null,
+  new_email       varchar(64)  not null,
+  token_hash      varchar(128) not null,
+  creation_time   datetime(3)  not null,
+  valid_until     datetime(3)  not null,
+  valid           int          not null DEFAULT 1,
+  constraint user_email_change_hash_uk unique (token_hash),
+  constraint user_email_change_usr_fk foreign key (user_id)
+    references user(user_id)
+);
+
+create index if not exists idx_user_email_change_usr on user_email_change (user_id);
+
+CREATE TABLE account_deletion_request (
+  deletion_request_id bigint       AUTO_INCREMENT PRIMARY KEY,
+  user_id             bigint       not null,
+  request_time        datetime(3)  not null,
+  reason              varchar(512),
+  status              varchar(16)  not null DEFAULT 'pending',
+  decided_by          varchar(64),
+  decision_time       datetime(3),
+  constraint account_deletion_req_usr_fk foreign key (user_id)
+    references user(user_id)
+);
+
+create index if not exists idx_account_deletion_req_usr on account_deletion_request (user_id);
+create index if not exists idx_account_deletion_req_status on account_deletion_request (status);
+
+CREATE TABLE audit_archive (
+  audit_archive_id   bigint        AUTO_INCREMENT PRIMARY KEY,
+  source             varchar(64)   not null,
+  first_audit_log_id bigint        not null,
+  last_audit_log_id  bigint        not null,
+  first_log_time     datetime(3)   not null,
+  last_log_time      datetime(3)   not null,
+  entries            int           not null,
+  file_name          varchar(256)  not null,
+  archive_time       datetime(3)   not null,
+  deleted            int           not null DEFAULT 0,
+  last_entry_hash    varchar(64),
+  signature          varchar(128),
+  constraint audit_archive_uk unique (source, first_audit_log_id)
+);
+
+CREATE TABLE audit_redaction (
+  audit_redaction_id bigint        AUTO_INCREMENT PRIMARY KEY,
+  audit_log_id       bigint        not null,
+  msg_hash           varchar(64)   not null,
+  redaction_time     datetime(3)   not null,
+  reason             varchar(64)   not null,
+  signature          varchar(128)
+);
+
+create index if not exists idx_audit_redaction_log on audit_redaction (audit_log_id);
@@ -29,7 +29,9 @@ create table audit_log (
     source         varchar2(64) not null,
     source_version varchar2(16) not null,
     log_time       timestamp not null,
-    log_msg        long      not null
+    log_msg        long      not null,
+    msg_hash       varchar2(64),
+    entry_hash     varchar2(64)
 );
 
 create index idx_time_audit_log on audit_log (log_time);
@@ -50,11 +52,13 @@ CREATE TABLE request (
     index_level       number,
     order_number      number,
     fire_event        number        DEFAULT 1     not null,
+    impersonation_allowed number  DEFAULT 0     not null,
     parent_id         int,
     constraint request_url_uk unique (request_url, request_type),
     constraint request_type_chk check (request_type in ('GET', 'POST')),
     constraint request_idx_uk unique (index_level, order_number),
     constraint request_event_chk check (fire_event in (0, 1)),
+    constraint request_impersonation_chk check (impersonation_allowed in (0, 1)),
     constraint request_parent foreign key (parent_id)
         references request (request_id)
 );
@@ -95,6 +99,67 @@ CREATE TABLE request_role (
 create index idx_request_role_id on request_role (role_id);
 create index idx_request_role_re1_id on request_role (request_id);
 
+CREATE TABLE role_inheritance (
+    parent_role_id number NOT NULL,
+    child_role_id  number NOT NULL,
+    constraint role_inheritance_pk PRIMARY KEY (parent_role_id, child_role_id),
+    constraint role_inheritance_parent_fk FOREIGN KEY (parent_role_id)
+      REFERENCES role (role_id),
+    constraint role_inheritance_child_fk FOREIGN KEY (child_role_id)
+      REFERENCES role (role_id)
+);
+
+create index idx_role_inh_child_id on role_inheritance (child_role_id);
+
+-- transitive closure of role_inheritance, maintained by the application
+-- every role is its own ancestor (depth 0)
+CREATE TABLE role_closure (
+    ancestor_role_id   number NOT NULL,
+    descendant_role_id number NOT NULL,
+    depth              number NOT NULL,
+    constraint role_closure_pk PRIMARY KEY (ancestor_role_id, descendant_role_id),
+    constraint role_closure_anc_fk FOREIGN KEY (ancestor_role_id)
+      REFERENCES role (role_id),
+    constraint role_closure_desc_fk FOREIGN KEY (descendant_role_id)
+      REFERENCES role (role_id)
+);
+
+create index idx_role_closure_desc_id on role_closure (descendant_role_id);
+
+create sequence s$permission nocache start with 1;
+
+CREATE TABLE permission (
+    permission_id number default s$permission.nextval PRIMARY KEY,
+    permission    varchar2(64) not null,
+    description   varchar2(256)
+);
+
+CREATE UNIQUE INDEX permission_uk ON permission (permission);
+
+CREATE TABLE role_permission (
+    role_id       number NOT NULL,
+    permission_id number NOT NULL,
+    constraint role_permission_pk PRIMARY KEY (role_id, permission_id),
+    constraint role_permission_role_fk FOREIGN KEY (role_id)
+      REFERENCES role (role_id),
+    constraint role_permission_perm_fk FOREIGN KEY (permission_id)
+      REFERENCES permission (permission_id)
+);
+
+create index idx_role_permission_perm_id on role_permission (permission_id);
+
+CREATE TABLE request_permission (
+    request_id    number NOT NULL,
+    permission_id number NOT NULL,
+    constraint request_permission_pk PRIMARY KEY (request_id, permission_id),
+    constraint request_permission_req_fk FOREIGN KEY (request_id)
+      REFERENCES request (request_id),
+    constraint request_permission_perm_fk FOREIGN KEY (permission_id)
+      REFERENCES permission (permission_id)
+);
+
+create index idx_request_perm_perm_id on request_permission (permission_id);
+
 create sequence s$user nocache start with 1;
 
 CREATE TABLE "user" (
@@ -117,10 +182,18 @@ CREATE TABLE "user" (
     last_connect_ip        varchar2(128),
     valid                  number      DEFAULT 1 not null,
     locked_out             number      DEFAULT 0 not null,
+    locked_until           timestamp,
+    lockout_count          number      DEFAULT 0 not null,
+    last_lockout           timestamp,
     password_expires       int         DEFAULT 1 not null,
+    password_source        varchar2(16) DEFAULT 'local' not null,
+    language               varchar2(8),
     constraint user_uk unique(loweredusername)
 );
 
+-- one user per email
+create unique index user_email_uk on "user" (loweredemail);
+
 create sequence s$user_password nocache start with 1;
 
 CREATE TABLE user_password (
@@ -155,22 +228,29 @@ CREATE TABLE user_role (
 
 create index idx_user_role_role_id on user_role (role_id);
 create index idx_user_role_usr_id on user_role (user_id);
+create unique index user_role_uk on user_role (user_id, role_id);
+
+create sequence s$user_role_history nocache start with 1;
 
 CREATE TABLE user_role_history (
-    user_role_id number PRIMARY KEY,
-    user_id      number not null,
-    role_id      number not null,
-    valid_from   timestamp not null,
-    valid_until  timestamp,
-    valid        int not null,
-    constraint  user_role_history_fk foreign key (role_id)
-        references role (role_id),
+    user_role_history_id number default s$user_role_history.nextval PRIMARY KEY,
+    user_role_id         number not null,
+    user_id              number not null,
+    role_id              number not null,
+    role                 varchar2(64) not null,
+    valid_from           timestamp not null,
+    valid_until          timestamp,
+    valid                int not null,
+    change_type          varchar2(16) not null,
+    change_time          timestamp not null,
+    changed_by           varchar2(64) not null,
     constraint user_role_h_usr_fk foreign key (user_id)
       references "user"(user_id)
 );
 
 create index idx_user_role_h_role_id on user_role_history (role_id);
 create index idx_user_role_h_usr_id on user_role_history (user_id);
+create index idx_user_role_h_time on user_role_history (change_time);
 
 create sequence s$user_ip nocache start with 1;
 
@@ -192,3 +272,152 @@ CREATE TABLE cookie_encode_key (
     valid_from           timestamp not null,
     valid_until          timestamp not null
 );
+
+create sequence s$user_api_token nocache start with 1;
+
+CREATE TABLE user_api_token (
+    api_token_id   number default s$user_api_token.nextval PRIMARY KEY,
+    user_id        number         not null,
+    name           nvarchar2(128) not null,
+    token_hash     varchar2(128)  not null,
+    token_prefix   varchar2(16)   not null,
+    creation_time  timestamp      not null,
+    valid_until    timestamp,
+    last_used_time timestamp,
+    last_used_ip   varchar2(128),
+    valid          number         DEFAULT 1 not null,
+    constraint user_api_token_hash_uk unique (token_hash),
+    constraint user_api_token_usr_fk foreign key (user_id)
+      references "user"(user_id)
+);
+
+create index idx_user_api_token_usr_id on user_api_token (user_id);
+
+CREATE TABLE user_api_token_role (
+    api_token_id number not null,
+    role_id      number not null,
+    constraint user_api_token_role_pk primary key (api_token_id, role_id),
+    constraint user_api_token_role_tk_fk foreign key (api_token_id)
+      references user_api_token (api_token_id),
+    constraint user_api_token_role_fk foreign key (role_id)
+      references role (role_id)
+);
+
+CREATE TABLE user_api_token_request (
+    api_token_id number not null,
+    request_id   number not null,
+    constraint user_api_token_request_pk primary key (api_token_id, request_id),
+    constraint user_api_token_req_tk_fk foreign key (api_token_id)
+      references user_api_token (api_token_id),
+    constraint user_api_token_req_fk foreign key (request_id)
+      references request (request_id)
+);
+
+create sequence s$access_rules_version nocache start with 1;
+
+CREATE TABLE access_rules_version (
+    access_rules_version_id number default s$access_rules_version.nextval PRIMARY KEY,
+    version                 number        not null,
+    checksum                varchar2(64)  not null,
+    rules_file              varchar2(256) not null,
+    applied_time            timestamp     not null
+);
+
+CREATE TABLE access_change_counter (
+    counter_id  number    PRIMARY KEY,
+    counter     number    not null,
+    change_time timestamp not null
+);
+
+create sequence s$login_attempt nocache start with 1;
+
+CREATE TABLE login_attempt (
+    login_attempt_id number default s$login_attempt.nextval PRIMARY KEY,
+    limit_key        varchar2(512) not null,
+    attempt_time     timestamp     not null
+);
+
+create index idx_login_attempt_key on login_attempt (limit_key, attempt_time);
+create index idx_login_attempt_time on login_attempt (attempt_time);
+
+create sequence s$user_external_identity nocache start with 1;
+
+CREATE TABLE user_external_identity (
+    external_identity_id number default s$user_external_identity.nextval PRIMARY KEY,
+    user_id              number        not null,
+    issuer               varchar2(256) not null,
+    subject              varchar2(256) not null,
+    email                varchar2(256),
+    creation_time        timestamp     not null,
+    last_login           timestamp     not null,
+    constraint user_external_identity_fk foreign key (user_id)
+        references "user"(user_id)
+);
+
+create unique index idx_user_ext_identity_sub on user_external_identity (issuer, subject);
+create index idx_user_ext_identity_usr on user_external_identity (user_id);
+
+create sequence s$user_email_change nocache start with 1;
+
+CREATE TABLE user_email_change (
+    email_change_id number default s$user_email_change.nextval PRIMARY KEY,
+    user_id         number         not null,
+    new_email       nvarchar2(128) not null,
+    token_hash      varchar2(128)  not null,
+    creation_time   timestamp      not null,
+    valid_until     timestamp      not null,
+    valid           number         DEFAULT 1 not null,
+    constraint user_email_change_hash_uk unique (token_hash),
+    constraint user_email_change_usr_fk foreign key (user_id)
+        references "user"(user_id)
+);
+
+create index idx_user_email_change_usr on user_email_change (user_id);
+
+create sequence s$account_deletion_request nocache start with 1;
+
+CREATE TABLE account_deletion_request (
+    deletion_request_id number default s$account_deletion_request.nextval PRIMARY KEY,
+    user_id             number         not null,
+    request_time        timestamp      not null,
+    reason              nvarchar2(512),
+    status              varchar2(16)   DEFAULT 'pending' not null,
+    decided_by          nvarchar2(128),
+    decision_time       timestamp,
+    constraint account_deletion_req_usr_fk foreign key (user_id)
+        references "user"(user_id)
+);
+
+create index idx_account_deletion_req_usr on account_deletion_request (user_id);
+create index idx_account_deletion_req_status on account_deletion_request (status);
+
+create sequence s$audit_archive nocache start with 1;
+
+CREATE TABLE audit_archive (
+    audit_archive_id   number default s$audit_archive.nextval PRIMARY KEY,
+    source             varchar2(64)    not null,
+    first_audit_log_id number          not null,
+    last_audit_log_id  number          not null,
+    first_log_time     timestamp       not null,
+    last_log_time      timestamp       not null,
+    entries            number          not null,
+    file_name          nvarchar2(256)  not null,
+    archive_time       timestamp       not null,
+    deleted            number          DEFAULT 0 not null,
+    last_entry_hash    varchar2(64),
+    signature          varchar2(128),
+    constraint audit_archive_uk unique (source, first_audit_log_id)
+);
+
+create sequence s$audit_redaction nocache start with 1;
+
+CREATE TABLE audit_redaction (
+    audit_redaction_id number default s$audit_redaction.nextval PRIMARY KEY,
+    audit_log_id       number          not null,
+    msg_hash           varchar2(64)    not null,
+    redaction_time     timestamp       not null,
+    reason             varchar2(64)    not null,
+    signature          varchar2(128)
+);
+
+create index idx_audit_redaction_log on audit_redaction (audit_log_id);
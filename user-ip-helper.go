@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"./models"
+
+	"github.com/geo-stanciu/go-utils/utils"
+)
+
+// GetAllowedNetworks - ips and cidr ranges the user may log in from; none - any address
+func (u *MembershipUser) GetAllowedNetworks() ([]*models.UserIPModel, error) {
+	var networks []*models.UserIPModel
+
+	pq := dbutl.PQuery(`
+		SELECT user_ip_id,
+		       ip
+		  FROM user_ip
+		 WHERE user_id = ?
+		 ORDER BY ip
+	`, u.UserID)
+
+	var err error
+	err = dbutl.ForEachRowTx(u.tx, pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		var n models.UserIPModel
+		err = sc.Scan(dbutl, row, &n)
+		if err != nil {
+			return err
+		}
+
+		_, perr := parseNetwork(n.Network)
+		n.Valid = perr == nil
+
+		networks = append(networks, &n)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return networks, nil
+}
+
+// AddAllowedNetwork - allow logins from an ip or cidr range, kept normalized
+func (u *MembershipUser) AddAllowedNetwork(network string) (string, error) {
+	u.Lock()
+	defer u.Unlock()
+
+	normalized, err := normalizeNetwork(network)
+	if err != nil {
+		return "", err
+	}
+
+	var found int
+
+	pq := dbutl.PQuery(`
+		SELECT CASE WHEN EXISTS (
+		           SELECT 1 FROM user_ip WHERE user_id = ? AND ip = ?
+		       ) THEN 1 ELSE 0 END
+		  FROM dual
+	`, u.UserID,
+		normalized)
+
+	err = u.tx.QueryRow(pq.Query, pq.Args...).Scan(&found)
+	if err != nil {
+		return "", err
+	}
+
+	if found == 1 {
+		return "", fmt.Errorf("\"%s\" is already allowed for \"%s\"", normalized, u.Username)
+	}
+
+	pq = dbutl.PQuery(`
+	    INSERT INTO user_ip (user_id, ip) VALUES (?, ?)
+	`, u.UserID,
+		normalized)
+
+	_, err = dbutl.ExecTx(u.tx, pq)
+	if err != nil {
+		return "", err
+	}
+
+	return normalized, nil
+}
+
+// RemoveAllowedNetwork - removing the last one allows logins from any address again
+func (u *MembershipUser) RemoveAllowedNetwork(userIPID int) (string, error) {
+	u.Lock()
+	defer u.Unlock()
+
+	var network string
+
+	pq := dbutl.PQuery(`
+		SELECT ip
+		  FROM user_ip
+		 WHERE user_ip_id = ?
+		   AND user_id = ?
+	`, userIPID,
+		u.UserID)
+
+	err := u.tx.QueryRow(pq.Query, pq.Args...).Scan(&network)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "", fmt.Errorf("network %d not found for \"%s\"", userIPID, u.Username)
+	case err != nil:
+		return "", err
+	}
+
+	pq = dbutl.PQuery(`
+	    DELETE FROM user_ip
+	     WHERE user_ip_id = ?
+	       AND user_id = ?
+	`, userIPID,
+		u.UserID)
+
+	_, err = dbutl.ExecTx(u.tx, pq)
+	if err != nil {
+		return "", err
+	}
+
+	return network, nil
+}
+
+// userIPAllowed - the user has no allowed networks or one of them contains the ip
+func userIPAllowed(userID int, user string, ip string) (bool, error) {
+	hasIPs := false
+	foundIP := false
+	clientIP := parseIP(ip)
+
+	pq := dbutl.PQuery(`
+		SELECT ip FROM user_ip WHERE user_id = ?
+	`, userID)
+
+	err := dbutl.ForEachRow(pq, func(row *sql.Rows, sc *utils.SQLScan) error {
+		hasIPs = true
+		var addr string
+		err := row.Scan(&addr)
+		if err != nil {
+			return err
+		}
+
+		network, err := parseNetwork(addr)
+		if err != nil {
+			audit.Log(err, "login", "Invalid user_ip row skipped", "user", user, "ip", addr)
+			return nil
+		}
+
+		if clientIP != nil && network.Contains(clientIP) {
+			foundIP = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return !hasIPs || foundIP, nil
+}